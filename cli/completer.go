@@ -21,7 +21,22 @@ func Complete(in prompt.Document) []prompt.Suggest {
 		{Text: "kubectl rm [deploymentName]", Description: "Destroy a deployment in kubernetes by its name."},
 		{Text: "flow [srcIp] [srcPort] [dstIp] [dstPort] [protocol]", Description: "Simulate a flow coming to the system."},
 		{Text: "deploy [user] [nf]", Description: "Adds a logical NF to |user|'s' NF DAG"},
-		{Text: "connect [user] [up] [down]", Description: "Connects two logical NFs"},
+		{Text: "connect [user] [up] [down] [weight]", Description: "Connects two logical NFs"},
+		{Text: "flowlet [user] [srcIP] [dstIP] [srcPorts] [dstPorts] [proto] [priority]", Description: "Adds a flowlet to an NF DAG"},
+		{Text: "lb [user] [policy] [qload] [pload] [maxPload]", Description: "Sets the load-balancing policy of an NF DAG"},
+		{Text: "quota [tenant] [flowRate] [flowBurst]", Description: "Limits the rate of new flows of a tenant"},
+		{Text: "sched [nodeName|all] [policy]", Description: "Sets the scheduling policy of workers"},
+		{Text: "sim [traceFile|synthetic] [policy]", Description: "Simulates scheduling policies on a trace"},
+		{Text: "simlb [traceFile|synthetic] [policy] [qload] [pload] [maxPload]", Description: "Simulates a load-balancing policy on a trace"},
+		{Text: "latency [user] [targetUs]", Description: "Sets the per-SGroup latency target of an NF DAG"},
+		{Text: "standby [user] [count]", Description: "Sets the number of standby sGroups of an NF DAG"},
+		{Text: "scalein [user] [minSGroups] [idleTimeout]", Description: "Sets the scale-in policy of an NF DAG"},
+		{Text: "states [on|off]", Description: "Prints sGroup state transitions as they happen"},
+		{Text: "load [fileName]", Description: "Loads and activates an NF DAG from a JSON/YAML spec"},
+		{Text: "exp [a|b|c]", Description: "Loads an experiment NF DAG in ./dags"},
+		{Text: "activate [user]", Description: "Activates |user|'s NF DAG"},
+		{Text: "deactivate [user]", Description: "Deactivates |user|'s NF DAG and releases its sGroups"},
+		{Text: "delete [user]", Description: "Deactivates and deletes |user|'s NF DAG"},
 		{Text: "kubectl", Description: "Control kubernetes clusters."},
 		{Text: "quit", Description: "Clean up and quit the controller."},
 	}
@@ -1,6 +1,7 @@
 package cli
 
 import (
+	"flag"
 	"fmt"
 	"os"
 	"strconv"
@@ -8,10 +9,36 @@ import (
 
 	controller "github.com/USC-NSL/Low-Latency-FaaS/controller"
 	kubectl "github.com/USC-NSL/Low-Latency-FaaS/kubectl"
+	simulator "github.com/USC-NSL/Low-Latency-FaaS/simulator"
+	utils "github.com/USC-NSL/Low-Latency-FaaS/utils"
 )
 
+// Experiment DAGs are specified in exp-[a|b|c].json of |dagsDir|.
+const kExpDAGSpecFormat = "exp-%s.json"
+
+// |dagsDir| is the directory of DAG specs.
+var dagsDir string
+
+func init() {
+	flag.StringVar(&dagsDir, "dags", "./dags", "The directory of DAG specs (e.g. experiment DAGs of the exp command)")
+}
+
+// The synthetic trace of the |sim| command: 12 SGroups of 3 NFs in
+// 5 minutes.
+const (
+	kSimSGroups = 12
+	kSimNFCount = 3
+	kSimTicks   = 3000
+)
+
+// The number of SGroup transitions buffered for the |states| command.
+const kWatchStateEventBufferSize = 256
+
+// |unwatchStates| (nil: not watching) stops printing SGroup
+// transitions.
 type Executor struct {
 	FaaSController *controller.FaaSController
+	unwatchStates  func()
 }
 
 func NewExecutor(FaaSController *controller.FaaSController) *Executor {
@@ -41,6 +68,47 @@ func NewExecutor(FaaSController *controller.FaaSController) *Executor {
 //    - cycle |nodeName| |port| |cyclePerPacket|
 // 10. Set batch size and number for an NF:
 //    - batch |nodeName| |port| |batchSize| |batchNumber|
+// 11. Connect two logical NFs. At a branching NF, traffic is split
+// among downstream NFs by |weight| (default: 1):
+//    - connect |user| |up| |down| [weight]
+// 12. Stop serving new flows with a user's DAG, and release its sGroups:
+//    - deactivate |user|
+// 13. Deactivate and delete a user's DAG:
+//    - delete |user|
+// 14. Load and activate a DAG from a JSON/YAML spec file:
+//    - load |fileName|
+// 15. Add a flowlet to a user's DAG. IPs may be CIDR prefixes, and
+// ports may be ranges (e.g. 1000-2000). "*" matches all:
+//    - flowlet |user| |srcIp| |dstIp| |srcPorts| |dstPorts| |protocol| [priority]
+// 16. Set the load-balancing policy of a user's DAG. Thresholds are
+// in percentage values (0: default). Lists all policies if no
+// arguments are given:
+//    - lb |user| |policy| [qload] [pload] [maxPload]
+// 17. Limit the rate of new flows of a tenant's DAGs (flows per
+// second, 0: no limit):
+//    - quota |tenant| |flowRate| [flowBurst]
+// 18. Set the scheduling policy of a worker (or "all" workers). Lists
+// all policies if no arguments are given:
+//    - sched |nodeName| |policy|
+// 19. Simulate scheduling policies (all policies by default) on a
+// recorded trace file, or a synthetic trace:
+//    - sim |traceFile|synthetic| [policy...]
+// 20. Set the latency target (in microseconds, 0: no target) of a
+// user's DAG:
+//    - latency |user| |targetUs|
+// 21. Set the number of standby SGroups of a user's DAG:
+//    - standby |user| |count|
+// 22. Print SGroup state transitions as they happen (or stop it):
+//    - states on|off
+// 23. Set the min number of SGroups of a user's DAG, and the time (in
+// seconds, 0: default, negative: never) before idle SGroups are
+// reclaimed:
+//    - scalein |user| |minSGroups| [idleTimeout]
+// 24. Simulate a load-balancing policy with thresholds (in percentage
+// values, 0: default) on a recorded trace file, or a synthetic trace.
+// Flows are assigned to SGroups of a worker that runs each scheduling
+// policy:
+//    - simlb |traceFile|synthetic| |policy| [qload] [pload] [maxPload]
 //---------------------------------------------------------
 func (e *Executor) Execute(s string) {
 	s = strings.TrimSpace(s)
@@ -76,7 +144,9 @@ func (e *Executor) Execute(s string) {
 		nodeName := words[1]
 		nfs := words[2:]
 
-		e.FaaSController.CreateSGroup(nodeName, nfs)
+		if err := e.FaaSController.CreateSGroup(nodeName, nfs); err != nil {
+			fmt.Printf("Failed to create sGroup on worker %s: %s!\n", nodeName, err.Error())
+		}
 	} else if words[0] == "rm" && len(words) >= 3 {
 		nodeName := words[1]
 		groupID, _ := strconv.Atoi(words[2])
@@ -120,51 +190,141 @@ func (e *Executor) Execute(s string) {
 	} else if words[0] == "deploy" && len(words) >= 3 {
 		user := words[1]
 		funcType := words[2]
-		nfID := e.FaaSController.AddNF(user, funcType)
-
-		fmt.Printf("User %s: add NF [%s], ID=%d.\n", user, funcType, nfID)
+		if nfID, err := e.FaaSController.AddNF(user, funcType); err != nil {
+			fmt.Println(err)
+		} else {
+			fmt.Printf("User %s: add NF [%s], ID=%d.\n", user, funcType, nfID)
+		}
 	} else if words[0] == "connect" && len(words) >= 4 {
 		user := words[1]
 		up, _ := strconv.Atoi(words[2])
 		down, _ := strconv.Atoi(words[3])
-		if err := e.FaaSController.ConnectNFs(user, up, down); err != nil {
+		weight := 1
+		if len(words) >= 5 {
+			weight, _ = strconv.Atoi(words[4])
+		}
+		if err := e.FaaSController.ConnectNFsWithWeight(user, up, down, weight); err != nil {
 			fmt.Println(err)
 		}
 
 		e.FaaSController.ShowNFDAGs(user)
+	} else if words[0] == "flowlet" && len(words) >= 7 {
+		user := words[1]
+		protocol := 0
+		if words[6] != "*" {
+			protocol, _ = strconv.Atoi(words[6])
+		}
+		priority := 0
+		if len(words) >= 8 {
+			priority, _ = strconv.Atoi(words[7])
+		}
+		if err := e.FaaSController.AddFlowlet(user, words[2], words[3], words[4], words[5], uint32(protocol), priority); err != nil {
+			fmt.Printf("Failed to add flowlet to DAG of user %s: %s!\n", user, err.Error())
+		}
+	} else if words[0] == "lb" {
+		if len(words) < 3 {
+			fmt.Printf("Load balancers: %s\n", strings.Join(controller.LoadBalancerNames(), ", "))
+			return
+		}
+
+		user := words[1]
+		th := parseLBThresholds(words[3:])
+		if err := e.FaaSController.SetLoadBalancer(user, words[2], th); err != nil {
+			fmt.Printf("Failed to set load balancer of user %s: %s!\n", user, err.Error())
+		}
+	} else if words[0] == "quota" && len(words) >= 3 {
+		tenant := words[1]
+		flowRate, _ := strconv.ParseFloat(words[2], 64)
+		flowBurst := 1
+		if len(words) >= 4 {
+			flowBurst, _ = strconv.Atoi(words[3])
+		}
+		e.FaaSController.SetTenantQuota(tenant, flowRate, flowBurst)
+	} else if words[0] == "sched" {
+		if len(words) < 3 {
+			fmt.Printf("Scheduling policies: %s\n", strings.Join(controller.SchedulingPolicyNames(), ", "))
+			return
+		}
+
+		nodeName := words[1]
+		if err := e.FaaSController.SetSchedulingPolicy(nodeName, words[2]); err != nil {
+			fmt.Printf("Failed to set scheduling policy of worker %s: %s!\n", nodeName, err.Error())
+		}
+	} else if words[0] == "latency" && len(words) >= 3 {
+		user := words[1]
+		targetUs, err := strconv.Atoi(words[2])
+		if err != nil {
+			fmt.Printf("Invalid latency target %s!\n", words[2])
+			return
+		}
+		if err := e.FaaSController.SetLatencyTarget(user, targetUs); err != nil {
+			fmt.Printf("Failed to set latency target of user %s: %s!\n", user, err.Error())
+		}
+	} else if words[0] == "standby" && len(words) >= 3 {
+		user := words[1]
+		count, err := strconv.Atoi(words[2])
+		if err != nil {
+			fmt.Printf("Invalid number of standby SGroups %s!\n", words[2])
+			return
+		}
+		if err := e.FaaSController.SetStandbySGroups(user, count); err != nil {
+			fmt.Printf("Failed to set standby SGroups of user %s: %s!\n", user, err.Error())
+		}
+	} else if words[0] == "scalein" && len(words) >= 3 {
+		user := words[1]
+		minSGroups, err := strconv.Atoi(words[2])
+		if err != nil {
+			fmt.Printf("Invalid min number of SGroups %s!\n", words[2])
+			return
+		}
+		idleTimeout := 0
+		if len(words) >= 4 {
+			idleTimeout, _ = strconv.Atoi(words[3])
+		}
+		if err := e.FaaSController.SetScaleIn(user, minSGroups, idleTimeout); err != nil {
+			fmt.Printf("Failed to set scale-in of user %s: %s!\n", user, err.Error())
+		}
+	} else if words[0] == "states" && len(words) >= 2 {
+		e.watchStates(words[1] == "on")
+	} else if words[0] == "sim" {
+		if len(words) < 2 {
+			fmt.Println("Usage: sim [traceFile|synthetic] [policy...]")
+			return
+		}
+		e.simulate(words[1], words[2:], simulator.DefaultConfig)
+	} else if words[0] == "simlb" {
+		if len(words) < 3 {
+			fmt.Println("Usage: simlb [traceFile|synthetic] [policy] [qload] [pload] [maxPload]")
+			return
+		}
+		cfg := simulator.DefaultConfig
+		cfg.LoadBalancer = words[2]
+		cfg.LBThresholds = parseLBThresholds(words[3:])
+		e.simulate(words[1], nil, cfg)
 	} else if words[0] == "show" && len(words) >= 2 {
 		user := words[1]
 		e.FaaSController.ShowNFDAGs(user)
 	} else if words[0] == "activate" && len(words) >= 2 {
 		user := words[1]
-		e.FaaSController.ActivateDAG(user)
+		if err := e.FaaSController.ActivateDAG(user); err != nil {
+			fmt.Printf("Failed to activate DAG of user %s: %s!\n", user, err.Error())
+		}
+	} else if words[0] == "deactivate" && len(words) >= 2 {
+		user := words[1]
+		if err := e.FaaSController.DeactivateDAG(user); err != nil {
+			fmt.Printf("Failed to deactivate DAG of user %s: %s!\n", user, err.Error())
+		}
+	} else if words[0] == "delete" && len(words) >= 2 {
+		user := words[1]
+		if err := e.FaaSController.RemoveDAG(user); err != nil {
+			fmt.Printf("Failed to delete DAG of user %s: %s!\n", user, err.Error())
+		}
+	} else if words[0] == "load" && len(words) >= 2 {
+		e.loadDAG(words[1])
 	} else if words[0] == "exp" {
 		if len(words) == 2 {
 			// For testing only, packets always have a dstPort 8080.
-			if words[1] == "a" {
-				user := "exp-a"
-				nf2 := e.FaaSController.AddDummyNF(user, "acl")
-				nf1 := e.FaaSController.AddDummyNF(user, "vlanpush")
-				e.FaaSController.ConnectNFs(user, nf1, nf2)
-				e.FaaSController.AddFlow(user, "", "", 0, 8080, 0)
-				e.FaaSController.ActivateDAG(user)
-			} else if words[1] == "b" {
-				user := "exp-b"
-				nf1 := e.FaaSController.AddDummyNF(user, "acl")
-				nf2 := e.FaaSController.AddDummyNF(user, "urlfilter")
-				nf3 := e.FaaSController.AddDummyNF(user, "chacha")
-				e.FaaSController.ConnectNFs(user, nf1, nf2)
-				e.FaaSController.ConnectNFs(user, nf2, nf3)
-				e.FaaSController.AddFlow(user, "", "", 0, 8080, 0)
-				e.FaaSController.ActivateDAG(user)
-			} else if words[1] == "c" {
-				user := "exp-c"
-				nf1 := e.FaaSController.AddDummyNF(user, "acl")
-				nf2 := e.FaaSController.AddNF(user, "nat")
-				e.FaaSController.ConnectNFs(user, nf1, nf2)
-				e.FaaSController.AddFlow(user, "", "", 0, 8080, 0)
-				e.FaaSController.ActivateDAG(user)
-			}
+			e.loadDAG(utils.DAGSpecPath(dagsDir, fmt.Sprintf(kExpDAGSpecFormat, words[1])))
 		} else {
 			fmt.Println("Usage: exp [a|b|c]")
 		}
@@ -185,3 +345,86 @@ func (e *Executor) Execute(s string) {
 		}
 	}
 }
+
+// Loads a DAG spec from |fileName|, and activates the DAG.
+func (e *Executor) loadDAG(fileName string) {
+	spec, err := utils.ParseDAGSpec(fileName)
+	if err != nil {
+		fmt.Printf("Failed to load DAG: %s!\n", err.Error())
+		return
+	}
+
+	if err := e.FaaSController.LoadDAG(spec); err != nil {
+		fmt.Printf("Failed to load DAG of user %s: %s!\n", spec.User, err.Error())
+		return
+	}
+	fmt.Printf("User %s: DAG is loaded from %s.\n", spec.User, fileName)
+}
+
+// Starts (if |on| is true) or stops printing SGroup transitions.
+func (e *Executor) watchStates(on bool) {
+	if e.unwatchStates != nil {
+		e.unwatchStates()
+		e.unwatchStates = nil
+	}
+	if !on {
+		return
+	}
+
+	events := make(chan controller.SGroupStateEvent, kWatchStateEventBufferSize)
+	unsubscribe := e.FaaSController.SubscribeSGroupStates(events)
+	done := make(chan bool)
+	go func() {
+		for {
+			select {
+			case ev := <-events:
+				fmt.Println(ev)
+			case <-done:
+				return
+			}
+		}
+	}()
+	e.unwatchStates = func() {
+		unsubscribe()
+		close(done)
+	}
+}
+
+// Parses load-balancing thresholds [qload] [pload] [maxPload] in
+// |words|. Missing thresholds are zeros, i.e. default values.
+func parseLBThresholds(words []string) controller.LBThresholds {
+	thresholds := make([]int, 3)
+	for i := 0; i < len(thresholds) && i < len(words); i++ {
+		thresholds[i], _ = strconv.Atoi(words[i])
+	}
+	return controller.LBThresholds{
+		QLoad:      thresholds[0],
+		PktLoad:    thresholds[1],
+		MaxPktLoad: thresholds[2],
+	}
+}
+
+// Replays a trace |traceName| on a simulated worker with each of
+// |policies| (all policies if empty) and |cfg|, and prints reports.
+func (e *Executor) simulate(traceName string, policies []string, cfg simulator.Config) {
+	var trace *simulator.Trace
+	if traceName == "synthetic" {
+		trace = simulator.NewSyntheticTrace(kSimSGroups, kSimNFCount, kSimTicks, 1)
+	} else {
+		var err error
+		if trace, err = simulator.LoadTrace(traceName, 0); err != nil {
+			fmt.Printf("Failed to load trace: %s!\n", err.Error())
+			return
+		}
+	}
+
+	if len(policies) == 0 {
+		policies = controller.SchedulingPolicyNames()
+	}
+	reports, err := simulator.Compare(trace, policies, cfg)
+	if err != nil {
+		fmt.Printf("Failed to simulate: %s!\n", err.Error())
+		return
+	}
+	fmt.Print(simulator.FormatReports(reports))
+}
@@ -0,0 +1,197 @@
+package controller
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	rate "golang.org/x/time/rate"
+)
+
+// This is the place to implement admission control.
+// FaaSController admits or rejects a new flow before assigning it to
+// an SGroup. New flows are rate-limited per DAG and per tenant, and
+// are rejected if the selected SGroup's queue is too long. A rejected
+// flow carries a |RejectReason|, which is returned to the ToR switch
+// in the |FlowTableEntry| response, so that the switch controller can
+// decide whether to drop, buffer or retry the flow.
+
+// |RejectReason| is why a new flow is rejected. Values are encoded
+// in |FlowTableEntry.reason|, and must not be changed.
+type RejectReason uint32
+
+const (
+	REJECT_NONE RejectReason = iota
+	REJECT_UNKNOWN_FLOWLET
+	REJECT_DAG_INACTIVE
+	REJECT_QUOTA_EXCEEDED
+	REJECT_NO_CAPACITY
+	REJECT_SGROUP_STARTING
+)
+
+func (r RejectReason) String() string {
+	switch r {
+	case REJECT_NONE:
+		return "NONE"
+	case REJECT_UNKNOWN_FLOWLET:
+		return "UNKNOWN_FLOWLET"
+	case REJECT_DAG_INACTIVE:
+		return "DAG_INACTIVE"
+	case REJECT_QUOTA_EXCEEDED:
+		return "QUOTA_EXCEEDED"
+	case REJECT_NO_CAPACITY:
+		return "NO_CAPACITY"
+	case REJECT_SGROUP_STARTING:
+		return "SGROUP_STARTING"
+	default:
+		return fmt.Sprintf("%d", uint32(r))
+	}
+}
+
+// |FlowRejectError| is returned by |UpdateFlow| when a new flow is
+// rejected. |Reason| is the type of the rejection.
+type FlowRejectError struct {
+	Reason RejectReason
+	Msg    string
+}
+
+func newFlowRejectError(reason RejectReason, format string, a ...interface{}) *FlowRejectError {
+	return &FlowRejectError{
+		Reason: reason,
+		Msg:    fmt.Sprintf(format, a...),
+	}
+}
+
+func (e *FlowRejectError) Error() string {
+	return fmt.Sprintf("Flow rejected [%s]: %s", e.Reason, e.Msg)
+}
+
+// Returns the reason code encoded in |FlowTableEntry.reason|.
+func (e *FlowRejectError) RejectReason() uint32 {
+	return uint32(e.Reason)
+}
+
+// |AdmissionPolicy| configures admission control for a DAG.
+// |Tenant| is the tenant that owns the DAG. DAGs of a tenant share
+// the tenant's quota (empty: the DAG's user).
+// |FlowRate| is the max rate of new flows (flows per second, 0: no
+// limit), and |FlowBurst| is the max burst of new flows (at least 1).
+// |MaxQLoad| is the max queue load (in percentage values) of an
+// SGroup to take new flows (0: no limit).
+type AdmissionPolicy struct {
+	Tenant    string
+	FlowRate  float64
+	FlowBurst int
+	MaxQLoad  int
+}
+
+// Returns a rate limiter of |flowRate| new flows per second with a
+// burst of |flowBurst| flows. Returns nil if there is no limit.
+func newFlowLimiter(flowRate float64, flowBurst int) *rate.Limiter {
+	if flowRate <= 0 {
+		return nil
+	}
+	if flowBurst <= 0 {
+		flowBurst = 1
+	}
+	return rate.NewLimiter(rate.Limit(flowRate), flowBurst)
+}
+
+// |admissionControl| keeps per-tenant quotas of new flows.
+// |tenants| are rate limiters indexed by tenants.
+// |mutex| protects |tenants|.
+type admissionControl struct {
+	tenants map[string]*rate.Limiter
+	mutex   sync.Mutex
+}
+
+func newAdmissionControl() *admissionControl {
+	return &admissionControl{
+		tenants: make(map[string]*rate.Limiter),
+	}
+}
+
+// Sets the quota of |tenant| to |flowRate| new flows per second with
+// a burst of |flowBurst| flows. A zero |flowRate| removes the quota.
+func (ac *admissionControl) setTenantQuota(tenant string, flowRate float64, flowBurst int) {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+
+	if limiter := newFlowLimiter(flowRate, flowBurst); limiter != nil {
+		ac.tenants[tenant] = limiter
+	} else {
+		delete(ac.tenants, tenant)
+	}
+}
+
+// Reserves a token of |tenant|'s quota for a new flow at |now|.
+// Returns false if the tenant exceeds its quota. The reservation is
+// nil if |tenant| has no quota.
+func (ac *admissionControl) reserveTenant(tenant string, now time.Time) (*rate.Reservation, bool) {
+	ac.mutex.Lock()
+	limiter, exists := ac.tenants[tenant]
+	ac.mutex.Unlock()
+
+	if !exists {
+		return nil, true
+	}
+	reservation := limiter.ReserveN(now, 1)
+	if !reservation.OK() || reservation.DelayFrom(now) > 0 {
+		reservation.CancelAt(now)
+		return nil, false
+	}
+	return reservation, true
+}
+
+// |admissionTicket| holds the tokens that an admitted flow takes
+// from its DAG's and its tenant's quotas at |now|.
+type admissionTicket struct {
+	now          time.Time
+	reservations []*rate.Reservation
+}
+
+// Returns the tokens of |t| to their quotas, e.g. if the flow is
+// rejected after it is admitted.
+// Note: a reservation can only be canceled at its own time. Tokens
+// refilled since then may be counted again, which is bounded by the
+// burst of the quota.
+func (t *admissionTicket) cancel() {
+	for _, reservation := range t.reservations {
+		reservation.CancelAt(t.now)
+	}
+	t.reservations = nil
+}
+
+// Admits a new flow to |dag|. Returns a |FlowRejectError| if the
+// flow exceeds the DAG's or the tenant's quota. A rejected flow
+// takes no tokens from either quota. Otherwise, returns the ticket
+// of the tokens taken by the flow.
+func (ac *admissionControl) admit(dag *DAG) (*admissionTicket, error) {
+	tenant, limiter, _ := dag.getAdmission()
+	if tenant == "" {
+		tenant = dag.user
+	}
+
+	// Reserves a token of the DAG's quota, and returns the token if
+	// the tenant's quota rejects the flow. Both happen at |now|, so
+	// that the token is restored.
+	now := time.Now()
+	ticket := &admissionTicket{now: now}
+	if limiter != nil {
+		reservation := limiter.ReserveN(now, 1)
+		if !reservation.OK() || reservation.DelayFrom(now) > 0 {
+			reservation.CancelAt(now)
+			return nil, newFlowRejectError(REJECT_QUOTA_EXCEEDED, "DAG of user [%s] exceeds its new-flow rate", dag.user)
+		}
+		ticket.reservations = append(ticket.reservations, reservation)
+	}
+	reservation, ok := ac.reserveTenant(tenant, now)
+	if !ok {
+		ticket.cancel()
+		return nil, newFlowRejectError(REJECT_QUOTA_EXCEEDED, "tenant [%s] exceeds its new-flow rate", tenant)
+	}
+	if reservation != nil {
+		ticket.reservations = append(ticket.reservations, reservation)
+	}
+	return ticket, nil
+}
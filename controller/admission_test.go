@@ -0,0 +1,150 @@
+package controller
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// Creates a controller without workers, and an active DAG of |user|
+// that serves flows to 10.0.0.0/24.
+func newAdmissionTestController(user string) (*FaaSController, *DAG) {
+	c := &FaaSController{
+		workers:   make(map[string]*Worker),
+		dags:      make(map[string]*DAG),
+		flows:     newFlowTable(time.Minute),
+		admission: newAdmissionControl(),
+	}
+	dag := c.getOrCreateDAG(user)
+	dag.addNF("acl")
+	dag.Activate()
+	c.AddFlowlet(user, "", "10.0.0.0/24", "*", "*", 0, 0)
+	return c, dag
+}
+
+// Adds a running SGroup to |dag|, which takes new flows.
+func addAdmissionTestSGroup(dag *DAG) *SGroup {
+	sg := newSchedTestSGroup(newSchedTestWorker(2), 0, 10, 2)
+	sg.state = SGROUP_RUNNING
+	dag.addSGroup(sg, 0)
+	return sg
+}
+
+// Returns the reason why |UpdateFlow| rejects a flow to |dstIP|.
+func rejectReason(c *FaaSController, dstIP string, srcPort uint32) RejectReason {
+	_, _, err := c.UpdateFlow("10.1.0.1", dstIP, srcPort, 8080, 6)
+	var rejection *FlowRejectError
+	if !errors.As(err, &rejection) {
+		return REJECT_NONE
+	}
+	return rejection.Reason
+}
+
+// Tests of rejection reasons of new flows.
+func TestAdmissionRejectReasons(t *testing.T) {
+	c, dag := newAdmissionTestController("u")
+
+	if r := rejectReason(c, "10.0.1.1", 1); r != REJECT_UNKNOWN_FLOWLET {
+		t.Errorf("Expect UNKNOWN_FLOWLET, got %s", r)
+	}
+	if r := rejectReason(c, "10.0.0.1", 1); r != REJECT_NO_CAPACITY {
+		t.Errorf("Expect NO_CAPACITY, got %s", r)
+	}
+
+	// The DAG has reached its max SGroups, and its SGroup is starting.
+	dag.setScaling(0, 1)
+	dag.addSGroup(&SGroup{}, 0)
+	if r := rejectReason(c, "10.0.0.1", 2); r != REJECT_SGROUP_STARTING {
+		t.Errorf("Expect SGROUP_STARTING, got %s", r)
+	}
+
+	dag.setActive(false)
+	if r := rejectReason(c, "10.0.0.1", 3); r != REJECT_DAG_INACTIVE {
+		t.Errorf("Expect DAG_INACTIVE, got %s", r)
+	}
+}
+
+// Tests of per-DAG and per-tenant quotas of new flows.
+func TestAdmissionQuotas(t *testing.T) {
+	c, dag := newAdmissionTestController("u")
+	addAdmissionTestSGroup(dag)
+	if err := c.SetAdmissionPolicy("u", AdmissionPolicy{FlowRate: 0.001, FlowBurst: 2}); err != nil {
+		t.Fatalf("Failed to set the admission policy: %v", err)
+	}
+
+	for i := uint32(0); i < 2; i++ {
+		if r := rejectReason(c, "10.0.0.1", i); r != REJECT_NONE {
+			t.Errorf("Flow %d is rejected within the DAG's burst: %s", i, r)
+		}
+	}
+	if r := rejectReason(c, "10.0.0.1", 2); r != REJECT_QUOTA_EXCEEDED {
+		t.Errorf("Expect QUOTA_EXCEEDED, got %s", r)
+	}
+
+	// DAGs of a tenant share the tenant's quota.
+	c2, dag2 := newAdmissionTestController("u2")
+	addAdmissionTestSGroup(dag2)
+	c2.SetAdmissionPolicy("u2", AdmissionPolicy{Tenant: "t"})
+	c2.SetTenantQuota("t", 0.001, 1)
+	if r := rejectReason(c2, "10.0.0.1", 0); r == REJECT_QUOTA_EXCEEDED {
+		t.Errorf("The first flow of a tenant is rejected")
+	}
+	if r := rejectReason(c2, "10.0.0.1", 1); r != REJECT_QUOTA_EXCEEDED {
+		t.Errorf("Expect QUOTA_EXCEEDED, got %s", r)
+	}
+	c2.SetTenantQuota("t", 0, 0)
+	if r := rejectReason(c2, "10.0.0.1", 2); r == REJECT_QUOTA_EXCEEDED {
+		t.Errorf("A removed tenant quota still rejects flows")
+	}
+
+	// Flows rejected by the tenant's quota take no tokens of the
+	// DAG's quota.
+	c3, dag3 := newAdmissionTestController("u3")
+	addAdmissionTestSGroup(dag3)
+	c3.SetAdmissionPolicy("u3", AdmissionPolicy{Tenant: "t", FlowRate: 0.001, FlowBurst: 2})
+	c3.SetTenantQuota("t", 0.001, 1)
+	for i := uint32(0); i < 4; i++ {
+		rejectReason(c3, "10.0.0.1", i)
+	}
+	c3.SetTenantQuota("t", 0, 0)
+	if r := rejectReason(c3, "10.0.0.1", 4); r == REJECT_QUOTA_EXCEEDED {
+		t.Errorf("Flows rejected by the tenant's quota took the DAG's quota")
+	}
+	if r := rejectReason(c3, "10.0.0.1", 5); r != REJECT_QUOTA_EXCEEDED {
+		t.Errorf("Expect QUOTA_EXCEEDED, got %s", r)
+	}
+}
+
+// Tests that flows rejected after their admission take no tokens of
+// the DAG's or the tenant's quota.
+func TestAdmissionCapacityRejections(t *testing.T) {
+	c, dag := newAdmissionTestController("u")
+	c.SetAdmissionPolicy("u", AdmissionPolicy{Tenant: "t", FlowRate: 0.001, FlowBurst: 2})
+	c.SetTenantQuota("t", 0.001, 2)
+
+	// No SGroups can take the flows, and the switch retries them.
+	for i := uint32(0); i < 5; i++ {
+		if r := rejectReason(c, "10.0.0.1", i); r != REJECT_NO_CAPACITY {
+			t.Errorf("Expect NO_CAPACITY, got %s", r)
+		}
+	}
+	dag.setScaling(0, 1)
+	dag.addSGroup(&SGroup{}, 0)
+	for i := uint32(0); i < 5; i++ {
+		if r := rejectReason(c, "10.0.0.1", i); r != REJECT_SGROUP_STARTING {
+			t.Errorf("Expect SGROUP_STARTING, got %s", r)
+		}
+	}
+
+	// The retries are admitted once the DAG's SGroup is running.
+	dag.sgroups = nil
+	addAdmissionTestSGroup(dag)
+	for i := uint32(0); i < 2; i++ {
+		if r := rejectReason(c, "10.0.0.1", i); r != REJECT_NONE {
+			t.Errorf("Flow %d is rejected within the quotas: %s", i, r)
+		}
+	}
+	if r := rejectReason(c, "10.0.0.1", 2); r != REJECT_QUOTA_EXCEEDED {
+		t.Errorf("Expect QUOTA_EXCEEDED, got %s", r)
+	}
+}
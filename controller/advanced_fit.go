@@ -0,0 +1,188 @@
+package controller
+
+import (
+	"time"
+
+	glog "github.com/golang/glog"
+)
+
+// This is the place to implement the advanced-fit scheduling policy.
+// Newly active SGroups are packed into cores by Best-Fit Decreasing.
+// An SGroup that stays overloaded on a shared core is rescheduled:
+// either the SGroup moves to a core of its own, or its lighter
+// neighbors move to other cores. Cores that stay underloaded are
+// repacked into other cores. Each migration is an |attachSGroup|
+// gRPC to CoopSched, which stalls the SGroup. The policy only spends
+// |kMaxRepackCostUs| on migrations to free a core.
+
+const (
+	// An SGroup is overloaded if its packet load is above
+	// |kMaxCorePktLoad| or its queue load is above |kSchedMaxQLoad|.
+	kSchedMaxQLoad = 40
+
+	// A core is underloaded if its packet load is below
+	// |kMinCorePktLoad|.
+	kMinCorePktLoad = 40
+
+	// The time (in milliseconds) that an SGroup stays overloaded (or a
+	// core stays underloaded) before it is rescheduled.
+	kOverloadDuration  = 500
+	kUnderloadDuration = 2000
+
+	// The max migration cost (in microseconds) spent to free a core.
+	kMaxRepackCostUs = 20000
+)
+
+// |advancedFitPolicy| packs non-overloaded SGroups into CPU cores, and
+// reschedules overloaded SGroups.
+// Algorithm:
+// Best-Fit Decreasing for newly active SGroups.
+// Rescheduling for overloaded SGroups.
+// Repacking for underloaded cores.
+// |overloaded| is the time since each SGroup is overloaded.
+// |underloaded| is the time since each core is underloaded.
+// |migrationCostUs| is the estimated cost of a migration, measured
+// by the worker's |migrationGovernor|.
+type advancedFitPolicy struct {
+	overloaded      map[*SGroup]time.Time
+	underloaded     map[int]time.Time
+	migrationCostUs int
+}
+
+func newAdvancedFitPolicy() *advancedFitPolicy {
+	return &advancedFitPolicy{
+		overloaded:      make(map[*SGroup]time.Time),
+		underloaded:     make(map[int]time.Time),
+		migrationCostUs: kDefaultMigrationCostUs,
+	}
+}
+
+func (p *advancedFitPolicy) Name() string {
+	return "advanced-fit"
+}
+
+func (p *advancedFitPolicy) ScheduleOnce(w *Worker) {
+	p.migrationCostUs = w.migrations.costUs
+	v := newSchedView(w, w.parkIdleSGroups())
+	w.migrations.execute(w, v, p.plan(w, v, w.migrations.now()))
+}
+
+// Plans migrations of SGroups in |v| at time |now|. Returns migrations
+// in the order to be executed.
+func (p *advancedFitPolicy) plan(w *Worker, v *schedView, now time.Time) []sgMove {
+	// Packs newly active SGroups by Best-Fit Decreasing.
+	v.placePending(w)
+
+	p.relieveOverloadedSGroups(w, v, now)
+	p.repackUnderloadedCores(v, now)
+	return v.result()
+}
+
+// Reschedules SGroups that stay overloaded on shared cores for
+// |kOverloadDuration|.
+func (p *advancedFitPolicy) relieveOverloadedSGroups(w *Worker, v *schedView, now time.Time) {
+	overloaded := make(map[*SGroup]time.Time)
+	candidates := make([]*SGroup, 0)
+	for _, coreID := range v.coreIDs {
+		core := v.cores[coreID]
+		if len(core.sgroups) <= 1 {
+			continue
+		}
+		for _, sg := range core.sgroups {
+			if !v.overloaded[sg] {
+				continue
+			}
+			since, exists := p.overloaded[sg]
+			if !exists {
+				since = now
+			}
+			overloaded[sg] = since
+			if now.Sub(since) >= kOverloadDuration*time.Millisecond {
+				candidates = append(candidates, sg)
+			}
+		}
+	}
+	p.overloaded = overloaded
+
+	for _, sg := range candidates {
+		coreID := v.coreOf[sg]
+		if len(v.cores[coreID].sgroups) <= 1 {
+			// |sg| has got a core of its own.
+			delete(p.overloaded, sg)
+			continue
+		}
+
+		// Option 1: moves lighter neighbors to other running cores.
+		// It does not take a new core, but may take more migrations.
+		neighbors := make([]*SGroup, 0)
+		for _, n := range v.cores[coreID].sgroups {
+			if n != sg {
+				neighbors = append(neighbors, n)
+			}
+		}
+		moves, ok := v.fitAll(neighbors, coreID)
+		for _, n := range neighbors {
+			if v.loads[n] > v.loads[sg] {
+				ok = false
+			}
+		}
+
+		// Option 2: moves |sg| to a core of its own.
+		emptyCoreID := v.emptyCore(sg)
+
+		if ok && len(moves)*p.migrationCostUs <= kMaxRepackCostUs {
+			for _, m := range moves {
+				v.move(m.sg, m.coreID)
+			}
+		} else if emptyCoreID != kFaaSInvalidCoreID {
+			v.move(sg, emptyCoreID)
+		} else if ok {
+			for _, m := range moves {
+				v.move(m.sg, m.coreID)
+			}
+		} else {
+			glog.Errorf("Worker[%s] runs out of cores for overloaded SGroup[%d]", w.name, sg.ID())
+			continue
+		}
+		delete(p.overloaded, sg)
+	}
+}
+
+// Frees the least loaded core that stays underloaded for
+// |kUnderloadDuration|, by repacking its SGroups into other running
+// cores. At most one core is freed in each round.
+func (p *advancedFitPolicy) repackUnderloadedCores(v *schedView, now time.Time) {
+	underloaded := make(map[int]time.Time)
+	loads := v.coreLoads()
+	target := kFaaSInvalidCoreID
+	for _, coreID := range v.coreIDs {
+		if len(v.cores[coreID].sgroups) == 0 || loads[coreID] >= kMinCorePktLoad {
+			continue
+		}
+		since, exists := p.underloaded[coreID]
+		if !exists {
+			since = now
+		}
+		underloaded[coreID] = since
+		if now.Sub(since) < kUnderloadDuration*time.Millisecond {
+			continue
+		}
+		if target == kFaaSInvalidCoreID || loads[coreID] < loads[target] {
+			target = coreID
+		}
+	}
+	p.underloaded = underloaded
+
+	if target == kFaaSInvalidCoreID {
+		return
+	}
+
+	moves, ok := v.fitAll(v.cores[target].sgroups, target)
+	if !ok || len(moves)*p.migrationCostUs > kMaxRepackCostUs {
+		return
+	}
+	for _, m := range moves {
+		v.move(m.sg, m.coreID)
+	}
+	delete(p.underloaded, target)
+}
@@ -0,0 +1,159 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	pb "github.com/USC-NSL/Low-Latency-FaaS/proto"
+)
+
+// |testCoopSched| is a CooperativeSched in tests. It records requests
+// in |log| (optional), e.g. "attach 2" for attaching a chain on core
+// #2. All requests fail while |fail| is true.
+type testCoopSched struct {
+	log  *[]string
+	fail bool
+}
+
+func (s *testCoopSched) request(req string) (*pb.Error, error) {
+	if s.fail {
+		return nil, errors.New("connection does not exist")
+	}
+	if s.log != nil {
+		*s.log = append(*s.log, req)
+	}
+	return &pb.Error{}, nil
+}
+
+func (s *testCoopSched) AttachChain(tids []int32, core int) (*pb.Error, error) {
+	return s.request(fmt.Sprintf("attach %d", core))
+}
+
+func (s *testCoopSched) DetachChain(tids []int32, core int) (*pb.Error, error) {
+	return s.request(fmt.Sprintf("detach %d", core))
+}
+
+func (s *testCoopSched) RemoveChain(tids []int32) (*pb.Error, error) {
+	return s.request("remove")
+}
+
+// Creates a test worker with Core #1 ~ #|coreNum|, where Core #1 is
+// the idle core.
+func newSchedTestWorker(coreNum int) *Worker {
+	w := &Worker{name: "node1", cores: make(map[int]*Core), idleCoreID: 1}
+	for coreID := 1; coreID <= coreNum; coreID++ {
+		w.cores[coreID] = NewCore(coreID, -1)
+	}
+	return w
+}
+
+// Creates an active test SGroup with packet load |pktLoad| running on
+// core |coreID| (|kFaaSInvalidCoreID|: not running).
+func newSchedTestSGroup(w *Worker, id int, pktLoad int, coreID int) *SGroup {
+	return &SGroup{
+		groupID:          id,
+		pcieIdx:          id,
+		worker:           w,
+		pktRateKpps:      pktLoad * 10,
+		maxRateKpps:      1000,
+		incQueueCapacity: 100,
+		state:            SGROUP_RUNNING,
+		coreID:           coreID,
+	}
+}
+
+// The period of scheduling rounds in tests.
+const kTestSchedPeriod = 100 * time.Millisecond
+
+// The simulated time of scheduling rounds in tests.
+var testSchedNow = time.Unix(0, 0)
+
+// Plans |rounds| scheduling rounds, every |kTestSchedPeriod| on the
+// same snapshot of |w|. Returns migrations planned in the last round.
+func planRounds(p *advancedFitPolicy, w *Worker, active []*SGroup, rounds int) map[*SGroup]int {
+	moves := make(map[*SGroup]int)
+	for i := 0; i < rounds; i++ {
+		moves = make(map[*SGroup]int)
+		testSchedNow = testSchedNow.Add(kTestSchedPeriod)
+		for _, m := range p.plan(w, newSchedView(w, active), testSchedNow) {
+			moves[m.sg] = m.coreID
+		}
+	}
+	return moves
+}
+
+// The number of scheduling rounds for an SGroup to stay overloaded
+// (or a core to stay underloaded) before it is rescheduled.
+const kOverloadRounds = int(kOverloadDuration*time.Millisecond/kTestSchedPeriod) + 1
+const kUnderloadRounds = int(kUnderloadDuration*time.Millisecond/kTestSchedPeriod) + 1
+
+// Tests of packing newly active SGroups.
+func TestSchedAdvancedFitPacking(t *testing.T) {
+	w := newSchedTestWorker(4)
+	a := newSchedTestSGroup(w, 0, 50, kFaaSInvalidCoreID)
+	b := newSchedTestSGroup(w, 1, 30, w.idleCoreID)
+	c := newSchedTestSGroup(w, 2, 20, kFaaSInvalidCoreID)
+
+	moves := planRounds(newAdvancedFitPolicy(), w, []*SGroup{a, b, c}, 1)
+	if moves[a] != 2 || moves[b] != 3 || moves[c] != 2 {
+		t.Errorf("Unexpected packing: a=%d, b=%d, c=%d", moves[a], moves[b], moves[c])
+	}
+}
+
+// Tests of rescheduling an SGroup that stays overloaded on a shared core.
+func TestSchedAdvancedFitOverload(t *testing.T) {
+	// Moves the lighter neighbor to another running core.
+	w := newSchedTestWorker(4)
+	a := newSchedTestSGroup(w, 0, 90, 2)
+	b := newSchedTestSGroup(w, 1, 10, 2)
+	c := newSchedTestSGroup(w, 2, 30, 3)
+
+	p := newAdvancedFitPolicy()
+	if moves := planRounds(p, w, []*SGroup{a, b, c}, kOverloadRounds-1); len(moves) != 0 {
+		t.Errorf("Rescheduled a transient overload: %v", moves)
+	}
+	moves := planRounds(p, w, []*SGroup{a, b, c}, 1)
+	if len(moves) != 1 || moves[b] != 3 {
+		t.Errorf("Failed to move the lighter neighbor away: %v", moves)
+	}
+
+	// Moves the overloaded SGroup to an empty core if its neighbor
+	// does not fit into other cores.
+	b = newSchedTestSGroup(w, 1, 50, 2)
+	c = newSchedTestSGroup(w, 2, 60, 3)
+	moves = planRounds(newAdvancedFitPolicy(), w, []*SGroup{a, b, c}, kOverloadRounds)
+	if len(moves) != 1 || moves[a] != 4 {
+		t.Errorf("Failed to move the overloaded SGroup to an empty core: %v", moves)
+	}
+
+	// Does nothing if the overloaded SGroup runs on its own core.
+	moves = planRounds(newAdvancedFitPolicy(), w, []*SGroup{a, c}, kOverloadRounds)
+	if len(moves) != 0 {
+		t.Errorf("Rescheduled an SGroup on its own core: %v", moves)
+	}
+}
+
+// Tests of repacking underloaded cores.
+func TestSchedAdvancedFitRepack(t *testing.T) {
+	w := newSchedTestWorker(4)
+	a := newSchedTestSGroup(w, 0, 10, 2)
+	b := newSchedTestSGroup(w, 1, 50, 3)
+
+	p := newAdvancedFitPolicy()
+	if moves := planRounds(p, w, []*SGroup{a, b}, kUnderloadRounds-1); len(moves) != 0 {
+		t.Errorf("Repacked a core too early: %v", moves)
+	}
+	moves := planRounds(p, w, []*SGroup{a, b}, 1)
+	if len(moves) != 1 || moves[a] != 3 {
+		t.Errorf("Failed to repack an underloaded core: %v", moves)
+	}
+
+	// Does not repack if migrations cost too much.
+	p = newAdvancedFitPolicy()
+	p.migrationCostUs = kMaxRepackCostUs + 1
+	if moves := planRounds(p, w, []*SGroup{a, b}, kUnderloadRounds); len(moves) != 0 {
+		t.Errorf("Repacked a core with expensive migrations: %v", moves)
+	}
+}
@@ -0,0 +1,343 @@
+package controller
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	utils "github.com/USC-NSL/Low-Latency-FaaS/utils"
+	glog "github.com/golang/glog"
+)
+
+// This is the place to audit scheduling and load-balancing decisions.
+// Each decision is recorded as an |AuditEvent| with the inputs used to
+// make it (e.g. loads and queue lengths). Events are written as JSON
+// lines to a rotating file set by the |-auditlog| flag. Events are in
+// time order, so that analysis tools and simulators can replay them
+// (see |ReadAuditLog| and |ReplayPlacements|).
+
+const (
+	// The version of the schema of |AuditEvent|.
+	kAuditSchemaVersion = 1
+
+	// The default max size (in MB) of an audit log file.
+	kDefaultAuditLogSizeMB = 64
+
+	// The default number of rotated audit log files.
+	kDefaultAuditLogBackups = 4
+)
+
+var auditLogPath string
+var auditLogSizeMB int
+var auditLogBackups int
+
+func init() {
+	flag.StringVar(&auditLogPath, "auditlog", "", "The JSONL file of scheduling decisions (empty: disabled)")
+	flag.IntVar(&auditLogSizeMB, "auditlogsize", kDefaultAuditLogSizeMB, "The max size (in MB) of an audit log file")
+	flag.IntVar(&auditLogBackups, "auditlogbackups", kDefaultAuditLogBackups, "The number of rotated audit log files")
+}
+
+// |AuditEventType| is the type of a decision.
+type AuditEventType string
+
+const (
+	// An SGroup is attached to a core.
+	AUDIT_ATTACH AuditEventType = "attach"
+	// An SGroup is detached from its core.
+	AUDIT_DETACH AuditEventType = "detach"
+	// An SGroup migrates from one running core to another.
+	AUDIT_MIGRATE AuditEventType = "migrate"
+	// A new flow is assigned to an SGroup.
+	AUDIT_FLOW AuditEventType = "flow"
+	// A new flow is rejected.
+	AUDIT_REJECT AuditEventType = "reject"
+	// A free SGroup starts to run a chain of a DAG.
+	AUDIT_SCALE_UP AuditEventType = "scale_up"
+	// An idle SGroup is reclaimed from its DAG.
+	AUDIT_SCALE_IN AuditEventType = "scale_in"
+	// An SGroup turns active.
+	AUDIT_ACTIVE AuditEventType = "active"
+	// An SGroup turns idle.
+	AUDIT_IDLE AuditEventType = "idle"
+)
+
+// |AuditEvent| is a decision of FaaSController.
+// |SGroup|, |Core| and |FromCore| are -1 if not applicable. |FromCore|
+// is the previous core of a migration.
+// |DAG| is the user of the DAG, and |Chain| is the index of the chain.
+// |Flow| is the 5-tuple of a flow, and |Reason| is why it is rejected.
+// |PktLoad|, |QLoad|, |QLen| and |PktRate| are stats of the SGroup
+// when the decision is made.
+// |CoreLoads| are packet loads of running cores of the worker.
+type AuditEvent struct {
+	Version   int            `json:"v"`
+	Time      time.Time      `json:"ts"`
+	Type      AuditEventType `json:"type"`
+	Worker    string         `json:"worker,omitempty"`
+	SGroup    int            `json:"sgroup"`
+	Core      int            `json:"core"`
+	FromCore  int            `json:"fromCore"`
+	DAG       string         `json:"dag,omitempty"`
+	Chain     int            `json:"chain"`
+	Flow      string         `json:"flow,omitempty"`
+	Reason    string         `json:"reason,omitempty"`
+	PktLoad   int            `json:"pktLoad"`
+	QLoad     int            `json:"qload"`
+	QLen      int            `json:"qlen"`
+	PktRate   int            `json:"kpps"`
+	CoreLoads map[int]int    `json:"coreLoads,omitempty"`
+}
+
+// |auditLog| writes |AuditEvent|s to |w| as JSON lines.
+// |mutex| protects |w|, which is nil after the log is closed.
+type auditLog struct {
+	w     io.WriteCloser
+	now   func() time.Time
+	mutex sync.Mutex
+}
+
+// The audit log of FaaSController (nil: disabled). It is protected by
+// |auditMutex|. Callers get it by |getAuditor|.
+var auditMutex sync.Mutex
+var auditor *auditLog = nil
+
+func newAuditLog(w io.WriteCloser) *auditLog {
+	return &auditLog{w: w, now: time.Now}
+}
+
+// Returns the audit log of FaaSController (nil: disabled).
+func getAuditor() *auditLog {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	return auditor
+}
+
+// Sets the audit log of FaaSController to |a|, and returns the
+// previous one.
+func setAuditor(a *auditLog) *auditLog {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	prev := auditor
+	auditor = a
+	return prev
+}
+
+// Opens the audit log set by the |-auditlog| flag. Does nothing if
+// the flag is not set.
+func openAuditLog() error {
+	if auditLogPath == "" {
+		return nil
+	}
+
+	f, err := utils.NewRotatingFile(auditLogPath, int64(auditLogSizeMB)<<20, auditLogBackups)
+	if err != nil {
+		return err
+	}
+	if prev := setAuditor(newAuditLog(f)); prev != nil {
+		prev.close()
+	}
+	glog.Infof("Audit scheduling decisions at %s", auditLogPath)
+	return nil
+}
+
+// Closes the audit log.
+func closeAuditLog() {
+	if a := setAuditor(nil); a != nil {
+		a.close()
+	}
+}
+
+// Closes |a|. Events recorded after are dropped.
+func (a *auditLog) close() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.w != nil {
+		a.w.Close()
+		a.w = nil
+	}
+}
+
+// Records |e|. Does nothing if |a| is disabled or closed.
+func (a *auditLog) record(e *AuditEvent) {
+	if a == nil {
+		return
+	}
+
+	e.Version = kAuditSchemaVersion
+	e.Time = a.now()
+	line, err := json.Marshal(e)
+	if err != nil {
+		glog.Errorf("Failed to encode audit event %s. %v", e.Type, err)
+		return
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.w == nil {
+		return
+	}
+	if _, err := a.w.Write(append(line, '\n')); err != nil {
+		glog.Errorf("Failed to write audit event %s. %v", e.Type, err)
+	}
+}
+
+// Returns an event of |eventType| on |sg| with its current stats.
+// |sg.mutex| must not be held.
+func newSGroupAuditEvent(eventType AuditEventType, sg *SGroup) *AuditEvent {
+	sg.mutex.Lock()
+	defer sg.mutex.Unlock()
+
+	return sg.newAuditEvent(eventType)
+}
+
+// Returns an event of |eventType| on |sg| with its current stats.
+// |sg.mutex| must be held.
+func (sg *SGroup) newAuditEvent(eventType AuditEventType) *AuditEvent {
+	e := &AuditEvent{
+		Type:     eventType,
+		SGroup:   sg.ID(),
+		Core:     sg.coreID,
+		FromCore: kFaaSInvalidCoreID,
+		Chain:    sg.chainIdx,
+		PktLoad:  sg.getPktLoad(),
+		QLoad:    sg.getQLoad(),
+		QLen:     sg.incQueueLength,
+		PktRate:  sg.pktRateKpps,
+	}
+	if sg.worker != nil {
+		e.Worker = sg.worker.name
+	}
+	if sg.dag != nil {
+		e.DAG = sg.dag.user
+	}
+	return e
+}
+
+// Returns packet loads of running cores of |w|. The caller must make
+// sure that cores are not changed concurrently, e.g. by holding
+// |w.sgMutex|, or running in the scheduling loop.
+func (w *Worker) getCoreLoads() map[int]int {
+	loads := make(map[int]int)
+	for coreID, core := range w.cores {
+		for _, sg := range core.sGroups {
+			if sg.IsSched() {
+				loads[coreID] += sg.GetPktLoad()
+			}
+		}
+	}
+	return loads
+}
+
+// Records an attach of |sg| to core |coreID|, which was on core
+// |prevCoreID|. A move between running cores is a migration.
+func (w *Worker) auditAttach(sg *SGroup, prevCoreID int, wasSched bool) {
+	a := getAuditor()
+	if a == nil {
+		return
+	}
+
+	e := newSGroupAuditEvent(AUDIT_ATTACH, sg)
+	if wasSched && prevCoreID != kFaaSInvalidCoreID && prevCoreID != w.idleCoreID {
+		e.Type = AUDIT_MIGRATE
+		e.FromCore = prevCoreID
+	}
+	e.CoreLoads = w.getCoreLoads()
+	a.record(e)
+}
+
+// Records a detach of |sg|.
+func (w *Worker) auditDetach(sg *SGroup) {
+	a := getAuditor()
+	if a == nil {
+		return
+	}
+
+	e := newSGroupAuditEvent(AUDIT_DETACH, sg)
+	e.CoreLoads = w.getCoreLoads()
+	a.record(e)
+}
+
+// Records that flow |k| is assigned to |sg|, or rejected by |err| if
+// |sg| is nil.
+func auditFlow(k flowKey, sg *SGroup, err error) {
+	a := getAuditor()
+	if a == nil {
+		return
+	}
+
+	var e *AuditEvent = nil
+	if sg != nil {
+		e = newSGroupAuditEvent(AUDIT_FLOW, sg)
+	} else {
+		e = &AuditEvent{Type: AUDIT_REJECT, SGroup: -1, Core: -1, FromCore: -1, Chain: -1}
+		if rejectErr, ok := err.(*FlowRejectError); ok {
+			e.Reason = rejectErr.Reason.String()
+		} else if err != nil {
+			e.Reason = err.Error()
+		}
+	}
+	e.Flow = k.String()
+	a.record(e)
+}
+
+// Records that |sg| scales up chain |chainIdx| of |dag|.
+func auditScaleUp(sg *SGroup, dag *DAG, chainIdx int) {
+	a := getAuditor()
+	if a == nil {
+		return
+	}
+
+	e := newSGroupAuditEvent(AUDIT_SCALE_UP, sg)
+	e.DAG = dag.user
+	e.Chain = chainIdx
+	a.record(e)
+}
+
+// Reads audit events from |r| in JSON lines.
+func ReadAuditLog(r io.Reader) ([]AuditEvent, error) {
+	events := make([]AuditEvent, 0)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if e.Version > kAuditSchemaVersion {
+			return nil, fmt.Errorf("line %d: unsupported schema version %d", line, e.Version)
+		}
+		events = append(events, e)
+	}
+	return events, scanner.Err()
+}
+
+// Replays |events|, and returns the core of each running SGroup of
+// each worker after all |events|. Detached SGroups are removed.
+func ReplayPlacements(events []AuditEvent) map[string]map[int]int {
+	placements := make(map[string]map[int]int)
+	for _, e := range events {
+		if e.Type != AUDIT_ATTACH && e.Type != AUDIT_MIGRATE && e.Type != AUDIT_DETACH {
+			continue
+		}
+		if _, exists := placements[e.Worker]; !exists {
+			placements[e.Worker] = make(map[int]int)
+		}
+		if e.Type == AUDIT_DETACH {
+			delete(placements[e.Worker], e.SGroup)
+		} else {
+			placements[e.Worker][e.SGroup] = e.Core
+		}
+	}
+	return placements
+}
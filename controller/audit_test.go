@@ -0,0 +1,105 @@
+package controller
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// |auditBuffer| keeps audit events in memory.
+type auditBuffer struct {
+	bytes.Buffer
+}
+
+func (b *auditBuffer) Close() error {
+	return nil
+}
+
+func TestAuditLog(t *testing.T) {
+	buf := &auditBuffer{}
+	log := newAuditLog(buf)
+	log.now = func() time.Time { return time.Unix(100, 0) }
+	setAuditor(log)
+	defer closeAuditLog()
+
+	w := newSchedTestWorker(3)
+	a := newSchedTestSGroup(w, 0, 30, kFaaSInvalidCoreID)
+	b := newSchedTestSGroup(w, 1, 50, 3)
+	w.cores[3].addSGroup(b)
+
+	a.coreID = 2
+	w.cores[2].addSGroup(a)
+	w.auditAttach(a, w.idleCoreID, true)
+
+	w.cores[2].removeSGroup(a)
+	a.coreID = 3
+	w.cores[3].addSGroup(a)
+	w.auditAttach(a, 2, true)
+
+	w.cores[3].removeSGroup(a)
+	a.coreID = w.idleCoreID
+	w.auditDetach(a)
+	auditFlow(flowKey{"10.0.0.1", "10.0.0.2", 1000, 80, 6}, b, nil)
+	auditFlow(flowKey{"10.0.0.1", "10.0.0.2", 1001, 80, 6}, nil, newFlowRejectError(REJECT_NO_CAPACITY, "test"))
+
+	events, err := ReadAuditLog(&buf.Buffer)
+	if err != nil {
+		t.Fatalf("Failed to read the audit log: %v", err)
+	}
+	if len(events) != 5 {
+		t.Fatalf("Expect 5 events, got %d", len(events))
+	}
+
+	types := []AuditEventType{AUDIT_ATTACH, AUDIT_MIGRATE, AUDIT_DETACH, AUDIT_FLOW, AUDIT_REJECT}
+	for i, e := range events {
+		if e.Type != types[i] || e.Version != kAuditSchemaVersion || !e.Time.Equal(time.Unix(100, 0)) {
+			t.Errorf("Expect a %s event, got %+v", types[i], e)
+		}
+	}
+	if e := events[0]; e.Worker != "node1" || e.Core != 2 || e.PktLoad != 30 || e.CoreLoads[2] != 30 || e.CoreLoads[3] != 50 {
+		t.Errorf("Wrong attach event %+v", e)
+	}
+	if e := events[1]; e.FromCore != 2 || e.Core != 3 || e.CoreLoads[3] != 80 {
+		t.Errorf("Wrong migration event %+v", e)
+	}
+	if e := events[4]; e.Reason != "NO_CAPACITY" || e.SGroup != -1 || e.Flow == "" {
+		t.Errorf("Wrong reject event %+v", e)
+	}
+
+	// Replays attach, migration and detach events.
+	placements := ReplayPlacements(events[:2])
+	if placements["node1"][0] != 3 {
+		t.Errorf("Expect SGroup[0] on core #3, got %v", placements)
+	}
+	if placements = ReplayPlacements(events); len(placements["node1"]) != 0 {
+		t.Errorf("Expect no running SGroups, got %v", placements)
+	}
+}
+
+// Tests of recording events while the audit log is closed.
+func TestAuditLogClose(t *testing.T) {
+	buf := &auditBuffer{}
+	log := newAuditLog(buf)
+	setAuditor(log)
+
+	k := flowKey{"10.0.0.1", "10.0.0.2", 1000, 80, 6}
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			auditFlow(k, nil, newFlowRejectError(REJECT_NO_CAPACITY, "test"))
+		}
+		done <- true
+	}()
+	closeAuditLog()
+	<-done
+
+	if getAuditor() != nil {
+		t.Errorf("The audit log is still enabled after it is closed")
+	}
+	n := buf.Len()
+	log.record(&AuditEvent{Type: AUDIT_REJECT})
+	auditFlow(k, nil, nil)
+	if buf.Len() != n {
+		t.Errorf("Recorded events after the audit log is closed")
+	}
+}
@@ -1,12 +1,14 @@
 package controller
 
 import (
+	"flag"
 	"fmt"
 	"strings"
 	"sync"
 	"time"
 
 	kubectl "github.com/USC-NSL/Low-Latency-FaaS/kubectl"
+	utils "github.com/USC-NSL/Low-Latency-FaaS/utils"
 	glog "github.com/golang/glog"
 )
 
@@ -14,10 +16,28 @@ import (
 // that run in the background.
 // 1. Worker
 // - Creates free SGroups in the background.
+// - Keeps a warm pool of free SGroups between its watermarks.
 // - Deploys NF containers in the background.
 // 2. Schedule
 // - Optimizes CPU scheduler in the background.
 
+const (
+	// Default watermarks of the warm pool of free SGroups on a worker.
+	kDefaultMinFreeSGroups = 2
+	kDefaultMaxFreeSGroups = 4
+
+	// The period (in milliseconds) of checking warm pools.
+	kWarmPoolPeriod = 1000
+)
+
+var defaultMinFreeSGroups int
+var defaultMaxFreeSGroups int
+
+func init() {
+	flag.IntVar(&defaultMinFreeSGroups, "freemin", kDefaultMinFreeSGroups, "The low watermark of free SGroups per worker")
+	flag.IntVar(&defaultMaxFreeSGroups, "freemax", kDefaultMaxFreeSGroups, "The high watermark of free SGroups per worker")
+}
+
 type FaaSOP int
 
 const (
@@ -26,6 +46,19 @@ const (
 	SHUTDOWN
 )
 
+// Sends SHUTDOWN to the go routine that serves |op|. Drops pending
+// ops, so that it never blocks even if the go routine is not running.
+func stopOpLoop(op chan FaaSOP) {
+	for {
+		select {
+		case <-op:
+			continue
+		case op <- SHUTDOWN:
+		}
+		return
+	}
+}
+
 func (op FaaSOP) String() string {
 	switch {
 	case op == FREE_SGROUP:
@@ -35,33 +68,156 @@ func (op FaaSOP) String() string {
 	}
 }
 
-// Long-running Go-routine function at each worker.
-// This function waits for control messages to create FreeSgroups.
-// The goal is to create a pool of NIC queues concurrently.
-func (w *Worker) RunFreeSGroupFactory(op chan FaaSOP) {
-	var msg FaaSOP
+// |warmPool| keeps the number of free SGroups of a worker between
+// its watermarks. When free SGroups drop below |low|, the pool is
+// replenished up to |high| in the background.
+// |pending| is the number of free SGroups being created.
+// |backoff| delays replenishing after a failed creation until
+// |retryAt|.
+// |newFreeSGroup| creates a free SGroup. Returns nil if it fails.
+// |mutex| protects all fields.
+type warmPool struct {
+	low           int
+	high          int
+	pending       int
+	backoff       utils.Backoff
+	retryAt       time.Time
+	newFreeSGroup func() *SGroup
+	mutex         sync.Mutex
+}
 
-	for {
-		msg = <-op
+func newWarmPool(low int, high int, newFreeSGroup func() *SGroup) *warmPool {
+	return &warmPool{
+		low:           low,
+		high:          high,
+		backoff:       utils.Backoff{Factor: 2, Jitter: true, Min: time.Second, Max: time.Minute},
+		newFreeSGroup: newFreeSGroup,
+	}
+}
 
-		if msg == FREE_SGROUP {
-			// TODO(Jianfeng): handle errors.
-			go w.createFreeSGroup()
-		}
+// Sets the watermarks of the warm pool of |w| to [|low|, |high|].
+func (w *Worker) setWarmPool(low int, high int) error {
+	if low < 0 || high < low {
+		return fmt.Errorf("invalid watermarks of free SGroups [%d, %d]", low, high)
+	}
 
-		if msg == SHUTDOWN {
-			w.wg.Done()
-			return
+	p := w.freePool
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.low = low
+	p.high = high
+	return nil
+}
+
+// Returns the warm pool levels of |w|, i.e. the number of free and
+// pending free SGroups, and the watermarks.
+func (w *Worker) getWarmPoolLevels() (free int, pending int, low int, high int) {
+	free = w.countFreeSGroups()
+
+	p := w.freePool
+	if p == nil {
+		return free, 0, 0, 0
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return free, p.pending, p.low, p.high
+}
+
+// Wakes up the warm pool manager of |w|. Never blocks.
+func (w *Worker) notifyWarmPool() {
+	select {
+	case w.poolOp <- FREE_SGROUP:
+	default:
+	}
+}
+
+// Long-running Go-routine function at each worker. Replenishes the
+// warm pool of free SGroups when it is notified, and every
+// |kWarmPoolPeriod|. Undrained SGroups are retried first, so that
+// they refill the warm pool.
+func (w *Worker) WarmPoolLoop() {
+	ticker := time.NewTicker(kWarmPoolPeriod * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case op := <-w.poolOp:
+			if op == SHUTDOWN {
+				w.wg.Done()
+				return
+			}
+		case <-ticker.C:
 		}
+
+		w.retryUndrainedSGroups()
+		w.replenishFreeSGroups(false)
+	}
+}
+
+// Creates free SGroups of |w| in the background up to the high
+// watermark, if free SGroups drop below the low watermark (or
+// always if |fill| is true). Never takes more than the free PCIe VFs.
+// Returns the number of free SGroups being created.
+func (w *Worker) replenishFreeSGroups(fill bool) int {
+	free := w.countFreeSGroups()
+
+	p := w.freePool
+	p.mutex.Lock()
+	if time.Now().Before(p.retryAt) || (!fill && free+p.pending >= p.low) {
+		p.mutex.Unlock()
+		return 0
+	}
+
+	// Pending SGroups may have taken their VFs. So, this is a
+	// conservative estimate of the free VFs.
+	n := p.high - free - p.pending
+	if vfs := w.pciePool.Size() - p.pending; n > vfs {
+		n = vfs
+	}
+	if n <= 0 {
+		p.mutex.Unlock()
+		return 0
+	}
+	p.pending += n
+	p.mutex.Unlock()
+
+	glog.Infof("Worker[%s] creates %d free SGroups (free=%d)", w.name, n, free)
+	for i := 0; i < n; i++ {
+		go w.createPooledFreeSGroup()
+	}
+	return n
+}
+
+// Go-routine function for creating a free SGroup of the warm pool.
+func (w *Worker) createPooledFreeSGroup() {
+	p := w.freePool
+	sg := p.newFreeSGroup()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.pending -= 1
+	if sg == nil {
+		delay := p.backoff.Duration()
+		p.retryAt = time.Now().Add(delay)
+		glog.Errorf("Worker[%s] failed to create a free SGroup. Retry in %v", w.name, delay)
+	} else {
+		p.backoff.Reset()
 	}
 }
 
 // Go-routine function for creating a FreeSgroup.
 // Creates and returns a free SGroup |sg|. |sg| initializes a NIC
 // queue (at most 4K packets) which can be used by an NF chain later.
-// Blocked until the pod is running.
+// Blocked until the pod is running. Returns nil if it fails.
 func (w *Worker) createFreeSGroup() *SGroup {
-	pcieIdx := w.pciePool.GetNextAvailable()
+	pcieIdx := w.allocPCIe()
+	if pcieIdx < 0 {
+		glog.Errorf("Worker[%s] runs out of PCIe VFs", w.name)
+		return nil
+	}
 	sg := newSGroup(w, pcieIdx)
 	if sg == nil {
 		w.pciePool.Free(pcieIdx)
@@ -104,16 +260,45 @@ func (w *Worker) destroyFreeSGroup(sg *SGroup, wg *sync.WaitGroup) {
 		time.Sleep(100 * time.Millisecond)
 	}
 
+	if err := sg.SetState(SGROUP_DESTROYED); err != nil {
+		glog.Errorf("%v", err)
+	}
 	w.pciePool.Free(sg.pcieIdx)
 }
 
-// Scales up the NF |dag| by creating all related NF containers. Also
-// sends a gRPC request to register all NF threads at the |w|'s
-// CooperativeSched. |sg| is updated after this function finishes.
-func (w *Worker) createSGroup(sg *SGroup, dag *DAG) {
+// Scales up the NF |dag| by creating all NF containers of the chain
+// |dag.chains[chainIdx]|. Also sends a gRPC request to register all
+// NF threads at the |w|'s CooperativeSched. |sg| is updated after
+// this function finishes.
+func (w *Worker) createSGroup(sg *SGroup, dag *DAG, chainIdx int) {
 	pcieIdx := sg.pcieIdx
+	chain := dag.getChain(chainIdx)
+
+	// Add |sg| to |dag|'s |sgroups| unless the caller has reserved
+	// |sg| for |dag| (e.g. as a standby SGroup). |sg| does not serve
+	// traffic until it is ready. An inactive |dag| takes no SGroups.
+	if sg.dag != dag && !dag.addSGroup(sg, chainIdx) {
+		glog.Warningf("User [%s] is inactive. SGroup[%d] returns to free SGroups.", dag.user, sg.ID())
+		w.putFreeSGroup(sg)
+		return
+	}
 
-	for i, nf := range dag.chains {
+	if chain == nil {
+		glog.Errorf("User [%s] has no chain %d. SGroup[%d] returns to free SGroups.", dag.user, chainIdx, sg.ID())
+		dag.removeSGroup(sg)
+		sg.dag = nil
+		w.putFreeSGroup(sg)
+		return
+	}
+	if err := sg.SetState(SGROUP_INSTANTIATING); err != nil {
+		glog.Errorf("Failed to start a chain of user [%s]. %v", dag.user, err)
+		dag.removeSGroup(sg)
+		sg.dag = nil
+		w.putFreeSGroup(sg)
+		return
+	}
+
+	for i, nf := range chain.nfs {
 		funcType := []string{nf.funcType}
 		cycleCost := nf.cycles
 		isPrimary := false
@@ -122,16 +307,20 @@ func (w *Worker) createSGroup(sg *SGroup, dag *DAG) {
 		if i == 0 {
 			isIngress = true
 		}
-		if i == len(dag.chains)-1 {
+		if i == len(chain.nfs)-1 {
 			isEgress = true
 		}
+		// Vports connect NFs along the chain. Each SGroup runs one
+		// chain, so vports are indexed by the NF's position in it.
 		vPortIncIdx, vPortOutIdx := i, i+1
 
-		ins, err := w.createInstance(funcType, cycleCost, pcieIdx, kFaaSStartCoreID, isPrimary, isIngress, isEgress, vPortIncIdx, vPortOutIdx)
+		ins, err := w.createInstance(funcType, cycleCost, pcieIdx, w.getStartupCore(pcieIdx), isPrimary, isIngress, isEgress, vPortIncIdx, vPortOutIdx)
 		if err != nil {
 			glog.Errorf("Failed to create nf[%s]. %s\n", funcType, err)
 
 			// Cleanup.. |sg| is moved to |w.freeSGroups|.
+			sg.SetState(SGROUP_FAILED)
+			dag.removeSGroup(sg)
 			w.destroySGroup(sg)
 			return
 		}
@@ -140,23 +329,30 @@ func (w *Worker) createSGroup(sg *SGroup, dag *DAG) {
 		sg.AppendInstance(ins)
 	}
 
-	// Add |sg| to |w.sgroups|.
-	w.sgMutex.Lock()
-	w.sgroups = append(w.sgroups, sg)
-	w.sgroupTarget += 1
-	w.sgMutex.Unlock()
-
-	// Add |sg| to |dag|'s active |sgroups|.
-	dag.sgroups = append(dag.sgroups, sg)
-	sg.dag = dag
+	// Add |sg| to |w.sgroups| unless |dag| has been deactivated, or
+	// |sg| has been released during the startup. Then, |sg| is
+	// dropped and moved to |w.freeSGroups|.
+	added := dag.commitSGroup(sg, func() {
+		w.sgMutex.Lock()
+		w.sgroups = append(w.sgroups, sg)
+		w.sgroupTarget += 1
+		w.sgMutex.Unlock()
+	})
+	if !added {
+		glog.Infof("SGroup[%d] of user [%s] is dropped after its startup", sg.ID(), dag.user)
+		w.destroySGroup(sg)
+		return
+	}
 
 	// Check whether the sg is ready to serve traffic.
 	// If yes, notify the cooperative scheduler.
-	sg.isComplete = true
+	sg.SetState(SGROUP_REGISTERING)
 	sg.preprocessBeforeReady()
 }
 
-func (w *Worker) metronCreateSGroup(sg *SGroup, dag *DAG) {
+// Metron runs all NFs of the chain |dag.chains[chainIdx]| in a
+// single instance.
+func (w *Worker) metronCreateSGroup(sg *SGroup, dag *DAG, chainIdx int) {
 	if sg == nil || dag == nil {
 		return
 	}
@@ -165,10 +361,21 @@ func (w *Worker) metronCreateSGroup(sg *SGroup, dag *DAG) {
 	}
 
 	pcieIdx := sg.pcieIdx
+	chain := dag.getChain(chainIdx)
+	if chain == nil {
+		glog.Errorf("User [%s] has no chain %d.", dag.user, chainIdx)
+		w.putFreeSGroup(sg)
+		return
+	}
+	if err := sg.SetState(SGROUP_INSTANTIATING); err != nil {
+		glog.Errorf("Failed to start a chain of user [%s]. %v", dag.user, err)
+		w.putFreeSGroup(sg)
+		return
+	}
 
 	nfTypes := make([]string, 0)
 	cycleCost := 0
-	for _, nf := range dag.chains {
+	for _, nf := range chain.nfs {
 		nfTypes = append(nfTypes, nf.funcType)
 		cycleCost += nf.cycles
 	}
@@ -183,6 +390,7 @@ func (w *Worker) metronCreateSGroup(sg *SGroup, dag *DAG) {
 		glog.Errorf("Failed to create nf[%s]. %s\n", strings.Join(nfTypes, ","), err)
 
 		// Cleanup.. |sg| is moved to |w.freeSGroups|.
+		sg.SetState(SGROUP_FAILED)
 		w.destroySGroup(sg)
 		return
 	}
@@ -196,11 +404,10 @@ func (w *Worker) metronCreateSGroup(sg *SGroup, dag *DAG) {
 	w.sgMutex.Unlock()
 
 	// Add |sg| to |dag|'s active |sgroups|.
-	dag.sgroups = append(dag.sgroups, sg)
-	sg.dag = dag
+	dag.addSGroup(sg, chainIdx)
 
 	// Check whether the sg is ready to serve traffic.
 	// If yes, notify the cooperative scheduler.
-	sg.isComplete = true
+	sg.SetState(SGROUP_REGISTERING)
 	sg.preprocessBeforeReady()
 }
@@ -0,0 +1,103 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	utils "github.com/USC-NSL/Low-Latency-FaaS/utils"
+)
+
+// Creates a test worker with |vfs| PCIe VFs, and a warm pool between
+// [|low|, |high|]. Free SGroups are created without pods. They fail
+// while |*fail| is true.
+func newWarmPoolTestWorker(vfs int, low int, high int, fail *bool) *Worker {
+	w := newSchedTestWorker(3)
+	w.pciePool = utils.NewIndexPool(0, vfs)
+	w.freePool = newWarmPool(low, high, func() *SGroup {
+		if *fail {
+			return nil
+		}
+		pcieIdx := w.pciePool.GetNextAvailable()
+		if pcieIdx < 0 {
+			return nil
+		}
+		sg := &SGroup{worker: w, pcieIdx: pcieIdx, coreID: kFaaSInvalidCoreID}
+		w.sgMutex.Lock()
+		w.freeSGroups = append(w.freeSGroups, sg)
+		w.sgMutex.Unlock()
+		return sg
+	})
+	return w
+}
+
+// Waits until no free SGroup of |w| is pending.
+func waitWarmPool(t *testing.T, w *Worker) {
+	for i := 0; i < 100; i++ {
+		if _, pending, _, _ := w.getWarmPoolLevels(); pending == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Free SGroups of Worker[%s] are still pending", w.name)
+}
+
+func TestWarmPool(t *testing.T) {
+	fail := false
+	w := newWarmPoolTestWorker(5, 2, 3, &fail)
+
+	// Fills the pool up to the high watermark.
+	if n := w.replenishFreeSGroups(true); n != 3 {
+		t.Errorf("Expect 3 new free SGroups, got %d", n)
+	}
+	waitWarmPool(t, w)
+	if free := w.countFreeSGroups(); free != 3 {
+		t.Errorf("Expect 3 free SGroups, got %d", free)
+	}
+
+	// Does nothing above the low watermark.
+	w.getFreeSGroup()
+	if n := w.replenishFreeSGroups(false); n != 0 {
+		t.Errorf("Expect no new free SGroups above the low watermark, got %d", n)
+	}
+
+	// Replenishes up to the high watermark below the low watermark,
+	// but never takes more than the free VFs.
+	w.getFreeSGroup()
+	if n := w.replenishFreeSGroups(false); n != 2 {
+		t.Errorf("Expect 2 new free SGroups, got %d", n)
+	}
+	waitWarmPool(t, w)
+	w.getFreeSGroup()
+	w.getFreeSGroup()
+	if n := w.replenishFreeSGroups(false); n != 0 {
+		t.Errorf("Expect no new free SGroups without free VFs, got %d", n)
+	}
+}
+
+func TestWarmPoolBackoff(t *testing.T) {
+	fail := true
+	w := newWarmPoolTestWorker(5, 1, 2, &fail)
+
+	if n := w.replenishFreeSGroups(false); n != 2 {
+		t.Errorf("Expect 2 new free SGroups, got %d", n)
+	}
+	waitWarmPool(t, w)
+
+	// Backs off after failures.
+	fail = false
+	if n := w.replenishFreeSGroups(false); n != 0 {
+		t.Errorf("Expect no new free SGroups during backoff, got %d", n)
+	}
+	w.freePool.retryAt = time.Time{}
+	if n := w.replenishFreeSGroups(false); n != 2 {
+		t.Errorf("Expect 2 new free SGroups after backoff, got %d", n)
+	}
+	waitWarmPool(t, w)
+	if free, _, _, _ := w.getWarmPoolLevels(); free != 2 {
+		t.Errorf("Expect 2 free SGroups, got %d", free)
+	}
+
+	if err := w.setWarmPool(3, 2); err == nil {
+		t.Errorf("Expect an error for invalid watermarks")
+	}
+}
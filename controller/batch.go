@@ -0,0 +1,201 @@
+package controller
+
+import (
+	"flag"
+	"math"
+	"time"
+
+	glog "github.com/golang/glog"
+)
+
+// This is the place to adapt batch counts of SGroups.
+// An SGroup runs |batchCount| batches of |batchSize| packets on its
+// core before CooperativeSched switches to another SGroup. A larger
+// count spends fewer cycles on context switching, but packets wait
+// longer for a round of batches. When an SGroup gets ready, its count
+// is set by profiled cycles (see |adjustBatchCount|). While it runs,
+// a feedback controller keeps adjusting the count by live stats:
+// * The count never goes below the count that keeps context switching
+// under 1-|kBatchEfficiency| of cycles.
+// * A round of batches should finish in the SGroup's latency target
+// (set in its DAG).
+// * If packets wait in the NIC queue longer than the latency target,
+// the SGroup lacks cycles, and the count is doubled (but not above the
+// latency bound) to spend fewer cycles on context switching. The count
+// is halved (but not below the latency bound) after the queue drains.
+// All instances of an SGroup run the same count. If an instance fails
+// to take a new count, instances that have taken it are rolled back.
+
+const (
+	// The min ratio of cycles spent on packet processing.
+	kBatchEfficiency = 0.95
+
+	// Batch counts are within [kMinBatchCount, kMaxBatchCount].
+	kMinBatchCount = 1
+	kMaxBatchCount = 64
+
+	// The period (in milliseconds) of adjusting batch counts.
+	kBatchAdjustPeriod = 1000
+)
+
+var adaptiveBatch bool
+
+func init() {
+	flag.BoolVar(&adaptiveBatch, "adaptbatch", true, "Whether to adjust batch counts of running SGroups")
+}
+
+// Returns the min batch count that keeps context switching under
+// 1-|kBatchEfficiency| of cycles on CPU |c|. |sumCycles| is the
+// per-packet cycle cost of |nfCount| NFs.
+func (c cpuSpec) minBatchCount(nfCount int, sumCycles int, batchSize int) int {
+	if sumCycles <= 0 || batchSize <= 0 {
+		return kMinBatchCount
+	}
+	cnt := float64(c.getContextSwitchCycles()) * float64(nfCount+1) / float64(1/kBatchEfficiency-1) / float64(sumCycles) / float64(batchSize)
+	return clampBatchCount(int(math.Ceil(cnt)))
+}
+
+// Returns the max batch count that finishes a round of batches in
+// |targetUs| microseconds on CPU |c|. Returns |kMaxBatchCount| if
+// there is no target.
+func (c cpuSpec) maxBatchCount(targetUs int, sumCycles int, batchSize int) int {
+	if targetUs <= 0 || sumCycles <= 0 || batchSize <= 0 {
+		return kMaxBatchCount
+	}
+	cnt := float64(targetUs) * float64(c.getFreqKHz()) / 1000 / float64(batchSize*sumCycles)
+	return clampBatchCount(int(math.Floor(cnt)))
+}
+
+func clampBatchCount(cnt int) int {
+	if cnt < kMinBatchCount {
+		return kMinBatchCount
+	} else if cnt > kMaxBatchCount {
+		return kMaxBatchCount
+	}
+	return cnt
+}
+
+// Returns the next batch count of an SGroup that runs |count| batches
+// of |batchSize| packets through |nfCount| NFs on CPU |c|. |sumCycles|
+// is the live per-packet cycle cost, |kpps| is the packet rate, and
+// |qlen| is the NIC queue length. |targetUs| is the latency target
+// (0: none).
+func (c cpuSpec) nextBatchCount(count int, batchSize int, nfCount int, sumCycles int, kpps int, qlen int, targetUs int) int {
+	lo := c.minBatchCount(nfCount, sumCycles, batchSize)
+	if targetUs <= 0 {
+		return lo
+	}
+
+	hi := c.maxBatchCount(targetUs, sumCycles, batchSize)
+	if hi < lo {
+		// The latency target wins over the efficiency target.
+		lo = hi
+	}
+
+	// The time (in microseconds) that packets wait in the NIC queue.
+	queueUs := 0
+	if kpps > 0 {
+		queueUs = qlen * 1000 / kpps
+	} else if qlen > 0 {
+		queueUs = math.MaxInt32
+	}
+
+	if queueUs > targetUs {
+		count = count * 2
+		if count > hi {
+			count = hi
+		}
+	} else if count > hi {
+		count = count / 2
+		if count < hi {
+			count = hi
+		}
+	}
+	if count < lo {
+		count = lo
+	}
+	return clampBatchCount(count)
+}
+
+// Adjusts the batch count of |sg| by its live stats and the latency
+// target of its DAG. Sends gRPC requests to its instances if the count
+// changes.
+func (sg *SGroup) adaptBatchCount() {
+	sg.mutex.Lock()
+	dag := sg.dag
+	sg.mutex.Unlock()
+
+	// Note: do not lock |dag| with |sg.mutex| held.
+	targetUs := 0
+	if dag != nil {
+		targetUs = dag.getLatencyTarget()
+	}
+
+	sg.mutex.Lock()
+	count := sg.getCPU().nextBatchCount(sg.batchCount, sg.batchSize, len(sg.instances), sg.sumCycles, sg.pktRateKpps, sg.incQueueLength, targetUs)
+	if count == sg.batchCount {
+		sg.mutex.Unlock()
+		return
+	}
+	batchSize, prevCount := sg.batchSize, sg.batchCount
+	instances := append([]*Instance{}, sg.instances...)
+	sg.mutex.Unlock()
+
+	// Note: gRPC requests are sent without holding |sg.mutex|.
+	if err := setBatchCounts(instances, batchSize, count, prevCount, (*Instance).setBatch); err != nil {
+		glog.Errorf("Failed to set the batch count of SGroup[%d]. %v", sg.ID(), err)
+		return
+	}
+
+	sg.mutex.Lock()
+	glog.Infof("SGroup[%d] batch count %d -> %d (target=%dus)", sg.groupID, sg.batchCount, count, targetUs)
+	sg.batchCount = count
+	sg.mutex.Unlock()
+}
+
+// Sets the batch count of all |instances| to |count| by |setBatch|.
+// If an instance fails, instances that have taken |count| are rolled
+// back to |prevCount|, so that all instances run the same count.
+func setBatchCounts(instances []*Instance, batchSize int, count int, prevCount int, setBatch func(ins *Instance, batchSize int, count int) error) error {
+	for i, ins := range instances {
+		if err := setBatch(ins, batchSize, count); err != nil {
+			for _, prev := range instances[:i] {
+				if err := setBatch(prev, batchSize, prevCount); err != nil {
+					glog.Errorf("Failed to roll back the batch count of Instance %s. %v", prev.funcType, err)
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Go routine that runs on each worker to adjust batch counts of its
+// ready and active SGroups every |kBatchAdjustPeriod|.
+func (w *Worker) BatchLoop() {
+	ticker := time.NewTicker(kBatchAdjustPeriod * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.batchOp:
+			w.wg.Done()
+			return
+		case <-ticker.C:
+		}
+
+		if !adaptiveBatch {
+			continue
+		}
+
+		w.sgMutex.Lock()
+		sgroups := append([]*SGroup{}, w.sgroups...)
+		w.sgMutex.Unlock()
+
+		for _, sg := range sgroups {
+			if sg.IsReady() && sg.IsActive() {
+				sg.adaptBatchCount()
+			}
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package controller
+
+import (
+	"errors"
+	"testing"
+)
+
+// Tests of the batch-count feedback controller.
+func TestBatchCount(t *testing.T) {
+	cpu := cpuSpec{}
+
+	// 5100 * 4 / (1/0.95 - 1) / 900 / 32 = 13.4
+	if cnt := cpu.minBatchCount(3, 900, 32); cnt != 14 {
+		t.Errorf("Expect min batch count 14, got %d", cnt)
+	}
+	if cnt := cpu.minBatchCount(3, 0, 32); cnt != kMinBatchCount {
+		t.Errorf("Expect min batch count %d without cycles, got %d", kMinBatchCount, cnt)
+	}
+	// 500us * 1700 cycles/us / (32 * 900) = 29.5
+	if cnt := cpu.maxBatchCount(500, 900, 32); cnt != 29 {
+		t.Errorf("Expect max batch count 29, got %d", cnt)
+	}
+	if cnt := cpu.maxBatchCount(0, 900, 32); cnt != kMaxBatchCount {
+		t.Errorf("Expect max batch count %d without a target, got %d", kMaxBatchCount, cnt)
+	}
+
+	// A faster CPU finishes more batches in the same time.
+	if cnt := (cpuSpec{freqKHz: 3400000}).maxBatchCount(500, 900, 32); cnt != 59 {
+		t.Errorf("Expect max batch count 59 at 3.4 GHz, got %d", cnt)
+	}
+	// A cheaper context switch needs fewer batches.
+	if cnt := (cpuSpec{ctxSwitchCycles: 2550}).minBatchCount(3, 900, 32); cnt != 7 {
+		t.Errorf("Expect min batch count 7, got %d", cnt)
+	}
+
+	// Without a target, the count keeps the efficiency target.
+	if cnt := cpu.nextBatchCount(1, 32, 3, 900, 100, 0, 0); cnt != 14 {
+		t.Errorf("Expect batch count 14 without a target, got %d", cnt)
+	}
+	// A count that violates the latency target is halved.
+	if cnt := cpu.nextBatchCount(60, 32, 3, 900, 100, 0, 500); cnt != 30 {
+		t.Errorf("Expect batch count 30, got %d", cnt)
+	}
+	if cnt := cpu.nextBatchCount(30, 32, 3, 900, 100, 0, 500); cnt != 29 {
+		t.Errorf("Expect batch count 29, got %d", cnt)
+	}
+	// A count below the efficiency target is raised.
+	if cnt := cpu.nextBatchCount(2, 32, 3, 900, 100, 0, 500); cnt != 14 {
+		t.Errorf("Expect batch count 14, got %d", cnt)
+	}
+	// A count within the bounds is kept.
+	if cnt := cpu.nextBatchCount(20, 32, 3, 900, 100, 0, 500); cnt != 20 {
+		t.Errorf("Expect batch count 20, got %d", cnt)
+	}
+	// Packets wait for 1000us in the queue: doubles the count within
+	// the latency bound.
+	if cnt := cpu.nextBatchCount(14, 32, 3, 900, 100, 100, 500); cnt != 28 {
+		t.Errorf("Expect batch count 28, got %d", cnt)
+	}
+	if cnt := cpu.nextBatchCount(20, 32, 3, 900, 100, 100, 500); cnt != 29 {
+		t.Errorf("Expect batch count 29, got %d", cnt)
+	}
+	if cnt := cpu.nextBatchCount(40, 32, 3, 900, 100, 100, 500); cnt != 29 {
+		t.Errorf("Expect batch count 29, got %d", cnt)
+	}
+	if cnt := cpu.nextBatchCount(40, 32, 3, 900, 100, 1000, 5000); cnt != kMaxBatchCount {
+		t.Errorf("Expect batch count %d, got %d", kMaxBatchCount, cnt)
+	}
+	// The latency target wins over the efficiency target.
+	if cnt := cpu.nextBatchCount(14, 32, 3, 900, 100, 0, 100); cnt != 7 {
+		t.Errorf("Expect batch count 7, got %d", cnt)
+	}
+	if cnt := cpu.nextBatchCount(7, 32, 3, 900, 100, 0, 100); cnt != 5 {
+		t.Errorf("Expect batch count 5, got %d", cnt)
+	}
+}
+
+// Tests of rolling back batch counts after an instance fails.
+func TestBatchCountRollback(t *testing.T) {
+	instances := make([]*Instance, 3)
+	for i := range instances {
+		instances[i] = newInstance("nf", i == 0, i == 2, 0, "127.0.0.1", 50051+i, "")
+	}
+	counts := make(map[*Instance]int)
+	setBatch := func(ins *Instance, batchSize int, count int) error {
+		if ins == instances[2] {
+			return errors.New("connection refused")
+		}
+		counts[ins] = count
+		return nil
+	}
+
+	if err := setBatchCounts(instances, 32, 20, 10, setBatch); err == nil {
+		t.Errorf("Expect an error from the last instance")
+	}
+	for _, ins := range instances[:2] {
+		if counts[ins] != 10 {
+			t.Errorf("Expect batch count 10 after the rollback, got %d", counts[ins])
+		}
+	}
+
+	if err := setBatchCounts(instances[:2], 32, 20, 10, setBatch); err != nil {
+		t.Errorf("Failed to set batch counts. %v", err)
+	}
+	if counts[instances[0]] != 20 || counts[instances[1]] != 20 {
+		t.Errorf("Expect batch count 20, got %v", counts)
+	}
+}
@@ -0,0 +1,211 @@
+package controller
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// This is the place to classify new flows into DAGs.
+// |UpdateFlow| runs on the first packet of every new flow, so that
+// it should not scan all flowlets of all DAGs. |flowClassifier| is
+// a tuple-space search classifier. Flowlets are grouped into tuples
+// by the fields they fix (i.e. prefix lengths, whether the protocol
+// and ports are exact). Each tuple is a hash table keyed by masked
+// 5-tuples, so that a lookup costs one hash probe per tuple. The
+// number of tuples is small in practice, even with thousands of
+// flowlets.
+//
+// A classifier is immutable once built. FaaSController rebuilds it
+// when DAGs or flowlets change, and swaps it in atomically, so that
+// lookups never take locks on the classifier.
+
+// |tupleMask| defines the fields that a tuple fixes.
+// |srcLen| and |dstLen| are IPv4 prefix lengths.
+// |exactProto| is true if the protocol is fixed.
+// |exactSrcPort| and |exactDstPort| are true if ports are fixed.
+// Flowlets with port ranges have non-exact ports, and their ranges
+// are checked after the hash probe.
+type tupleMask struct {
+	srcLen       int
+	dstLen       int
+	exactProto   bool
+	exactSrcPort bool
+	exactDstPort bool
+}
+
+// |tupleKey| is a 5-tuple masked by a |tupleMask|.
+type tupleKey struct {
+	srcIP   uint32
+	dstIP   uint32
+	srcPort uint32
+	dstPort uint32
+	proto   uint32
+}
+
+// |classifierRule| is a flowlet of a user's DAG.
+type classifierRule struct {
+	user string
+	dag  *DAG
+	f    *flowlet
+}
+
+// Returns true if |r| takes precedence over |other|. A rule with
+// a higher priority, and then a higher specificity, wins. Ties are
+// broken by user IDs.
+func (r *classifierRule) preferredTo(other *classifierRule) bool {
+	if other == nil {
+		return true
+	}
+	if r.f.preferredTo(other.f) {
+		return true
+	}
+	return !other.f.preferredTo(r.f) && r.user < other.user
+}
+
+type tupleTable struct {
+	mask  tupleMask
+	rules map[tupleKey][]*classifierRule
+}
+
+type flowClassifier struct {
+	tuples []*tupleTable
+	size   int
+}
+
+func maskIPv4(ip uint32, prefixLen int) uint32 {
+	if prefixLen == 0 {
+		return 0
+	}
+	return ip & (^uint32(0) << uint(32-prefixLen))
+}
+
+// Converts an IPv4 address |s| to an integer. Returns false if |s|
+// is not an IPv4 address.
+func parseIPv4(s string) (uint32, bool) {
+	ip := net.ParseIP(s).To4()
+	if ip == nil {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(ip), true
+}
+
+func prefixIPv4(prefix *net.IPNet) uint32 {
+	if prefix == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(prefix.IP.To4())
+}
+
+func (m tupleMask) key(srcIP uint32, dstIP uint32, srcPort uint32, dstPort uint32, proto uint32) tupleKey {
+	k := tupleKey{
+		srcIP: maskIPv4(srcIP, m.srcLen),
+		dstIP: maskIPv4(dstIP, m.dstLen),
+	}
+	if m.exactSrcPort {
+		k.srcPort = srcPort
+	}
+	if m.exactDstPort {
+		k.dstPort = dstPort
+	}
+	if m.exactProto {
+		k.proto = proto
+	}
+	return k
+}
+
+// Builds a classifier for all flowlets of |dags|.
+func newFlowClassifier(dags map[string]*DAG) *flowClassifier {
+	cls := &flowClassifier{
+		tuples: make([]*tupleTable, 0),
+	}
+	tables := make(map[tupleMask]*tupleTable)
+
+	for user, dag := range dags {
+		for _, f := range dag.getFlowlets() {
+			mask := tupleMask{
+				srcLen:       prefixLen(f.srcNet),
+				dstLen:       prefixLen(f.dstNet),
+				exactProto:   f.proto != 0,
+				exactSrcPort: f.srcPorts.min == f.srcPorts.max,
+				exactDstPort: f.dstPorts.min == f.dstPorts.max,
+			}
+			table, exists := tables[mask]
+			if !exists {
+				table = &tupleTable{
+					mask:  mask,
+					rules: make(map[tupleKey][]*classifierRule),
+				}
+				tables[mask] = table
+				cls.tuples = append(cls.tuples, table)
+			}
+
+			k := mask.key(prefixIPv4(f.srcNet), prefixIPv4(f.dstNet), f.srcPorts.min, f.dstPorts.min, f.proto)
+			table.rules[k] = append(table.rules[k], &classifierRule{user, dag, f})
+			cls.size += 1
+		}
+	}
+	return cls
+}
+
+// Returns the DAG that processes a flow. Follows the same rules as
+// |matchDAG|: prefers active DAGs, and then picks the preferred
+// matched flowlet. Returns nil if no DAGs match the flow.
+func (cls *flowClassifier) lookup(srcIP string, dstIP string, srcPort uint32, dstPort uint32, proto uint32) *DAG {
+	if cls == nil || cls.size == 0 {
+		return nil
+	}
+
+	// Invalid IPs only match flowlets with wildcard IPs.
+	src, srcValid := parseIPv4(srcIP)
+	dst, dstValid := parseIPv4(dstIP)
+
+	var active *classifierRule = nil
+	var inactive *classifierRule = nil
+	for _, table := range cls.tuples {
+		m := table.mask
+		if (!srcValid && m.srcLen > 0) || (!dstValid && m.dstLen > 0) {
+			continue
+		}
+
+		rules, exists := table.rules[m.key(src, dst, srcPort, dstPort, proto)]
+		if !exists {
+			continue
+		}
+		for _, r := range rules {
+			if !r.f.srcPorts.contains(srcPort) || !r.f.dstPorts.contains(dstPort) {
+				continue
+			}
+			if r.dag.IsActive() {
+				if r.preferredTo(active) {
+					active = r
+				}
+			} else if r.preferredTo(inactive) {
+				inactive = r
+			}
+		}
+	}
+
+	if active != nil {
+		return active.dag
+	} else if inactive != nil {
+		return inactive.dag
+	}
+	return nil
+}
+
+// Returns the current flow classifier of |c|. Returns nil if it
+// has not been built.
+func (c *FaaSController) getClassifier() *flowClassifier {
+	cls, _ := c.classifier.Load().(*flowClassifier)
+	return cls
+}
+
+// Rebuilds the flow classifier of |c| with all DAGs. Called when
+// flowlets are added, and when DAGs are activated, deactivated or
+// removed.
+func (c *FaaSController) rebuildClassifier() {
+	c.classifierMutex.Lock()
+	defer c.classifierMutex.Unlock()
+
+	c.classifier.Store(newFlowClassifier(c.getDAGs()))
+}
@@ -0,0 +1,172 @@
+package controller
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"testing"
+)
+
+// Returns the DAG that processes a flow by scanning all flowlets of
+// all DAGs. This is the reference of |flowClassifier|.
+func linearMatchDAG(dags map[string]*DAG, srcIP string, dstIP string, srcPort uint32, dstPort uint32, proto uint32) *DAG {
+	var active, inactive *classifierRule = nil, nil
+	for user, dag := range dags {
+		f := dag.matchFlowlet(srcIP, dstIP, srcPort, dstPort, proto)
+		if f == nil {
+			continue
+		}
+		r := &classifierRule{user, dag, f}
+		if dag.IsActive() {
+			if r.preferredTo(active) {
+				active = r
+			}
+		} else if r.preferredTo(inactive) {
+			inactive = r
+		}
+	}
+
+	if active != nil {
+		return active.dag
+	} else if inactive != nil {
+		return inactive.dag
+	}
+	return nil
+}
+
+// Creates a controller with |userCount| users. Each user's DAG has
+// |flowletCount| random flowlets.
+func newClassifierTestController(r *rand.Rand, userCount int, flowletCount int) *FaaSController {
+	c := &FaaSController{dags: make(map[string]*DAG)}
+	prefixLens := []int{0, 8, 16, 24, 32}
+	for i := 0; i < userCount; i++ {
+		dag := newDAG()
+		for j := 0; j < flowletCount; j++ {
+			srcIP := fmt.Sprintf("10.%d.%d.%d/%d", r.Intn(4), r.Intn(4), r.Intn(4), prefixLens[r.Intn(len(prefixLens))])
+			dstIP := fmt.Sprintf("192.168.%d.%d/%d", r.Intn(4), r.Intn(4), prefixLens[r.Intn(len(prefixLens))])
+			dstPorts := anyPort
+			switch r.Intn(3) {
+			case 0:
+				dstPorts = exactPort(uint32(8000 + r.Intn(16)))
+			case 1:
+				min := uint32(8000 + r.Intn(16))
+				dstPorts = portRange{min, min + uint32(r.Intn(8))}
+			}
+			proto := []uint32{0, 6, 17}[r.Intn(3)]
+			f, _ := newFlowlet(srcIP, dstIP, anyPort, dstPorts, proto, r.Intn(3))
+			dag.addFlow(f)
+		}
+		dag.setActive(r.Intn(4) != 0)
+		c.dags[fmt.Sprintf("user%d", i)] = dag
+	}
+	c.rebuildClassifier()
+	return c
+}
+
+// Returns a random flow that is likely to hit some flowlets of the
+// controllers created by |newClassifierTestController|.
+func randomTestFlow(r *rand.Rand) (string, string, uint32, uint32, uint32) {
+	srcIP := fmt.Sprintf("10.%d.%d.%d", r.Intn(4), r.Intn(4), r.Intn(4))
+	dstIP := fmt.Sprintf("192.168.%d.%d", r.Intn(4), r.Intn(4))
+	return srcIP, dstIP, uint32(r.Intn(65536)), uint32(8000 + r.Intn(32)), []uint32{6, 17}[r.Intn(2)]
+}
+
+// Tests that the classifier picks the same DAGs as a linear scan.
+func TestClassifierMatchesLinearScan(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	c := newClassifierTestController(r, 50, 20)
+
+	for i := 0; i < 20000; i++ {
+		srcIP, dstIP, srcPort, dstPort, proto := randomTestFlow(r)
+		expected := linearMatchDAG(c.dags, srcIP, dstIP, srcPort, dstPort, proto)
+		if dag := c.matchDAG(srcIP, dstIP, srcPort, dstPort, proto); dag != expected {
+			t.Fatalf("Flow (%s:%d -> %s:%d, %d) is classified differently", srcIP, srcPort, dstIP, dstPort, proto)
+		}
+	}
+
+	// Flows with invalid IPs only match wildcard IPs.
+	if dag := c.matchDAG("", "", 0, 8008, 6); dag != linearMatchDAG(c.dags, "", "", 0, 8008, 6) {
+		t.Errorf("A flow with invalid IPs is classified differently")
+	}
+}
+
+// Tests that the classifier follows DAG changes.
+func TestClassifierRebuild(t *testing.T) {
+	c := &FaaSController{dags: make(map[string]*DAG)}
+	if dag := c.matchDAG("10.0.0.1", "10.0.0.2", 1, 80, 6); dag != nil {
+		t.Fatalf("An empty classifier matches a flow")
+	}
+
+	c.dags["web"] = newDAG()
+	if err := c.AddFlowlet("web", "", "10.0.0.0/24", "*", "80", 6, 0); err != nil {
+		t.Fatalf("Failed to add a flowlet: %v", err)
+	}
+	if dag := c.matchDAG("10.0.0.1", "10.0.0.2", 1, 80, 6); dag != c.dags["web"] {
+		t.Errorf("Failed to match a new flowlet")
+	}
+
+	delete(c.dags, "web")
+	c.rebuildClassifier()
+	if dag := c.matchDAG("10.0.0.1", "10.0.0.2", 1, 80, 6); dag != nil {
+		t.Errorf("A removed DAG still matches flows")
+	}
+}
+
+// Tests of adding flowlets while the classifier is rebuilt, e.g. by
+// DAGs being deactivated. Run with -race.
+func TestClassifierConcurrentFlowlets(t *testing.T) {
+	c := &FaaSController{dags: make(map[string]*DAG)}
+	c.dags["web"] = newDAG()
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				c.rebuildClassifier()
+			}
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		// Lets rebuilds run between flowlets even on a single CPU.
+		runtime.Gosched()
+		if err := c.AddFlowlet("web", "", fmt.Sprintf("10.0.%d.0/24", i), "*", "80", 6, 0); err != nil {
+			t.Fatalf("Failed to add a flowlet: %v", err)
+		}
+	}
+	close(stop)
+	<-done
+
+	if dag := c.matchDAG("10.0.0.1", "10.0.19.2", 1, 80, 6); dag != c.dags["web"] {
+		t.Errorf("Failed to match the last flowlet")
+	}
+}
+
+func benchmarkClassifier(b *testing.B, userCount int, flowletCount int, linear bool) {
+	r := rand.New(rand.NewSource(1))
+	c := newClassifierTestController(r, userCount, flowletCount)
+	flows := make([][]interface{}, 1024)
+	for i := range flows {
+		srcIP, dstIP, srcPort, dstPort, proto := randomTestFlow(r)
+		flows[i] = []interface{}{srcIP, dstIP, srcPort, dstPort, proto}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f := flows[i%len(flows)]
+		if linear {
+			linearMatchDAG(c.dags, f[0].(string), f[1].(string), f[2].(uint32), f[3].(uint32), f[4].(uint32))
+		} else {
+			c.matchDAG(f[0].(string), f[1].(string), f[2].(uint32), f[3].(uint32), f[4].(uint32))
+		}
+	}
+}
+
+func BenchmarkClassifier1KFlowlets(b *testing.B)  { benchmarkClassifier(b, 100, 10, false) }
+func BenchmarkClassifier10KFlowlets(b *testing.B) { benchmarkClassifier(b, 1000, 10, false) }
+func BenchmarkLinearScan1KFlowlets(b *testing.B)  { benchmarkClassifier(b, 100, 10, true) }
+func BenchmarkLinearScan10KFlowlets(b *testing.B) { benchmarkClassifier(b, 1000, 10, true) }
@@ -7,6 +7,7 @@ import (
 	"os/exec"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	grpc "github.com/USC-NSL/Low-Latency-FaaS/grpc"
@@ -17,6 +18,10 @@ import (
 
 const (
 	kMaxCountSGroupsStartupPerWorker = 20
+
+	// The max time (in seconds) to wait for a DAG's SGroups to turn
+	// idle when deactivating the DAG.
+	kDAGDrainTimeout = 30
 )
 
 var controllerOption string
@@ -26,42 +31,82 @@ var controllerOption string
 // |workers| are all the worker nodes (i.e. physical or virtual machines) in the system.
 // |instances| maintains all running NF instances.
 // |dags| maintains all logical representations of NF DAGs.
+// |dagMutex| protects |dags|.
+// |classifier| holds the |*flowClassifier| that maps new flows to DAGs.
+// |classifierMutex| serializes rebuilds of |classifier|.
+// |flows| remembers the SGroups assigned to flows.
+// |trafficClasses| pin background traffic to workers.
+// |admission| keeps per-tenant quotas of new flows.
+// |standbyOp| is a channel to the standby SGroup maintainer (go
+// routine).
+// |scaleInOp| is a channel to the idle SGroup reclaimer (go routine).
+// |torIP| is the IP of the ToR switch (empty: not connected).
+// |torSwitch| (optional) replaces |ToRGRPCHandler|, e.g. in tests.
 type FaaSController struct {
 	grpc.ToRGRPCHandler
-	ofctlRpc grpc.OfctlRpcHandler
-	workers  map[string]*Worker
-	dags     map[string]*DAG
-	masterIP string
-	ofctlIP  string
-	logger   *FaaSLogger
+	ofctlRpc        grpc.OfctlRpcHandler
+	workers         map[string]*Worker
+	dags            map[string]*DAG
+	dagMutex        sync.Mutex
+	classifier      atomic.Value
+	classifierMutex sync.Mutex
+	flows           *flowTable
+	trafficClasses  []*trafficClass
+	admission       *admissionControl
+	standbyOp       chan FaaSOP
+	scaleInOp       chan FaaSOP
+	masterIP        string
+	ofctlIP         string
+	torIP           string
+	torSwitch       torSwitchClient
+	logger          *FaaSLogger
 }
 
 // Creates a new FaaS controller.
 func NewFaaSController(isTest bool, ctlOption string, cluster *utils.Cluster) *FaaSController {
 	controllerOption = ctlOption
 	c := &FaaSController{
-		workers:  make(map[string]*Worker),
-		dags:     make(map[string]*DAG),
-		masterIP: cluster.Master.IP,
-		ofctlIP:  cluster.Ofctl.IP,
-		logger:   nil,
+		workers:   make(map[string]*Worker),
+		dags:      make(map[string]*DAG),
+		flows:     newFlowTable(kFlowIdleTimeout * time.Second),
+		admission: newAdmissionControl(),
+		standbyOp: make(chan FaaSOP, 64),
+		scaleInOp: make(chan FaaSOP, 64),
+		masterIP:  cluster.Master.IP,
+		ofctlIP:   cluster.Ofctl.IP,
+		torIP:     cluster.ToR.IP,
+		logger:    nil,
 	}
 	c.logger = NewFaaSLogger(c)
+	if err := openAuditLog(); err != nil {
+		glog.Errorf("Failed to open the audit log. %v", err)
+	}
 
 	kubectl.SetFaaSClusterInfo(cluster)
 
 	// Creates all worker nodes.
-	// Note: at each worker machine, core 0 is reserved for the scheduler on
-	// the machine. Then, coreNum is set to Cores - 1 because these cores are
-	// for running NFs.
+	// Note: at each worker machine, the scheduler runs on its own
+	// cores (by default, core 0), which never run NFs. See the core
+	// map of each worker.
 	for i := 0; i < len(cluster.Workers); i++ {
 		name := cluster.Workers[i].Name
-		ip := cluster.Workers[i].IP
-		coreNum := cluster.Workers[i].Cores - 1
-		pcie := cluster.Workers[i].PCIe
-		switchPort := uint32(cluster.Workers[i].SwitchPort)
-		c.createWorker(name, ip, 1, coreNum, pcie, switchPort)
+		if err := c.createWorker(&cluster.Workers[i]); err != nil {
+			glog.Errorf("Failed to create worker[%s]. %v", name, err)
+			continue
+		}
+
+		// Per-worker policies override the cluster's policy.
+		policy := cluster.SchedulingPolicy
+		if cluster.Workers[i].SchedulingPolicy != "" {
+			policy = cluster.Workers[i].SchedulingPolicy
+		}
+		if policy != "" {
+			if err := c.SetSchedulingPolicy(name, policy); err != nil {
+				glog.Errorf("Failed to set the scheduling policy of worker[%s]. %v", name, err)
+			}
+		}
 	}
+	c.loadTrafficClasses(cluster.BackgroundTraffic)
 
 	// If we are running tests, skip initializing all free SGroups
 	// because these tests are expected to create their free SGroups.
@@ -83,6 +128,17 @@ func NewFaaSController(isTest bool, ctlOption string, cluster *utils.Cluster) *F
 				}(w)
 			}
 			wg.Wait()
+
+			// Connects to the ToR switch, so that flows of draining
+			// SGroups are deleted at the switch.
+			if c.torIP != "" {
+				if err := c.ToRGRPCHandler.EstablishConnection(fmt.Sprintf("%s:%d", c.torIP, torPort)); err != nil {
+					glog.Errorf("Failed to connect to the ToR switch. %v", err)
+				}
+			}
+
+			go c.runStandbys()
+			go c.runScaleIn()
 		} else if controllerOption == "metron" {
 			for _, w := range c.workers {
 				w.metronInit()
@@ -104,18 +160,75 @@ func NewFaaSController(isTest bool, ctlOption string, cluster *utils.Cluster) *F
 		}
 
 		go c.logger.RunFaaSLogger()
+		go c.flows.runExpiry()
 	}
 
 	return c
 }
 
-func (c *FaaSController) createWorker(name string, ip string,
-	coreNumOffset int, coreCount int, pcie []string, switchPort uint32) {
-	if _, exists := c.workers[name]; exists {
-		return
+// Creates a worker by its config |node|.
+func (c *FaaSController) createWorker(node *utils.ClusterNode) error {
+	if _, exists := c.workers[node.Name]; exists {
+		return nil
+	}
+
+	cpu, err := newCPUSpec(node.CPUFreqKHz, node.ContextSwitchCycles)
+	if err != nil {
+		return err
+	}
+	coreMap, err := node.GetCoreMap()
+	if err != nil {
+		return err
 	}
 
-	c.workers[name] = NewWorker(name, ip, coreNumOffset, coreCount, pcie, switchPort)
+	w := NewWorker(node.Name, node.IP, coreMap, node.PCIe, uint32(node.SwitchPort))
+	w.setCPU(cpu)
+	w.setPCIeNUMA(node.PCIeNUMA)
+	if node.MinFreeSGroups > 0 || node.MaxFreeSGroups > 0 {
+		_, _, low, high := w.getWarmPoolLevels()
+		if node.MinFreeSGroups > 0 {
+			low = node.MinFreeSGroups
+		}
+		if node.MaxFreeSGroups > 0 {
+			high = node.MaxFreeSGroups
+		}
+		if err := w.setWarmPool(low, high); err != nil {
+			return err
+		}
+	}
+	// Flows assigned to a destroyed SGroup are reassigned when the
+	// switch asks about them again.
+	w.onSGroupDestroyed = func(sg *SGroup) {
+		c.flows.removeSGroup(sg)
+	}
+	w.onSGroupDraining = c.deleteSGroupFlows
+	c.workers[node.Name] = w
+	return nil
+}
+
+// Sets the scheduling policy of worker |nodeName| to |policy|. Sets
+// the policy of all workers if |nodeName| is "all".
+func (c *FaaSController) SetSchedulingPolicy(nodeName string, policy string) error {
+	workers := make([]*Worker, 0)
+	if nodeName == "all" {
+		for _, w := range c.workers {
+			workers = append(workers, w)
+		}
+	} else if w := c.getWorker(nodeName); w != nil {
+		workers = append(workers, w)
+	} else {
+		return errors.New(fmt.Sprintf("Worker [%s] does not exist.", nodeName))
+	}
+
+	for _, w := range workers {
+		// Each worker has its own policy instance.
+		p, err := newSchedulingPolicy(policy)
+		if err != nil {
+			return err
+		}
+		w.setSchedulingPolicy(p)
+	}
+	return nil
 }
 
 func (c *FaaSController) getWorker(nodeName string) *Worker {
@@ -140,6 +253,10 @@ func (c *FaaSController) Close() error {
 		close(wgDone)
 	}()
 
+	// Stops rebuilding standby SGroups and reclaiming idle SGroups.
+	stopOpLoop(c.standbyOp)
+	stopOpLoop(c.scaleInOp)
+
 	// Stops all workers.
 	for _, w := range c.workers {
 		go func(w *Worker) {
@@ -156,6 +273,9 @@ func (c *FaaSController) Close() error {
 	}(c.logger)
 
 	c.ofctlRpc.CloseConnection()
+	if c.ToRGRPCHandler.IsConnEstablished() {
+		c.ToRGRPCHandler.CloseConnection()
+	}
 
 	select {
 	case <-wgDone:
@@ -163,6 +283,7 @@ func (c *FaaSController) Close() error {
 	case err := <-errmsg:
 		allErr = append(allErr, err)
 	}
+	closeAuditLog()
 
 	if len(allErr) > 0 {
 		return errors.New(strings.Join(allErr, ""))
@@ -188,72 +309,266 @@ func (c *FaaSController) GetWorkerInfoByName(nodeName string) string {
 	return ""
 }
 
-// Adds an NF of |funcType| to a |user|'s DAG. Returns an integral
-// handler of this NF. |user| represents the user's ID. If |user|
-// does not exist, creates a new |user| in |FaaSController|.
-func (c *FaaSController) AddNF(user string, funcType string) int {
+// Returns |user|'s DAG, or nil if |user| does not exist.
+func (c *FaaSController) getDAG(user string) *DAG {
+	c.dagMutex.Lock()
+	defer c.dagMutex.Unlock()
+
+	return c.dags[user]
+}
+
+// Returns |user|'s DAG. Creates a new DAG if |user| does not exist.
+func (c *FaaSController) getOrCreateDAG(user string) *DAG {
+	c.dagMutex.Lock()
+	defer c.dagMutex.Unlock()
+
 	if _, exists := c.dags[user]; !exists {
 		c.dags[user] = newDAG()
+		c.dags[user].user = user
 	}
+	return c.dags[user]
+}
+
+// Creates an empty DAG for |user|. Returns an error if |user| already
+// has a DAG.
+func (c *FaaSController) createDAG(user string) (*DAG, error) {
+	c.dagMutex.Lock()
+	defer c.dagMutex.Unlock()
 
-	return c.dags[user].addNF(funcType)
+	if _, exists := c.dags[user]; exists {
+		return nil, fmt.Errorf("User [%s] already has a DAG", user)
+	}
+	dag := newDAG()
+	dag.user = user
+	c.dags[user] = dag
+	return dag, nil
 }
 
-func (c *FaaSController) AddDummyNF(user string, funcType string) int {
-	if _, exists := c.dags[user]; !exists {
-		c.dags[user] = newDAG()
+// Returns a copy of all DAGs, indexed by their users.
+func (c *FaaSController) getDAGs() map[string]*DAG {
+	c.dagMutex.Lock()
+	defer c.dagMutex.Unlock()
+
+	dags := make(map[string]*DAG)
+	for user, dag := range c.dags {
+		dags[user] = dag
 	}
+	return dags
+}
+
+// Adds an NF of |funcType| to a |user|'s DAG. Returns an integral
+// handler of this NF. |user| represents the user's ID. If |user|
+// does not exist, creates a new |user| in |FaaSController|. Returns
+// an error if the DAG is active.
+func (c *FaaSController) AddNF(user string, funcType string) (int, error) {
+	if id := c.getOrCreateDAG(user).addNF(funcType); id >= 0 {
+		return id, nil
+	}
+	return -1, newDAGError(DAG_ERR_ACTIVE, nil, "DAG of user [%s] is active", user)
+}
 
-	return c.dags[user].addDummyNF(funcType)
+func (c *FaaSController) AddDummyNF(user string, funcType string) (int, error) {
+	if id := c.getOrCreateDAG(user).addDummyNF(funcType); id >= 0 {
+		return id, nil
+	}
+	return -1, newDAGError(DAG_ERR_ACTIVE, nil, "DAG of user [%s] is active", user)
 }
 
 // Connects two NFs |upNF| -> |downNF| to a |user|'s DAG.
-// |user| is a string that represents the user's ID.
+// |user| is a string that represents the user's ID. Returns an error
+// if the DAG is active.
 func (c *FaaSController) ConnectNFs(user string, upNF int, downNF int) error {
-	if _, exists := c.dags[user]; !exists {
+	return c.ConnectNFsWithWeight(user, upNF, downNF, 1)
+}
+
+// Connects two NFs |upNF| -> |downNF| to a |user|'s DAG. If |upNF|
+// branches to multiple NFs, its traffic is split among them in
+// proportion to their |weight|.
+func (c *FaaSController) ConnectNFsWithWeight(user string, upNF int, downNF int, weight int) error {
+	dag := c.getDAG(user)
+	if dag == nil {
 		return errors.New(fmt.Sprintf("User [%s] has no NFs.", user))
 	}
 
-	return c.dags[user].connectNFs(upNF, downNF)
+	return dag.connectNFs(upNF, downNF, weight)
 }
 
+// Adds a flowlet that matches flows with exact ports to a |user|'s
+// DAG. Empty IPs and zero ports or |protoIP| match all flows.
 func (c *FaaSController) AddFlow(user string, srcIP string, dstIP string, srcPort uint32, dstPort uint32, protoIP uint32) error {
-	dag, exists := c.dags[user]
-	if !exists {
+	return c.addFlowlet(user, srcIP, dstIP, exactPort(srcPort), exactPort(dstPort), protoIP, 0)
+}
+
+// Adds a flowlet to a |user|'s DAG. |srcIP| and |dstIP| are IPv4
+// addresses or CIDR prefixes (e.g. 10.0.0.0/8). |srcPorts| and
+// |dstPorts| are ports or inclusive port ranges (e.g. 1000-2000).
+// "*" matches all. |priority| ranks flowlets of overlapping DAGs.
+func (c *FaaSController) AddFlowlet(user string, srcIP string, dstIP string, srcPorts string, dstPorts string, protoIP uint32, priority int) error {
+	srcRange, err := parsePortRange(srcPorts)
+	if err != nil {
+		return err
+	}
+	dstRange, err := parsePortRange(dstPorts)
+	if err != nil {
+		return err
+	}
+	return c.addFlowlet(user, srcIP, dstIP, srcRange, dstRange, protoIP, priority)
+}
+
+func (c *FaaSController) addFlowlet(user string, srcIP string, dstIP string, srcPorts portRange, dstPorts portRange, protoIP uint32, priority int) error {
+	dag := c.getDAG(user)
+	if dag == nil {
+		return errors.New(fmt.Sprintf("User [%s] does not exist.", user))
+	}
+
+	f, err := newFlowlet(srcIP, dstIP, srcPorts, dstPorts, protoIP, priority)
+	if err != nil {
+		return err
+	}
+	dag.addFlow(f)
+	c.rebuildClassifier()
+	return nil
+}
+
+// Returns the DAG that processes an incoming flow. If multiple
+// active DAGs match the flow, picks the one whose matched flowlet
+// has the highest priority, and then the highest specificity. Ties
+// are broken by user IDs. Returns an inactive matched DAG if no
+// active DAGs match the flow, or nil if no DAGs match the flow.
+func (c *FaaSController) matchDAG(srcIP string, dstIP string, srcPort uint32, dstPort uint32, proto uint32) *DAG {
+	return c.getClassifier().lookup(srcIP, dstIP, srcPort, dstPort, proto)
+}
+
+// Sets the load-balancing policy of |user|'s DAG to |policy| with
+// thresholds |th|. Zero thresholds are set to their default values.
+// Applies to new flows only.
+func (c *FaaSController) SetLoadBalancer(user string, policy string, th LBThresholds) error {
+	dag := c.getDAG(user)
+	if dag == nil {
+		return errors.New(fmt.Sprintf("User [%s] does not exist.", user))
+	}
+
+	lb, err := newLoadBalancer(policy)
+	if err != nil {
+		return err
+	}
+	dag.setLoadBalancer(lb, th)
+	return nil
+}
+
+// Sets the admission-control |policy| of |user|'s DAG.
+func (c *FaaSController) SetAdmissionPolicy(user string, policy AdmissionPolicy) error {
+	dag := c.getDAG(user)
+	if dag == nil {
+		return errors.New(fmt.Sprintf("User [%s] does not exist.", user))
+	}
+
+	dag.setAdmission(policy)
+	return nil
+}
+
+// Sets the latency target of |user|'s DAG to |targetUs| microseconds
+// (0: no target). Batch counts of the DAG's SGroups are adjusted to
+// meet the target.
+func (c *FaaSController) SetLatencyTarget(user string, targetUs int) error {
+	dag := c.getDAG(user)
+	if dag == nil {
+		return errors.New(fmt.Sprintf("User [%s] does not exist.", user))
+	}
+	if targetUs < 0 {
+		return errors.New(fmt.Sprintf("Invalid latency target %d us.", targetUs))
+	}
+
+	dag.setLatencyTarget(targetUs)
+	return nil
+}
+
+// Sets the number of standby SGroups of |user|'s DAG to |n|. Standby
+// SGroups start up in the background, and are claimed by scale-ups.
+func (c *FaaSController) SetStandbySGroups(user string, n int) error {
+	dag := c.getDAG(user)
+	if dag == nil {
+		return errors.New(fmt.Sprintf("User [%s] does not exist.", user))
+	}
+	if n < 0 {
+		return errors.New(fmt.Sprintf("Invalid number of standby SGroups %d.", n))
+	}
+
+	dag.setStandbyTarget(n)
+	c.notifyStandbys()
+	return nil
+}
+
+// Sets the min number of SGroups of |user|'s DAG to |minSGroups|, and
+// the time (in seconds) that its SGroups stay idle before they are
+// reclaimed to |idleTimeout| (0: the |-scaleintimeout| flag, negative:
+// never).
+func (c *FaaSController) SetScaleIn(user string, minSGroups int, idleTimeout int) error {
+	dag := c.getDAG(user)
+	if dag == nil {
 		return errors.New(fmt.Sprintf("User [%s] does not exist.", user))
 	}
+	if minSGroups < 0 {
+		return errors.New(fmt.Sprintf("Invalid min number of SGroups %d.", minSGroups))
+	}
 
-	dag.addFlow(srcIP, dstIP, srcPort, dstPort, protoIP)
+	dag.setScaleIn(minSGroups, time.Duration(idleTimeout)*time.Second)
 	return nil
 }
 
-// Prepare to deploy NF chains for an NF DAG.
+// Sets the quota of |tenant| to |flowRate| new flows per second with
+// a burst of |flowBurst| flows. All DAGs of |tenant| share the quota.
+// A zero |flowRate| removes the quota.
+func (c *FaaSController) SetTenantQuota(tenant string, flowRate float64, flowBurst int) {
+	c.admission.setTenantQuota(tenant, flowRate, flowBurst)
+}
+
+// Prepare to deploy NF chains for an NF DAG. Returns a |DAGError|
+// if the DAG is invalid.
 func (c *FaaSController) ActivateDAG(user string) error {
-	dag, exists := c.dags[user]
-	if !exists {
+	dag := c.getDAG(user)
+	if dag == nil {
 		return errors.New(fmt.Sprintf("User [%s] has no NFs.", user))
 	}
-	if len(dag.flowlets) == 0 {
-		return errors.New(fmt.Sprintf("User [%s] has no target flowlets.", user))
+	if err := dag.validate(true); err != nil {
+		return err
 	}
 
-	dag.Activate()
+	if err := dag.Activate(); err != nil {
+		return err
+	}
+	c.rebuildClassifier()
 
 	if controllerOption == "faas" { // FaaS-NFV starts up.
-		// Starts NF chains at all available free SGroups.
+		// Starts NF chains at available free SGroups. Starts at most
+		// |initialSGroups| SGroups if it is set.
+		initialSGroups, _ := dag.getScaling()
 		var wg sync.WaitGroup
+		var startMutex sync.Mutex
+		started := 0
 		wg.Add(len(c.workers))
 
 		for _, w := range c.workers {
 			go func(w *Worker) {
 				for {
+					startMutex.Lock()
+					if initialSGroups > 0 && started >= initialSGroups {
+						startMutex.Unlock()
+						break
+					}
 					sg := w.getFreeSGroup()
+					if sg != nil {
+						started += 1
+					}
+					startMutex.Unlock()
+
 					if sg != nil {
 						for w.countPendingSGroups() >= kMaxCountSGroupsStartupPerWorker {
 							time.Sleep(500 * time.Millisecond)
 						}
 
-						sg.worker.createSGroup(sg, dag)
+						// Spreads SGroups among all chains of |dag|.
+						sg.worker.createSGroup(sg, dag, dag.nextChain())
 					} else {
 						break
 					}
@@ -262,6 +577,11 @@ func (c *FaaSController) ActivateDAG(user string) error {
 			}(w)
 		}
 		wg.Wait()
+
+		// Starts standby SGroups of |dag| after its initial SGroups.
+		// Only |runStandbys| replenishes standby SGroups, so that
+		// DAGs never race for them.
+		c.notifyStandbys()
 	} else if controllerOption == "metron" { // Metron starts up.
 		c.metronStartUp()
 	}
@@ -270,11 +590,190 @@ func (c *FaaSController) ActivateDAG(user string) error {
 	return nil
 }
 
+// Creates and activates a DAG from a declarative |spec|. The DAG is
+// built with |AddNF|, |ConnectNFs| and |AddFlow|. It is removed if
+// it fails to get activated. Returns an error if |spec.User| already
+// has a DAG.
+func (c *FaaSController) LoadDAG(spec *utils.DAGSpec) error {
+	dag, err := c.createDAG(spec.User)
+	if err != nil {
+		return err
+	}
+
+	err = func() error {
+		nfIDs := make(map[string]int)
+		for _, nf := range spec.NFs {
+			var id int
+			var err error
+			if nf.Dummy {
+				id, err = c.AddDummyNF(spec.User, nf.Type)
+			} else {
+				id, err = c.AddNF(spec.User, nf.Type)
+			}
+			if err != nil {
+				return err
+			}
+			if nf.Cycles > 0 {
+				dag.NFMap[id].cycles = nf.Cycles
+			}
+			nfIDs[nf.ID] = id
+		}
+
+		for _, e := range spec.Edges {
+			weight := e.Weight
+			if weight == 0 {
+				weight = 1
+			}
+			if err := c.ConnectNFsWithWeight(spec.User, nfIDs[e.From], nfIDs[e.To], weight); err != nil {
+				return err
+			}
+		}
+
+		for _, f := range spec.Flowlets {
+			srcPorts, dstPorts := f.SrcPorts, f.DstPorts
+			if srcPorts == "" {
+				srcPorts = fmt.Sprintf("%d", f.SrcPort)
+			}
+			if dstPorts == "" {
+				dstPorts = fmt.Sprintf("%d", f.DstPort)
+			}
+			if err := c.AddFlowlet(spec.User, f.SrcIP, f.DstIP, srcPorts, dstPorts, f.Proto, f.Priority); err != nil {
+				return err
+			}
+		}
+
+		dag.setScaling(spec.Scaling.InitialSGroups, spec.Scaling.MaxSGroups)
+		dag.setStandbyTarget(spec.Scaling.StandbySGroups)
+		dag.setScaleIn(spec.Scaling.MinSGroups, time.Duration(spec.Scaling.IdleTimeout)*time.Second)
+
+		lbSpec := spec.LoadBalancer
+		th := LBThresholds{lbSpec.QLoad, lbSpec.PktLoad, lbSpec.MaxPktLoad}
+		if err := c.SetLoadBalancer(spec.User, lbSpec.Policy, th); err != nil {
+			return err
+		}
+
+		admission := spec.Admission
+		policy := AdmissionPolicy{admission.Tenant, admission.FlowRate, admission.FlowBurst, admission.MaxQLoad}
+		if err := c.SetAdmissionPolicy(spec.User, policy); err != nil {
+			return err
+		}
+
+		if err := c.SetLatencyTarget(spec.User, spec.LatencyTarget); err != nil {
+			return err
+		}
+
+		return c.ActivateDAG(spec.User)
+	}()
+
+	if err != nil {
+		c.dagMutex.Lock()
+		if c.dags[spec.User] == dag {
+			delete(c.dags, spec.User)
+		}
+		c.dagMutex.Unlock()
+		c.rebuildClassifier()
+		return err
+	}
+	return nil
+}
+
+// Deactivates |user|'s DAG. The DAG stops serving new flows. This
+// function waits for all SGroups of the DAG to turn idle, detaches
+// them from their cores, and returns them to their workers' free
+// SGroups. The DAG itself is kept, and can be activated again.
+func (c *FaaSController) DeactivateDAG(user string) error {
+	dag := c.getDAG(user)
+	if dag == nil {
+		return errors.New(fmt.Sprintf("User [%s] has no NFs.", user))
+	}
+
+	// |UpdateFlow| does not assign new flows to inactive DAGs.
+	dag.setActive(false)
+	c.rebuildClassifier()
+
+	// Waits for SGroups to finish startups and existing flows.
+	start := time.Now()
+	for time.Now().Unix()-start.Unix() < kDAGDrainTimeout {
+		if dag.isIdle() {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	if !dag.isIdle() {
+		glog.Warningf("DAG of user [%s] is still busy after %d seconds. Deactivate it anyway.", user, kDAGDrainTimeout)
+	}
+
+	// Takes all SGroups (including standby SGroups) from |dag|.
+	// SGroups that are still starting are not in their workers'
+	// |sgroups|. They are dropped by |createSGroup| after their
+	// startups.
+	sgroups := dag.takeSGroups()
+	var wg sync.WaitGroup
+	errmsg := make(chan string, len(sgroups))
+	for _, sg := range sgroups {
+		if sg.worker.getSGroup(sg.ID()) != sg {
+			glog.Infof("SGroup[%d] of user [%s] is still starting. It is dropped after its startup.", sg.ID(), user)
+			continue
+		}
+		wg.Add(1)
+		go func(sg *SGroup) {
+			defer wg.Done()
+			if err := sg.worker.releaseSGroup(sg); err != nil {
+				errmsg <- fmt.Sprintf("SGroup[%d] on worker[%s] failed to release. Reason: %v\n", sg.ID(), sg.worker.name, err)
+			}
+		}(sg)
+	}
+	wg.Wait()
+	close(errmsg)
+
+	allErr := []string{}
+	for msg := range errmsg {
+		allErr = append(allErr, msg)
+	}
+	if len(allErr) > 0 {
+		return errors.New(strings.Join(allErr, ""))
+	}
+
+	glog.Infof("DAG of user [%s] is deactivated.", user)
+	return nil
+}
+
+// Deactivates and deletes |user|'s DAG. The DAG is deleted even if
+// some of its SGroups fail to release. Returns their errors.
+func (c *FaaSController) RemoveDAG(user string) error {
+	if c.getDAG(user) == nil {
+		return errors.New(fmt.Sprintf("User [%s] has no NFs.", user))
+	}
+	err := c.DeactivateDAG(user)
+
+	c.dagMutex.Lock()
+	delete(c.dags, user)
+	c.dagMutex.Unlock()
+	c.rebuildClassifier()
+
+	glog.Infof("DAG of user [%s] is removed.", user)
+	return err
+}
+
 // Prints all DAGs managed by |FaaSController|.
 func (c *FaaSController) ShowNFDAGs(user string) {
-	for u, dag := range c.dags {
+	for u, dag := range c.getDAGs() {
 		if user == u || user == "all" {
-			fmt.Printf("[%s] deploys NF DAG [actived=%t]:\n", u, dag.isActive)
+			fmt.Printf("[%s] deploys NF DAG [actived=%t]:\n", u, dag.IsActive())
+			lb, th := dag.getLoadBalancer()
+			fmt.Printf("  load balancer %s (%s)\n", lb.Name(), th)
+			if targetUs := dag.getLatencyTarget(); targetUs > 0 {
+				fmt.Printf("  latency target %d us\n", targetUs)
+			}
+			if target := dag.getStandbyTarget(); target > 0 {
+				fmt.Printf("  standby SGroups %d/%d\n", len(dag.getStandbySGroups()), target)
+			}
+			if minSGroups, timeout := dag.getScaleIn(); timeout > 0 {
+				fmt.Printf("  scale-in after %v idle (min SGroups: %d)\n", timeout, minSGroups)
+			}
+			for _, f := range dag.getFlowlets() {
+				fmt.Printf("  flowlet %s\n", f)
+			}
 
 			// Prints the NF graphs to the terminal.
 			drawCmd := exec.Command("graph-easy")
@@ -297,14 +796,25 @@ func (c *FaaSController) CreateSGroup(nodeName string, nfs []string) error {
 	}
 
 	dag := newDAG()
+	prevID := -1
 	for _, nf := range nfs {
-		dag.addNF(nf)
+		id := dag.addNF(nf)
+		if prevID >= 0 {
+			if err := dag.connectNFs(prevID, id, 1); err != nil {
+				return err
+			}
+		}
+		prevID = id
+	}
+	// |dag| is not matched with flows. It does not need flowlets.
+	if err := dag.validate(false); err != nil {
+		return err
 	}
 	if err := dag.Activate(); err != nil {
 		return err
 	}
 
-	glog.Infof("Deploy a DAG %v", dag.chains)
+	glog.Infof("Deploy a DAG %v", dag.getChain(0))
 
 	n := len(w.freeSGroups)
 	if n <= 0 {
@@ -313,7 +823,7 @@ func (c *FaaSController) CreateSGroup(nodeName string, nfs []string) error {
 	var sg *SGroup = w.freeSGroups[n-1]
 	w.freeSGroups = w.freeSGroups[:(n - 1)]
 
-	w.createSGroup(sg, dag)
+	w.createSGroup(sg, dag, 0)
 	return nil
 }
 
@@ -328,7 +838,8 @@ func (c *FaaSController) DestroySGroup(nodeName string, groupID int) error {
 		return fmt.Errorf("SGroup %d not found by worker[%s]", groupID, w.name)
 	}
 
-	return c.workers[nodeName].destroySGroup(sg)
+	// |sg| drains before its NF pods are deleted.
+	return c.workers[nodeName].releaseSGroup(sg)
 }
 
 func (c *FaaSController) AttachSGroup(nodeName string, groupID int, coreId int) error {
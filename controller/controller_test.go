@@ -6,12 +6,13 @@ import (
 	"testing"
 
 	grpc "github.com/USC-NSL/Low-Latency-FaaS/grpc"
+	utils "github.com/USC-NSL/Low-Latency-FaaS/utils"
 )
 
 var c *FaaSController = nil
 
 func TestMain(m *testing.M) {
-	c = NewFaaSController(true)
+	c = NewFaaSController(true, "faas", &utils.Cluster{})
 	// TODO(Jianfeng): set a fixed timeout on the instance startup time.
 	go grpc.NewGRPCServer(c)
 
@@ -7,23 +7,29 @@ import (
 )
 
 // The abstraction of CPU core.
+// |numaNode| is the NUMA node of this core (-1: unknown).
 // |sGroups| contains all sgroups managed by this core.
 // Each SGroup is a minimal scheduling unit and is run-to-completion.
 type Core struct {
-	coreID  int
-	sGroups SGroupSlice
+	coreID   int
+	numaNode int
+	sGroups  SGroupSlice
 }
 
-func NewCore(coreID int) *Core {
+func NewCore(coreID int, numaNode int) *Core {
 	core := Core{
-		coreID:  coreID,
-		sGroups: make([]*SGroup, 0),
+		coreID:   coreID,
+		numaNode: numaNode,
+		sGroups:  make([]*SGroup, 0),
 	}
 	return &core
 }
 
 func (c *Core) String() string {
 	info := fmt.Sprintf("Core[%d] [", c.coreID)
+	if c.numaNode >= 0 {
+		info = fmt.Sprintf("Core[%d] (NUMA %d) [", c.coreID, c.numaNode)
+	}
 
 	sumLoad := 0
 	if len(c.sGroups) == 0 {
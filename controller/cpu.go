@@ -0,0 +1,67 @@
+package controller
+
+import (
+	"fmt"
+)
+
+// This is the place to describe CPUs of workers.
+// Workers may run different CPU generations. Max packet rates and
+// batch counts of SGroups are estimated by the CPU frequency and the
+// cost of context switching on their workers, which are set per
+// worker in the cluster config.
+
+const (
+	// The default CPU frequency (in kHz) of workers.
+	kDefaultCPUFreqKHz = 1700000
+
+	// The default context switch time in CPU cycles.
+	kDefaultContextSwitchCycles = 5100
+)
+
+// |cpuSpec| describes the CPU of a worker.
+// |freqKHz| is the CPU frequency (in kHz).
+// |ctxSwitchCycles| is the cost (in CPU cycles) of a context switch
+// between NF threads.
+// Zero fields take default values.
+type cpuSpec struct {
+	freqKHz         int
+	ctxSwitchCycles int
+}
+
+func newCPUSpec(freqKHz int, ctxSwitchCycles int) (cpuSpec, error) {
+	if freqKHz < 0 {
+		return cpuSpec{}, fmt.Errorf("invalid CPU frequency %d kHz", freqKHz)
+	}
+	if ctxSwitchCycles < 0 {
+		return cpuSpec{}, fmt.Errorf("invalid context switch cost %d cycles", ctxSwitchCycles)
+	}
+	return cpuSpec{freqKHz: freqKHz, ctxSwitchCycles: ctxSwitchCycles}, nil
+}
+
+func (c cpuSpec) getFreqKHz() int {
+	if c.freqKHz <= 0 {
+		return kDefaultCPUFreqKHz
+	}
+	return c.freqKHz
+}
+
+func (c cpuSpec) getContextSwitchCycles() int {
+	if c.ctxSwitchCycles <= 0 {
+		return kDefaultContextSwitchCycles
+	}
+	return c.ctxSwitchCycles
+}
+
+func (c cpuSpec) String() string {
+	return fmt.Sprintf("%d MHz, %d cycles per context switch", c.getFreqKHz()/1000, c.getContextSwitchCycles())
+}
+
+// Returns the max packet rate (in kpps) of a chain of |nfCount| NFs
+// that costs |sumCycles| cycles per packet, and runs |batchPkts|
+// packets per context switch.
+func (c cpuSpec) maxPktRate(nfCount int, sumCycles int, batchPkts int) int {
+	if batchPkts <= 0 {
+		batchPkts = 1
+	}
+	return c.getFreqKHz() / (sumCycles + c.getContextSwitchCycles()*(nfCount+1)/batchPkts)
+}
@@ -1,40 +1,112 @@
 package controller
 
 import (
-	"errors"
 	"fmt"
+	"hash/fnv"
 	"strings"
+	"sync"
+	"time"
+
+	rate "golang.org/x/time/rate"
 )
 
 // |NF| is the abstraction of logical NFs.
 // All NFs are managed and read/written by DAG.
+// |nextWeights| are the traffic split weights of edges in |nextNFs|
+// (in the exactly same order).
 type NF struct {
-	id       int
-	funcType string
-	cycles   int
-	prevNFs  []int
-	nextNFs  []int
+	id          int
+	funcType    string
+	cycles      int
+	prevNFs     []int
+	nextNFs     []int
+	nextWeights []int
+}
+
+// |nfChain| is a linear path of NFs from the ingress NF of a DAG
+// to one of its egress NFs. A SGroup always runs one |nfChain|.
+// |weight| is the fraction of the DAG's traffic steered to this chain.
+type nfChain struct {
+	nfs    []*NF
+	weight float64
+}
+
+func (chain *nfChain) String() string {
+	funcTypes := make([]string, 0)
+	for _, nf := range chain.nfs {
+		funcTypes = append(funcTypes, nf.funcType)
+	}
+	return fmt.Sprintf("%s (weight=%.2f)", strings.Join(funcTypes, " -> "), chain.weight)
 }
 
 // |DAG| is the abstraction of NF DAG deployment specified by
 // FaaS-NFV users. It defines a logical NF DAG that defines
 // dependencies among NFs, and a set of |flowlets| that defines
 // a set of traffic to be processed by this |DAG| deployment.
+// |chains| are linear NF chains compiled from the DAG. A branching
+// DAG is compiled into one chain per ingress-to-egress path. NFs and
+// |chains| only change while |g| is inactive.
+// |nextChainIdx| is used to spread new SGroups among |chains|.
+// |initialSGroups| is the number of SGroups started when |g| is
+// activated (0: all free SGroups in the cluster).
+// |maxSGroups| caps the number of SGroups of |g| (0: no limit).
+// |standbys| are SGroups that run |chains| but get no traffic until
+// a scale-up claims them, and |standbyTarget| is the number of them
+// kept by the controller (see standby.go). |maxSGroups| does not
+// count |standbys|.
+// |minSGroups| is the number of SGroups of |g| kept by scale-in, and
+// |idleTimeout| is the time that an SGroup of |g| stays idle before
+// it is reclaimed (0: default, negative: never).
+// |lb| is the load-balancing policy that assigns flows to SGroups,
+// and |lbThresholds| are its thresholds.
+// |user| is the user that deploys |g|, and |tenant| is the tenant
+// that owns |g| (empty: |user|).
+// |flowLimiter| limits the rate of new flows (nil: no limit).
+// |maxQLoad| is the max queue load of an SGroup to take new flows.
+// |latencyTargetUs| is the target latency (in microseconds) of packets
+// in each SGroup of |g| (0: no target).
+// |mutex| protects updates of |NFMap|, |flowlets|, |chains|,
+// |sgroups|, |initialSGroups|, |maxSGroups|, |standbys|,
+// |standbyTarget|, |minSGroups|, |idleTimeout|, |nextChainIdx|,
+// |isActive|, |lb|, |lbThresholds|, |latencyTargetUs| and
+// admission-control fields.
 type DAG struct {
-	NFMap    map[int]*NF
-	flowlets []*flowlet
-	chains   []*NF
-	sgroups  []*SGroup
-	isActive bool
+	user            string
+	tenant          string
+	flowLimiter     *rate.Limiter
+	maxQLoad        int
+	NFMap           map[int]*NF
+	flowlets        []*flowlet
+	chains          []*nfChain
+	sgroups         []*SGroup
+	nextChainIdx    int
+	initialSGroups  int
+	maxSGroups      int
+	standbys        []*SGroup
+	standbyTarget   int
+	minSGroups      int
+	idleTimeout     time.Duration
+	isActive        bool
+	lb              LoadBalancer
+	lbThresholds    LBThresholds
+	latencyTargetUs int
+	mutex           sync.Mutex
 }
 
 func newDAG() *DAG {
 	return &DAG{
-		NFMap:    make(map[int]*NF),
-		flowlets: make([]*flowlet, 0),
-		chains:   make([]*NF, 0),
-		sgroups:  make([]*SGroup, 0),
-		isActive: false,
+		NFMap:          make(map[int]*NF),
+		flowlets:       make([]*flowlet, 0),
+		chains:         make([]*nfChain, 0),
+		sgroups:        make([]*SGroup, 0),
+		nextChainIdx:   0,
+		initialSGroups: 0,
+		maxSGroups:     0,
+		standbys:       make([]*SGroup, 0),
+		standbyTarget:  0,
+		isActive:       false,
+		lb:             &highLoadFirstLB{},
+		lbThresholds:   DefaultLBThresholds,
 	}
 }
 
@@ -47,23 +119,116 @@ func (g *DAG) String() string {
 		currStr := fmt.Sprintf("[%s\\nid=%d]", nf.funcType, id)
 		dag = append(dag, currStr)
 
-		// Adds all edges.
-		for _, nextId := range nf.nextNFs {
+		// Adds all edges. Labels weighted edges at branches.
+		for i, nextId := range nf.nextNFs {
 			nextNF := g.NFMap[nextId]
 			nextStr := fmt.Sprintf("[%s\\nid=%d]", nextNF.funcType, nextId)
-			dag = append(dag, currStr+" -> "+nextStr)
+			if len(nf.nextNFs) > 1 {
+				dag = append(dag, fmt.Sprintf("%s -- w=%d --> %s", currStr, nf.nextWeights[i], nextStr))
+			} else {
+				dag = append(dag, currStr+" -> "+nextStr)
+			}
 		}
 	}
 	return strings.Join(dag, " ")
 }
 
 func (g *DAG) IsActive() bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
 	return g.isActive
 }
 
+func (g *DAG) setActive(isActive bool) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.isActive = isActive
+}
+
+// Returns the load-balancing policy of |g| and its thresholds.
+func (g *DAG) getLoadBalancer() (LoadBalancer, LBThresholds) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	return g.lb, g.lbThresholds
+}
+
+// Sets the load-balancing policy of |g| to |lb| with thresholds
+// |th|. Zero thresholds are set to their default values.
+func (g *DAG) setLoadBalancer(lb LoadBalancer, th LBThresholds) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.lb = lb
+	g.lbThresholds = th.withDefaults()
+}
+
+// Returns the admission-control config of |g|.
+func (g *DAG) getAdmission() (string, *rate.Limiter, int) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	return g.tenant, g.flowLimiter, g.maxQLoad
+}
+
+// Sets the admission-control config of |g| to |policy|.
+func (g *DAG) setAdmission(policy AdmissionPolicy) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.tenant = policy.Tenant
+	g.flowLimiter = newFlowLimiter(policy.FlowRate, policy.FlowBurst)
+	g.maxQLoad = policy.MaxQLoad
+}
+
+// Returns the latency target (in microseconds) of |g|.
+func (g *DAG) getLatencyTarget() int {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	return g.latencyTargetUs
+}
+
+// Sets the latency target of |g| to |targetUs| microseconds.
+func (g *DAG) setLatencyTarget(targetUs int) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.latencyTargetUs = targetUs
+}
+
+// Returns the number of SGroups started when |g| is activated, and
+// the max number of SGroups of |g|.
+func (g *DAG) getScaling() (int, int) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	return g.initialSGroups, g.maxSGroups
+}
+
+// Sets the number of SGroups started when |g| is activated to
+// |initialSGroups|, and the max number of SGroups of |g| to
+// |maxSGroups| (0: no limit).
+func (g *DAG) setScaling(initialSGroups int, maxSGroups int) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.initialSGroups = initialSGroups
+	g.maxSGroups = maxSGroups
+}
+
 // This function adds a logical NF of |funcType| to DAG |g|.
-// Returns an integral handler of this added NF.
+// Returns an integral handler of this added NF. Returns -1 if |g| is
+// active.
 func (g *DAG) addNF(funcType string) int {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if g.isActive {
+		return -1
+	}
 	id := len(g.NFMap)
 	cycleCost, exists := NFCycleCosts[funcType]
 	if !exists {
@@ -72,16 +237,25 @@ func (g *DAG) addNF(funcType string) int {
 	}
 
 	g.NFMap[id] = &NF{
-		id:       id,
-		funcType: funcType,
-		cycles:   cycleCost,
-		nextNFs:  make([]int, 0),
-		prevNFs:  make([]int, 0),
+		id:          id,
+		funcType:    funcType,
+		cycles:      cycleCost,
+		nextNFs:     make([]int, 0),
+		nextWeights: make([]int, 0),
+		prevNFs:     make([]int, 0),
 	}
 	return id
 }
 
+// Adds a dummy NF (i.e. a "bypass" NF that costs the cycles of
+// |funcType|) to DAG |g|. Returns -1 if |g| is active.
 func (g *DAG) addDummyNF(funcType string) int {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if g.isActive {
+		return -1
+	}
 	id := len(g.NFMap)
 	cycleCost, exists := NFCycleCosts[funcType]
 	if !exists {
@@ -90,50 +264,280 @@ func (g *DAG) addDummyNF(funcType string) int {
 	}
 
 	g.NFMap[id] = &NF{
-		id:       id,
-		funcType: "bypass",
-		cycles:   cycleCost,
-		nextNFs:  make([]int, 0),
-		prevNFs:  make([]int, 0),
+		id:          id,
+		funcType:    "bypass",
+		cycles:      cycleCost,
+		nextNFs:     make([]int, 0),
+		nextWeights: make([]int, 0),
+		prevNFs:     make([]int, 0),
 	}
 	return id
 }
 
-func (g *DAG) connectNFs(upID int, downID int) error {
-	if upID < 0 || upID > len(g.NFMap) {
-		return fmt.Errorf("Invalid NF |upID| (expect: [0, %d], input: %d)", len(g.NFMap), upID)
+// Connects |upID| -> |downID| in DAG |g|. If |upID| has multiple
+// downstream NFs, its traffic is split among them in proportion
+// to their |weight|. Returns an error if |g| is active.
+func (g *DAG) connectNFs(upID int, downID int, weight int) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if g.isActive {
+		return newDAGError(DAG_ERR_ACTIVE, nil, "DAG of user [%s] is active", g.user)
+	}
+	if _, exists := g.NFMap[upID]; !exists {
+		return newDAGError(DAG_ERR_DANGLING_NF, []int{upID}, "invalid NF |upID| %d", upID)
+	}
+	if _, exists := g.NFMap[downID]; !exists {
+		return newDAGError(DAG_ERR_DANGLING_NF, []int{downID}, "invalid NF |downID| %d", downID)
+	}
+	if upID == downID {
+		return newDAGError(DAG_ERR_SELF_LOOP, []int{upID}, "NF %d connects to itself", upID)
+	}
+	for _, nextID := range g.NFMap[upID].nextNFs {
+		if nextID == downID {
+			return newDAGError(DAG_ERR_DUPLICATE_EDGE, []int{upID, downID}, "duplicate edge %d -> %d", upID, downID)
+		}
 	}
-	if downID < 0 || downID > len(g.NFMap) {
-		return fmt.Errorf("Invalid NF |downID| (expect: [0, %d], input: %d)", len(g.NFMap), downID)
+	if weight <= 0 {
+		return newDAGError(DAG_ERR_INVALID_WEIGHT, []int{upID, downID}, "edge %d -> %d has weight %d", upID, downID, weight)
 	}
 
 	g.NFMap[upID].nextNFs = append(g.NFMap[upID].nextNFs, downID)
+	g.NFMap[upID].nextWeights = append(g.NFMap[upID].nextWeights, weight)
 	g.NFMap[downID].prevNFs = append(g.NFMap[downID].prevNFs, upID)
 	return nil
 }
 
-// Adds a new flowlet to |g|. Flows matched with this flowlet are
-// processed by this logical DAG.
-func (g *DAG) addFlow(srcIP string, dstIP string, srcPort uint32, dstPort uint32, proto uint32) {
-	f := flowlet{srcIP, dstIP, srcPort, dstPort, proto}
-	g.flowlets = append(g.flowlets, &f)
+// Adds a new flowlet |f| to |g|. Flows matched with this flowlet
+// are processed by this logical DAG.
+func (g *DAG) addFlow(f *flowlet) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.flowlets = append(g.flowlets, f)
+}
+
+// Returns a copy of |g|'s |flowlets|.
+func (g *DAG) getFlowlets() []*flowlet {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	flowlets := make([]*flowlet, len(g.flowlets))
+	copy(flowlets, g.flowlets)
+	return flowlets
 }
 
 // Checks whether an incoming flow needs to be processed by |g|.
 func (g *DAG) Match(srcIP string, dstIP string, srcPort uint32, dstPort uint32, proto uint32) bool {
-	for _, f := range g.flowlets {
-		if f.Match(srcIP, dstIP, srcPort, dstPort, proto) {
-			return true
+	return g.matchFlowlet(srcIP, dstIP, srcPort, dstPort, proto) != nil
+}
+
+// Returns the preferred flowlet of |g| that matches an incoming
+// flow. Returns nil if no flowlets match the flow.
+func (g *DAG) matchFlowlet(srcIP string, dstIP string, srcPort uint32, dstPort uint32, proto uint32) *flowlet {
+	var selected *flowlet = nil
+	for _, f := range g.getFlowlets() {
+		if f.Match(srcIP, dstIP, srcPort, dstPort, proto) && f.preferredTo(selected) {
+			selected = f
+		}
+	}
+	return selected
+}
+
+// Selects the chain in |g.chains| to process a flow. The flow's
+// 5-tuple is hashed, so that all packets of a flow go through the
+// same chain, and flows are split among chains by chain weights.
+// Returns -1 if |g| has no chains.
+func (g *DAG) selectChain(srcIP string, dstIP string, srcPort uint32, dstPort uint32, proto uint32) int {
+	chains := g.getChains()
+	if len(chains) == 0 {
+		return -1
+	}
+	if len(chains) == 1 {
+		return 0
+	}
+
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s|%s|%d|%d|%d", srcIP, dstIP, srcPort, dstPort, proto)
+	point := float64(h.Sum32()) / float64(1<<32)
+
+	sum := 0.0
+	for i, chain := range chains {
+		sum += chain.weight
+		if point < sum {
+			return i
 		}
 	}
-	return false
+	return len(chains) - 1
+}
+
+// Returns the chains of |g|. |g.chains| is replaced rather than
+// updated, so the returned slice is never changed.
+func (g *DAG) getChains() []*nfChain {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	return g.chains
+}
+
+// Returns the chain |g.chains[chainIdx]|. Returns nil if |g| has no
+// such chain.
+func (g *DAG) getChain(chainIdx int) *nfChain {
+	chains := g.getChains()
+	if chainIdx < 0 || chainIdx >= len(chains) {
+		return nil
+	}
+	return chains[chainIdx]
+}
+
+// Returns the index of the next chain in |g.chains| that a new
+// SGroup should run. Chains are picked in a round-robin manner.
+func (g *DAG) nextChain() int {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if len(g.chains) == 0 {
+		return -1
+	}
+	idx := g.nextChainIdx % len(g.chains)
+	g.nextChainIdx += 1
+	return idx
+}
+
+// Adds a SGroup |sg| that runs |g.chains[chainIdx]| to |g|'s
+// active |sgroups|. Returns false if |g| is inactive.
+func (g *DAG) addSGroup(sg *SGroup, chainIdx int) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if !g.isActive {
+		return false
+	}
+	g.sgroups = append(g.sgroups, sg)
+	sg.dag = g
+	sg.chainIdx = chainIdx
+	return true
 }
 
-// This function activates a logical NF DAG |g|. First, it parses
-// the logical DAG, and translates it into a set of logical SGroups.
-// Then, it sets |g| as active, which indicates that this logical
-// DAG is ready to serve traffic.
+// Returns true if |g| is allowed to have one more SGroup.
+func (g *DAG) canScaleUp() bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	return g.maxSGroups <= 0 || len(g.sgroups) < g.maxSGroups
+}
+
+// Adds a SGroup |sg| that is going to run |g.chains[chainIdx]|
+// to |g| if |g| is active, and is allowed to have one more SGroup.
+// Returns true if |sg| is added.
+func (g *DAG) reserveSGroup(sg *SGroup, chainIdx int) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if !g.isActive || (g.maxSGroups > 0 && len(g.sgroups) >= g.maxSGroups) {
+		return false
+	}
+	g.sgroups = append(g.sgroups, sg)
+	sg.dag = g
+	sg.chainIdx = chainIdx
+	return true
+}
+
+// Removes a SGroup |sg| from |g|'s active |sgroups| or |standbys|.
+func (g *DAG) removeSGroup(sg *SGroup) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.removeSGroupLocked(sg)
+}
+
+// Removes a SGroup |sg| from |g|. |g.mutex| must be held.
+func (g *DAG) removeSGroupLocked(sg *SGroup) {
+	for i, s := range g.sgroups {
+		if s == sg {
+			g.sgroups = append(g.sgroups[:i], g.sgroups[i+1:]...)
+			return
+		}
+	}
+	for i, s := range g.standbys {
+		if s == sg {
+			g.standbys = append(g.standbys[:i], g.standbys[i+1:]...)
+			return
+		}
+	}
+}
+
+// Runs |commit| with |g.mutex| held if |sg| still belongs to |g|,
+// and |g| is active. So, |g| cannot be deactivated until |commit|
+// returns. Otherwise, removes |sg| from |g|, and returns false.
+// Note: |commit| may lock |w.sgMutex|. |g.mutex| is always locked
+// before |w.sgMutex|.
+func (g *DAG) commitSGroup(sg *SGroup, commit func()) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	member := false
+	for _, sgroups := range [][]*SGroup{g.sgroups, g.standbys} {
+		for _, s := range sgroups {
+			member = member || s == sg
+		}
+	}
+	if !g.isActive || !member {
+		g.removeSGroupLocked(sg)
+		return false
+	}
+	commit()
+	return true
+}
+
+// Removes and returns all SGroups of |g|, including standby SGroups.
+// |g| must be inactive, so that it takes no more SGroups.
+func (g *DAG) takeSGroups() []*SGroup {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	sgroups := append(g.sgroups, g.standbys...)
+	g.sgroups = make([]*SGroup, 0)
+	g.standbys = make([]*SGroup, 0)
+	return sgroups
+}
+
+// Returns true if all SGroups of |g| (including standby SGroups) have
+// finished startups, and none of them is serving traffic.
+func (g *DAG) isIdle() bool {
+	for _, sg := range append(g.getSGroups(), g.getStandbySGroups()...) {
+		if !sg.IsReady() || sg.IsActive() {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns a copy of |g|'s active |sgroups|.
+func (g *DAG) getSGroups() []*SGroup {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	sgroups := make([]*SGroup, len(g.sgroups))
+	copy(sgroups, g.sgroups)
+	return sgroups
+}
+
+// This function activates a logical NF DAG |g|. Callers should
+// validate |g| before activating it. First, it parses
+// the logical DAG, and translates it into a set of linear NF chains.
+// Each ingress-to-egress path is a chain. At a branching NF, traffic
+// is split among downstream NFs by edge weights. Then, it sets |g|
+// as active, which indicates that this logical DAG is ready to serve
+// traffic. Returns an error if |g| is already active.
 func (g *DAG) Activate() error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if g.isActive {
+		return newDAGError(DAG_ERR_ACTIVE, nil, "DAG of user [%s] is already active", g.user)
+	}
+
 	cnt := 0
 	var ingress *NF = nil
 	for _, nf := range g.NFMap {
@@ -143,29 +547,55 @@ func (g *DAG) Activate() error {
 		}
 	}
 
-	if ingress == nil || cnt != 1 {
-		return errors.New("Failed to activate an NF chain. Invalid ingress node.")
+	if ingress == nil {
+		return newDAGError(DAG_ERR_NO_INGRESS, nil, "no ingress NF")
+	}
+	if cnt != 1 {
+		return newDAGError(DAG_ERR_MULTIPLE_INGRESSES, nil, "expect one ingress NF, found %d", cnt)
 	}
 
-	g.chains = nil
-	// TODO: handle branching cases
-	curr := ingress
-	for {
-		g.chains = append(g.chains, curr)
+	chains := make([]*nfChain, 0)
+	onPath := make(map[int]bool)
+	var walk func(path []*NF, curr *NF, weight float64) error
+	walk = func(path []*NF, curr *NF, weight float64) error {
+		if onPath[curr.id] {
+			return newDAGError(DAG_ERR_CYCLE, []int{curr.id}, "NF %d is in a cycle", curr.id)
+		}
+		path = append(path, curr)
 
 		if len(curr.nextNFs) == 0 {
-			break
+			nfs := make([]*NF, len(path))
+			copy(nfs, path)
+			chains = append(chains, &nfChain{nfs: nfs, weight: weight})
+			return nil
+		}
+
+		sumWeights := 0
+		for _, w := range curr.nextWeights {
+			sumWeights += w
 		}
 
-		curr = g.NFMap[curr.nextNFs[0]]
+		onPath[curr.id] = true
+		for i, nextID := range curr.nextNFs {
+			nextWeight := weight * float64(curr.nextWeights[i]) / float64(sumWeights)
+			if err := walk(path, g.NFMap[nextID], nextWeight); err != nil {
+				return err
+			}
+		}
+		onPath[curr.id] = false
+		return nil
+	}
+
+	if err := walk(nil, ingress, 1.0); err != nil {
+		return err
 	}
 
+	g.chains = chains
 	g.isActive = true
 
-	chainStr := make([]string, 0)
-	for _, i := range g.chains {
-		chainStr = append(chainStr, i.funcType)
+	fmt.Printf("Activated chains:\n")
+	for i, chain := range g.chains {
+		fmt.Printf("  [%d] %s\n", i, chain)
 	}
-	fmt.Printf("Activated chains:\n%v\n", chainStr)
 	return nil
 }
@@ -0,0 +1,361 @@
+package controller
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	utils "github.com/USC-NSL/Low-Latency-FaaS/utils"
+)
+
+// Tests of validating logical NF DAGs.
+func TestDAGValidate(t *testing.T) {
+	chain := newDAG()
+	nf1 := chain.addNF("acl")
+	nf2 := chain.addNF("nat")
+	chain.connectNFs(nf1, nf2, 1)
+
+	if err := chain.validate(false); err != nil {
+		t.Errorf("Failed to validate a chain: %v", err)
+	}
+	if err, ok := chain.validate(true).(*DAGError); !ok || err.Code != DAG_ERR_NO_FLOWLETS {
+		t.Errorf("Failed to reject a DAG without flowlets")
+	}
+	f, _ := newFlowlet("", "", anyPort, exactPort(8080), 0, 0)
+	chain.addFlow(f)
+	if err := chain.validate(true); err != nil {
+		t.Errorf("Failed to validate a chain with flowlets: %v", err)
+	}
+
+	unknown := newDAG()
+	unknown.addNF("acl")
+	unknown.NFMap[0].funcType = "foo"
+	if err, ok := unknown.validate(false).(*DAGError); !ok || err.Code != DAG_ERR_UNKNOWN_FUNC {
+		t.Errorf("Failed to reject an unknown function type")
+	}
+
+	ingresses := newDAG()
+	ingresses.addNF("acl")
+	ingresses.addNF("nat")
+	if err, ok := ingresses.validate(false).(*DAGError); !ok || err.Code != DAG_ERR_MULTIPLE_INGRESSES {
+		t.Errorf("Failed to reject multiple ingresses")
+	}
+
+	cycle := newDAG()
+	nf1 = cycle.addNF("acl")
+	nf2 = cycle.addNF("nat")
+	nf3 := cycle.addNF("fc")
+	cycle.connectNFs(nf1, nf2, 1)
+	cycle.connectNFs(nf2, nf3, 1)
+	cycle.connectNFs(nf3, nf2, 1)
+	if err, ok := cycle.validate(false).(*DAGError); !ok || err.Code != DAG_ERR_CYCLE {
+		t.Errorf("Failed to reject a cycle")
+	}
+
+	if err := newDAG().validate(false); err == nil {
+		t.Errorf("Failed to reject an empty DAG")
+	}
+
+	// Activation rejects DAGs without exactly one ingress.
+	ring := newDAG()
+	nf1 = ring.addNF("acl")
+	nf2 = ring.addNF("nat")
+	ring.connectNFs(nf1, nf2, 1)
+	ring.connectNFs(nf2, nf1, 1)
+	if err, ok := ring.Activate().(*DAGError); !ok || err.Code != DAG_ERR_NO_INGRESS {
+		t.Errorf("Failed to reject activating a DAG without ingresses")
+	}
+	if err, ok := ingresses.Activate().(*DAGError); !ok || err.Code != DAG_ERR_MULTIPLE_INGRESSES {
+		t.Errorf("Failed to reject activating a DAG with multiple ingresses")
+	}
+}
+
+// Tests of rejecting invalid edges when connecting NFs.
+func TestDAGConnectNFs(t *testing.T) {
+	dag := newDAG()
+	nf1 := dag.addNF("acl")
+	nf2 := dag.addNF("nat")
+
+	codes := map[DAGErrorCode]error{
+		DAG_ERR_DANGLING_NF:    dag.connectNFs(nf1, len(dag.NFMap), 1),
+		DAG_ERR_SELF_LOOP:      dag.connectNFs(nf1, nf1, 1),
+		DAG_ERR_INVALID_WEIGHT: dag.connectNFs(nf1, nf2, 0),
+	}
+	if err := dag.connectNFs(nf1, nf2, 1); err != nil {
+		t.Fatalf("Failed to connect NFs: %v", err)
+	}
+	codes[DAG_ERR_DUPLICATE_EDGE] = dag.connectNFs(nf1, nf2, 1)
+
+	for code, err := range codes {
+		if e, ok := err.(*DAGError); !ok || e.Code != code {
+			t.Errorf("Expect error %s, got %v", code, err)
+		}
+	}
+}
+
+// Tests of compiling a branching DAG into weighted chains.
+func TestDAGActivateBranching(t *testing.T) {
+	dag := newDAG()
+	classifier := dag.addNF("acl")
+	nat := dag.addNF("nat")
+	fc := dag.addNF("fc")
+	filter := dag.addNF("filter")
+	dag.connectNFs(classifier, nat, 3)
+	dag.connectNFs(classifier, fc, 1)
+	dag.connectNFs(nat, filter, 1)
+
+	if err := dag.Activate(); err != nil {
+		t.Fatalf("Failed to activate a branching DAG: %v", err)
+	}
+	if len(dag.chains) != 2 {
+		t.Fatalf("Expect 2 chains, got %d", len(dag.chains))
+	}
+	if len(dag.chains[0].nfs) != 3 || dag.chains[0].weight != 0.75 {
+		t.Errorf("Unexpected chain %s", dag.chains[0])
+	}
+	if len(dag.chains[1].nfs) != 2 || dag.chains[1].weight != 0.25 {
+		t.Errorf("Unexpected chain %s", dag.chains[1])
+	}
+
+	counts := make([]int, len(dag.chains))
+	for i := 0; i < 10000; i++ {
+		srcIP := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		idx := dag.selectChain(srcIP, "10.1.0.1", uint32(i), 8080, 6)
+		if idx != dag.selectChain(srcIP, "10.1.0.1", uint32(i), 8080, 6) {
+			t.Fatalf("A flow is split into multiple chains")
+		}
+		counts[idx] += 1
+	}
+	if counts[0] < 7000 || counts[0] > 8000 {
+		t.Errorf("Unexpected traffic split %v", counts)
+	}
+}
+
+// Tests of changing an active DAG.
+func TestDAGActivateTwice(t *testing.T) {
+	c, dag := newAdmissionTestController("u")
+	chains := dag.getChains()
+
+	// Flows select chains of a DAG while it gets activated.
+	dag2 := c.getOrCreateDAG("u2")
+	dag2.addNF("acl")
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 1000; i++ {
+			dag2.selectChain("10.1.0.1", "10.0.0.1", uint32(i), 8080, 6)
+		}
+		done <- true
+	}()
+	if err := dag2.Activate(); err != nil {
+		t.Errorf("Failed to activate a DAG. %v", err)
+	}
+	<-done
+
+	if e, ok := c.ActivateDAG("u").(*DAGError); !ok || e.Code != DAG_ERR_ACTIVE {
+		t.Errorf("Expect error %s, got %v", DAG_ERR_ACTIVE, e)
+	}
+	if _, err := c.AddNF("u", "nat"); err == nil {
+		t.Errorf("Added an NF to an active DAG")
+	}
+	if e, ok := c.ConnectNFs("u", 0, 0).(*DAGError); !ok || e.Code != DAG_ERR_ACTIVE {
+		t.Errorf("Expect error %s, got %v", DAG_ERR_ACTIVE, e)
+	}
+	if len(dag.NFMap) != 1 || len(dag.getChains()) != 1 || dag.getChain(0) != chains[0] {
+		t.Errorf("The active DAG is changed: %v", dag.getChains())
+	}
+
+	// A deactivated DAG can be changed and activated again.
+	dag.setActive(false)
+	if _, err := c.AddNF("u", "nat"); err != nil {
+		t.Errorf("Failed to add an NF to an inactive DAG. %v", err)
+	}
+	if err := c.ConnectNFs("u", 0, 1); err != nil {
+		t.Errorf("Failed to connect NFs of an inactive DAG. %v", err)
+	}
+	if err := dag.Activate(); err != nil || len(dag.getChain(0).nfs) != 2 {
+		t.Errorf("Failed to activate the changed DAG. %v", err)
+	}
+}
+
+// Tests of spreading flows and SGroups among chains of a DAG.
+func TestDAGChainSelection(t *testing.T) {
+	dag := newDAG()
+	if dag.selectChain("10.0.0.1", "10.1.0.1", 1, 8080, 6) != -1 || dag.nextChain() != -1 {
+		t.Errorf("Expect no chains before activation")
+	}
+
+	classifier := dag.addNF("acl")
+	nat := dag.addNF("nat")
+	fc := dag.addNF("fc")
+	dag.connectNFs(classifier, nat, 1)
+	dag.connectNFs(classifier, fc, 1)
+	if err := dag.Activate(); err != nil {
+		t.Fatalf("Failed to activate a branching DAG: %v", err)
+	}
+
+	// New SGroups run chains in turn.
+	for i := 0; i < 4; i++ {
+		if idx := dag.nextChain(); idx != i%2 {
+			t.Errorf("Expect chain %d for SGroup %d, got %d", i%2, i, idx)
+		}
+	}
+
+	// A flow is only served by SGroups of its chain.
+	w := newSchedTestWorker(3)
+	sgroups := make([]*SGroup, 2)
+	for i := range sgroups {
+		sgroups[i] = newSchedTestSGroup(w, i, 0, w.idleCoreID)
+		sgroups[i].state = SGROUP_PARKED
+		dag.addSGroup(sgroups[i], i)
+	}
+	for i := 0; i < 100; i++ {
+		k := flowKey{srcIP: fmt.Sprintf("10.0.0.%d", i), dstIP: "10.1.0.1", srcPort: uint32(i), dstPort: 8080, proto: 6}
+		idx := dag.selectChain(k.srcIP, k.dstIP, k.srcPort, k.dstPort, k.proto)
+		if sg := dag.findAvailableSGroup(idx, k); sg != sgroups[idx] {
+			t.Fatalf("Expect SGroup[%d] of chain %d to serve the flow", idx, idx)
+		}
+	}
+
+	// A single chain takes all flows.
+	chain := newDAG()
+	chain.connectNFs(chain.addNF("acl"), chain.addNF("nat"), 1)
+	chain.Activate()
+	if idx := chain.selectChain("10.0.0.1", "10.1.0.1", 1, 8080, 6); idx != 0 {
+		t.Errorf("Expect chain 0 of a linear DAG, got %d", idx)
+	}
+}
+
+// Tests of SGroups that finish startups after their DAG is
+// deactivated.
+func TestDAGDeactivateStartingSGroups(t *testing.T) {
+	_, dag := newAdmissionTestController("u")
+	w := newSchedTestWorker(3)
+	ready := newSchedTestSGroup(w, 1, 0, w.idleCoreID)
+	starting := newSchedTestSGroup(w, 2, 0, kFaaSInvalidCoreID)
+	dag.addSGroup(ready, 0)
+	dag.reserveSGroup(starting, 0)
+
+	// An inactive DAG takes no more SGroups.
+	dag.setActive(false)
+	late := newSchedTestSGroup(w, 3, 0, kFaaSInvalidCoreID)
+	if dag.addSGroup(late, 0) || dag.reserveSGroup(late, 0) || dag.reserveStandby(late, 0) {
+		t.Errorf("Added an SGroup to an inactive DAG")
+	}
+
+	// A starting SGroup taken from its DAG is dropped after its
+	// startup.
+	if sgroups := dag.takeSGroups(); len(sgroups) != 2 {
+		t.Errorf("Expect 2 SGroups taken from the DAG, got %d", len(sgroups))
+	}
+	dag.setActive(true)
+	if dag.commitSGroup(starting, func() { t.Errorf("Committed a released SGroup") }) {
+		t.Errorf("Expect the released SGroup to be dropped")
+	}
+
+	// A starting SGroup of a deactivated DAG is dropped, and removed
+	// from the DAG.
+	dag.reserveSGroup(starting, 0)
+	dag.setActive(false)
+	if dag.commitSGroup(starting, func() { t.Errorf("Committed an SGroup of an inactive DAG") }) || len(dag.getSGroups()) != 0 {
+		t.Errorf("Expect the SGroup of an inactive DAG to be dropped")
+	}
+}
+
+// Tests of removing a DAG whose SGroups fail to release.
+func TestDAGRemove(t *testing.T) {
+	defer func(timeout int) { drainTimeout = timeout }(drainTimeout)
+	drainTimeout = 0
+
+	c, dag := newAdmissionTestController("u")
+	var log []string
+	w := newSchedTestWorker(3)
+	w.coopSched = &testCoopSched{log: &log, fail: true}
+	c.workers[w.name] = w
+	for i := 0; i < 2; i++ {
+		sg := newSchedTestSGroup(w, i, 0, w.idleCoreID)
+		sg.state = SGROUP_PARKED
+		w.sgroups = append(w.sgroups, sg)
+		w.cores[w.idleCoreID].addSGroup(sg)
+		dag.addSGroup(sg, 0)
+	}
+	// SGroup[1] fails to be removed from CooperativeSched.
+	w.sgroups[1].tids = []int32{1}
+
+	if err := c.RemoveDAG("u"); err == nil {
+		t.Errorf("Expect an error from the failed SGroup")
+	}
+	if c.getDAG("u") != nil || dag.IsActive() {
+		t.Errorf("Expect the DAG to be removed anyway")
+	}
+	if w.countFreeSGroups() != 1 {
+		t.Errorf("Expect 1 free SGroup, got %d", w.countFreeSGroups())
+	}
+	if err := c.RemoveDAG("u"); err == nil {
+		t.Errorf("Removed a DAG twice")
+	}
+}
+
+// Tests of loading DAG specs in ../dags.
+func TestLoadDAG(t *testing.T) {
+	c, _ := newAdmissionTestController("u")
+
+	for _, name := range []string{"branching.yaml", "exp-a.json", "exp-b.json", "exp-c.json"} {
+		spec, err := utils.ParseDAGSpec(utils.DAGSpecPath("../dags", name))
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", name, err)
+		}
+		if err := c.LoadDAG(spec); err != nil {
+			t.Fatalf("Failed to load %s: %v", name, err)
+		}
+		if dag := c.getDAG(spec.User); dag == nil || !dag.IsActive() {
+			t.Errorf("Expect an active DAG of user [%s]", spec.User)
+		}
+		if err := c.LoadDAG(spec); err == nil {
+			t.Errorf("Loaded the DAG of user [%s] twice", spec.User)
+		}
+	}
+
+	// Hints of branching.yaml are applied.
+	dag := c.getDAG("branching")
+	if len(dag.chains) != 2 || dag.chains[0].weight != 0.75 {
+		t.Errorf("Expect 2 chains split by 3:1, got %v", dag.chains)
+	}
+	lb, _ := dag.getLoadBalancer()
+	minSGroups, idleTimeout := dag.getScaleIn()
+	_, maxSGroups := dag.getScaling()
+	if maxSGroups != 8 || dag.getStandbyTarget() != 1 || lb.Name() != "least-loaded" ||
+		dag.getLatencyTarget() != 200 || minSGroups != 2 || idleTimeout != 120*time.Second {
+		t.Errorf("Failed to apply hints of branching.yaml")
+	}
+
+	// A DAG that fails to activate is not kept.
+	bad := &utils.DAGSpec{
+		User: "bad",
+		NFs:  []utils.NFSpec{{ID: "a", Type: "acl"}, {ID: "b", Type: "nat"}},
+	}
+	if err := c.LoadDAG(bad); err == nil || c.getDAG("bad") != nil {
+		t.Errorf("Kept an invalid DAG")
+	}
+
+	// Concurrent loads for one user create one DAG.
+	spec, err := utils.ParseDAGSpec(utils.DAGSpecPath("../dags", "exp-a.json"))
+	if err != nil {
+		t.Fatalf("Failed to parse exp-a.json: %v", err)
+	}
+	spec.User = "twice"
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			errs <- c.LoadDAG(spec)
+		}()
+	}
+	failed := 0
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			failed += 1
+		}
+	}
+	if dag := c.getDAG("twice"); failed != 1 || dag == nil || len(dag.NFMap) != len(spec.NFs) {
+		t.Errorf("Expect one load of user [twice] to fail, and the other to keep its NFs")
+	}
+}
@@ -0,0 +1,196 @@
+package controller
+
+import (
+	"fmt"
+	"sort"
+
+	kubectl "github.com/USC-NSL/Low-Latency-FaaS/kubectl"
+)
+
+// This is the place to validate logical NF DAGs. A DAG is validated
+// before it gets activated or deployed. Validation errors are typed,
+// so that the CLI and gRPC callers can tell users what is wrong.
+
+type DAGErrorCode int
+
+const (
+	_ DAGErrorCode = iota // Ignore first value.
+	DAG_ERR_EMPTY
+	DAG_ERR_DANGLING_NF
+	DAG_ERR_UNKNOWN_FUNC
+	DAG_ERR_SELF_LOOP
+	DAG_ERR_DUPLICATE_EDGE
+	DAG_ERR_INVALID_WEIGHT
+	DAG_ERR_CYCLE
+	DAG_ERR_NO_INGRESS
+	DAG_ERR_MULTIPLE_INGRESSES
+	DAG_ERR_NO_FLOWLETS
+	DAG_ERR_ACTIVE
+)
+
+func (code DAGErrorCode) String() string {
+	switch code {
+	case DAG_ERR_EMPTY:
+		return "EMPTY_DAG"
+	case DAG_ERR_DANGLING_NF:
+		return "DANGLING_NF"
+	case DAG_ERR_UNKNOWN_FUNC:
+		return "UNKNOWN_FUNC"
+	case DAG_ERR_SELF_LOOP:
+		return "SELF_LOOP"
+	case DAG_ERR_DUPLICATE_EDGE:
+		return "DUPLICATE_EDGE"
+	case DAG_ERR_INVALID_WEIGHT:
+		return "INVALID_WEIGHT"
+	case DAG_ERR_CYCLE:
+		return "CYCLE"
+	case DAG_ERR_NO_INGRESS:
+		return "NO_INGRESS"
+	case DAG_ERR_MULTIPLE_INGRESSES:
+		return "MULTIPLE_INGRESSES"
+	case DAG_ERR_NO_FLOWLETS:
+		return "NO_FLOWLETS"
+	case DAG_ERR_ACTIVE:
+		return "ACTIVE_DAG"
+	default:
+		return fmt.Sprintf("%d", code)
+	}
+}
+
+// |DAGError| describes why a DAG is invalid.
+// |Code| is the type of the error.
+// |NFs| are IDs of NFs involved in the error (may be empty).
+// |Msg| is a human-readable message.
+type DAGError struct {
+	Code DAGErrorCode
+	NFs  []int
+	Msg  string
+}
+
+func newDAGError(code DAGErrorCode, nfs []int, format string, a ...interface{}) *DAGError {
+	return &DAGError{
+		Code: code,
+		NFs:  nfs,
+		Msg:  fmt.Sprintf(format, a...),
+	}
+}
+
+func (e *DAGError) Error() string {
+	if len(e.NFs) == 0 {
+		return fmt.Sprintf("Invalid DAG [%s]: %s", e.Code, e.Msg)
+	}
+	return fmt.Sprintf("Invalid DAG [%s] at NFs %v: %s", e.Code, e.NFs, e.Msg)
+}
+
+// Returns IDs of all NFs in |g| in the ascending order, so that
+// validation results are deterministic.
+func (g *DAG) sortedNFIDs() []int {
+	ids := make([]int, 0, len(g.NFMap))
+	for id := range g.NFMap {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// Validates the logical NF DAG |g|. Returns the first error found,
+// or nil if |g| is valid. |g| must:
+// (1) have at least one NF, and all NFs have known function types;
+// (2) have no dangling NF IDs, self-loops, duplicate edges or cycles;
+// (3) have exactly one ingress NF;
+// (4) have at least one flowlet if |requireFlowlets| is true.
+func (g *DAG) validate(requireFlowlets bool) error {
+	if len(g.NFMap) == 0 {
+		return newDAGError(DAG_ERR_EMPTY, nil, "no NFs")
+	}
+
+	ids := g.sortedNFIDs()
+	for _, id := range ids {
+		nf := g.NFMap[id]
+		if !kubectl.IsSupportedNF(nf.funcType) {
+			return newDAGError(DAG_ERR_UNKNOWN_FUNC, []int{id}, "unknown function type %s", nf.funcType)
+		}
+
+		seen := make(map[int]bool)
+		for i, nextID := range nf.nextNFs {
+			if _, exists := g.NFMap[nextID]; !exists {
+				return newDAGError(DAG_ERR_DANGLING_NF, []int{id, nextID}, "NF %d does not exist", nextID)
+			}
+			if nextID == id {
+				return newDAGError(DAG_ERR_SELF_LOOP, []int{id}, "NF %d connects to itself", id)
+			}
+			if seen[nextID] {
+				return newDAGError(DAG_ERR_DUPLICATE_EDGE, []int{id, nextID}, "duplicate edge %d -> %d", id, nextID)
+			}
+			if nf.nextWeights[i] <= 0 {
+				return newDAGError(DAG_ERR_INVALID_WEIGHT, []int{id, nextID}, "edge %d -> %d has weight %d", id, nextID, nf.nextWeights[i])
+			}
+			seen[nextID] = true
+		}
+		for _, prevID := range nf.prevNFs {
+			if _, exists := g.NFMap[prevID]; !exists {
+				return newDAGError(DAG_ERR_DANGLING_NF, []int{prevID, id}, "NF %d does not exist", prevID)
+			}
+		}
+	}
+
+	ingresses := make([]int, 0)
+	for _, id := range ids {
+		if len(g.NFMap[id].prevNFs) == 0 {
+			ingresses = append(ingresses, id)
+		}
+	}
+	if len(ingresses) > 1 {
+		return newDAGError(DAG_ERR_MULTIPLE_INGRESSES, ingresses, "expect one ingress NF, found %d", len(ingresses))
+	}
+
+	// Finds cycles with a DFS. A DAG with a cycle may still have an
+	// ingress, so cycles are checked before the missing ingress.
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[int]int)
+	var path []int
+	var dfs func(id int) error
+	dfs = func(id int) error {
+		state[id] = visiting
+		path = append(path, id)
+		for _, nextID := range g.NFMap[id].nextNFs {
+			if state[nextID] == visiting {
+				cycle := []int{nextID}
+				for i := len(path) - 1; i >= 0 && path[i] != nextID; i-- {
+					cycle = append([]int{path[i]}, cycle...)
+				}
+				cycle = append([]int{nextID}, cycle...)
+				return newDAGError(DAG_ERR_CYCLE, cycle[:len(cycle)-1], "NFs form a cycle")
+			}
+			if state[nextID] == unvisited {
+				if err := dfs(nextID); err != nil {
+					return err
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[id] = visited
+		return nil
+	}
+	for _, id := range ids {
+		if state[id] == unvisited {
+			if err := dfs(id); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(ingresses) == 0 {
+		return newDAGError(DAG_ERR_NO_INGRESS, nil, "no ingress NF")
+	}
+
+	if requireFlowlets && len(g.getFlowlets()) == 0 {
+		return newDAGError(DAG_ERR_NO_FLOWLETS, nil, "no target flowlets")
+	}
+
+	return nil
+}
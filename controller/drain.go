@@ -0,0 +1,183 @@
+package controller
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	glog "github.com/golang/glog"
+)
+
+// This is the place to drain SGroups before they are destroyed.
+// Deleting the NF pods of an SGroup drops packets in its NIC queue,
+// and packets of flows that the ToR switch still sends to its dmac.
+// A live SGroup drains in steps:
+// 1. It moves to draining, so that load balancing skips it;
+// 2. Its flows are deleted at the controller and the ToR switch, so
+// that they are assigned to other SGroups;
+// 3. It keeps running until its NIC queue and packet rate reach zero,
+// or the drain timeout passes;
+// 4. It is detached, removed from CooperativeSched and its core.
+// Only then its NF pods are deleted by |destroySGroup|. An SGroup that
+// fails to be removed from CooperativeSched stays draining, and is
+// retried by its worker's warm pool manager.
+
+const (
+	// The default max time (in milliseconds) to wait for the traffic
+	// of a draining SGroup to stop.
+	kDefaultDrainTimeout = 5000
+
+	// The period (in milliseconds) of checking draining SGroups.
+	kDrainPollPeriod = 50
+)
+
+var drainTimeout int
+
+func init() {
+	flag.IntVar(&drainTimeout, "draintimeout", kDefaultDrainTimeout, "The max time (in milliseconds) to wait for the traffic of a draining SGroup to stop")
+}
+
+// Returns true if |sg| has no packets in its NIC queue, and gets no
+// traffic.
+func (sg *SGroup) isDrained() bool {
+	sg.mutex.Lock()
+	defer sg.mutex.Unlock()
+
+	return sg.incQueueLength == 0 && sg.pktRateKpps == 0
+}
+
+// Waits until |sg| is drained, or |timeout| passes. Traffic info of
+// |sg| keeps being updated by its NF instances. Returns true if |sg|
+// is drained.
+func (sg *SGroup) waitDrained(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for !sg.isDrained() {
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		time.Sleep(kDrainPollPeriod * time.Millisecond)
+	}
+	return true
+}
+
+// Drains a live SGroup |sg| (see above), and waits at most |timeout|
+// for its traffic to stop. |sg| must have been removed from
+// |w.sgroups|. Returns an error if |sg| is still scheduled, i.e. it
+// cannot be destroyed.
+func (w *Worker) drainSGroup(sg *SGroup, timeout time.Duration) error {
+	if err := sg.beginDrain(); err != nil {
+		return err
+	}
+	if w.onSGroupDraining != nil {
+		w.onSGroupDraining(sg)
+	}
+
+	if !sg.waitDrained(timeout) {
+		glog.Warningf("SGroup[%d] on worker[%s] still has traffic (q=%d, %d kpps) after %v. Drain it anyway.", sg.ID(), w.name, sg.GetQlen(), sg.GetPktRate(), timeout)
+	}
+	return w.unscheduleSGroup(sg)
+}
+
+// Retries to unschedule and destroy SGroups of |w| that failed to
+// unschedule after draining. SGroups that fail again are kept for the
+// next retry. Returns the number of SGroups returned to
+// |w.freeSGroups|.
+func (w *Worker) retryUndrainedSGroups() int {
+	w.sgMutex.Lock()
+	undrained := w.undrained
+	w.undrained = nil
+	w.sgMutex.Unlock()
+
+	released := 0
+	failed := make([]*SGroup, 0)
+	for _, sg := range undrained {
+		if err := w.unscheduleSGroup(sg); err != nil {
+			glog.Errorf("SGroup[%d] on worker[%s] is still draining. %v", sg.ID(), w.name, err)
+			failed = append(failed, sg)
+			continue
+		}
+		if err := w.destroySGroup(sg); err != nil {
+			glog.Errorf("Failed to destroy SGroup[%d] on worker[%s]. %v", sg.ID(), w.name, err)
+			continue
+		}
+		released += 1
+	}
+
+	w.sgMutex.Lock()
+	w.undrained = append(w.undrained, failed...)
+	w.sgMutex.Unlock()
+	return released
+}
+
+// Detaches |sg|, removes its chain from CooperativeSched, and removes
+// it from its core. Returns an error if CooperativeSched still
+// manages NF threads of |sg|.
+func (w *Worker) unscheduleSGroup(sg *SGroup) error {
+	if controllerOption == "faas" && sg.hasChain() {
+		if sg.IsSched() {
+			if err := sg.detachSGroup(); err != nil {
+				glog.Errorf("Failed to detach SGroup[%d]. %v", sg.ID(), err)
+			} else {
+				// A detached draining SGroup never runs again.
+				w.removeFromCore(sg)
+			}
+		}
+
+		if status, err := w.getCoopSched().RemoveChain(sg.tids); err != nil {
+			return fmt.Errorf("Failed to remove SGroup[%d] from the scheduler. %v", sg.ID(), err)
+		} else if status.GetCode() != 0 {
+			return fmt.Errorf("RemoveChain gRPC request errmsg: %s", status.GetErrmsg())
+		}
+	}
+	w.removeFromCore(sg)
+	return nil
+}
+
+// Removes |sg| from its core, so that it is no longer scheduled.
+// Cores are updated by the scheduler with |w.sgMutex| held.
+func (w *Worker) removeFromCore(sg *SGroup) {
+	w.sgMutex.Lock()
+	defer w.sgMutex.Unlock()
+
+	if coreID := sg.GetCoreID(); coreID != kFaaSInvalidCoreID {
+		if core, exists := w.cores[coreID]; exists {
+			core.removeSGroup(sg)
+		}
+	}
+	sg.SetCoreID(kFaaSInvalidCoreID)
+}
+
+// |torSwitchClient| deletes flow entries at the ToR switch.
+type torSwitchClient interface {
+	IsConnEstablished() bool
+	DeleteFlowEntry(srcIP string, dstIP string, proto uint32, srcPort uint32, dstPort uint32) error
+}
+
+// Returns the client of the ToR switch.
+func (c *FaaSController) getToRSwitch() torSwitchClient {
+	if c.torSwitch != nil {
+		return c.torSwitch
+	}
+	return &c.ToRGRPCHandler
+}
+
+// Removes flows assigned to |sg| from |c.flows|, and then from the
+// ToR switch. The switch keys its flow entries by 5-tuples, so each
+// flow is deleted on its own. The switch asks about these flows
+// again, and they are assigned to other SGroups.
+func (c *FaaSController) deleteSGroupFlows(sg *SGroup) {
+	keys := c.flows.removeSGroup(sg)
+	tor := c.getToRSwitch()
+	if len(keys) == 0 || !tor.IsConnEstablished() {
+		return
+	}
+
+	failed := 0
+	for _, k := range keys {
+		if err := tor.DeleteFlowEntry(k.srcIP, k.dstIP, k.proto, k.srcPort, k.dstPort); err != nil {
+			glog.Errorf("Failed to delete flow %s of SGroup[%d] at the ToR switch. %v", k, sg.ID(), err)
+			failed += 1
+		}
+	}
+	glog.Infof("Deleted %d/%d flows of SGroup[%d] at the ToR switch", len(keys)-failed, len(keys), sg.ID())
+}
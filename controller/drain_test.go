@@ -0,0 +1,154 @@
+package controller
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// |drainTestToRSwitch| records flows deleted at the ToR switch in
+// |deleted|.
+type drainTestToRSwitch struct {
+	deleted []flowKey
+}
+
+func (s *drainTestToRSwitch) IsConnEstablished() bool {
+	return true
+}
+
+func (s *drainTestToRSwitch) DeleteFlowEntry(srcIP string, dstIP string, proto uint32, srcPort uint32, dstPort uint32) error {
+	s.deleted = append(s.deleted, flowKey{srcIP, dstIP, srcPort, dstPort, proto})
+	return nil
+}
+
+// Creates a running test SGroup of worker |w| on core #2 with traffic.
+func newDrainTestSGroup(w *Worker, id int) *SGroup {
+	sg := newSchedTestSGroup(w, id, 10, 2)
+	sg.state = SGROUP_RUNNING
+	sg.tids = []int32{int32(id)}
+	sg.incQueueLength = 16
+	w.sgroups = append(w.sgroups, sg)
+	w.cores[2].addSGroup(sg)
+	return sg
+}
+
+// Tests of draining SGroups before they are destroyed.
+func TestSGroupDrain(t *testing.T) {
+	defer func(timeout int) { drainTimeout = timeout }(drainTimeout)
+
+	var log []string
+	coopSched := &testCoopSched{log: &log}
+	w := newSchedTestWorker(3)
+	w.coopSched = coopSched
+	var mutex sync.Mutex
+	w.onSGroupDraining = func(sg *SGroup) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		log = append(log, "flows")
+		if sg.IsReady() {
+			t.Errorf("Expect SGroup[%d] to be skipped by load balancing", sg.ID())
+		}
+	}
+
+	// A scheduled SGroup is never destroyed.
+	sg := newDrainTestSGroup(w, 1)
+	if err := w.destroySGroup(sg); err == nil || sg.GetState() != SGROUP_RUNNING {
+		t.Errorf("Destroyed a scheduled SGroup")
+	}
+
+	// Waits for the traffic of |sg| to stop.
+	drainTimeout = 5000
+	go func() {
+		time.Sleep(2 * kDrainPollPeriod * time.Millisecond)
+		mutex.Lock()
+		defer mutex.Unlock()
+		log = append(log, "stopped")
+		sg.mutex.Lock()
+		sg.incQueueLength, sg.pktRateKpps = 0, 0
+		sg.mutex.Unlock()
+	}()
+	if err := w.releaseSGroup(sg); err != nil {
+		t.Fatalf("Failed to release SGroup[%d]: %v", sg.ID(), err)
+	}
+	expected := []string{"flows", "stopped", "detach 2", "remove"}
+	if len(log) != len(expected) {
+		t.Fatalf("Expect drain steps %v, got %v", expected, log)
+	}
+	for i := range expected {
+		if log[i] != expected[i] {
+			t.Errorf("Expect drain steps %v, got %v", expected, log)
+			break
+		}
+	}
+	if sg.GetState() != SGROUP_FREE || sg.IsSched() || len(w.cores[2].sGroups) != 0 || w.countFreeSGroups() != 1 {
+		t.Errorf("Expect SGroup[%d] to be a free SGroup", sg.ID())
+	}
+
+	// Drains anyway after the timeout.
+	drainTimeout = 2 * kDrainPollPeriod
+	log = nil
+	sg = newDrainTestSGroup(w, 2)
+	if err := w.releaseSGroup(sg); err != nil || sg.GetState() != SGROUP_FREE {
+		t.Errorf("Failed to release SGroup[%d] after the timeout: %v", sg.ID(), err)
+	}
+
+	// Keeps the pods of an SGroup that is still managed by
+	// CooperativeSched, and retries it later.
+	coopSched.fail = true
+	sg = newDrainTestSGroup(w, 3)
+	sg.incQueueLength, sg.pktRateKpps = 0, 0
+	if err := w.releaseSGroup(sg); err == nil || sg.GetState() != SGROUP_DRAINING {
+		t.Errorf("Destroyed SGroup[%d] that failed to unschedule", sg.ID())
+	}
+	if n := w.retryUndrainedSGroups(); n != 0 || len(w.undrained) != 1 || sg.GetState() != SGROUP_DRAINING {
+		t.Errorf("Expect SGroup[%d] to be retried later", sg.ID())
+	}
+	if w.countFreeSGroups() != 2 {
+		t.Errorf("Expect 2 free SGroups, got %d", w.countFreeSGroups())
+	}
+
+	coopSched.fail = false
+	if n := w.retryUndrainedSGroups(); n != 1 || len(w.undrained) != 0 || sg.GetState() != SGROUP_FREE {
+		t.Errorf("Failed to release SGroup[%d] after the retry", sg.ID())
+	}
+	if w.countFreeSGroups() != 3 || len(w.cores[2].sGroups) != 0 {
+		t.Errorf("Expect 3 free SGroups, got %d", w.countFreeSGroups())
+	}
+}
+
+// Tests of deleting flows of a draining SGroup at the ToR switch.
+func TestSGroupDrainFlows(t *testing.T) {
+	c, _ := newAdmissionTestController("u")
+	tor := &drainTestToRSwitch{}
+	c.torSwitch = tor
+	w := newSchedTestWorker(3)
+	sg1 := newDrainTestSGroup(w, 1)
+	sg2 := newDrainTestSGroup(w, 2)
+
+	k1 := flowKey{"10.0.0.1", "10.0.0.2", 1234, 8080, 6}
+	k2 := flowKey{"10.0.0.3", "10.0.0.2", 1234, 8080, 17}
+	k3 := flowKey{"10.0.0.4", "10.0.0.2", 1234, 8080, 6}
+	c.flows.insert(k1, sg1, 1, "00:00:00:00:00:01")
+	c.flows.insert(k2, sg1, 1, "00:00:00:00:00:01")
+	c.flows.insert(k3, sg2, 1, "00:00:00:00:00:02")
+
+	// Each flow of |sg1| is deleted by its 5-tuple.
+	c.deleteSGroupFlows(sg1)
+	deleted := map[flowKey]bool{}
+	for _, k := range tor.deleted {
+		deleted[k] = true
+	}
+	if len(tor.deleted) != 2 || !deleted[k1] || !deleted[k2] {
+		t.Errorf("Expect flows %v and %v to be deleted at the ToR switch, got %v", k1, k2, tor.deleted)
+	}
+	if c.flows.lookup(k1) != nil || c.flows.lookup(k2) != nil || c.flows.lookup(k3) == nil {
+		t.Errorf("Expect only flows of SGroup[%d] to be removed", sg1.ID())
+	}
+
+	// No requests for an SGroup without flows.
+	tor.deleted = nil
+	c.deleteSGroupFlows(sg1)
+	if len(tor.deleted) != 0 {
+		t.Errorf("Expect no deleted flows, got %v", tor.deleted)
+	}
+}
@@ -0,0 +1,190 @@
+package controller
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// The time (in seconds) for an idle flow to expire.
+	kFlowIdleTimeout = 30
+
+	// The period (in seconds) of removing expired flows.
+	kFlowExpirePeriod = 5
+)
+
+// This is the place to keep flow affinity.
+// The ToR switch asks FaaSController about a flow when the flow's
+// first packet misses the switch's flow table. The switch may ask
+// about the same flow again (e.g. after evicting its rule). The flow
+// must go to the same SGroup. Otherwise, stateful NFs (e.g. nat) on
+// the new SGroup break the flow. |flowTable| remembers the SGroup
+// assigned to each flow until the flow is idle for a while, or its
+// SGroup is destroyed.
+
+// |flowKey| is a flow's 5-tuple.
+type flowKey struct {
+	srcIP   string
+	dstIP   string
+	srcPort uint32
+	dstPort uint32
+	proto   uint32
+}
+
+func (k flowKey) String() string {
+	return fmt.Sprintf("%s:%d -> %s:%d (%d)", k.srcIP, k.srcPort, k.dstIP, k.dstPort, k.proto)
+}
+
+// |flowEntry| is the assignment of a flow.
+// |sg| is the SGroup that serves the flow.
+// |switchPort| and |dmac| are returned to the switch.
+// |lastSeen| is the last time that the switch asks about the flow.
+type flowEntry struct {
+	sg         *SGroup
+	switchPort uint32
+	dmac       string
+	lastSeen   time.Time
+}
+
+// |flowTable| maps flows to their assignments.
+// |flows| are all flow entries.
+// |sgFlows| are flows assigned to each SGroup.
+// |idleTimeout| is the time for an idle flow to expire.
+// |mutex| protects |flows| and |sgFlows|.
+type flowTable struct {
+	flows       map[flowKey]*flowEntry
+	sgFlows     map[*SGroup]map[flowKey]bool
+	idleTimeout time.Duration
+	mutex       sync.Mutex
+}
+
+func newFlowTable(idleTimeout time.Duration) *flowTable {
+	return &flowTable{
+		flows:       make(map[flowKey]*flowEntry),
+		sgFlows:     make(map[*SGroup]map[flowKey]bool),
+		idleTimeout: idleTimeout,
+	}
+}
+
+// Returns the assignment of flow |k|, and refreshes its idle timer.
+// Returns nil if |k| has no assignment, or its entry has expired.
+func (t *flowTable) lookup(k flowKey) *flowEntry {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	e, exists := t.flows[k]
+	if !exists {
+		return nil
+	}
+
+	now := time.Now()
+	if now.Sub(e.lastSeen) > t.idleTimeout {
+		t.remove(k)
+		return nil
+	}
+	e.lastSeen = now
+	return e
+}
+
+// Assigns flow |k| to |sg|. Returns the existing assignment if
+// another caller has assigned |k| concurrently.
+func (t *flowTable) insert(k flowKey, sg *SGroup, switchPort uint32, dmac string) *flowEntry {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := time.Now()
+	if e, exists := t.flows[k]; exists && now.Sub(e.lastSeen) <= t.idleTimeout {
+		e.lastSeen = now
+		return e
+	} else if exists {
+		t.remove(k)
+	}
+
+	e := &flowEntry{
+		sg:         sg,
+		switchPort: switchPort,
+		dmac:       dmac,
+		lastSeen:   now,
+	}
+	t.flows[k] = e
+	if _, exists := t.sgFlows[sg]; !exists {
+		t.sgFlows[sg] = make(map[flowKey]bool)
+	}
+	t.sgFlows[sg][k] = true
+	sg.addFlowCount(1)
+	return e
+}
+
+// Removes flow |k|. |t.mutex| must be held.
+func (t *flowTable) remove(k flowKey) {
+	e, exists := t.flows[k]
+	if !exists {
+		return
+	}
+
+	delete(t.flows, k)
+	if keys, exists := t.sgFlows[e.sg]; exists {
+		delete(keys, k)
+		if len(keys) == 0 {
+			delete(t.sgFlows, e.sg)
+		}
+	}
+	e.sg.addFlowCount(-1)
+}
+
+// Removes all flows assigned to |sg|. Called when |sg| is destroyed.
+// Returns the keys of removed flows.
+func (t *flowTable) removeSGroup(sg *SGroup) []flowKey {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	keys := make([]flowKey, 0, len(t.sgFlows[sg]))
+	for k := range t.sgFlows[sg] {
+		keys = append(keys, k)
+	}
+	for _, k := range keys {
+		t.remove(k)
+	}
+	return keys
+}
+
+// Removes all flows that are idle for more than |t.idleTimeout|.
+// Returns the number of removed flows.
+func (t *flowTable) expire() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := time.Now()
+	count := 0
+	for k, e := range t.flows {
+		if now.Sub(e.lastSeen) > t.idleTimeout {
+			t.remove(k)
+			count += 1
+		}
+	}
+	return count
+}
+
+// Returns the number of flows assigned to |sg|.
+func (t *flowTable) flowCount(sg *SGroup) int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return len(t.sgFlows[sg])
+}
+
+// Returns the number of all flows.
+func (t *flowTable) size() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return len(t.flows)
+}
+
+// Removes expired flows periodically. Runs in a go routine.
+func (t *flowTable) runExpiry() {
+	for range time.Tick(kFlowExpirePeriod * time.Second) {
+		t.expire()
+	}
+}
@@ -0,0 +1,64 @@
+package controller
+
+import (
+	"testing"
+	"time"
+)
+
+// Tests of keeping flow affinity in |flowTable|.
+func TestFlowTableAffinity(t *testing.T) {
+	table := newFlowTable(time.Hour)
+	sg1, sg2 := &SGroup{}, &SGroup{}
+	k := flowKey{"10.0.0.1", "10.0.0.2", 1234, 8080, 6}
+
+	if e := table.lookup(k); e != nil {
+		t.Fatalf("Found an unknown flow %s", k)
+	}
+	table.insert(k, sg1, 1, "00:00:00:00:00:01")
+
+	// A concurrent assignment of the same flow gets the first one.
+	if e := table.insert(k, sg2, 2, "00:00:00:00:00:02"); e.sg != sg1 {
+		t.Errorf("Flow %s is reassigned", k)
+	}
+	if e := table.lookup(k); e == nil || e.sg != sg1 || e.switchPort != 1 || e.dmac != "00:00:00:00:00:01" {
+		t.Errorf("Failed to look up flow %s", k)
+	}
+
+	k2 := flowKey{"10.0.0.3", "10.0.0.2", 1234, 8080, 6}
+	table.insert(k2, sg1, 1, "00:00:00:00:00:01")
+	if table.flowCount(sg1) != 2 || sg1.GetFlowCount() != 2 || sg2.GetFlowCount() != 0 {
+		t.Errorf("Expect 2 flows at SGroup 1, got %d", sg1.GetFlowCount())
+	}
+
+	// Flows are removed with their SGroup.
+	if keys := table.removeSGroup(sg1); len(keys) != 2 {
+		t.Errorf("Expect 2 removed flows, got %d", len(keys))
+	}
+	if table.lookup(k) != nil || table.size() != 0 || sg1.GetFlowCount() != 0 {
+		t.Errorf("Failed to remove flows of a destroyed SGroup")
+	}
+}
+
+// Tests of expiring idle flows.
+func TestFlowTableExpire(t *testing.T) {
+	table := newFlowTable(50 * time.Millisecond)
+	sg := &SGroup{}
+	idle := flowKey{"10.0.0.1", "10.0.0.2", 1, 80, 6}
+	busy := flowKey{"10.0.0.1", "10.0.0.2", 2, 80, 6}
+	table.insert(idle, sg, 1, "00:00:00:00:00:01")
+	table.insert(busy, sg, 1, "00:00:00:00:00:01")
+
+	for i := 0; i < 4; i++ {
+		time.Sleep(20 * time.Millisecond)
+		table.lookup(busy)
+	}
+	if n := table.expire(); n != 1 {
+		t.Errorf("Expect 1 expired flow, got %d", n)
+	}
+	if table.lookup(idle) != nil || table.lookup(busy) == nil {
+		t.Errorf("Failed to expire the idle flow only")
+	}
+	if sg.GetFlowCount() != 1 {
+		t.Errorf("Expect 1 flow at the SGroup, got %d", sg.GetFlowCount())
+	}
+}
@@ -1,5 +1,17 @@
 package controller
 
+import (
+	"fmt"
+	"math/bits"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	kMaxPort = 65535
+)
+
 // |Flowlet| is the abstraction of incoming traffic flows.
 // All Flowlets are managed by DAG, and DO NOT change during
 // their lifetime.
@@ -7,17 +19,182 @@ type Flowlet interface {
 	Match(srcIP string, dstIP string, srcPort uint32, dstPort uint32, proto uint32) bool
 }
 
+// |portRange| is an inclusive range of L4 ports [min, max].
+// [0, kMaxPort] matches all ports.
+type portRange struct {
+	min uint32
+	max uint32
+}
+
+var anyPort = portRange{0, kMaxPort}
+
+// Parses a port range |s|. |s| is a port ("80"), an inclusive
+// range ("1000-2000"), or a wildcard ("", "*" or "0").
+func parsePortRange(s string) (portRange, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "*" || s == "0" {
+		return anyPort, nil
+	}
+
+	bounds := strings.SplitN(s, "-", 2)
+	min, err := strconv.ParseUint(strings.TrimSpace(bounds[0]), 10, 32)
+	if err != nil {
+		return anyPort, fmt.Errorf("Invalid port range %s", s)
+	}
+	max := min
+	if len(bounds) == 2 {
+		max, err = strconv.ParseUint(strings.TrimSpace(bounds[1]), 10, 32)
+		if err != nil {
+			return anyPort, fmt.Errorf("Invalid port range %s", s)
+		}
+	}
+	if min > max || max > kMaxPort {
+		return anyPort, fmt.Errorf("Invalid port range %s", s)
+	}
+	return portRange{uint32(min), uint32(max)}, nil
+}
+
+// Returns a port range that only matches |port|. A zero |port|
+// matches all ports.
+func exactPort(port uint32) portRange {
+	if port == 0 {
+		return anyPort
+	}
+	return portRange{port, port}
+}
+
+func (r portRange) isAny() bool {
+	return r.min == 0 && r.max == kMaxPort
+}
+
+func (r portRange) contains(port uint32) bool {
+	return r.min <= port && port <= r.max
+}
+
+// Returns the number of fixed bits of |r|, i.e. 16 for a single
+// port, and 0 for all ports.
+func (r portRange) specificity() int {
+	return bits.LeadingZeros32(r.max-r.min) - 16
+}
+
+func (r portRange) String() string {
+	if r.isAny() {
+		return "*"
+	} else if r.min == r.max {
+		return fmt.Sprintf("%d", r.min)
+	}
+	return fmt.Sprintf("%d-%d", r.min, r.max)
+}
+
+// Parses an IPv4 prefix |s|. |s| is an address ("10.0.0.1"), a
+// CIDR prefix ("10.0.0.0/8"), or a wildcard ("", "*" or a /0
+// prefix). Returns nil for wildcards.
+func parseIPv4Prefix(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "*" {
+		return nil, nil
+	}
+
+	if !strings.Contains(s, "/") {
+		s += "/32"
+	}
+	_, prefix, err := net.ParseCIDR(s)
+	if err != nil || prefix.IP.To4() == nil {
+		return nil, fmt.Errorf("Invalid IPv4 prefix %s", s)
+	}
+	if prefixLen(prefix) == 0 {
+		return nil, nil
+	}
+	return prefix, nil
+}
+
+func prefixLen(prefix *net.IPNet) int {
+	if prefix == nil {
+		return 0
+	}
+	ones, _ := prefix.Mask.Size()
+	return ones
+}
+
+func prefixString(prefix *net.IPNet) string {
+	if prefix == nil {
+		return "*"
+	}
+	return prefix.String()
+}
+
+// |flowlet| matches flows by IPv4 prefixes, L4 port ranges and the
+// IP protocol. A nil prefix or a zero |proto| matches all flows.
+// |priority| ranks overlapping flowlets. A flowlet with a higher
+// priority, and then a higher specificity, wins.
 type flowlet struct {
-	srcIP   string
-	dstIP   string
-	srcPort uint32
-	dstPort uint32
-	proto   uint32
+	srcNet   *net.IPNet
+	dstNet   *net.IPNet
+	srcPorts portRange
+	dstPorts portRange
+	proto    uint32
+	priority int
+}
+
+func newFlowlet(srcIP string, dstIP string, srcPorts portRange, dstPorts portRange, proto uint32, priority int) (*flowlet, error) {
+	srcNet, err := parseIPv4Prefix(srcIP)
+	if err != nil {
+		return nil, err
+	}
+	dstNet, err := parseIPv4Prefix(dstIP)
+	if err != nil {
+		return nil, err
+	}
+	if proto > 255 {
+		return nil, fmt.Errorf("Invalid IP protocol %d", proto)
+	}
+
+	return &flowlet{
+		srcNet:   srcNet,
+		dstNet:   dstNet,
+		srcPorts: srcPorts,
+		dstPorts: dstPorts,
+		proto:    proto,
+		priority: priority,
+	}, nil
+}
+
+func (f *flowlet) String() string {
+	return fmt.Sprintf("(src=%s:%s, dst=%s:%s, proto=%d, prio=%d)",
+		prefixString(f.srcNet), f.srcPorts, prefixString(f.dstNet), f.dstPorts, f.proto, f.priority)
 }
 
 func (f *flowlet) Match(srcIP string, dstIP string, srcPort uint32, dstPort uint32, proto uint32) bool {
-	return (f.srcIP == "" || f.srcIP == srcIP) &&
-		(f.dstIP == "" || f.dstIP == dstIP) &&
-		(f.srcPort == 0 || f.srcPort == srcPort) &&
-		(f.dstPort == 0 || f.dstPort == dstPort)
+	if !(f.proto == 0 || f.proto == proto) ||
+		!f.srcPorts.contains(srcPort) || !f.dstPorts.contains(dstPort) {
+		return false
+	}
+	if f.srcNet != nil && !f.srcNet.Contains(net.ParseIP(srcIP)) {
+		return false
+	}
+	if f.dstNet != nil && !f.dstNet.Contains(net.ParseIP(dstIP)) {
+		return false
+	}
+	return true
+}
+
+// Returns the number of fixed bits in the flowlet's match fields.
+func (f *flowlet) specificity() int {
+	s := prefixLen(f.srcNet) + prefixLen(f.dstNet) + f.srcPorts.specificity() + f.dstPorts.specificity()
+	if f.proto != 0 {
+		s += 8
+	}
+	return s
+}
+
+// Returns true if |f| takes precedence over |other| when a flow
+// matches both of them. |other| may be nil.
+func (f *flowlet) preferredTo(other *flowlet) bool {
+	if other == nil {
+		return true
+	}
+	if f.priority != other.priority {
+		return f.priority > other.priority
+	}
+	return f.specificity() > other.specificity()
 }
@@ -0,0 +1,98 @@
+package controller
+
+import (
+	"testing"
+)
+
+// Tests of parsing port ranges.
+func TestFlowletPortRange(t *testing.T) {
+	valid := map[string]portRange{
+		"":          anyPort,
+		"*":         anyPort,
+		"0":         anyPort,
+		"80":        {80, 80},
+		"1000-2000": {1000, 2000},
+	}
+	for s, expected := range valid {
+		if r, err := parsePortRange(s); err != nil || r != expected {
+			t.Errorf("Failed to parse port range %q: %v, %v", s, r, err)
+		}
+	}
+
+	for _, s := range []string{"foo", "2000-1000", "1-70000", "-1"} {
+		if _, err := parsePortRange(s); err == nil {
+			t.Errorf("Failed to reject port range %q", s)
+		}
+	}
+}
+
+// Tests of matching flows with CIDR prefixes, port ranges and protocols.
+func TestFlowletMatch(t *testing.T) {
+	f, err := newFlowlet("10.0.0.0/8", "192.168.1.1", anyPort, portRange{1000, 2000}, 6, 0)
+	if err != nil {
+		t.Fatalf("Failed to create a flowlet: %v", err)
+	}
+
+	if !f.Match("10.1.2.3", "192.168.1.1", 5000, 1500, 6) {
+		t.Errorf("Flowlet %s fails to match a flow", f)
+	}
+	mismatches := [][]interface{}{
+		{"11.1.2.3", "192.168.1.1", uint32(5000), uint32(1500), uint32(6)},
+		{"10.1.2.3", "192.168.1.2", uint32(5000), uint32(1500), uint32(6)},
+		{"10.1.2.3", "192.168.1.1", uint32(5000), uint32(2001), uint32(6)},
+		{"10.1.2.3", "192.168.1.1", uint32(5000), uint32(1500), uint32(17)},
+	}
+	for _, m := range mismatches {
+		if f.Match(m[0].(string), m[1].(string), m[2].(uint32), m[3].(uint32), m[4].(uint32)) {
+			t.Errorf("Flowlet %s matches flow %v", f, m)
+		}
+	}
+
+	if _, err := newFlowlet("10.0.0/8", "", anyPort, anyPort, 0, 0); err == nil {
+		t.Errorf("Failed to reject an invalid prefix")
+	}
+}
+
+// Tests of picking the DAG for a flow matched by multiple DAGs.
+func TestFlowletMatchDAG(t *testing.T) {
+	c := &FaaSController{dags: make(map[string]*DAG)}
+	newUserDAG := func(user string, dstIP string, dstPorts portRange, priority int) *DAG {
+		dag := newDAG()
+		f, _ := newFlowlet("", dstIP, anyPort, dstPorts, 0, priority)
+		dag.addFlow(f)
+		dag.setActive(true)
+		c.dags[user] = dag
+		c.rebuildClassifier()
+		return dag
+	}
+
+	all := newUserDAG("all", "", anyPort, 0)
+	subnet := newUserDAG("subnet", "10.0.0.0/24", anyPort, 0)
+	web := newUserDAG("web", "10.0.0.0/24", exactPort(80), 0)
+
+	if dag := c.matchDAG("1.1.1.1", "10.0.0.1", 5000, 80, 6); dag != web {
+		t.Errorf("Failed to pick the most specific DAG")
+	}
+	if dag := c.matchDAG("1.1.1.1", "10.0.0.1", 5000, 8080, 6); dag != subnet {
+		t.Errorf("Failed to pick the subnet DAG")
+	}
+	if dag := c.matchDAG("1.1.1.1", "10.0.1.1", 5000, 80, 6); dag != all {
+		t.Errorf("Failed to pick the wildcard DAG")
+	}
+
+	// A higher priority wins over a higher specificity.
+	urgent := newUserDAG("urgent", "10.0.0.0/16", anyPort, 1)
+	if dag := c.matchDAG("1.1.1.1", "10.0.0.1", 5000, 80, 6); dag != urgent {
+		t.Errorf("Failed to pick the DAG with the highest priority")
+	}
+
+	// Inactive DAGs are only returned if no active DAGs match.
+	urgent.setActive(false)
+	if dag := c.matchDAG("1.1.1.1", "10.0.0.1", 5000, 80, 6); dag != web {
+		t.Errorf("Failed to skip an inactive DAG")
+	}
+	all.setActive(false)
+	if dag := c.matchDAG("1.1.1.1", "10.1.0.1", 5000, 80, 6); dag != all {
+		t.Errorf("Failed to return an inactive matched DAG")
+	}
+}
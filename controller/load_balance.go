@@ -1,9 +1,6 @@
 package controller
 
 import (
-	"errors"
-	"fmt"
-
 	glog "github.com/golang/glog"
 )
 
@@ -16,39 +13,73 @@ import (
 // Called when a new flow arrives at the ToR switch. FaaSController
 // decides the target logical NF chain, and picks an active NF
 // chain to serve this flow. Returns the selected NF chain's unique
-// NIC MAC address.
-// TODO: Complete the reasons for returning errors.
+// NIC MAC address. A flow that has been assigned before goes to the
+// same SGroup, as long as the flow has not expired and the SGroup
+// has not been destroyed. Returns a |FlowRejectError| with the
+// reason if the flow is rejected.
 func (c *FaaSController) UpdateFlow(srcIP string, dstIP string,
 	srcPort uint32, dstPort uint32, proto uint32) (uint32, string, error) {
-	//return 0, "00:00:00:00:00:01", nil
-
-	if dstPort < 2000 {
-		// Serve background traffic.
-		sg := c.findAvailableSGroupOnIdleWorker(dstPort)
-		if sg != nil {
-			if !sg.IsActive() {
-				sg.SetActive()
-			}
-			glog.Infof("Background traffic to %s via port %d", sg.worker.name, sg.worker.switchPort)
-			return sg.worker.switchPort, DefaultDstMACs[sg.pcieIdx], nil
-		}
+	k := flowKey{srcIP, dstIP, srcPort, dstPort, proto}
+	if e := c.flows.lookup(k); e != nil {
+		return e.switchPort, e.dmac, nil
+	}
+
+	sg, err := c.assignFlow(k)
+	if err != nil {
+		auditFlow(k, nil, err)
+		return 0, "none", err
 	}
 
-	var dag *DAG = nil
-	for _, d := range c.dags {
-		if d.Match(srcIP, dstIP, srcPort, dstPort, proto) {
-			dag = d
-			break
+	e := c.flows.insert(k, sg, sg.worker.switchPort, DefaultDstMACs[sg.pcieIdx])
+	auditFlow(k, e.sg, nil)
+	return e.switchPort, e.dmac, nil
+}
+
+// Picks the SGroup to serve a new flow |k|, if the flow is admitted
+// by its DAG's and its tenant's quotas.
+func (c *FaaSController) assignFlow(k flowKey) (*SGroup, error) {
+	// Serves background traffic.
+	if sg := c.findBackgroundSGroup(k); sg != nil {
+		if !sg.IsActive() {
+			sg.SetActive()
 		}
+		glog.Infof("Background traffic to %s via port %d", sg.worker.name, sg.worker.switchPort)
+		return sg, nil
 	}
 
+	dag := c.matchDAG(k.srcIP, k.dstIP, k.srcPort, k.dstPort, k.proto)
+
 	// The flow does not match any activated DAGs. Just ignore it.
-	if dag == nil || (!dag.isActive) {
+	if dag == nil {
 		glog.Infof("This new flow does not match any DAG.")
-		return 0, "none", errors.New(fmt.Sprintf("unknown flowlet"))
+		return nil, newFlowRejectError(REJECT_UNKNOWN_FLOWLET, "flow %s matches no DAGs", k)
 	}
+	if !dag.IsActive() {
+		return nil, newFlowRejectError(REJECT_DAG_INACTIVE, "DAG of user [%s] is inactive", dag.user)
+	}
+
+	// Enforces per-DAG and per-tenant quotas of new flows. A flow
+	// rejected after its admission returns its tokens, so that the
+	// switch's retries of the flow are not rejected by the quotas.
+	ticket, err := c.admission.admit(dag)
+	if err != nil {
+		return nil, err
+	}
+	sg, err := c.assignDAGFlow(dag, k)
+	if err != nil {
+		ticket.cancel()
+	}
+	return sg, err
+}
 
-	sg := dag.findAvailableSGroupHighLoadFirst()
+// Picks the SGroup of |dag| to serve a new flow |k|. Triggers a
+// scale-up event if no active SGroups are available.
+func (c *FaaSController) assignDAGFlow(dag *DAG, k flowKey) (*SGroup, error) {
+	// Picks the chain of |dag| to serve this flow. A branching DAG
+	// has multiple chains, and splits flows among them.
+	chainIdx := dag.selectChain(k.srcIP, k.dstIP, k.srcPort, k.dstPort, k.proto)
+
+	sg := dag.findAvailableSGroup(chainIdx, k)
 	// Picks an active SGroup |sg| and assigns the flow to it.
 	if sg != nil {
 		//glog.Infof("SGroup[%d], mac=%s, load=%d", sg.ID(), DefaultDstMACs[sg.pcieIdx], sg.GetPktLoad())
@@ -56,24 +87,57 @@ func (c *FaaSController) UpdateFlow(srcIP string, dstIP string,
 		if !sg.IsActive() {
 			sg.SetActive()
 		}
-		return sg.worker.switchPort, DefaultDstMACs[sg.pcieIdx], nil
+		return sg, nil
 	}
 
 	// No active SGroups. Triggers a scale-up event.
-	// 1. Finds a free SGroup |sg| (NIC queue resource);
-	// 2. Starts to deploy a new DAG with |sg|;
+	// 0. Claims a standby SGroup |sg| of the chain if any. Its NFs
+	// have started up (or are starting);
+	// 1. Otherwise, finds a free SGroup |sg| (NIC queue resource);
+	// 2. Starts to deploy the selected chain of |dag| with |sg|;
 	// 3. (Optional) Triggers background threads to prepare more SGroups.
 	// 4. Assigns the flow to the selected NIC queue. Even if packets
 	// get queued up at the NIC queue for a while.
+	// Respects |dag|'s scaling limit. If the flow cannot be served
+	// now, but an SGroup of the chain is starting, the switch may
+	// retry the flow later.
+	if !dag.canScaleUp() {
+		if dag.hasStartingSGroup(chainIdx) {
+			return nil, newFlowRejectError(REJECT_SGROUP_STARTING, "SGroups of user [%s] are starting", dag.user)
+		}
+		return nil, newFlowRejectError(REJECT_QUOTA_EXCEEDED, "DAG of user [%s] reaches its max SGroups", dag.user)
+	}
+	if sg = dag.claimStandby(chainIdx); sg != nil {
+		auditScaleUp(sg, dag, chainIdx)
+		c.notifyStandbys()
+		if sg.IsReady() && !sg.IsActive() {
+			sg.SetActive()
+		}
+		return sg, nil
+	}
 	if sg = c.getFreeSGroup(); sg != nil {
-		go sg.worker.createSGroup(sg, dag)
-		return sg.worker.switchPort, DefaultDstMACs[sg.pcieIdx], nil
+		if dag.reserveSGroup(sg, chainIdx) {
+			auditScaleUp(sg, dag, chainIdx)
+			go sg.worker.createSGroup(sg, dag, chainIdx)
+			return sg, nil
+		}
+		// Another flow has reserved the last SGroup for |dag|, or
+		// |dag| has been deactivated. Returns |sg| to its worker's
+		// free SGroups.
+		sg.worker.putFreeSGroup(sg)
+		if !dag.IsActive() {
+			return nil, newFlowRejectError(REJECT_DAG_INACTIVE, "DAG of user [%s] is inactive", dag.user)
+		}
+		return nil, newFlowRejectError(REJECT_SGROUP_STARTING, "SGroups of user [%s] are starting", dag.user)
 	}
 
 	// All active SGroups are running heavily. No free SGroups
 	// are available. Just drop the packet. (Ideally, we should
 	// never reach here if the cluster has enough resources.)
-	return 0, "none", errors.New(fmt.Sprintf("No enough resources"))
+	if dag.hasStartingSGroup(chainIdx) {
+		return nil, newFlowRejectError(REJECT_SGROUP_STARTING, "SGroups of user [%s] are starting", dag.user)
+	}
+	return nil, newFlowRejectError(REJECT_NO_CAPACITY, "No enough resources")
 }
 
 // Finds and returns a free |sGroup| in the cluster. Returns nil
@@ -87,108 +151,47 @@ func (c *FaaSController) getFreeSGroup() *SGroup {
 	return nil
 }
 
-// Selects an active |SGroup| for the logical NF DAG |g|. Picks
-// the one with the lowest traffic load (packet rate).
-func (g *DAG) findAvailableSGroup() *SGroup {
-	var selected *SGroup = nil
-	for _, sg := range g.sgroups {
-		// Skips if there are instances not ready.
-		if !sg.IsReady() {
-			continue
-		}
-
-		// Skips overloaded SGroups.
-		if sg.GetQLoad() > 40 && sg.GetPktLoad() > 60 {
+// Selects an active |SGroup| that runs the chain |chainIdx| of the
+// logical NF DAG |g| to serve a new flow |k|. The SGroup is picked by
+// |g|'s load-balancing policy. Returns nil if no SGroups can take
+// the flow.
+func (g *DAG) findAvailableSGroup(chainIdx int, k flowKey) *SGroup {
+	_, _, maxQLoad := g.getAdmission()
+
+	candidates := make([]*SGroup, 0)
+	for _, sg := range g.getSGroups() {
+		// Skips SGroups running other chains.
+		if sg.chainIdx != chainIdx {
 			continue
 		}
 
-		if selected == nil {
-			selected = sg
-		} else if selected.GetPktRate() > sg.GetPktRate() {
-			selected = sg
-		}
-	}
-	if selected != nil {
-		return selected
-	}
-
-	for _, sg := range g.sgroups {
 		// Skips if there are instances not ready.
 		if !sg.IsReady() {
 			continue
 		}
 
-		// Skips overloaded SGroups.
-		if sg.GetPktLoad() > 80 {
+		// Skips SGroups whose queues are too long to admit new flows.
+		if maxQLoad > 0 && sg.GetQLoad() > maxQLoad {
 			continue
 		}
 
-		if selected == nil {
-			selected = sg
-		} else if selected.GetPktRate() > sg.GetPktRate() {
-			selected = sg
-		}
+		candidates = append(candidates, sg)
 	}
-
-	return selected
-}
-
-// Selects an active |SGroup| for the logical NF DAG |g|. Picks
-// the one with the highest CPU load (packet rate).
-func (g *DAG) findAvailableSGroupHighLoadFirst() *SGroup {
-	var selected *SGroup = nil
-	for _, sg := range g.sgroups {
-		// Skips if there are instances not ready.
-		if !sg.IsReady() {
-			continue
-		}
-
-		// Skips overloaded SGroups.
-		if sg.GetQLoad() > 40 || sg.GetPktLoad() > 80 {
-			continue
-		}
-
-		if selected == nil {
-			selected = sg
-		} else if selected.GetPktRate() < sg.GetPktRate() {
-			selected = sg
-		}
-	}
-	if selected != nil {
-		return selected
+	if len(candidates) == 0 {
+		return nil
 	}
 
-	for _, sg := range g.sgroups {
-		// Skips if there are instances not ready.
-		if !sg.IsReady() {
-			continue
-		}
-
-		// Skips overloaded SGroups.
-		if sg.GetPktLoad() > 80 {
-			continue
-		}
-
-		if selected == nil {
-			selected = sg
-		} else if selected.GetPktRate() < sg.GetPktRate() {
-			selected = sg
-		}
-	}
-
-	return selected
+	lb, th := g.getLoadBalancer()
+	return lb.Select(candidates, k, th)
 }
 
-// Selects the first SGroup from a worker w/o backgroun traffic.
-func (c *FaaSController) findAvailableSGroupOnIdleWorker(dstPort uint32) *SGroup {
-	var selected *SGroup = nil
-
-	// Note: node1 starts at dstPort 1000
-	workerName := fmt.Sprintf("node%d", dstPort-999)
-	if w, ok := c.workers[workerName]; ok {
-		if len(w.sgroups) > 0 {
-			selected = w.sgroups[0]
+// Returns true if an SGroup of |g| that runs the chain |chainIdx| is
+// starting, i.e. it is not ready to serve traffic yet.
+func (g *DAG) hasStartingSGroup(chainIdx int) bool {
+	for _, sg := range g.getSGroups() {
+		if sg.chainIdx == chainIdx && !sg.IsReady() {
+			return true
 		}
 	}
-	return selected
+	return false
 }
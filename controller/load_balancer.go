@@ -0,0 +1,303 @@
+package controller
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// This is the place to define load-balancing policies.
+// A |LoadBalancer| picks the SGroup that serves a new flow among all
+// ready SGroups running the flow's chain. Policies are registered by
+// their names, and each DAG picks its own policy and thresholds, so
+// that policies can be compared without recompiling the controller.
+
+const (
+	// Default load-balancing thresholds (in percentage values).
+	// An SGroup with a queue load above |kDefaultLBQLoad| is busy.
+	// An SGroup with a packet load above |kDefaultLBPktLoad| and a
+	// busy queue is overloaded. An SGroup with a packet load above
+	// |kDefaultLBMaxPktLoad| never takes new flows.
+	kDefaultLBQLoad      = 40
+	kDefaultLBPktLoad    = 60
+	kDefaultLBMaxPktLoad = 80
+
+	// The default load-balancing policy.
+	kDefaultLoadBalancer = "high-load-first"
+)
+
+// |LBThresholds| are the thresholds used by a |LoadBalancer|.
+// |QLoad| is the queue load above which an SGroup is busy.
+// |PktLoad| is the packet load above which a busy SGroup is
+// overloaded.
+// |MaxPktLoad| is the packet load above which an SGroup is saturated
+// and never takes new flows.
+type LBThresholds struct {
+	QLoad      int
+	PktLoad    int
+	MaxPktLoad int
+}
+
+var DefaultLBThresholds = LBThresholds{
+	QLoad:      kDefaultLBQLoad,
+	PktLoad:    kDefaultLBPktLoad,
+	MaxPktLoad: kDefaultLBMaxPktLoad,
+}
+
+func (th LBThresholds) String() string {
+	return fmt.Sprintf("qload=%d, pload=%d, max_pload=%d", th.QLoad, th.PktLoad, th.MaxPktLoad)
+}
+
+// Returns |th| with zero fields set to their default values.
+func (th LBThresholds) withDefaults() LBThresholds {
+	if th.QLoad <= 0 {
+		th.QLoad = DefaultLBThresholds.QLoad
+	}
+	if th.PktLoad <= 0 {
+		th.PktLoad = DefaultLBThresholds.PktLoad
+	}
+	if th.MaxPktLoad <= 0 {
+		th.MaxPktLoad = DefaultLBThresholds.MaxPktLoad
+	}
+	return th
+}
+
+func (th LBThresholds) isSaturated(sg *SGroup) bool {
+	return sg.GetPktLoad() > th.MaxPktLoad
+}
+
+func (th LBThresholds) isBusy(sg *SGroup) bool {
+	return sg.GetQLoad() > th.QLoad || sg.GetPktLoad() > th.MaxPktLoad
+}
+
+func (th LBThresholds) isOverloaded(sg *SGroup) bool {
+	return sg.GetQLoad() > th.QLoad && sg.GetPktLoad() > th.PktLoad
+}
+
+// |LoadBalancer| is a load-balancing policy.
+// |Select| picks an SGroup among |sgroups| to serve a new flow |k|.
+// |sgroups| are ready SGroups that run the flow's chain. Returns nil
+// if all SGroups are saturated, which triggers a scale-up event.
+type LoadBalancer interface {
+	Name() string
+	Select(sgroups []*SGroup, k flowKey, th LBThresholds) *SGroup
+}
+
+var lbMutex sync.Mutex
+var loadBalancers = make(map[string]func() LoadBalancer)
+
+// Registers a load-balancing policy |name|. |newLB| creates a new
+// instance of the policy for a DAG.
+func RegisterLoadBalancer(name string, newLB func() LoadBalancer) {
+	lbMutex.Lock()
+	defer lbMutex.Unlock()
+
+	loadBalancers[name] = newLB
+}
+
+// Returns names of all registered load-balancing policies.
+func LoadBalancerNames() []string {
+	lbMutex.Lock()
+	defer lbMutex.Unlock()
+
+	names := make([]string, 0, len(loadBalancers))
+	for name := range loadBalancers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Creates a load-balancing policy by its |name|. An empty |name|
+// creates the default policy.
+func newLoadBalancer(name string) (LoadBalancer, error) {
+	if name == "" {
+		name = kDefaultLoadBalancer
+	}
+
+	lbMutex.Lock()
+	newLB, exists := loadBalancers[name]
+	lbMutex.Unlock()
+
+	if !exists {
+		return nil, fmt.Errorf("Unknown load balancer %s (supported: %v)", name, LoadBalancerNames())
+	}
+	return newLB(), nil
+}
+
+func init() {
+	RegisterLoadBalancer("high-load-first", func() LoadBalancer { return &highLoadFirstLB{} })
+	RegisterLoadBalancer("least-loaded", func() LoadBalancer { return &leastLoadedLB{} })
+	RegisterLoadBalancer("p2c", func() LoadBalancer { return &p2cLB{} })
+	RegisterLoadBalancer("weighted-random", func() LoadBalancer { return &weightedRandomLB{} })
+	RegisterLoadBalancer("consistent-hash", func() LoadBalancer { return &consistentHashLB{} })
+}
+
+// Returns the SGroup with the highest (or the lowest if |highest|
+// is false) packet rate among |sgroups| that are not skipped.
+func selectByPktRate(sgroups []*SGroup, highest bool, skip func(sg *SGroup) bool) *SGroup {
+	var selected *SGroup = nil
+	for _, sg := range sgroups {
+		if skip(sg) {
+			continue
+		}
+
+		if selected == nil {
+			selected = sg
+		} else if highest && selected.GetPktRate() < sg.GetPktRate() {
+			selected = sg
+		} else if !highest && selected.GetPktRate() > sg.GetPktRate() {
+			selected = sg
+		}
+	}
+	return selected
+}
+
+// |highLoadFirstLB| packs flows into the SGroup with the highest
+// packet rate, so that the scheduler can pack SGroups into fewer
+// cores. Busy SGroups are only used if all SGroups are busy.
+type highLoadFirstLB struct{}
+
+func (lb *highLoadFirstLB) Name() string {
+	return "high-load-first"
+}
+
+func (lb *highLoadFirstLB) Select(sgroups []*SGroup, k flowKey, th LBThresholds) *SGroup {
+	if sg := selectByPktRate(sgroups, true, th.isBusy); sg != nil {
+		return sg
+	}
+	return selectByPktRate(sgroups, true, th.isSaturated)
+}
+
+// |leastLoadedLB| spreads flows to the SGroup with the lowest packet
+// rate. Overloaded SGroups are only used if all SGroups are
+// overloaded. Saturated SGroups are never used.
+type leastLoadedLB struct{}
+
+func (lb *leastLoadedLB) Name() string {
+	return "least-loaded"
+}
+
+func (lb *leastLoadedLB) Select(sgroups []*SGroup, k flowKey, th LBThresholds) *SGroup {
+	notAvailable := func(sg *SGroup) bool {
+		return th.isOverloaded(sg) || th.isSaturated(sg)
+	}
+	if sg := selectByPktRate(sgroups, false, notAvailable); sg != nil {
+		return sg
+	}
+	return selectByPktRate(sgroups, false, th.isSaturated)
+}
+
+// |p2cLB| samples two non-saturated SGroups at random, and picks the
+// one with the lower packet rate (power of two choices).
+type p2cLB struct{}
+
+func (lb *p2cLB) Name() string {
+	return "p2c"
+}
+
+func (lb *p2cLB) Select(sgroups []*SGroup, k flowKey, th LBThresholds) *SGroup {
+	candidates := make([]*SGroup, 0, len(sgroups))
+	for _, sg := range sgroups {
+		if !th.isSaturated(sg) {
+			candidates = append(candidates, sg)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil
+	} else if len(candidates) == 1 {
+		return candidates[0]
+	}
+
+	i := rand.Intn(len(candidates))
+	j := rand.Intn(len(candidates) - 1)
+	if j >= i {
+		j += 1
+	}
+	if candidates[i].GetPktRate() <= candidates[j].GetPktRate() {
+		return candidates[i]
+	}
+	return candidates[j]
+}
+
+// |weightedRandomLB| picks a non-saturated SGroup at random. The
+// probability is proportional to the SGroup's remaining packet load
+// below |th.MaxPktLoad|.
+type weightedRandomLB struct{}
+
+func (lb *weightedRandomLB) Name() string {
+	return "weighted-random"
+}
+
+func (lb *weightedRandomLB) Select(sgroups []*SGroup, k flowKey, th LBThresholds) *SGroup {
+	candidates := make([]*SGroup, 0, len(sgroups))
+	weights := make([]int, 0, len(sgroups))
+	sum := 0
+	for _, sg := range sgroups {
+		load := sg.GetPktLoad()
+		if load > th.MaxPktLoad {
+			continue
+		}
+
+		// Every candidate has a chance to be picked.
+		weight := th.MaxPktLoad - load + 1
+		candidates = append(candidates, sg)
+		weights = append(weights, weight)
+		sum += weight
+	}
+
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	point := rand.Intn(sum)
+	for i, weight := range weights {
+		if point < weight {
+			return candidates[i]
+		}
+		point -= weight
+	}
+	return candidates[len(candidates)-1]
+}
+
+// |consistentHashLB| maps a flow to an SGroup by rendezvous hashing
+// of the flow's 5-tuple. Adding or removing an SGroup only remaps
+// flows of that SGroup. Saturated SGroups are skipped, so that their
+// flows fall back to the next SGroup in the flow's ranking.
+type consistentHashLB struct{}
+
+func (lb *consistentHashLB) Name() string {
+	return "consistent-hash"
+}
+
+func (lb *consistentHashLB) Select(sgroups []*SGroup, k flowKey, th LBThresholds) *SGroup {
+	var selected *SGroup = nil
+	var maxScore uint64 = 0
+	for _, sg := range sgroups {
+		if th.isSaturated(sg) {
+			continue
+		}
+
+		h := fnv.New64a()
+		fmt.Fprintf(h, "%s|%s|%d|%d|%d|%s|%d", k.srcIP, k.dstIP, k.srcPort, k.dstPort, k.proto, sg.worker.name, sg.groupID)
+		if score := mix64(h.Sum64()); selected == nil || score > maxScore {
+			selected = sg
+			maxScore = score
+		}
+	}
+	return selected
+}
+
+// Mixes bits of |x| (the splitmix64 finalizer), so that similar
+// inputs get uncorrelated scores.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
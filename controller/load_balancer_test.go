@@ -0,0 +1,89 @@
+package controller
+
+import (
+	"fmt"
+	"testing"
+)
+
+// Creates test SGroups with packet loads |pktLoads| and queue loads
+// |qLoads| (in percentage values).
+func newLBTestSGroups(pktLoads []int, qLoads []int) []*SGroup {
+	w := &Worker{name: "node1"}
+	sgroups := make([]*SGroup, len(pktLoads))
+	for i := range pktLoads {
+		sgroups[i] = &SGroup{
+			groupID:          i,
+			worker:           w,
+			pktRateKpps:      pktLoads[i] * 10,
+			maxRateKpps:      1000,
+			incQueueLength:   qLoads[i],
+			incQueueCapacity: 100,
+		}
+	}
+	return sgroups
+}
+
+// Tests of registered load-balancing policies.
+func TestLoadBalancers(t *testing.T) {
+	sgroups := newLBTestSGroups([]int{10, 50, 70, 90}, []int{0, 0, 50, 0})
+	k := flowKey{"10.0.0.1", "10.0.0.2", 1234, 8080, 6}
+	th := DefaultLBThresholds
+
+	for _, name := range LoadBalancerNames() {
+		lb, err := newLoadBalancer(name)
+		if err != nil || lb.Name() != name {
+			t.Fatalf("Failed to create load balancer %s: %v", name, err)
+		}
+
+		for i := 0; i < 100; i++ {
+			sg := lb.Select(sgroups, k, th)
+			if sg == nil || sg == sgroups[3] {
+				t.Fatalf("Load balancer %s picks a saturated SGroup", name)
+			}
+		}
+		if sg := lb.Select(sgroups[3:], k, th); sg != nil {
+			t.Errorf("Load balancer %s assigns a flow to saturated SGroups", name)
+		}
+	}
+
+	if _, err := newLoadBalancer("foo"); err == nil {
+		t.Errorf("Failed to reject an unknown load balancer")
+	}
+
+	// High-load-first skips the busy SGroup 2.
+	if sg := (&highLoadFirstLB{}).Select(sgroups, k, th); sg != sgroups[1] {
+		t.Errorf("High-load-first picks SGroup %d", sg.groupID)
+	}
+	if sg := (&leastLoadedLB{}).Select(sgroups, k, th); sg != sgroups[0] {
+		t.Errorf("Least-loaded picks SGroup %d", sg.groupID)
+	}
+	// Thresholds are configurable.
+	if sg := (&highLoadFirstLB{}).Select(sgroups, k, LBThresholds{60, 60, 95}); sg != sgroups[3] {
+		t.Errorf("High-load-first ignores thresholds")
+	}
+}
+
+// Tests that consistent hashing keeps flows when an SGroup is added.
+func TestLoadBalancerConsistentHash(t *testing.T) {
+	sgroups := newLBTestSGroups([]int{10, 10, 10, 10, 10}, []int{0, 0, 0, 0, 0})
+	lb := &consistentHashLB{}
+	th := DefaultLBThresholds
+
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		k := flowKey{fmt.Sprintf("10.0.%d.%d", i/256, i%256), "10.1.0.1", uint32(i), 8080, 6}
+		before := lb.Select(sgroups[:4], k, th)
+		if before != lb.Select(sgroups[:4], k, th) {
+			t.Fatalf("Flow %s is mapped to multiple SGroups", k)
+		}
+		if after := lb.Select(sgroups, k, th); after != before {
+			if after != sgroups[4] {
+				t.Fatalf("Flow %s moves between existing SGroups", k)
+			}
+			moved += 1
+		}
+	}
+	if moved < 100 || moved > 300 {
+		t.Errorf("Expect ~200 flows moved to the new SGroup, got %d", moved)
+	}
+}
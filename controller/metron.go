@@ -25,7 +25,7 @@ func (c *FaaSController) UpdatePort(ports []uint32) ([]int32, error) {
 			}
 		}
 
-		glog.Errorf("Port %d does not match any worker")
+		glog.Errorf("Port %d does not match any worker", p)
 	}
 
 	return allSGs, nil
@@ -36,19 +36,19 @@ func (c *FaaSController) UpdatePort(ports []uint32) ([]int32, error) {
 func (c *FaaSController) metronStartUp() {
 	var wg sync.WaitGroup
 
-	for _, dag := range c.dags {
+	for _, dag := range c.getDAGs() {
 		if !dag.IsActive() {
 			continue
 		}
 
-		for i := 0; i < kDefaultSGroupInStartup; i++ {
+		for i := 0; i < kDefaultSGroupInStartup*len(dag.getChains()); i++ {
 			wg.Add(1)
-			go func(c *FaaSController, dag *DAG) {
+			go func(c *FaaSController, dag *DAG, chainIdx int) {
 				sg := c.metronGetFreeSGroup()
 				glog.Info(sg)
 				if sg != nil {
 					// Note: before creating a new sg, metron has to set a valid coreID for this sg.
-					sg.worker.metronCreateSGroup(sg, dag)
+					sg.worker.metronCreateSGroup(sg, dag, chainIdx)
 
 					// Check that sg is up and then notify ofctl
 					start := time.Now()
@@ -63,7 +63,7 @@ func (c *FaaSController) metronStartUp() {
 				}
 
 				wg.Done()
-			}(c, dag)
+			}(c, dag, dag.nextChain())
 		}
 	}
 
@@ -92,7 +92,7 @@ func (c *FaaSController) metronGetFreeSGroup() *SGroup {
 	}
 
 	if freeSG != nil {
-		if core := freeSG.worker.getIdleCore(); core != nil {
+		if core := freeSG.worker.getIdleCore(freeSG.getNUMANode()); core != nil {
 			freeSG.SetCoreID(core.coreID)
 			core.addSGroup(freeSG)
 		} else {
@@ -112,7 +112,7 @@ func (c *FaaSController) metronProcessWorker(w *Worker) []int32 {
 			sgs = append(sgs, int32(sg.groupID))
 			c.metronScaleUp(sg)
 		}
-		glog.Infof("sg (%s) is affected", sg.groupID)
+		glog.Infof("sg (%d) is affected", sg.groupID)
 	}
 
 	return sgs
@@ -129,7 +129,7 @@ func (c *FaaSController) metronScaleUp(sg *SGroup) {
 	}
 
 	// Create newSGroup that replicates sg.
-	newSGroup.worker.metronCreateSGroup(newSGroup, sg.dag)
+	newSGroup.worker.metronCreateSGroup(newSGroup, sg.dag, sg.chainIdx)
 
 	// Wait for the new sg is up. Then, update to ofctl.
 	start := time.Now()
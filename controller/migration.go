@@ -0,0 +1,203 @@
+package controller
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	glog "github.com/golang/glog"
+)
+
+// This is the place to govern SGroup migrations.
+// Scheduling policies run on scheduling events and sweeps. Small
+// fluctuations of packet rates may change a policy's plan in every
+// round, and move SGroups between cores back and forth. Each
+// migration is an |attachSGroup| gRPC to CoopSched, which stalls the
+// SGroup. |migrationGovernor| keeps the previous assignment unless a
+// new plan is better by a margin, keeps an SGroup on its core for a
+// minimum residency time, and limits the number of migrations in each
+// round. Moves of a plan depend on each other, e.g. a migration frees
+// room for a placement. So, a plan with suppressed migrations is
+// re-planned before any of its moves is executed.
+
+const (
+	// The default min gain (in the unit of |schedView.cost|, i.e. 100
+	// for a core) of a new plan over the previous assignment.
+	kDefaultMigrationMargin = 20
+
+	// The default min time (in milliseconds) that an SGroup stays on
+	// a core before it migrates again.
+	kDefaultMinResidency = 1000
+
+	// The default max number of migrations in each scheduling round.
+	kDefaultMigrationBudget = 4
+
+	// The initial estimation (in microseconds) of the cost of an
+	// |attachSGroup| migration.
+	kDefaultMigrationCostUs = 2000
+)
+
+var migrationMargin int
+var minResidencyMs int
+var migrationBudget int
+
+func init() {
+	flag.IntVar(&migrationMargin, "schedmargin", kDefaultMigrationMargin, "The min gain of a new schedule to migrate SGroups (100: a core)")
+	flag.IntVar(&minResidencyMs, "schedresidency", kDefaultMinResidency, "The min time (in ms) that an SGroup stays on a core")
+	flag.IntVar(&migrationBudget, "schedbudget", kDefaultMigrationBudget, "The max number of SGroup migrations in each scheduling round (0: no limit)")
+}
+
+// |migrationGovernor| executes planned migrations of a worker.
+// |margin| is the min gain of a new plan over the previous assignment.
+// |minResidency| is the min time that an SGroup stays on a core.
+// |budget| is the max number of migrations in each round (0: no limit).
+// |arrival| is the time that each SGroup arrived at its core.
+// |done| and |suppressed| count migrations done and suppressed.
+// |costUs| is the moving average of the migration cost.
+// |migrationTime| is the time spent on all migrations.
+// |now| returns the current time (a simulated clock in simulation).
+// It is protected by the worker's |sgMutex|.
+type migrationGovernor struct {
+	margin        int
+	minResidency  time.Duration
+	budget        int
+	arrival       map[*SGroup]time.Time
+	done          int
+	suppressed    int
+	costUs        int
+	migrationTime time.Duration
+	now           func() time.Time
+}
+
+func newMigrationGovernor() *migrationGovernor {
+	return &migrationGovernor{
+		margin:       migrationMargin,
+		minResidency: time.Duration(minResidencyMs) * time.Millisecond,
+		budget:       migrationBudget,
+		arrival:      make(map[*SGroup]time.Time),
+		costUs:       kDefaultMigrationCostUs,
+		now:          time.Now,
+	}
+}
+
+func (g *migrationGovernor) String() string {
+	return fmt.Sprintf("done=%d, suppressed=%d, cost=%dus", g.done, g.suppressed, g.costUs)
+}
+
+// Returns the plan to execute: |candidate| if it is better than
+// |baseline| (the previous assignment) by |g.margin|. Otherwise,
+// returns |baseline|, and counts migrations in |candidate| as
+// suppressed.
+func (g *migrationGovernor) choose(baseline *schedView, candidate *schedView) *schedView {
+	if candidate.cost()+g.margin <= baseline.cost() {
+		return candidate
+	}
+
+	for _, m := range candidate.result() {
+		if m.isMigration() {
+			g.suppressed += 1
+		}
+	}
+	return baseline
+}
+
+// Executes |moves| planned on |v| for worker |w|. A migration is
+// suppressed if its SGroup has not stayed on its core for
+// |g.minResidency|, or the round has used up |g.budget|. If any
+// migration is suppressed, the plan is re-planned (see |g.replan|).
+func (g *migrationGovernor) execute(w *Worker, v *schedView, moves []sgMove) {
+	now := g.now()
+
+	// Forgets SGroups that are no longer running, and starts the
+	// residency time of SGroups seen for the first time.
+	arrival := make(map[*SGroup]time.Time)
+	for sg, coreID := range v.origin {
+		if coreID == kFaaSInvalidCoreID {
+			continue
+		}
+		if t, exists := g.arrival[sg]; exists {
+			arrival[sg] = t
+		} else {
+			arrival[sg] = now
+		}
+	}
+	g.arrival = arrival
+
+	allowed := make([]sgMove, 0, len(moves))
+	migrations := 0
+	for _, m := range moves {
+		if m.isMigration() {
+			if now.Sub(g.arrival[m.sg]) < g.minResidency {
+				continue
+			}
+			if g.budget > 0 && migrations >= g.budget {
+				continue
+			}
+			migrations += 1
+		}
+		allowed = append(allowed, m)
+	}
+
+	if migrations < countMigrations(moves) {
+		allowed = g.replan(w, v, allowed)
+		g.suppressed += countMigrations(moves) - countMigrations(allowed)
+	}
+	for _, m := range allowed {
+		g.migrate(m)
+	}
+}
+
+// Re-plans the moves planned on |v| when some migrations are
+// suppressed. Suppressed SGroups stay on their original cores, the
+// |allowed| migrations are applied, and pending SGroups are placed
+// again by Best-Fit Decreasing, so that no placement relies on a
+// suppressed migration. Returns the re-planned moves if they are no
+// worse than keeping all SGroups on their original cores. Otherwise,
+// suppresses all migrations and returns placements of pending SGroups.
+func (g *migrationGovernor) replan(w *Worker, v *schedView, allowed []sgMove) []sgMove {
+	baseline := v.unplanned()
+	baseline.placePending(w)
+
+	partial := v.unplanned()
+	for _, m := range allowed {
+		if m.isMigration() {
+			partial.move(m.sg, m.coreID)
+		}
+	}
+	partial.placePending(w)
+
+	if partial.cost() <= baseline.cost() {
+		return partial.result()
+	}
+	return baseline.result()
+}
+
+// Returns the number of migrations in |moves|.
+func countMigrations(moves []sgMove) int {
+	count := 0
+	for _, m := range moves {
+		if m.isMigration() {
+			count += 1
+		}
+	}
+	return count
+}
+
+// Migrates (or places) |m.sg| to core |m.coreID|, and updates the
+// migration cost.
+func (g *migrationGovernor) migrate(m sgMove) {
+	start := g.now()
+	if err := m.sg.attachSGroup(m.coreID); err != nil {
+		glog.Errorf("Failed to attach SGroup[%d] to Core[%d]. %v", m.sg.ID(), m.coreID, err)
+		return
+	}
+
+	end := g.now()
+	elapsed := end.Sub(start)
+	g.arrival[m.sg] = end
+	if m.isMigration() {
+		g.done += 1
+		g.migrationTime += elapsed
+		g.costUs = (7*g.costUs + int(elapsed/time.Microsecond)) / 8
+	}
+}
@@ -0,0 +1,112 @@
+package controller
+
+import (
+	"testing"
+	"time"
+)
+
+// Tests of keeping the previous assignment unless a new plan is better
+// by a margin.
+func TestSchedMigrationMargin(t *testing.T) {
+	w := newSchedTestWorker(5)
+	a := newSchedTestSGroup(w, 0, 50, 3)
+	b := newSchedTestSGroup(w, 1, 40, 2)
+	active := []*SGroup{a, b}
+
+	g := newMigrationGovernor()
+	g.margin = kDefaultMigrationMargin
+
+	// Packing from scratch swaps cores of |a| and |b| without any gain.
+	baseline := newSchedView(w, active)
+	baseline.placePending(w)
+	candidate := newSchedView(w, active)
+	w.packSGroups(candidate, PACK_BEST_FIT)
+	if g.choose(baseline, candidate) != baseline || g.suppressed == 0 {
+		t.Errorf("Migrated SGroups without any gain")
+	}
+	if len(baseline.result()) != 0 {
+		t.Errorf("The previous assignment migrates SGroups: %v", baseline.result())
+	}
+
+	// Packing saves a core.
+	a = newSchedTestSGroup(w, 0, 40, 3)
+	b = newSchedTestSGroup(w, 1, 30, 4)
+	active = []*SGroup{a, b}
+	baseline = newSchedView(w, active)
+	candidate = newSchedView(w, active)
+	w.packSGroups(candidate, PACK_BEST_FIT)
+	if g.choose(baseline, candidate) != candidate {
+		t.Errorf("Failed to pack SGroups into fewer cores")
+	}
+	if moves := candidate.result(); len(moves) != 2 || moves[0].coreID != 2 || moves[1].coreID != 2 {
+		t.Errorf("Unexpected packing %v", moves)
+	}
+}
+
+// Tests of relieving an overloaded core by opening another core.
+func TestSchedMigrationOverload(t *testing.T) {
+	w := newSchedTestWorker(4)
+	a := newSchedTestSGroup(w, 0, 70, 2)
+	b := newSchedTestSGroup(w, 1, 60, 2)
+	active := []*SGroup{a, b}
+
+	g := newMigrationGovernor()
+	g.margin = kDefaultMigrationMargin
+
+	baseline := newSchedView(w, active)
+	candidate := newSchedView(w, active)
+	w.packSGroups(candidate, PACK_BEST_FIT)
+	if baseline.cost() <= 200 || candidate.cost() != 200 {
+		t.Errorf("Unexpected costs: overloaded=%d, packed=%d", baseline.cost(), candidate.cost())
+	}
+	if g.choose(baseline, candidate) != candidate {
+		t.Errorf("Kept SGroups on an overloaded core")
+	}
+}
+
+// Tests of min residency times and migration budgets.
+func TestSchedMigrationSuppression(t *testing.T) {
+	w := newSchedTestWorker(5)
+	a := newSchedTestSGroup(w, 0, 10, 2)
+	b := newSchedTestSGroup(w, 1, 10, 3)
+	c := newSchedTestSGroup(w, 2, 10, kFaaSInvalidCoreID)
+	v := newSchedView(w, []*SGroup{a, b, c})
+	moves := []sgMove{{a, 2, 4}, {b, 3, 4}, {c, kFaaSInvalidCoreID, 4}}
+
+	g := newMigrationGovernor()
+	g.minResidency = time.Hour
+	g.budget = 0
+	g.execute(w, v, moves)
+	if g.suppressed != 2 {
+		t.Errorf("Expect 2 migrations suppressed by residency, got %d", g.suppressed)
+	}
+
+	g = newMigrationGovernor()
+	g.minResidency = 0
+	g.budget = 1
+	g.execute(w, v, moves)
+	if g.suppressed != 1 {
+		t.Errorf("Expect 1 migration suppressed by budget, got %d", g.suppressed)
+	}
+}
+
+// Tests of re-planning placements that rely on suppressed migrations.
+func TestSchedMigrationReplan(t *testing.T) {
+	w := newSchedTestWorker(4)
+	w.coopSched = &testCoopSched{}
+	x := newSchedTestSGroup(w, 0, 60, 3)
+	y := newSchedTestSGroup(w, 1, 50, kFaaSInvalidCoreID)
+	z := newSchedTestSGroup(w, 2, 60, 2)
+	v := newSchedView(w, []*SGroup{x, y, z})
+
+	// |y| takes the room freed by |x|, but |x| has just arrived.
+	g := newMigrationGovernor()
+	g.minResidency = time.Hour
+	g.execute(w, v, []sgMove{{x, 3, 4}, {y, kFaaSInvalidCoreID, 3}})
+	if g.suppressed != 1 || x.GetCoreID() != 3 {
+		t.Errorf("Expect the migration of SGroup[0] suppressed, got %d on Core #%d", g.suppressed, x.GetCoreID())
+	}
+	if y.GetCoreID() != 4 {
+		t.Errorf("Expect SGroup[1] placed on the empty Core #4, got Core #%d", y.GetCoreID())
+	}
+}
@@ -0,0 +1,139 @@
+package controller
+
+import (
+	"sync/atomic"
+
+	glog "github.com/golang/glog"
+)
+
+// This is the place to keep SGroups close to their NICs.
+// An SGroup receives packets from its PCIe VF. If it runs on a core of
+// another NUMA node, every packet crosses the socket interconnect. The
+// cluster config records NUMA nodes of PCIe devices and cores. Free
+// SGroups take VFs on the NUMA node with the most spare cores, and
+// schedulers prefer cores on the NUMA node of an SGroup's VF. SGroups
+// that still run on remote cores are reported as cross-NUMA
+// placements.
+
+// The NUMA node of a device that is not annotated.
+const kUnknownNUMANode = -1
+
+// Sets NUMA nodes of |w.pcie| by |pcieNUMA|, which maps PCIe devices
+// to their NUMA nodes. Devices not in |pcieNUMA| are on unknown nodes.
+// It must be called before |w| creates SGroups.
+func (w *Worker) setPCIeNUMA(pcieNUMA map[string]int) {
+	w.pcieNUMA = make([]int, len(w.pcie))
+	for i, pcie := range w.pcie {
+		if node, exists := pcieNUMA[pcie]; exists && node >= 0 {
+			w.pcieNUMA[i] = node
+		} else {
+			w.pcieNUMA[i] = kUnknownNUMANode
+		}
+	}
+}
+
+// Returns the NUMA node of PCIe device |pcieIdx| of |w|.
+func (w *Worker) getPCIeNUMANode(pcieIdx int) int {
+	if pcieIdx < 0 || pcieIdx >= len(w.pcieNUMA) {
+		return kUnknownNUMANode
+	}
+	return w.pcieNUMA[pcieIdx]
+}
+
+// Returns the NUMA node of core |coreID| of |w|.
+func (w *Worker) getCoreNUMANode(coreID int) int {
+	if core, exists := w.cores[coreID]; exists {
+		return core.numaNode
+	}
+	return kUnknownNUMANode
+}
+
+// Returns the NUMA node of the PCIe VF of |sg|.
+func (sg *SGroup) getNUMANode() int {
+	if sg.worker == nil {
+		return kUnknownNUMANode
+	}
+	return sg.worker.getPCIeNUMANode(sg.pcieIdx)
+}
+
+// Returns true if |sg| runs on a core of another NUMA node when it
+// runs on core |coreID|. Returns false if either node is unknown.
+func (w *Worker) isCrossNUMA(sg *SGroup, coreID int) bool {
+	sgNode := sg.getNUMANode()
+	coreNode := w.getCoreNUMANode(coreID)
+	return sgNode != kUnknownNUMANode && coreNode != kUnknownNUMANode && sgNode != coreNode
+}
+
+// Counts a placement of |sg| on core |coreID| if it crosses NUMA nodes.
+func (w *Worker) recordPlacement(sg *SGroup, coreID int) {
+	if coreID == w.idleCoreID || !w.isCrossNUMA(sg, coreID) {
+		return
+	}
+
+	atomic.AddUint64(&w.crossNUMAPlacements, 1)
+	glog.V(1).Infof("SGroup[%d] (NUMA %d) runs on W %s Core[%d] (NUMA %d)",
+		sg.ID(), sg.getNUMANode(), w.name, coreID, w.getCoreNUMANode(coreID))
+}
+
+// Returns the number of placements across NUMA nodes on |w|.
+func (w *Worker) getCrossNUMAPlacements() uint64 {
+	return atomic.LoadUint64(&w.crossNUMAPlacements)
+}
+
+// Returns the number of running SGroups of |w| on cores of other NUMA
+// nodes. |w.sgMutex| must be held.
+func (w *Worker) countCrossNUMASGroups() int {
+	count := 0
+	for _, sg := range w.sgroups {
+		coreID := sg.GetCoreID()
+		if sg.IsSched() && coreID != w.idleCoreID && w.isCrossNUMA(sg, coreID) {
+			count += 1
+		}
+	}
+	return count
+}
+
+// Returns the NUMA node with the most spare cores, i.e. NF cores that
+// are not claimed by SGroups on VFs of the node. Returns
+// |kUnknownNUMANode| if cores are not annotated.
+func (w *Worker) getPreferredNUMANode() int {
+	spare := make(map[int]int)
+	for coreID, core := range w.cores {
+		if core.numaNode != kUnknownNUMANode && coreID != w.idleCoreID {
+			spare[core.numaNode] += 1
+		}
+	}
+	if len(spare) == 0 {
+		return kUnknownNUMANode
+	}
+
+	w.sgMutex.Lock()
+	for _, sgroups := range []SGroupSlice{w.sgroups, w.freeSGroups} {
+		for _, sg := range sgroups {
+			if node := sg.getNUMANode(); node != kUnknownNUMANode {
+				spare[node] -= 1
+			}
+		}
+	}
+	w.sgMutex.Unlock()
+
+	selected := kUnknownNUMANode
+	for node, cnt := range spare {
+		if selected == kUnknownNUMANode || cnt > spare[selected] || (cnt == spare[selected] && node < selected) {
+			selected = node
+		}
+	}
+	return selected
+}
+
+// Allocates a PCIe VF for a new SGroup. Prefers VFs on the NUMA node
+// with the most spare cores. Returns -1 if all VFs are taken.
+func (w *Worker) allocPCIe() int {
+	node := w.getPreferredNUMANode()
+	if node == kUnknownNUMANode {
+		return w.pciePool.GetNextAvailable()
+	}
+	return w.pciePool.GetNextAvailableIf(func(pcieIdx int) bool {
+		return w.getPCIeNUMANode(pcieIdx) == node
+	})
+}
@@ -0,0 +1,78 @@
+package controller
+
+import (
+	"testing"
+
+	utils "github.com/USC-NSL/Low-Latency-FaaS/utils"
+)
+
+// Creates a test worker with Core #1 ~ #5 and PCIe VFs #0 ~ #4. Core
+// #1 is the idle core. Cores #2, #3 and VFs #0 ~ #2 are on NUMA node
+// 0, and the rest are on NUMA node 1.
+func newNUMATestWorker() *Worker {
+	w := newSchedTestWorker(5)
+	for coreID, core := range w.cores {
+		if coreID == 2 || coreID == 3 {
+			core.numaNode = 0
+		} else if coreID >= 4 {
+			core.numaNode = 1
+		}
+	}
+	w.pcie = []string{"06:00.0", "06:00.1", "06:00.2", "86:00.0", "86:00.1"}
+	w.pciePool = utils.NewIndexPool(0, len(w.pcie))
+	w.setPCIeNUMA(map[string]int{"06:00.0": 0, "06:00.1": 0, "06:00.2": 0, "86:00.0": 1, "86:00.1": 1})
+	return w
+}
+
+func TestNUMAPacking(t *testing.T) {
+	w := newNUMATestWorker()
+
+	// Without NUMA nodes, both SGroups would share one core.
+	a := newSchedTestSGroup(w, 3, 30, kFaaSInvalidCoreID)
+	b := newSchedTestSGroup(w, 0, 30, kFaaSInvalidCoreID)
+	v := newSchedView(w, []*SGroup{a, b})
+	w.packSGroups(v, PACK_FIRST_FIT)
+	if v.coreOf[a] != 4 || v.coreOf[b] != 2 {
+		t.Errorf("Expect SGroups on local cores #4 and #2, got #%d and #%d", v.coreOf[a], v.coreOf[b])
+	}
+
+	// SGroups on node 0 take remote cores after local cores are full.
+	c := newSchedTestSGroup(w, 1, 60, kFaaSInvalidCoreID)
+	d := newSchedTestSGroup(w, 2, 60, kFaaSInvalidCoreID)
+	v = newSchedView(w, []*SGroup{b, c, d})
+	w.packSGroups(v, PACK_BEST_FIT)
+	if v.coreOf[c] != 2 || v.coreOf[d] != 3 || v.coreOf[b] != 4 {
+		t.Errorf("Expect SGroups on cores #2, #3 and #4, got #%d, #%d and #%d", v.coreOf[c], v.coreOf[d], v.coreOf[b])
+	}
+	if !w.isCrossNUMA(b, 4) || w.isCrossNUMA(b, 2) {
+		t.Errorf("Wrong cross-NUMA placements of SGroup[%d]", b.ID())
+	}
+
+	// A newly active SGroup prefers an empty local core to a remote
+	// core with room.
+	v = newSchedView(w, []*SGroup{a, b})
+	v.move(a, 4)
+	v.placePending(w)
+	if v.coreOf[b] != 2 {
+		t.Errorf("Expect SGroup[%d] on core #2, got #%d", b.ID(), v.coreOf[b])
+	}
+
+	if core := w.getIdleCore(1); core == nil || core.numaNode != 1 {
+		t.Errorf("Expect an idle core on NUMA node 1, got %v", core)
+	}
+}
+
+func TestNUMAPCIeAllocation(t *testing.T) {
+	w := newNUMATestWorker()
+
+	// Both nodes have 2 spare cores.
+	if idx := w.allocPCIe(); idx != 0 {
+		t.Errorf("Expect VF #0, got #%d", idx)
+	}
+	w.freeSGroups = append(w.freeSGroups, &SGroup{worker: w, pcieIdx: 0})
+
+	// Node 1 has more spare cores.
+	if idx := w.allocPCIe(); idx != 3 {
+		t.Errorf("Expect VF #3, got #%d", idx)
+	}
+}
@@ -0,0 +1,194 @@
+package controller
+
+import (
+	"flag"
+	"sort"
+	"sync"
+	"time"
+
+	glog "github.com/golang/glog"
+)
+
+// This is the place to implement automatic scale-in.
+// An idle SGroup is parked on the idle core, but keeps its NF pods,
+// instance ports and NIC queue. An SGroup that stays parked for the
+// idle timeout of its DAG is reclaimed: it is removed from its DAG,
+// unregistered at CooperativeSched, and its NF instances are torn
+// down. It goes back to the free SGroups of its worker, and keeps its
+// NIC queue (PCIe VF), so that the warm pool reuses it. Only free
+// SGroups above the high watermark of the warm pool release their
+// NIC queues.
+// Each DAG keeps at least its |minSGroups| SGroups. Reclaiming is off
+// by default, since the idle timeout |kDefaultScaleInTimeout| is 0.
+
+const (
+	// The default idle timeout (in seconds) of SGroups (0: never).
+	kDefaultScaleInTimeout = 0
+
+	// The period (in milliseconds) of reclaiming idle SGroups.
+	kScaleInPeriod = 5000
+)
+
+var defaultScaleInTimeout int
+
+func init() {
+	flag.IntVar(&defaultScaleInTimeout, "scaleintimeout", kDefaultScaleInTimeout, "The time (in seconds) before an idle SGroup is reclaimed (0: never)")
+}
+
+// Returns the min number of SGroups of |g|, and the time that an
+// SGroup of |g| stays idle before it is reclaimed (0: never).
+func (g *DAG) getScaleIn() (int, time.Duration) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	timeout := g.idleTimeout
+	if timeout == 0 {
+		timeout = time.Duration(defaultScaleInTimeout) * time.Second
+	}
+	if timeout < 0 {
+		timeout = 0
+	}
+	return g.minSGroups, timeout
+}
+
+// Sets the min number of SGroups of |g| to |minSGroups|, and the idle
+// timeout of its SGroups to |idleTimeout| (0: the |-scaleintimeout|
+// flag, negative: never).
+func (g *DAG) setScaleIn(minSGroups int, idleTimeout time.Duration) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.minSGroups = minSGroups
+	g.idleTimeout = idleTimeout
+}
+
+// Moves |sg| to draining if it has been parked for |timeout| by
+// |now|. Returns true if |sg| is draining.
+func (sg *SGroup) drainIfIdle(timeout time.Duration, now time.Time) bool {
+	sg.mutex.Lock()
+	defer sg.mutex.Unlock()
+
+	if sg.state != SGROUP_PARKED || now.Sub(sg.stateSince) < timeout {
+		return false
+	}
+	if err := sg.setState(SGROUP_DRAINING); err != nil {
+		glog.Errorf("%v", err)
+		return false
+	}
+	return true
+}
+
+// Reclaims SGroups of |dag| that have been parked for its idle
+// timeout by |now|. SGroups that have been parked the longest go
+// first. Keeps at least |dag.minSGroups| SGroups. Returns the number
+// of reclaimed SGroups.
+func (c *FaaSController) reclaimIdleSGroups(dag *DAG, now time.Time) int {
+	minSGroups, timeout := dag.getScaleIn()
+	if timeout <= 0 {
+		return 0
+	}
+
+	sgroups := dag.getSGroups()
+	idle := make([]*SGroup, 0)
+	for _, sg := range sgroups {
+		if sg.GetState() == SGROUP_PARKED && now.Sub(sg.getStateSince()) >= timeout {
+			idle = append(idle, sg)
+		}
+	}
+	sort.SliceStable(idle, func(i, j int) bool {
+		return idle[i].getStateSince().Before(idle[j].getStateSince())
+	})
+
+	draining := make([]*SGroup, 0)
+	for _, sg := range idle {
+		if len(sgroups)-len(draining) <= minSGroups {
+			break
+		}
+		// |sg| may have turned active since.
+		if !sg.drainIfIdle(timeout, now) {
+			continue
+		}
+		draining = append(draining, sg)
+	}
+
+	// SGroups drain in parallel.
+	var wg sync.WaitGroup
+	results := make(chan *Worker, len(draining))
+	for _, sg := range draining {
+		if a := getAuditor(); a != nil {
+			a.record(newSGroupAuditEvent(AUDIT_SCALE_IN, sg))
+		}
+		glog.Infof("Reclaim SGroup[%d] of user [%s] on worker[%s] after %v idle", sg.ID(), dag.user, sg.worker.name, timeout)
+
+		wg.Add(1)
+		go func(sg *SGroup) {
+			defer wg.Done()
+			w := sg.worker
+			if err := w.releaseSGroup(sg); err != nil {
+				glog.Errorf("Failed to reclaim SGroup[%d] on worker[%s]. %v", sg.ID(), w.name, err)
+				return
+			}
+			results <- w
+		}(sg)
+	}
+	wg.Wait()
+	close(results)
+
+	// Trims each worker once after all its SGroups are reclaimed.
+	reclaimed := 0
+	workers := make(map[*Worker]bool)
+	for w := range results {
+		reclaimed += 1
+		workers[w] = true
+	}
+	for w := range workers {
+		w.trimFreeSGroups()
+	}
+	return reclaimed
+}
+
+// Destroys free SGroups of |w| above the high watermark of its warm
+// pool, so that their NIC queues are released. Free SGroups up to the
+// high watermark keep their NIC queues.
+func (w *Worker) trimFreeSGroups() {
+	if w.freePool == nil {
+		return
+	}
+	_, _, _, high := w.getWarmPoolLevels()
+
+	w.sgMutex.Lock()
+	extra := make([]*SGroup, 0)
+	for len(w.freeSGroups) > high {
+		n := len(w.freeSGroups)
+		extra = append(extra, w.freeSGroups[n-1])
+		w.freeSGroups = w.freeSGroups[:(n - 1)]
+	}
+	w.sgMutex.Unlock()
+
+	var wg sync.WaitGroup
+	wg.Add(len(extra))
+	for _, sg := range extra {
+		go w.destroyFreeSGroup(sg, &wg)
+	}
+	wg.Wait()
+}
+
+// Long-running Go-routine function. Reclaims idle SGroups of all
+// DAGs every |kScaleInPeriod|.
+func (c *FaaSController) runScaleIn() {
+	ticker := time.NewTicker(kScaleInPeriod * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case op := <-c.scaleInOp:
+			if op == SHUTDOWN {
+				return
+			}
+		case now := <-ticker.C:
+			for _, dag := range c.getDAGs() {
+				c.reclaimIdleSGroups(dag, now)
+			}
+		}
+	}
+}
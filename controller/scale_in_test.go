@@ -0,0 +1,55 @@
+package controller
+
+import (
+	"testing"
+	"time"
+)
+
+// Tests of reclaiming idle SGroups.
+func TestScaleIn(t *testing.T) {
+	c, dag := newAdmissionTestController("u")
+	w := newSchedTestWorker(3)
+	now := time.Now()
+
+	// SGroups that have been parked for 60s, 30s and 5s, and a
+	// running SGroup.
+	sgroups := make([]*SGroup, 0)
+	for i, idle := range []int{60, 30, 5, -1} {
+		sg := newSchedTestSGroup(w, i, 0, w.idleCoreID)
+		sg.state = SGROUP_PARKED
+		if idle < 0 {
+			sg.state = SGROUP_RUNNING
+		}
+		sg.stateSince = now.Add(-time.Duration(idle) * time.Second)
+		w.sgroups = append(w.sgroups, sg)
+		w.cores[w.idleCoreID].addSGroup(sg)
+		dag.addSGroup(sg, 0)
+		sgroups = append(sgroups, sg)
+	}
+
+	// Never reclaims SGroups if the timeout is negative.
+	dag.setScaleIn(2, -time.Second)
+	if n := c.reclaimIdleSGroups(dag, now); n != 0 {
+		t.Errorf("Expect no reclaimed SGroups, got %d", n)
+	}
+
+	// Reclaims SGroups idle for 10s until 3 SGroups are left.
+	dag.setScaleIn(3, 10*time.Second)
+	if n := c.reclaimIdleSGroups(dag, now); n != 1 {
+		t.Errorf("Expect 1 reclaimed SGroup, got %d", n)
+	}
+	if sgroups[0].GetState() != SGROUP_FREE || sgroups[1].GetState() != SGROUP_PARKED {
+		t.Errorf("Expect the longest idle SGroup to be reclaimed first")
+	}
+
+	dag.setScaleIn(1, 10*time.Second)
+	if n := c.reclaimIdleSGroups(dag, now); n != 1 {
+		t.Errorf("Expect 1 reclaimed SGroup, got %d", n)
+	}
+	if left := dag.getSGroups(); len(left) != 2 || left[0] != sgroups[2] || left[1] != sgroups[3] {
+		t.Errorf("Expect recently idle and running SGroups to be kept")
+	}
+	if len(w.sgroups) != 2 || w.countFreeSGroups() != 2 || len(w.cores[w.idleCoreID].sGroups) != 2 {
+		t.Errorf("Expect reclaimed SGroups to be free SGroups of worker[%s]", w.name)
+	}
+}
@@ -0,0 +1,327 @@
+package controller
+
+import (
+	"sort"
+
+	glog "github.com/golang/glog"
+)
+
+// This is the place to plan CPU scheduling.
+// A policy takes a snapshot of a worker's cores and active SGroups
+// (|schedView|), plans migrations on the snapshot, and executes them
+// after planning. So, a policy can compare plans before migrating any
+// SGroups.
+
+// The cost of each percentage of a core's load above |kMaxCorePktLoad|.
+const kOverloadCostFactor = 10
+
+// |sgMove| migrates |sg| from core |from| to core |coreID|. |from|
+// is |kFaaSInvalidCoreID| if |sg| is not running on any core, i.e.
+// the move is a placement rather than a migration.
+type sgMove struct {
+	sg     *SGroup
+	from   int
+	coreID int
+}
+
+func (m sgMove) isMigration() bool {
+	return m.from != kFaaSInvalidCoreID
+}
+
+// |coreView| is a snapshot of a core in a scheduling round.
+// |numaNode| is the NUMA node of the core.
+// |sgroups| are active SGroups running on the core.
+type coreView struct {
+	coreID   int
+	numaNode int
+	sgroups  []*SGroup
+}
+
+// |schedView| is a snapshot of a worker's cores and active SGroups.
+// Policies plan migrations on the snapshot, and execute them after.
+// |coreIDs| are sorted IDs of cores that run SGroups (excluding the
+// idle core).
+// |coreOf| is the core of each SGroup in the plan.
+// |origin| is the core of each SGroup before the plan.
+// |loads| and |overloaded| are the packet loads and overload states
+// of SGroups.
+// |numa| are NUMA nodes of SGroups' PCIe VFs. Cores on the same NUMA
+// node as an SGroup are preferred.
+// |pending| are active SGroups that are not running on any core,
+// sorted by their packet loads in the decreasing order.
+// |moves| are all planned migrations.
+type schedView struct {
+	coreIDs    []int
+	cores      map[int]*coreView
+	coreOf     map[*SGroup]int
+	origin     map[*SGroup]int
+	loads      map[*SGroup]int
+	overloaded map[*SGroup]bool
+	numa       map[*SGroup]int
+	pending    []*SGroup
+	moves      []sgMove
+}
+
+// Creates a snapshot of Worker |w| and its |active| SGroups.
+// |w.sgMutex| must be held.
+func newSchedView(w *Worker, active []*SGroup) *schedView {
+	v := &schedView{
+		coreIDs:    make([]int, 0, len(w.cores)),
+		cores:      make(map[int]*coreView),
+		coreOf:     make(map[*SGroup]int),
+		origin:     make(map[*SGroup]int),
+		loads:      make(map[*SGroup]int),
+		overloaded: make(map[*SGroup]bool),
+		numa:       make(map[*SGroup]int),
+		pending:    make([]*SGroup, 0),
+	}
+	for coreID := range w.cores {
+		if coreID == w.idleCoreID {
+			continue
+		}
+		v.coreIDs = append(v.coreIDs, coreID)
+		v.cores[coreID] = &coreView{coreID: coreID, numaNode: w.getCoreNUMANode(coreID), sgroups: make([]*SGroup, 0)}
+	}
+	sort.Ints(v.coreIDs)
+
+	for _, sg := range active {
+		v.loads[sg] = sg.GetPktLoad()
+		v.overloaded[sg] = sg.IsOverloaded()
+		v.numa[sg] = sg.getNUMANode()
+
+		coreID := sg.GetCoreID()
+		if core, exists := v.cores[coreID]; exists && sg.IsSched() {
+			core.sgroups = append(core.sgroups, sg)
+			v.coreOf[sg] = coreID
+			v.origin[sg] = coreID
+		} else {
+			v.coreOf[sg] = kFaaSInvalidCoreID
+			v.origin[sg] = kFaaSInvalidCoreID
+			v.pending = append(v.pending, sg)
+		}
+	}
+	sort.SliceStable(v.pending, func(i, j int) bool {
+		return v.loads[v.pending[i]] > v.loads[v.pending[j]]
+	})
+	return v
+}
+
+// Places pending SGroups by Best-Fit Decreasing. SGroups that are
+// running keep their cores. Returns false if |w| runs out of cores.
+func (v *schedView) placePending(w *Worker) bool {
+	pending := v.pending
+	v.pending = make([]*SGroup, 0)
+	for i, sg := range pending {
+		coreID := v.bestFit(v.coreLoads(), sg, kFaaSInvalidCoreID)
+		if emptyCoreID := v.emptyCore(sg); coreID == kFaaSInvalidCoreID {
+			coreID = emptyCoreID
+		} else if !v.isLocal(sg, coreID) && emptyCoreID != kFaaSInvalidCoreID && v.isLocal(sg, emptyCoreID) {
+			// Prefers an empty core on the NUMA node of |sg| to a
+			// running core on another node.
+			coreID = emptyCoreID
+		}
+		if coreID == kFaaSInvalidCoreID {
+			glog.Errorf("Worker[%s] runs out of cores", w.name)
+			v.pending = pending[i:]
+			return false
+		}
+		v.move(sg, coreID)
+	}
+	return true
+}
+
+// Returns a copy of |v| without any planned moves, i.e. all SGroups
+// are on their original cores, and SGroups without a core are pending.
+func (v *schedView) unplanned() *schedView {
+	u := &schedView{
+		coreIDs:    v.coreIDs,
+		cores:      make(map[int]*coreView),
+		coreOf:     make(map[*SGroup]int),
+		origin:     v.origin,
+		loads:      v.loads,
+		overloaded: v.overloaded,
+		numa:       v.numa,
+		pending:    make([]*SGroup, 0),
+	}
+	for _, coreID := range v.coreIDs {
+		core := v.cores[coreID]
+		u.cores[coreID] = &coreView{coreID: coreID, numaNode: core.numaNode, sgroups: make([]*SGroup, 0)}
+	}
+
+	sgroups := append([]*SGroup{}, v.pending...)
+	for _, coreID := range v.coreIDs {
+		sgroups = append(sgroups, v.cores[coreID].sgroups...)
+	}
+	for _, sg := range sgroups {
+		coreID := v.origin[sg]
+		u.coreOf[sg] = coreID
+		if core, exists := u.cores[coreID]; exists {
+			core.sgroups = append(core.sgroups, sg)
+		} else {
+			u.pending = append(u.pending, sg)
+		}
+	}
+	sort.SliceStable(u.pending, func(i, j int) bool {
+		return u.loads[u.pending[i]] > u.loads[u.pending[j]]
+	})
+	return u
+}
+
+// Removes all SGroups from their cores, so that a policy can pack
+// them from scratch. The original cores are kept in |v.origin|.
+func (v *schedView) clear() {
+	for _, coreID := range v.coreIDs {
+		core := v.cores[coreID]
+		v.pending = append(v.pending, core.sgroups...)
+		for _, sg := range core.sgroups {
+			v.coreOf[sg] = kFaaSInvalidCoreID
+		}
+		core.sgroups = make([]*SGroup, 0)
+	}
+	sort.SliceStable(v.pending, func(i, j int) bool {
+		return v.loads[v.pending[i]] > v.loads[v.pending[j]]
+	})
+}
+
+// Returns the cost of the assignment in |v|: 100 for each running
+// core, plus |kOverloadCostFactor| times the load of each core above
+// |kMaxCorePktLoad|, plus 100 for each SGroup that does not get a
+// core. Measured loads of an overloaded core are capped by the core,
+// so that overloads are costly, and opening a core to relieve an
+// overload pays off.
+func (v *schedView) cost() int {
+	cost := 100 * len(v.pending)
+	for coreID, load := range v.coreLoads() {
+		if len(v.cores[coreID].sgroups) == 0 {
+			continue
+		}
+		cost += 100
+		if load > kMaxCorePktLoad {
+			cost += kOverloadCostFactor * (load - kMaxCorePktLoad)
+		}
+	}
+	return cost
+}
+
+// Returns the packet load of each core.
+func (v *schedView) coreLoads() map[int]int {
+	loads := make(map[int]int)
+	for coreID, core := range v.cores {
+		for _, sg := range core.sgroups {
+			loads[coreID] += v.loads[sg]
+		}
+	}
+	return loads
+}
+
+// Returns true if core |coreID| is on the NUMA node of |sg|, or
+// either NUMA node is unknown.
+func (v *schedView) isLocal(sg *SGroup, coreID int) bool {
+	sgNode := v.numa[sg]
+	coreNode := v.cores[coreID].numaNode
+	return sgNode == kUnknownNUMANode || coreNode == kUnknownNUMANode || sgNode == coreNode
+}
+
+// Returns the most loaded running core (other than |exclude|) that
+// can take |sg| without exceeding |kMaxCorePktLoad|. Cores on the
+// NUMA node of |sg| are preferred. |loads| are packet loads of cores.
+// Returns |kFaaSInvalidCoreID| if none fits.
+func (v *schedView) bestFit(loads map[int]int, sg *SGroup, exclude int) int {
+	selected := kFaaSInvalidCoreID
+	for _, coreID := range v.coreIDs {
+		if coreID == exclude || len(v.cores[coreID].sgroups) == 0 {
+			continue
+		}
+		if loads[coreID]+v.loads[sg] >= kMaxCorePktLoad {
+			continue
+		}
+		if selected == kFaaSInvalidCoreID {
+			selected = coreID
+		} else if local := v.isLocal(sg, coreID); local != v.isLocal(sg, selected) {
+			if local {
+				selected = coreID
+			}
+		} else if loads[coreID] > loads[selected] {
+			selected = coreID
+		}
+	}
+	return selected
+}
+
+// Returns the core with the lowest ID that runs no SGroups. Cores on
+// the NUMA node of |sg| are preferred. Returns |kFaaSInvalidCoreID|
+// if all cores are running SGroups.
+func (v *schedView) emptyCore(sg *SGroup) int {
+	selected := kFaaSInvalidCoreID
+	for _, coreID := range v.coreIDs {
+		if len(v.cores[coreID].sgroups) != 0 {
+			continue
+		}
+		if v.isLocal(sg, coreID) {
+			return coreID
+		}
+		if selected == kFaaSInvalidCoreID {
+			selected = coreID
+		}
+	}
+	return selected
+}
+
+// Fits all |sgroups| into running cores other than |exclude| by
+// Best-Fit Decreasing. Returns planned migrations, and false if some
+// SGroup does not fit. |v| is not changed.
+func (v *schedView) fitAll(sgroups []*SGroup, exclude int) ([]sgMove, bool) {
+	sorted := append([]*SGroup{}, sgroups...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return v.loads[sorted[i]] > v.loads[sorted[j]]
+	})
+
+	loads := v.coreLoads()
+	moves := make([]sgMove, 0, len(sorted))
+	for _, sg := range sorted {
+		coreID := v.bestFit(loads, sg, exclude)
+		if coreID == kFaaSInvalidCoreID {
+			return nil, false
+		}
+		loads[coreID] += v.loads[sg]
+		moves = append(moves, sgMove{sg: sg, from: v.coreOf[sg], coreID: coreID})
+	}
+	return moves, true
+}
+
+// Plans to migrate |sg| to core |coreID|.
+func (v *schedView) move(sg *SGroup, coreID int) {
+	if prev, exists := v.cores[v.coreOf[sg]]; exists {
+		for i, s := range prev.sgroups {
+			if s == sg {
+				prev.sgroups = append(prev.sgroups[:i], prev.sgroups[i+1:]...)
+				break
+			}
+		}
+	}
+	for i, s := range v.pending {
+		if s == sg {
+			v.pending = append(v.pending[:i], v.pending[i+1:]...)
+			break
+		}
+	}
+	v.cores[coreID].sgroups = append(v.cores[coreID].sgroups, sg)
+	v.coreOf[sg] = coreID
+	v.moves = append(v.moves, sgMove{sg: sg, from: v.origin[sg], coreID: coreID})
+}
+
+// Returns the migrations to execute. An SGroup that is planned to
+// move several times migrates once to its final core, and an SGroup
+// that ends up on its original core does not migrate.
+func (v *schedView) result() []sgMove {
+	moves := make([]sgMove, 0, len(v.moves))
+	planned := make(map[*SGroup]bool)
+	for _, m := range v.moves {
+		if planned[m.sg] || v.coreOf[m.sg] == v.origin[m.sg] {
+			continue
+		}
+		planned[m.sg] = true
+		moves = append(moves, sgMove{sg: m.sg, from: v.origin[m.sg], coreID: v.coreOf[m.sg]})
+	}
+	return moves
+}
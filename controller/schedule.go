@@ -1,218 +1,283 @@
 package controller
 
 import (
+	"flag"
+	"fmt"
 	"sort"
+	"sync"
 	"time"
 
 	glog "github.com/golang/glog"
 )
 
 // This is the place to implement CPU scheduling.
-// NF chains are scheduled periodically based on real-time monitoring.
+// NF chains are scheduled when their states change (see |schedEvent|),
+// and periodically by a slow sweep based on real-time monitoring.
+// Each worker runs a |SchedulingPolicy|. Policies are registered by
+// their names, and are selected by the |-sched| flag, by the cluster
+// config, or at runtime from the CLI.
+
+const (
+	// The default scheduling policy.
+	kDefaultSchedulingPolicy = "no-packing"
+
+	// The max packet load (in percentage values) of a core when
+	// packing SGroups into cores.
+	kMaxCorePktLoad = 80
+
+	// The period (in milliseconds) of scheduling sweeps. A sweep runs
+	// a scheduling round even if no events arrive.
+	kSchedSweepPeriod = 1000
+
+	// The size of a worker's scheduling event channel.
+	kSchedEventQueueSize = 64
+)
+
+var defaultSchedulingPolicy string
+
+func init() {
+	flag.StringVar(&defaultSchedulingPolicy, "sched", kDefaultSchedulingPolicy, "The default per-worker scheduling policy")
+}
+
+// |SchedulingPolicy| decides which cores run the SGroups of a worker.
+// |ScheduleOnce| is called by |Worker.ScheduleLoop| on scheduling
+// events and sweeps with |w.sgMutex| held. It must not acquire
+// |w.sgMutex|. Rounds are not evenly spaced, so a policy should
+// measure time by |w.migrations.now| instead of counting rounds.
+type SchedulingPolicy interface {
+	Name() string
+	ScheduleOnce(w *Worker)
+}
+
+var schedMutex sync.Mutex
+var schedulingPolicies = make(map[string]func() SchedulingPolicy)
+
+// Registers a scheduling policy |name|. |newPolicy| creates a new
+// instance of the policy for a worker.
+func RegisterSchedulingPolicy(name string, newPolicy func() SchedulingPolicy) {
+	schedMutex.Lock()
+	defer schedMutex.Unlock()
+
+	schedulingPolicies[name] = newPolicy
+}
+
+// Returns names of all registered scheduling policies.
+func SchedulingPolicyNames() []string {
+	schedMutex.Lock()
+	defer schedMutex.Unlock()
+
+	names := make([]string, 0, len(schedulingPolicies))
+	for name := range schedulingPolicies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Creates a scheduling policy by its |name|. An empty |name| creates
+// the default policy set by the |-sched| flag.
+func newSchedulingPolicy(name string) (SchedulingPolicy, error) {
+	if name == "" {
+		name = defaultSchedulingPolicy
+	}
+
+	schedMutex.Lock()
+	newPolicy, exists := schedulingPolicies[name]
+	schedMutex.Unlock()
+
+	if !exists {
+		return nil, fmt.Errorf("Unknown scheduling policy %s (supported: %v)", name, SchedulingPolicyNames())
+	}
+	return newPolicy(), nil
+}
+
+func init() {
+	RegisterSchedulingPolicy("no-packing", func() SchedulingPolicy { return &noPackingPolicy{} })
+	RegisterSchedulingPolicy("bfd", func() SchedulingPolicy { return &bfdPolicy{} })
+	RegisterSchedulingPolicy("ffd", func() SchedulingPolicy { return &ffdPolicy{} })
+	RegisterSchedulingPolicy("advanced-fit", func() SchedulingPolicy { return newAdvancedFitPolicy() })
+}
+
+// |schedEventType| is the type of a state change of an SGroup that
+// calls for a scheduling round.
+type schedEventType int
+
+const (
+	SCHED_EVENT_ACTIVE schedEventType = iota
+	SCHED_EVENT_IDLE
+	SCHED_EVENT_OVERLOAD
+	SCHED_EVENT_UNDERLOAD
+)
+
+func (t schedEventType) String() string {
+	switch t {
+	case SCHED_EVENT_ACTIVE:
+		return "active"
+	case SCHED_EVENT_IDLE:
+		return "idle"
+	case SCHED_EVENT_OVERLOAD:
+		return "overload"
+	case SCHED_EVENT_UNDERLOAD:
+		return "underload"
+	default:
+		return fmt.Sprintf("%d", int(t))
+	}
+}
+
+// |schedEvent| is a state change of SGroup |sg|.
+type schedEvent struct {
+	sg        *SGroup
+	eventType schedEventType
+}
+
+// Posts a scheduling event to |w|. Never blocks. If the event channel
+// is full, the event is dropped, since a scheduling round is pending
+// anyway.
+func (w *Worker) postSchedEvent(sg *SGroup, eventType schedEventType) {
+	if w == nil {
+		return
+	}
+
+	select {
+	case w.schedEvents <- schedEvent{sg: sg, eventType: eventType}:
+	default:
+	}
+}
 
 // Go routine that runs on each worker to rebalance traffic loads among
-// available CPU cores. Select a scheduling algorithm by changing the
-// per-worker scheduling function here.
+// available CPU cores. The scheduling algorithm is the worker's
+// |schedPolicy|. A round runs right after SGroups post scheduling
+// events, and every |kSchedSweepPeriod| as a safety net. Events that
+// arrive together are handled in one round.
 func (w *Worker) ScheduleLoop() {
+	sweep := time.NewTicker(kSchedSweepPeriod * time.Millisecond)
+	defer sweep.Stop()
+
 	for {
 		select {
 		case <-w.schedOp:
 			w.wg.Done()
 			return
+		case ev := <-w.schedEvents:
+			glog.V(1).Infof("Worker[%s] schedules on SGroup[%d] %s", w.name, ev.sg.ID(), ev.eventType)
+			w.drainSchedEvents()
+		case <-sweep.C:
+		}
+
+		// Stops all updates on Worker |w| temporally.
+		w.sgMutex.Lock()
+		w.schedPolicy.ScheduleOnce(w)
+		w.sgMutex.Unlock()
+	}
+}
+
+// Drops all pending scheduling events, which are handled by the next
+// scheduling round.
+func (w *Worker) drainSchedEvents() {
+	for {
+		select {
+		case <-w.schedEvents:
 		default:
-			w.noPackingScheduleOnce()
-			time.Sleep(100 * time.Millisecond)
+			return
 		}
 	}
 }
 
 // Returns an idle CPU core |core| in |w.cores|. The CPU core does not
-// run any NF chains. This function is only called by other per-worker
-// functions. So, no lock as other functions must lock first.
-func (w *Worker) getIdleCore() *Core {
+// run any NF chains, and is not the core that holds idle SGroups.
+// Prefers cores on NUMA node |numaNode|. This function is only called
+// by other per-worker functions. So, no lock as other functions must
+// lock first.
+func (w *Worker) getIdleCore(numaNode int) *Core {
+	var selected *Core = nil
 	for _, core := range w.cores {
-		if len(core.sGroups) == 0 {
+		if len(core.sGroups) != 0 || core.coreID == w.idleCoreID {
+			continue
+		}
+		if numaNode == kUnknownNUMANode || core.numaNode == numaNode {
 			return core
 		}
+		if selected == nil {
+			selected = core
+		}
 	}
 
-	return nil
+	return selected
 }
 
-// The per-worker NF thread scheduler.
-// This function monitors traffic loads for all deployed SGroups.
-// It packs SGroups into a minimum number of CPU cores.
-// Algorithm: Best Fit Decreasing.
-func (w *Worker) scheduleOnce() {
-	// Stops all updates on Worker |w| temporally.
-	w.sgMutex.Lock()
-	defer w.sgMutex.Unlock()
-
-	sort.Sort(sort.Reverse(w.sgroups))
-
-	coreID := 0
-	load := 80
+// Parks an inactive SGroup |sg| on the idle core of |w|, and
+// detaches it, so that it no longer takes CPU cycles. An idle |sg|
+// turns parked.
+func (w *Worker) parkIdleSGroup(sg *SGroup) {
+	if sg.IsSched() && !w.detachIdleSGroup(sg) {
+		return
+	}
 
-	for _, sg := range w.sgroups {
-		if !sg.IsReady() {
-			// Skips if |sg| is not ready for scheduling.
-			continue
-		} else if !sg.IsActive() {
-			// Detaches |sg| if it is still being scheduled.
-			if sg.IsSched() {
-				if sg.GetCoreID() != 1 {
-					if err := sg.attachSGroup(1); err != nil {
-						glog.Errorf("Failed to attach SGroup[%d] to Core #1. %v", sg.ID(), err)
-						continue
-					}
-
-					// |sg| should be attached successfully.
-					if sg.GetCoreID() != 1 || !sg.IsSched() {
-						glog.Errorf("SGroup[%d] was Attached to Core #1 but not running on it!", sg.ID())
-					}
-				}
-
-				if err := sg.detachSGroup(); err != nil {
-					glog.Errorf("Failed to detach SGroup[%d]. %v", sg.ID(), err)
-					continue
-				}
-
-				// |sg| should be detached successfully.
-				if sg.IsSched() {
-					glog.Errorf("SGroup[%d] was Detached but still running!", sg.ID())
-				}
-			}
+	sg.mutex.Lock()
+	defer sg.mutex.Unlock()
 
-			continue
+	if sg.state == SGROUP_IDLE {
+		if err := sg.setState(SGROUP_PARKED); err != nil {
+			glog.Errorf("%v", err)
 		}
+	}
+}
 
-		sgLoad := sg.GetPktLoad()
-
-		if load+sgLoad < 80 {
-			load = load + sgLoad
-		} else if coreID < len(w.cores) {
-			coreID += 1
-			load = sgLoad
-		} else {
-			glog.Errorf("Worker[%s] runs out of cores", w.name)
-			break
+// Moves a running SGroup |sg| to the idle core of |w|, and detaches
+// it. Returns true if |sg| is detached.
+func (w *Worker) detachIdleSGroup(sg *SGroup) bool {
+	if sg.GetCoreID() != w.idleCoreID {
+		if err := sg.attachSGroup(w.idleCoreID); err != nil {
+			glog.Errorf("Failed to attach SGroup[%d] to Core #%d. %v", sg.ID(), w.idleCoreID, err)
+			return false
 		}
 
-		// Enforce scheduling.
-		// Note: be careful about deadlocks.
-		if err := sg.attachSGroup(coreID); err != nil {
-			glog.Errorf("Failed to attach SGroup[%d] to Core[%d]", sg.ID(), coreID)
+		// |sg| should be attached successfully.
+		if sg.GetCoreID() != w.idleCoreID {
+			glog.Errorf("SGroup[%d] was Attached to Core #%d but not running on it!", sg.ID(), w.idleCoreID)
+			return false
 		}
 	}
-}
-
-// Algorithm:
-// Best-Fit Decreasing for non-overloaded SGroups.
-// Rescheduling for overloaded SGroups.
-func (w *Worker) advancedFitScheduleOnce() {
-	// Stops all updates on Worker |w| temporally.
-	w.sgMutex.Lock()
-	defer w.sgMutex.Unlock()
 
-	sort.Sort(sort.Reverse(w.sgroups))
-
-	coreID := 0
-	load := 80
+	if err := sg.detachSGroup(); err != nil {
+		glog.Errorf("Failed to detach SGroup[%d]. %v", sg.ID(), err)
+		return false
+	}
+	return true
+}
 
+// Parks all ready but inactive SGroups of |w|, and returns all ready
+// and active SGroups, which are to be scheduled by a policy.
+// |w.sgMutex| must be held.
+func (w *Worker) parkIdleSGroups() []*SGroup {
+	active := make([]*SGroup, 0, len(w.sgroups))
 	for _, sg := range w.sgroups {
 		if !sg.IsReady() {
 			// Skips if |sg| is not ready for scheduling.
 			continue
 		} else if !sg.IsActive() {
 			// Detaches |sg| if it is still being scheduled.
-			if sg.IsSched() {
-				if sg.GetCoreID() != 1 {
-					if err := sg.attachSGroup(1); err != nil {
-						glog.Errorf("Failed to attach SGroup[%d] to Core #1. %v", sg.ID(), err)
-						continue
-					}
-
-					// |sg| should be attached successfully.
-					if sg.GetCoreID() != 1 || !sg.IsSched() {
-						glog.Errorf("SGroup[%d] was Attached to Core #1 but not running on it!", sg.ID())
-					}
-				}
-
-				if err := sg.detachSGroup(); err != nil {
-					glog.Errorf("Failed to detach SGroup[%d]. %v", sg.ID(), err)
-					continue
-				}
-
-				// |sg| should be detached successfully.
-				if sg.IsSched() {
-					glog.Errorf("SGroup[%d] was Detached but still running!", sg.ID())
-				}
-			}
-
+			w.parkIdleSGroup(sg)
 			continue
 		}
-
-		sgLoad := sg.GetPktLoad()
-
-		if load+sgLoad < 80 {
-			load = load + sgLoad
-		} else if coreID < len(w.cores) {
-			coreID += 1
-			load = sgLoad
-		} else {
-			glog.Errorf("Worker[%s] runs out of cores", w.name)
-			break
-		}
-
-		// Enforce scheduling.
-		// Note: be careful about deadlocks.
-		if err := sg.attachSGroup(coreID); err != nil {
-			glog.Errorf("Failed to attach SGroup[%d] to Core[%d]", sg.ID(), coreID)
-		}
+		active = append(active, sg)
 	}
+	return active
 }
 
-func (w *Worker) noPackingScheduleOnce() {
-	// Stops all updates on Worker |w| temporally.
-	w.sgMutex.Lock()
-	defer w.sgMutex.Unlock()
-
-	for _, sg := range w.sgroups {
-		if !sg.IsReady() {
-			// Skips if |sg| is not ready for scheduling.
-			continue
-		} else if !sg.IsActive() {
-			// Detaches |sg| if it is still being scheduled.
-			if sg.IsSched() {
-				if sg.GetCoreID() != 1 {
-					if err := sg.attachSGroup(1); err != nil {
-						glog.Errorf("Failed to attach SGroup[%d] to Core #1. %v", sg.ID(), err)
-						continue
-					}
-
-					// |sg| should be attached successfully.
-					if sg.GetCoreID() != 1 || !sg.IsSched() {
-						glog.Errorf("SGroup[%d] was Attached to Core #1 but not running on it!", sg.ID())
-					}
-				}
-
-				if err := sg.detachSGroup(); err != nil {
-					glog.Errorf("Failed to detach SGroup[%d]. %v", sg.ID(), err)
-					continue
-				}
-
-				// |sg| should be detached successfully.
-				if sg.IsSched() {
-					glog.Errorf("SGroup[%d] was Detached but still running!", sg.ID())
-				}
-			}
+// |noPackingPolicy| runs each active SGroup on its own idle core.
+type noPackingPolicy struct{}
 
-			continue
-		}
+func (p *noPackingPolicy) Name() string {
+	return "no-packing"
+}
 
+func (p *noPackingPolicy) ScheduleOnce(w *Worker) {
+	for _, sg := range w.parkIdleSGroups() {
 		// |sg| is ready and active. Schedule the sg with one idle CPU core.
-		if !sg.IsSched() {
-			core := w.getIdleCore()
+		// Note: a newly ready SGroup may still run on the idle core.
+		if !sg.IsSched() || sg.GetCoreID() == w.idleCoreID {
+			core := w.getIdleCore(sg.getNUMANode())
 			if core == nil {
 				glog.Errorf("Worker[%s] runs out of cores", w.name)
 				continue
@@ -226,3 +291,118 @@ func (w *Worker) noPackingScheduleOnce() {
 		}
 	}
 }
+
+// |packFit| picks the opened core that takes an SGroup when packing
+// SGroups (see |packSGroups|).
+type packFit int
+
+const (
+	// The first opened core that still has room for the SGroup.
+	PACK_FIRST_FIT packFit = iota
+	// The opened core with the least room left that still fits the
+	// SGroup.
+	PACK_BEST_FIT
+)
+
+// Packs SGroups in |v| into a minimum number of CPU cores from
+// scratch. SGroups are sorted by their loads in the decreasing order,
+// and are packed into cores one by one. A core takes SGroups until
+// its load reaches |kMaxCorePktLoad|. Each SGroup goes to the opened
+// core picked by |fit|, or opens a new core if none has room for it.
+// Cores on the NUMA node of an SGroup are preferred. A core on
+// another node is used only if no core on the node has room for the
+// SGroup.
+func (w *Worker) packSGroups(v *schedView, fit packFit) {
+	v.clear()
+
+	opened := make([]int, 0, len(v.coreIDs))
+	for len(v.pending) > 0 {
+		sg := v.pending[0]
+		loads := v.coreLoads()
+
+		coreID := kFaaSInvalidCoreID
+		for _, local := range []bool{true, false} {
+			if coreID = v.fitOpened(opened, loads, sg, fit, local); coreID != kFaaSInvalidCoreID {
+				break
+			}
+			if coreID = v.emptyCore(sg); coreID != kFaaSInvalidCoreID && (!local || v.isLocal(sg, coreID)) {
+				opened = append(opened, coreID)
+				break
+			}
+			coreID = kFaaSInvalidCoreID
+		}
+
+		if coreID == kFaaSInvalidCoreID {
+			glog.Errorf("Worker[%s] runs out of cores", w.name)
+			break
+		}
+		v.move(sg, coreID)
+	}
+}
+
+// Returns the core in |opened| that takes |sg| by |fit| when packing
+// SGroups. Only cores on the NUMA node of |sg| are considered if
+// |local| is true. Returns |kFaaSInvalidCoreID| if none has room for
+// |sg|.
+func (v *schedView) fitOpened(opened []int, loads map[int]int, sg *SGroup, fit packFit, local bool) int {
+	selected := kFaaSInvalidCoreID
+	for _, coreID := range opened {
+		if local && !v.isLocal(sg, coreID) {
+			continue
+		}
+		if loads[coreID]+v.loads[sg] >= kMaxCorePktLoad {
+			continue
+		}
+		if fit == PACK_FIRST_FIT {
+			return coreID
+		}
+		if selected == kFaaSInvalidCoreID || loads[coreID] > loads[selected] {
+			selected = coreID
+		}
+	}
+	return selected
+}
+
+// Schedules active SGroups of |w| by packing them into cores. The
+// previous assignment is kept unless the packing is better by the
+// margin of |w.migrations|.
+func (w *Worker) schedulePacking(fit packFit) {
+	active := w.parkIdleSGroups()
+
+	// The previous assignment with newly active SGroups placed.
+	baseline := newSchedView(w, active)
+	baseline.placePending(w)
+
+	candidate := newSchedView(w, active)
+	w.packSGroups(candidate, fit)
+
+	v := w.migrations.choose(baseline, candidate)
+	w.migrations.execute(w, v, v.result())
+}
+
+// |bfdPolicy| packs SGroups into a minimum number of CPU cores. Each
+// SGroup goes to the core with the least room left that still fits
+// it, so that loads are packed tightly.
+// Algorithm: Best Fit Decreasing.
+type bfdPolicy struct{}
+
+func (p *bfdPolicy) Name() string {
+	return "bfd"
+}
+
+func (p *bfdPolicy) ScheduleOnce(w *Worker) {
+	w.schedulePacking(PACK_BEST_FIT)
+}
+
+// |ffdPolicy| packs SGroups into CPU cores. Unlike |bfdPolicy|, each
+// SGroup goes to the first core that still has room for it.
+// Algorithm: First Fit Decreasing.
+type ffdPolicy struct{}
+
+func (p *ffdPolicy) Name() string {
+	return "ffd"
+}
+
+func (p *ffdPolicy) ScheduleOnce(w *Worker) {
+	w.schedulePacking(PACK_FIRST_FIT)
+}
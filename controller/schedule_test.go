@@ -0,0 +1,183 @@
+package controller
+
+import (
+	"testing"
+)
+
+// Tests of selecting per-worker scheduling policies.
+func TestSchedulingPolicies(t *testing.T) {
+	for _, name := range []string{"no-packing", "bfd", "ffd", "advanced-fit"} {
+		policy, err := newSchedulingPolicy(name)
+		if err != nil {
+			t.Fatalf("Failed to create scheduling policy %s. %v", name, err)
+		}
+		if policy.Name() != name {
+			t.Errorf("Expect policy %s, got %s", name, policy.Name())
+		}
+	}
+	if len(SchedulingPolicyNames()) < 4 {
+		t.Errorf("Missing scheduling policies %v", SchedulingPolicyNames())
+	}
+
+	if policy, err := newSchedulingPolicy(""); err != nil || policy.Name() != kDefaultSchedulingPolicy {
+		t.Errorf("Failed to create the default scheduling policy")
+	}
+	if _, err := newSchedulingPolicy("round-robin"); err == nil {
+		t.Errorf("Created an unknown scheduling policy")
+	}
+
+	c := &FaaSController{workers: make(map[string]*Worker)}
+	for _, name := range []string{"alpha", "beta"} {
+		c.workers[name] = &Worker{name: name, schedPolicy: &noPackingPolicy{}}
+	}
+
+	if err := c.SetSchedulingPolicy("alpha", "ffd"); err != nil {
+		t.Fatalf("Failed to set scheduling policy. %v", err)
+	}
+	if c.workers["alpha"].schedPolicy.Name() != "ffd" || c.workers["beta"].schedPolicy.Name() != "no-packing" {
+		t.Errorf("Failed to set the scheduling policy of worker alpha")
+	}
+
+	if err := c.SetSchedulingPolicy("all", "bfd"); err != nil {
+		t.Fatalf("Failed to set scheduling policy. %v", err)
+	}
+	for _, w := range c.workers {
+		if w.schedPolicy.Name() != "bfd" {
+			t.Errorf("Worker %s uses %s, expect bfd", w.name, w.schedPolicy.Name())
+		}
+	}
+
+	if err := c.SetSchedulingPolicy("node1", "bfd"); err == nil {
+		t.Errorf("Set the scheduling policy of an unknown worker")
+	}
+	if err := c.SetSchedulingPolicy("alpha", "round-robin"); err == nil {
+		t.Errorf("Set an unknown scheduling policy")
+	}
+}
+
+// Tests of packing SGroups by First-Fit and Best-Fit Decreasing.
+func TestSchedPacking(t *testing.T) {
+	w := newSchedTestWorker(4)
+	sgroups := make([]*SGroup, 0)
+	for i, load := range []int{50, 40, 30, 8} {
+		sgroups = append(sgroups, newSchedTestSGroup(w, i, load, kFaaSInvalidCoreID))
+	}
+
+	// Both open cores #2 [50] and #3 [40, 30]. First-Fit puts the
+	// SGroup of 8 on the first core with room, and Best-Fit puts it on
+	// the core with the least room left.
+	expected := map[packFit][]int{
+		PACK_FIRST_FIT: {2, 3, 3, 2},
+		PACK_BEST_FIT:  {2, 3, 3, 3},
+	}
+	for fit, cores := range expected {
+		v := newSchedView(w, sgroups)
+		w.packSGroups(v, fit)
+		for i, sg := range sgroups {
+			if v.coreOf[sg] != cores[i] {
+				t.Errorf("Packing %d: expect SGroup[%d] on core #%d, got #%d", fit, sg.ID(), cores[i], v.coreOf[sg])
+			}
+		}
+		if v.cost() != 200 {
+			t.Errorf("Packing %d: expect 2 cores, got cost %d", fit, v.cost())
+		}
+	}
+}
+
+// Tests of running each active SGroup on its own core.
+func TestSchedNoPacking(t *testing.T) {
+	w := newSchedTestWorker(4)
+	w.coopSched = &testCoopSched{}
+	a := newSchedTestSGroup(w, 0, 10, 2)
+	b := newSchedTestSGroup(w, 1, 10, w.idleCoreID)
+	c := newSchedTestSGroup(w, 2, 10, kFaaSInvalidCoreID)
+	for _, sg := range []*SGroup{a, b, c} {
+		sg.state = SGROUP_RUNNING
+		if core, exists := w.cores[sg.coreID]; exists {
+			core.addSGroup(sg)
+		}
+		w.sgroups = append(w.sgroups, sg)
+	}
+
+	// |b| gets ready on the idle core, and becomes active before
+	// it is detached.
+	(&noPackingPolicy{}).ScheduleOnce(w)
+	cores := make(map[int]bool)
+	for _, sg := range []*SGroup{a, b, c} {
+		coreID := sg.GetCoreID()
+		if !sg.IsSched() || cores[coreID] {
+			t.Errorf("SGroup[%d] does not run on its own core (core=%d)", sg.ID(), coreID)
+		}
+		cores[coreID] = true
+	}
+	if a.GetCoreID() != 2 || b.GetCoreID() == w.idleCoreID {
+		t.Errorf("Unexpected cores: a=%d, b=%d", a.GetCoreID(), b.GetCoreID())
+	}
+}
+
+// Returns the type of the next scheduling event of |w|, or -1 if
+// there are no events.
+func nextSchedEvent(w *Worker) schedEventType {
+	select {
+	case ev := <-w.schedEvents:
+		return ev.eventType
+	default:
+		return -1
+	}
+}
+
+// Tests of posting scheduling events on SGroup state changes.
+func TestSchedEvents(t *testing.T) {
+	w := &Worker{name: "node1", schedEvents: make(chan schedEvent, 2)}
+	sg := &SGroup{
+		worker:           w,
+		state:            SGROUP_PARKED,
+		batchSize:        32,
+		batchCount:       1,
+		incQueueCapacity: 100,
+	}
+	ins := newInstance("nf", true, true, 0, "127.0.0.1", 0, "")
+	sg.instances = append(sg.instances, ins)
+
+	sg.SetActive()
+	if ev := nextSchedEvent(w); ev != SCHED_EVENT_ACTIVE {
+		t.Errorf("Expect an active event, got %v", ev)
+	}
+	sg.SetActive()
+	if ev := nextSchedEvent(w); ev != -1 {
+		t.Errorf("Expect no events for an active SGroup, got %v", ev)
+	}
+
+	// The max rate is 1700000 / (1000 + 5100 * 2 / 32) = 1604 kpps.
+	ins.UpdateTrafficInfo(0, 1500, 1000)
+	sg.UpdateTrafficInfo()
+	if ev := nextSchedEvent(w); ev != SCHED_EVENT_OVERLOAD {
+		t.Errorf("Expect an overload event, got %v", ev)
+	}
+	sg.UpdateTrafficInfo()
+	if ev := nextSchedEvent(w); ev != -1 {
+		t.Errorf("Expect no events for a steady overload, got %v", ev)
+	}
+	ins.UpdateTrafficInfo(0, 100, 1000)
+	sg.UpdateTrafficInfo()
+	if ev := nextSchedEvent(w); ev != SCHED_EVENT_UNDERLOAD {
+		t.Errorf("Expect an underload event, got %v", ev)
+	}
+
+	ins.UpdateTrafficInfo(0, 0, 1000)
+	for i := 0; i < MIN_IDLE_DURATION; i++ {
+		sg.UpdateTrafficInfo()
+	}
+	if ev := nextSchedEvent(w); ev != SCHED_EVENT_IDLE {
+		t.Errorf("Expect an idle event, got %v", ev)
+	}
+
+	// Events are dropped if the channel is full.
+	for i := 0; i < 3; i++ {
+		w.postSchedEvent(sg, SCHED_EVENT_ACTIVE)
+	}
+	w.drainSchedEvents()
+	if ev := nextSchedEvent(w); ev != -1 {
+		t.Errorf("Failed to drain events, got %v", ev)
+	}
+}
@@ -3,7 +3,6 @@ package controller
 import (
 	"flag"
 	"fmt"
-	"math"
 	"sync"
 	"time"
 
@@ -17,11 +16,6 @@ const (
 
 	// FaaS Core IDs
 	kFaaSInvalidCoreID = -1
-	kFaaSStartCoreID   = 19
-	kFaaSIdleCoreID    = 1
-
-	// The context switch time in CPU cycles
-	CONTEXT_SWITCH_CYCLE_COST_PP = 5100
 
 	// A SGroup turns idle if it has been idle for this amount of samples.
 	// By default, the monitoring period is 300ms.
@@ -77,10 +71,10 @@ func init() {
 // |manager| manages NIC queues, memory buffers.
 // |groupID| is the unique ID of the sGroup on a worker.
 // |pcieIdx| is used to identify this sgroup.
-// |isReady| is true if all instances are ready and detached on Core #1.
-// |isActive| is true if this SGroup is serving traffic, i.e.
-// |isSched| is true if this SGroup is scheduled on a core.
-// packets are coming into the SGroup's NIC queue.
+// |state| is the lifecycle state of this SGroup (see sgroup_state.go),
+// and |stateSince| is the time that it entered |state|.
+// Whether this SGroup is scheduled on a core is derived from |state|
+// and |coreID| (see |isScheduled|).
 // |instances| are NF instances within the scheduling group.
 // |tids| is an array of all NF thread's IDs.
 // |sumCycles| is the sum of all instances' cycle costs.
@@ -89,8 +83,11 @@ func init() {
 // for all instances.
 // |QueueLength, QueueCapacity| are the NIC queue information.
 // |pktRateKpps| describes the observed traffic.
+// |flowCount| is the number of flows assigned to the SGroup.
 // |worker| is the worker node that the sGroup attached to. Set -1 when not attached.
 // |coreID| is the core that the sGroup scheduled to.
+// |dag| is the NF DAG served by this SGroup, and |chainIdx| is the
+// index of the chain in |dag.chains| that this SGroup runs.
 // Note:
 // 1. All Instances in |instances| is placed in a InsStartupPool;
 // 2. If |tids| is empty, it means that one or more NF threadsl
@@ -101,10 +98,9 @@ type SGroup struct {
 	manager          *Instance
 	groupID          int
 	pcieIdx          int
-	isComplete       bool
-	isReady          bool
-	isActive         bool
-	isSched          bool
+	state            SGroupState
+	stateSince       time.Time
+	isOverloaded     bool
 	idleSampleCnt    int
 	instances        []*Instance
 	tids             []int32
@@ -117,9 +113,11 @@ type SGroup struct {
 	outQueueCapacity int
 	pktRateKpps      int
 	maxRateKpps      int
+	flowCount        int
 	worker           *Worker
 	coreID           int
 	dag              *DAG
+	chainIdx         int
 	mutex            sync.Mutex
 }
 
@@ -129,10 +127,8 @@ func newSGroup(w *Worker, pcieIdx int) *SGroup {
 	sg := SGroup{
 		groupID:          pcieIdx,
 		pcieIdx:          pcieIdx,
-		isComplete:       false,
-		isReady:          false,
-		isActive:         false,
-		isSched:          false,
+		state:            SGROUP_FREE,
+		stateSince:       time.Now(),
 		idleSampleCnt:    0,
 		instances:        make([]*Instance, 0),
 		tids:             make([]int32, 0),
@@ -145,9 +141,11 @@ func newSGroup(w *Worker, pcieIdx int) *SGroup {
 		outQueueCapacity: NIC_TX_QUEUE_LENGTH,
 		pktRateKpps:      0,
 		maxRateKpps:      800,
+		flowCount:        0,
 		worker:           w,
 		coreID:           kFaaSInvalidCoreID,
 		dag:              nil,
+		chainIdx:         -1,
 	}
 
 	isPrimary := true
@@ -156,7 +154,7 @@ func newSGroup(w *Worker, pcieIdx int) *SGroup {
 	vPortIncIdx := 0
 	vPortOutIdx := 0
 
-	ins, err := w.createInstance([]string{"prim"}, 0, pcieIdx, kFaaSStartCoreID, isPrimary, isIngress, isEgress, vPortIncIdx, vPortOutIdx)
+	ins, err := w.createInstance([]string{"prim"}, 0, pcieIdx, w.getStartupCore(pcieIdx), isPrimary, isIngress, isEgress, vPortIncIdx, vPortOutIdx)
 	if err != nil {
 		// Fail to create the head instance. Cleanup..
 		glog.Errorf("Failed to create Instance. %v", err)
@@ -185,8 +183,8 @@ func (sg *SGroup) String() string {
 		}
 	}
 	info += fmt.Sprintf("]\n")
-	info += fmt.Sprintf("    Info: id=%d, pcie=%s, core=%d\n", sg.groupID, sg.worker.pcie[sg.pcieIdx], sg.coreID)
-	info += fmt.Sprintf("    Status: rdy=%v, active=%v, sched=%v\n", sg.isReady, sg.isActive, sg.isSched)
+	info += fmt.Sprintf("    Info: id=%d, pcie=%s, core=%d, chain=%d\n", sg.groupID, sg.worker.pcie[sg.pcieIdx], sg.coreID, sg.chainIdx)
+	info += fmt.Sprintf("    Status: state=%s, sched=%v, flows=%d\n", sg.state, sg.isScheduled(), sg.flowCount)
 	info += fmt.Sprintf("    Performance: cycles=%d, batch=(size=%d, cnt=%d), (q=%d, qload=%d), (pps=%d kpps, pload=%d)", sg.sumCycles, sg.batchSize, sg.batchCount, sg.incQueueLength, qLoad, sg.pktRateKpps, pLoad)
 
 	return info
@@ -196,12 +194,42 @@ func (sg *SGroup) ID() int {
 	return sg.pcieIdx
 }
 
-// Destroys and removes all instances associaed with |sg|.
-func (sg *SGroup) Reset() {
+// Returns the CPU of the worker that runs |sg|.
+func (sg *SGroup) getCPU() cpuSpec {
+	if sg.worker == nil {
+		return cpuSpec{}
+	}
+	return sg.worker.cpu
+}
+
+// Returns the number of flows assigned to |sg|.
+func (sg *SGroup) GetFlowCount() int {
+	sg.mutex.Lock()
+	defer sg.mutex.Unlock()
+
+	return sg.flowCount
+}
+
+func (sg *SGroup) addFlowCount(delta int) {
 	sg.mutex.Lock()
 	defer sg.mutex.Unlock()
 
+	sg.flowCount += delta
+}
+
+// Destroys and removes all instances associaed with |sg|. Resets
+// |sg| to a free SGroup, so that it can serve a new NF chain. Returns
+// an error if |sg| is neither draining nor failed.
+func (sg *SGroup) Reset() error {
+	sg.mutex.Lock()
+	defer sg.mutex.Unlock()
+
+	if err := sg.setState(SGROUP_FREE); err != nil {
+		return err
+	}
+
 	for _, ins := range sg.instances {
+		sg.worker.insStartupPool.remove(ins.port)
 		err := sg.worker.destroyInstance(ins)
 		if err != nil {
 			glog.Errorf("Failed to remove Instance %s from SGroup %d. %v", ins.funcType, sg.ID(), err)
@@ -212,6 +240,13 @@ func (sg *SGroup) Reset() {
 	sg.instances = nil
 	sg.tids = nil
 	sg.dag = nil
+	sg.chainIdx = -1
+	sg.isOverloaded = false
+	sg.idleSampleCnt = 0
+	sg.coreID = kFaaSInvalidCoreID
+	sg.incQueueLength = 0
+	sg.pktRateKpps = 0
+	return nil
 }
 
 // Appends a new Instance |ins| to the end of this SGroup |sg|.
@@ -236,15 +271,15 @@ func (sg *SGroup) adjustRuntimeConfig() {
 	glog.Infof("Finish setting the runtime config for SGroup (w:%s, idx:%d)", sg.worker.name, sg.groupID)
 }
 
+// Sets the batch count of |sg| by profiled cycles when |sg| gets
+// ready. The count is adjusted by live stats later (see batch.go).
 func (sg *SGroup) adjustBatchCount() {
 	sumCycleCost := 0
 	for _, ins := range sg.instances {
 		sumCycleCost += ins.profiledCycle
 	}
 	nfCount := len(sg.instances)
-	cnt := 5100 * float64(nfCount+1) / float64(1/0.95-1) / float64(sumCycleCost) / float64(sg.batchSize)
-	sg.batchCount = int(math.Ceil(cnt))
-	//sg.batchCount = int(math.Pow(2, math.Ceil(math.Log2(cnt))))
+	sg.batchCount = sg.getCPU().minBatchCount(nfCount, sumCycleCost, sg.batchSize)
 
 	for _, ins := range sg.instances {
 		if err := ins.setBatch(sg.batchSize, sg.batchCount); err != nil {
@@ -265,7 +300,7 @@ func (sg *SGroup) preprocessBeforeReady() {
 	defer sg.mutex.Unlock()
 
 	// Ignore unnecessary and duplicated calls.
-	if !sg.isComplete || sg.isReady {
+	if sg.state != SGROUP_REGISTERING {
 		return
 	}
 
@@ -285,9 +320,9 @@ func (sg *SGroup) preprocessBeforeReady() {
 		sg.adjustRuntimeConfig()
 
 		if controllerOption == "metron" {
-			sg.isReady = true
-			sg.isActive = true
-			sg.isSched = true
+			if err := sg.setState(SGROUP_RUNNING); err != nil {
+				glog.Errorf("%v", err)
+			}
 			return
 		}
 
@@ -315,11 +350,19 @@ func (sg *SGroup) preprocessBeforeReady() {
 
 		time.Sleep(100 * time.Millisecond)
 
-		coreID := kFaaSIdleCoreID
-		if status, err := w.AttachChain(sg.tids, coreID); err != nil {
-			glog.Errorf("Failed to attach SGroup[%d] on core #1. %s", sg.ID(), err)
+		// Parks |sg| on the idle core: its NF threads are pinned to the
+		// core, but are not executed.
+		coreID := w.idleCoreID
+		if schedCoreID, err := w.coopSchedCore(coreID); err != nil {
+			glog.Errorf("Failed to attach SGroup[%d] on core #%d. %s", sg.ID(), coreID, err)
+		} else if status, err := w.AttachChain(sg.tids, schedCoreID); err != nil {
+			glog.Errorf("Failed to attach SGroup[%d] on core #%d. %s", sg.ID(), coreID, err)
 		} else if status.GetCode() != 0 {
 			glog.Errorf("AttachChain gRPC request errmsg: %s", status.GetErrmsg())
+		} else if status, err := w.DetachChain(sg.tids, schedCoreID); err != nil {
+			glog.Errorf("Failed to detach SGroup[%d] on core #%d. %s", sg.ID(), coreID, err)
+		} else if status.GetCode() != 0 {
+			glog.Errorf("DetachChain gRPC request errmsg: %s", status.GetErrmsg())
 		}
 
 		time.Sleep(100 * time.Millisecond)
@@ -333,47 +376,87 @@ func (sg *SGroup) preprocessBeforeReady() {
 
 		time.Sleep(100 * time.Millisecond)
 
-		sg.coreID = 1
-		sg.isReady = true
-		sg.isSched = true
+		sg.coreID = coreID
+		if err := sg.setState(SGROUP_PARKED); err != nil {
+			glog.Errorf("%v", err)
+		}
 	}
 }
 
+// Returns true if NF threads of |sg| have been registered at
+// CooperativeSched.
+func (sg *SGroup) hasChain() bool {
+	sg.mutex.Lock()
+	defer sg.mutex.Unlock()
+
+	return len(sg.tids) > 0
+}
+
 // Returns true if all instances are ready to be scheduled.
 func (sg *SGroup) IsReady() bool {
 	sg.mutex.Lock()
 	defer sg.mutex.Unlock()
 
-	return sg.isReady
+	return sg.state.isReady()
 }
 
+// Returns true if |sg| is serving traffic, i.e. packets are coming
+// into its NIC queue.
 func (sg *SGroup) IsActive() bool {
 	sg.mutex.Lock()
 	defer sg.mutex.Unlock()
 
-	return sg.isActive
+	return sg.state == SGROUP_RUNNING
+}
+
+// Returns true if |sg| is scheduled on a core, i.e. CooperativeSched
+// executes its NF threads on core |sg.coreID|. A running, idle or
+// draining SGroup is scheduled on its core, unless the core is the
+// idle core, which only holds detached SGroups. |sg.mutex| must be
+// held.
+func (sg *SGroup) isScheduled() bool {
+	switch sg.state {
+	case SGROUP_RUNNING, SGROUP_IDLE, SGROUP_DRAINING:
+	default:
+		return false
+	}
+	if sg.coreID == kFaaSInvalidCoreID {
+		return false
+	}
+	return sg.worker == nil || sg.coreID != sg.worker.idleCoreID
 }
 
 func (sg *SGroup) IsSched() bool {
 	sg.mutex.Lock()
 	defer sg.mutex.Unlock()
 
-	return sg.isSched
+	return sg.isScheduled()
 }
 
 func (sg *SGroup) SetActive() {
 	sg.mutex.Lock()
 	defer sg.mutex.Unlock()
 
-	sg.isActive = true
+	if sg.state != SGROUP_RUNNING {
+		if err := sg.setState(SGROUP_RUNNING); err != nil {
+			glog.Errorf("Failed to turn SGroup[%d] active. %v", sg.ID(), err)
+			return
+		}
+		sg.worker.postSchedEvent(sg, SCHED_EVENT_ACTIVE)
+		if a := getAuditor(); a != nil {
+			a.record(sg.newAuditEvent(AUDIT_ACTIVE))
+		}
+	}
 	sg.idleSampleCnt = 0
 }
 
-func (sg *SGroup) SetSched(isSched bool) {
+// Returns true if |sg| is overloaded, i.e. its packet load is above
+// |kMaxCorePktLoad| or its queue load is above |kSchedMaxQLoad|.
+func (sg *SGroup) IsOverloaded() bool {
 	sg.mutex.Lock()
 	defer sg.mutex.Unlock()
 
-	sg.isSched = isSched
+	return sg.getPktLoad() > kMaxCorePktLoad || sg.getQLoad() > kSchedMaxQLoad
 }
 
 // TODO (Jianfeng): trigger extra scaling operations.
@@ -383,6 +466,8 @@ func (sg *SGroup) SetSched(isSched bool) {
 // * Estimates the max packet rate with the context switching overhead.
 // * Marks |sg| active if there are packets in its NIC queue, and
 // marks inactive if it has zero traffic rate and zero queue length.
+// * Posts a scheduling event to its worker if |sg| turns active or
+// idle, or crosses the overload threshold.
 func (sg *SGroup) UpdateTrafficInfo() {
 	sg.mutex.Lock()
 	defer sg.mutex.Unlock()
@@ -399,24 +484,51 @@ func (sg *SGroup) UpdateTrafficInfo() {
 
 		// Calculates the max rate without context switching.
 		if sg.sumCycles > 0 {
-			sg.maxRateKpps = 1700000 / (sg.sumCycles + 5100*(nfCount+1)/(sg.batchSize*sg.batchCount))
+			sg.maxRateKpps = sg.getCPU().maxPktRate(nfCount, sg.sumCycles, sg.batchSize*sg.batchCount)
 		}
 	}
 
-	if sg.isActive {
+	wasActive := sg.state == SGROUP_RUNNING
+	if wasActive {
 		if sg.pktRateKpps == 0 {
 			if !SupportQueueLength || (SupportQueueLength && sg.incQueueLength == 0) {
 				sg.idleSampleCnt += 1
-				if sg.isActive && sg.idleSampleCnt >= MIN_IDLE_DURATION {
-					sg.isActive = false
+				if sg.idleSampleCnt >= MIN_IDLE_DURATION {
+					if err := sg.setState(SGROUP_IDLE); err != nil {
+						glog.Errorf("Failed to turn SGroup[%d] idle. %v", sg.ID(), err)
+					}
 				}
 			}
 		}
-	} else {
+	} else if sg.state.isReady() {
 		if SupportQueueLength && sg.incQueueLength > 0 {
-			sg.isActive = true
+			if err := sg.setState(SGROUP_RUNNING); err != nil {
+				glog.Errorf("Failed to turn SGroup[%d] active. %v", sg.ID(), err)
+			} else {
+				sg.idleSampleCnt = 0
+			}
 		}
 	}
+	isActive := sg.state == SGROUP_RUNNING
+
+	wasOverloaded := sg.isOverloaded
+	sg.isOverloaded = sg.getPktLoad() > kMaxCorePktLoad || sg.getQLoad() > kSchedMaxQLoad
+
+	if !wasActive && isActive {
+		sg.worker.postSchedEvent(sg, SCHED_EVENT_ACTIVE)
+		if a := getAuditor(); a != nil {
+			a.record(sg.newAuditEvent(AUDIT_ACTIVE))
+		}
+	} else if wasActive && !isActive {
+		sg.worker.postSchedEvent(sg, SCHED_EVENT_IDLE)
+		if a := getAuditor(); a != nil {
+			a.record(sg.newAuditEvent(AUDIT_IDLE))
+		}
+	} else if !wasOverloaded && sg.isOverloaded {
+		sg.worker.postSchedEvent(sg, SCHED_EVENT_OVERLOAD)
+	} else if wasOverloaded && !sg.isOverloaded {
+		sg.worker.postSchedEvent(sg, SCHED_EVENT_UNDERLOAD)
+	}
 }
 
 func (sg *SGroup) GetCycles() int {
@@ -497,7 +609,8 @@ func (sg *SGroup) getPktLoad() int {
 
 // Migrates/Schedules a SGroup with |groupId| to core |coreId|.
 func (sg *SGroup) attachSGroup(coreID int) error {
-	if sg.GetCoreID() == coreID && sg.IsSched() {
+	prevCoreID, wasSched := sg.GetCoreID(), sg.IsSched()
+	if prevCoreID == coreID && wasSched {
 		// Returns if |sg| is scheduled by |coreID| now.
 		return nil
 	}
@@ -508,26 +621,25 @@ func (sg *SGroup) attachSGroup(coreID int) error {
 	}
 
 	sg.SetCoreID(coreID)
-	sg.SetSched(true)
 	glog.Infof("SGroup[%d] runs on W %s Core[%d]", sg.ID(), sg.worker.name, coreID)
+	sg.worker.auditAttach(sg, prevCoreID, wasSched)
 	return nil
 }
 
+// Detaches |sg| on its core. Callers make sure that |sg| is attached,
+// e.g. it has just moved to the idle core. |sg| is no longer scheduled
+// once it is parked on the idle core, or is removed from its core.
 func (sg *SGroup) detachSGroup() error {
 	if sg.GetCoreID() == kFaaSInvalidCoreID {
 		return fmt.Errorf("SGroup[%d] is not running", sg.ID())
 	}
-	if !sg.IsSched() {
-		// Returns if |sg| has already detached.
-		return nil
-	}
 
 	// Detaches |sg| from its running Core.
 	if err := sg.worker.detachSGroup(sg); err != nil {
 		return err
 	}
 
-	sg.SetSched(false)
 	glog.Infof("SGroup[%d] is detached on W %s Core[%d]", sg.ID(), sg.worker.name, sg.GetCoreID())
+	sg.worker.auditDetach(sg)
 	return nil
 }
@@ -0,0 +1,232 @@
+package controller
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	glog "github.com/golang/glog"
+)
+
+// This is the place to define the lifecycle of SGroups.
+// An SGroup is always in one |SGroupState|. It moves between states
+// only along the edges in |kSGroupTransitions|. Illegal transitions
+// are rejected with errors. Each transition is published to
+// subscribers (e.g. FaaSLogger and CLI) as a |SGroupStateEvent|.
+//
+// free -> instantiating -> registering -> parked <-> running <-> idle
+//                                              (metron) -> running
+// Live SGroups go to draining before they are reset to free. Failed
+// startups go to failed before they are reset to free. A free SGroup
+// is destroyed when its NIC queue is released.
+// Whether CooperativeSched executes an SGroup also follows its state:
+// a parked SGroup is detached on the idle core, and a running, idle or
+// draining SGroup runs on its core unless it is on the idle core.
+
+// |SGroupState| is the lifecycle state of an SGroup.
+type SGroupState int
+
+const (
+	// A free SGroup owns a NIC queue, but runs no NFs.
+	SGROUP_FREE SGroupState = iota
+	// NF instances of a chain are being created.
+	SGROUP_INSTANTIATING
+	// All NF instances are created, and are registering at
+	// CooperativeSched.
+	SGROUP_REGISTERING
+	// Ready, but gets no traffic. It is parked on the idle core.
+	SGROUP_PARKED
+	// Ready, and serves traffic.
+	SGROUP_RUNNING
+	// Ready, and has got no traffic for a while. It still runs on
+	// its core until the scheduler parks it.
+	SGROUP_IDLE
+	// Being released from its DAG.
+	SGROUP_DRAINING
+	// Failed to start up.
+	SGROUP_FAILED
+	// Its NIC queue has been released.
+	SGROUP_DESTROYED
+)
+
+func (s SGroupState) String() string {
+	switch s {
+	case SGROUP_FREE:
+		return "free"
+	case SGROUP_INSTANTIATING:
+		return "instantiating"
+	case SGROUP_REGISTERING:
+		return "registering"
+	case SGROUP_PARKED:
+		return "parked"
+	case SGROUP_RUNNING:
+		return "running"
+	case SGROUP_IDLE:
+		return "idle"
+	case SGROUP_DRAINING:
+		return "draining"
+	case SGROUP_FAILED:
+		return "failed"
+	case SGROUP_DESTROYED:
+		return "destroyed"
+	default:
+		return fmt.Sprintf("%d", int(s))
+	}
+}
+
+// Returns true if an SGroup in state |s| is ready to serve traffic,
+// i.e. its NF threads are managed by CooperativeSched.
+func (s SGroupState) isReady() bool {
+	return s == SGROUP_PARKED || s == SGROUP_RUNNING || s == SGROUP_IDLE
+}
+
+// |kSGroupTransitions| are legal transitions between SGroup states.
+var kSGroupTransitions = map[SGroupState][]SGroupState{
+	SGROUP_FREE:          {SGROUP_INSTANTIATING, SGROUP_DESTROYED},
+	SGROUP_INSTANTIATING: {SGROUP_REGISTERING, SGROUP_DRAINING, SGROUP_FAILED},
+	SGROUP_REGISTERING:   {SGROUP_PARKED, SGROUP_RUNNING, SGROUP_DRAINING, SGROUP_FAILED},
+	SGROUP_PARKED:        {SGROUP_RUNNING, SGROUP_DRAINING},
+	SGROUP_RUNNING:       {SGROUP_IDLE, SGROUP_DRAINING},
+	SGROUP_IDLE:          {SGROUP_RUNNING, SGROUP_PARKED, SGROUP_DRAINING},
+	SGROUP_DRAINING:      {SGROUP_FREE, SGROUP_FAILED},
+	SGROUP_FAILED:        {SGROUP_FREE, SGROUP_DESTROYED},
+	SGROUP_DESTROYED:     {},
+}
+
+// Returns true if an SGroup can move from state |from| to |to|.
+// Staying in the same state is always allowed.
+func canTransition(from SGroupState, to SGroupState) bool {
+	if from == to {
+		return true
+	}
+	for _, s := range kSGroupTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// |SGroupStateEvent| is a transition of SGroup |SGroup| on |Worker|
+// from state |From| to state |To|.
+type SGroupStateEvent struct {
+	Time   time.Time
+	Worker string
+	SGroup int
+	From   SGroupState
+	To     SGroupState
+}
+
+func (e SGroupStateEvent) String() string {
+	return fmt.Sprintf("%s SGroup[%d] on worker[%s]: %s -> %s", e.Time.Format("15:04:05.000"), e.SGroup, e.Worker, e.From, e.To)
+}
+
+// |sgroupStateBus| publishes |SGroupStateEvent|s to subscribers.
+// |subscribers| are channels of subscribers indexed by their IDs.
+// |mutex| protects all fields.
+type sgroupStateBus struct {
+	subscribers map[int]chan<- SGroupStateEvent
+	nextID      int
+	mutex       sync.Mutex
+}
+
+// The bus of state transitions of all SGroups.
+var sgroupStates = &sgroupStateBus{subscribers: make(map[int]chan<- SGroupStateEvent)}
+
+// Subscribes |ch| to all transitions. Returns the function that
+// unsubscribes |ch|.
+func (b *sgroupStateBus) subscribe(ch chan<- SGroupStateEvent) func() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	id := b.nextID
+	b.nextID += 1
+	b.subscribers[id] = ch
+	return func() {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+
+		delete(b.subscribers, id)
+	}
+}
+
+// Publishes |e| to all subscribers. Never blocks. If the channel of
+// a subscriber is full, the event is dropped for the subscriber.
+func (b *sgroupStateBus) publish(e SGroupStateEvent) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Subscribes |ch| to state transitions of all SGroups. Transitions
+// are dropped if |ch| is full. Returns the function that unsubscribes
+// |ch|.
+func (c *FaaSController) SubscribeSGroupStates(ch chan<- SGroupStateEvent) func() {
+	return sgroupStates.subscribe(ch)
+}
+
+// Moves |sg| to state |to|, and publishes the transition. Returns an
+// error if the transition is illegal. |sg.mutex| must be held.
+func (sg *SGroup) setState(to SGroupState) error {
+	from := sg.state
+	if !canTransition(from, to) {
+		return fmt.Errorf("SGroup[%d] cannot move from %s to %s", sg.ID(), from, to)
+	}
+	if from == to {
+		return nil
+	}
+
+	sg.state = to
+	sg.stateSince = time.Now()
+	e := SGroupStateEvent{Time: sg.stateSince, SGroup: sg.ID(), From: from, To: to}
+	if sg.worker != nil {
+		e.Worker = sg.worker.name
+	}
+	glog.V(1).Infof("%s", e)
+	sgroupStates.publish(e)
+	return nil
+}
+
+// Moves |sg| to state |to|. Returns an error if the transition is
+// illegal.
+func (sg *SGroup) SetState(to SGroupState) error {
+	sg.mutex.Lock()
+	defer sg.mutex.Unlock()
+
+	return sg.setState(to)
+}
+
+// Returns the state of |sg|.
+func (sg *SGroup) GetState() SGroupState {
+	sg.mutex.Lock()
+	defer sg.mutex.Unlock()
+
+	return sg.state
+}
+
+// Returns the time that |sg| entered its current state.
+func (sg *SGroup) getStateSince() time.Time {
+	sg.mutex.Lock()
+	defer sg.mutex.Unlock()
+
+	return sg.stateSince
+}
+
+// Moves a live |sg| to draining before it is reset. Does nothing if
+// |sg| is free, failed or draining.
+func (sg *SGroup) beginDrain() error {
+	sg.mutex.Lock()
+	defer sg.mutex.Unlock()
+
+	switch sg.state {
+	case SGROUP_FREE, SGROUP_FAILED, SGROUP_DRAINING:
+		return nil
+	}
+	return sg.setState(SGROUP_DRAINING)
+}
@@ -0,0 +1,103 @@
+package controller
+
+import (
+	"testing"
+)
+
+// Tests of SGroup state transitions.
+func TestSGroupStates(t *testing.T) {
+	events := make(chan SGroupStateEvent, 16)
+	unsubscribe := sgroupStates.subscribe(events)
+	defer unsubscribe()
+
+	w := newSchedTestWorker(3)
+	sg := &SGroup{worker: w, pcieIdx: 4}
+
+	// A free SGroup starts up, serves traffic and is released.
+	path := []SGroupState{SGROUP_INSTANTIATING, SGROUP_REGISTERING, SGROUP_PARKED, SGROUP_RUNNING, SGROUP_IDLE, SGROUP_PARKED, SGROUP_DRAINING}
+	for _, s := range path {
+		if err := sg.SetState(s); err != nil {
+			t.Fatalf("Failed to move to %s: %v", s, err)
+		}
+	}
+	if err := sg.Reset(); err != nil || sg.GetState() != SGROUP_FREE {
+		t.Errorf("Failed to reset a draining SGroup: %v", err)
+	}
+
+	from := SGROUP_FREE
+	for _, to := range append(path, SGROUP_FREE) {
+		select {
+		case e := <-events:
+			if e.Worker != "node1" || e.SGroup != 4 || e.From != from || e.To != to {
+				t.Errorf("Expect %s -> %s, got %s", from, to, e)
+			}
+		default:
+			t.Fatalf("Missing the transition %s -> %s", from, to)
+		}
+		from = to
+	}
+
+	// Illegal transitions are rejected, and are not published.
+	if err := sg.SetState(SGROUP_RUNNING); err == nil || sg.GetState() != SGROUP_FREE {
+		t.Errorf("Moved a free SGroup to running")
+	}
+	sg.SetActive()
+	if sg.IsActive() {
+		t.Errorf("Turned a free SGroup active")
+	}
+	if err := sg.SetState(SGROUP_FREE); err != nil {
+		t.Errorf("Failed to stay in the same state: %v", err)
+	}
+	sg.SetState(SGROUP_DESTROYED)
+	if err := sg.Reset(); err == nil {
+		t.Errorf("Reset a destroyed SGroup")
+	}
+	if n := len(events); n != 1 {
+		t.Errorf("Expect 1 transition, got %d", n)
+	}
+
+	// Live SGroups drain before they are reset.
+	sg = &SGroup{worker: w, state: SGROUP_RUNNING, coreID: kFaaSInvalidCoreID}
+	if err := sg.Reset(); err == nil {
+		t.Errorf("Reset a running SGroup")
+	}
+	if err := w.destroySGroup(sg); err != nil || sg.GetState() != SGROUP_FREE {
+		t.Errorf("Failed to destroy a running SGroup: %v", err)
+	}
+}
+
+// Tests that whether an SGroup is scheduled follows its state and core.
+func TestSGroupScheduled(t *testing.T) {
+	var log []string
+	w := newSchedTestWorker(3)
+	w.coopSched = &testCoopSched{log: &log}
+
+	cases := []struct {
+		state  SGroupState
+		coreID int
+		sched  bool
+	}{
+		{SGROUP_RUNNING, 2, true},
+		{SGROUP_IDLE, 2, true},
+		{SGROUP_DRAINING, 2, true},
+		{SGROUP_RUNNING, w.idleCoreID, false},
+		{SGROUP_PARKED, w.idleCoreID, false},
+		{SGROUP_RUNNING, kFaaSInvalidCoreID, false},
+		{SGROUP_INSTANTIATING, 2, false},
+	}
+	for _, c := range cases {
+		sg := &SGroup{worker: w, state: c.state, coreID: c.coreID}
+		if sg.IsSched() != c.sched {
+			t.Errorf("Expect a %s SGroup on core #%d scheduled=%v", c.state, c.coreID, c.sched)
+		}
+	}
+
+	// An idle SGroup is detached on the idle core, and is parked.
+	sg := newSchedTestSGroup(w, 0, 0, 2)
+	sg.state = SGROUP_IDLE
+	w.cores[2].addSGroup(sg)
+	w.parkIdleSGroup(sg)
+	if sg.GetState() != SGROUP_PARKED || sg.IsSched() || len(log) != 2 || log[0] != "attach 1" || log[1] != "detach 1" {
+		t.Errorf("Failed to park SGroup[%d]: state=%s, requests=%v", sg.ID(), sg.GetState(), log)
+	}
+}
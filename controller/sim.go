@@ -0,0 +1,214 @@
+package controller
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	pb "github.com/USC-NSL/Low-Latency-FaaS/proto"
+)
+
+// This is the place to run workers in simulation.
+// A simulated worker runs the same scheduling policies and migration
+// governor as a real worker. CooperativeSched is replaced by an
+// in-memory fake, and SGroups are created ready without Kubernetes.
+// The simulator (see package simulator) feeds per-instance stats to
+// SGroups, and runs scheduling rounds on a simulated clock.
+
+// |SimClock| is a simulated clock. It only moves forward when the
+// simulator advances it.
+type SimClock struct {
+	now   time.Time
+	mutex sync.Mutex
+}
+
+func NewSimClock() *SimClock {
+	return &SimClock{now: time.Unix(0, 0)}
+}
+
+func (c *SimClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.now
+}
+
+func (c *SimClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+// |simCoopSched| is an in-memory CooperativeSched. Each request takes
+// |latency| on |clock|.
+type simCoopSched struct {
+	clock   *SimClock
+	latency time.Duration
+}
+
+func (s *simCoopSched) AttachChain(tids []int32, core int) (*pb.Error, error) {
+	s.clock.Advance(s.latency)
+	return &pb.Error{}, nil
+}
+
+func (s *simCoopSched) DetachChain(tids []int32, core int) (*pb.Error, error) {
+	s.clock.Advance(s.latency)
+	return &pb.Error{}, nil
+}
+
+func (s *simCoopSched) RemoveChain(tids []int32) (*pb.Error, error) {
+	s.clock.Advance(s.latency)
+	return &pb.Error{}, nil
+}
+
+// Creates a simulated worker with Core #1 ~ #|coreNum|, where Core #1
+// is the idle core. The worker runs scheduling |policy|, and each
+// attach/detach request to its CooperativeSched takes |latency| on
+// |clock|.
+func NewSimWorker(name string, coreNum int, policy string, clock *SimClock, latency time.Duration) (*Worker, error) {
+	schedPolicy, err := newSchedulingPolicy(policy)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Worker{
+		name:        name,
+		ip:          "127.0.0.1",
+		cores:       make(map[int]*Core),
+		idleCoreID:  1,
+		sgroups:     make([]*SGroup, 0),
+		freeSGroups: make([]*SGroup, 0),
+		schedPolicy: schedPolicy,
+		migrations:  newMigrationGovernor(),
+		coopSched:   &simCoopSched{clock: clock, latency: latency},
+	}
+	w.migrations.now = clock.Now
+
+	for coreID := 1; coreID <= coreNum; coreID++ {
+		w.cores[coreID] = NewCore(coreID, -1)
+	}
+	return w, nil
+}
+
+// Creates a ready SGroup |groupID| of |nfCount| NFs on simulated
+// worker |w|. Like a real SGroup after it gets ready, the SGroup is
+// parked on the idle core, and is not active.
+func (w *Worker) NewSimSGroup(groupID int, nfCount int) *SGroup {
+	sg := &SGroup{
+		groupID:          groupID,
+		pcieIdx:          groupID,
+		state:            SGROUP_PARKED,
+		instances:        make([]*Instance, 0, nfCount),
+		tids:             make([]int32, 0, nfCount),
+		batchSize:        32,
+		batchCount:       1,
+		incQueueCapacity: NIC_RX_QUEUE_LENGTH,
+		outQueueCapacity: NIC_TX_QUEUE_LENGTH,
+		maxRateKpps:      800,
+		worker:           w,
+		coreID:           w.idleCoreID,
+		chainIdx:         -1,
+	}
+	for i := 0; i < nfCount; i++ {
+		ins := newInstance(fmt.Sprintf("nf%d", i), i == 0, i == nfCount-1, 0, w.ip, 0, "")
+		ins.sg = sg
+		ins.tid = groupID*nfCount + i
+		sg.instances = append(sg.instances, ins)
+		sg.tids = append(sg.tids, int32(ins.tid))
+	}
+
+	w.sgMutex.Lock()
+	defer w.sgMutex.Unlock()
+
+	w.sgroups = append(w.sgroups, sg)
+	w.cores[w.idleCoreID].addSGroup(sg)
+	return sg
+}
+
+// Feeds stats of instance |idx| to |sg|. |qlen|, |kpps| and |cycle|
+// are the same stats that instances report to FaaSController.
+func (sg *SGroup) SimUpdateInstance(idx int, qlen int, kpps int, cycle int) {
+	if idx < 0 || idx >= len(sg.instances) {
+		return
+	}
+	sg.instances[idx].UpdateTrafficInfo(qlen, kpps, cycle)
+}
+
+// Updates traffic info of |sg| after all instances have reported
+// their stats. An inactive SGroup with traffic becomes active, as if
+// FaaSController had assigned a new flow to it.
+func (sg *SGroup) SimUpdateTrafficInfo() {
+	sg.UpdateTrafficInfo()
+	if !sg.IsActive() && (sg.GetPktRate() > 0 || sg.GetQlen() > 0) {
+		sg.SetActive()
+	}
+}
+
+// Returns the estimated max packet rate of |sg|.
+func (sg *SGroup) GetMaxPktRate() int {
+	sg.mutex.Lock()
+	defer sg.mutex.Unlock()
+
+	return sg.maxRateKpps
+}
+
+// Returns the core that runs |sg|. Returns -1 if |sg| is not running,
+// or is running on the idle core.
+func (sg *SGroup) SimRunningCore() int {
+	sg.mutex.Lock()
+	defer sg.mutex.Unlock()
+
+	if !sg.isScheduled() {
+		return -1
+	}
+	return sg.coreID
+}
+
+// |SimLoadBalancer| assigns new flows to simulated SGroups with the
+// same load-balancing policies and thresholds as DAGs.
+type SimLoadBalancer struct {
+	lb LoadBalancer
+	th LBThresholds
+}
+
+// Creates a simulated load balancer that runs load-balancing |policy|
+// with thresholds |th|. Zero thresholds take their default values.
+func NewSimLoadBalancer(policy string, th LBThresholds) (*SimLoadBalancer, error) {
+	lb, err := newLoadBalancer(policy)
+	if err != nil {
+		return nil, err
+	}
+	return &SimLoadBalancer{lb: lb, th: th.withDefaults()}, nil
+}
+
+func (s *SimLoadBalancer) String() string {
+	return fmt.Sprintf("%s (%s)", s.lb.Name(), s.th)
+}
+
+// Picks the SGroup among |sgroups| to serve new flow |flowID|. Returns
+// nil if no SGroups can take the flow, i.e. the flow triggers a
+// scale-up event.
+func (s *SimLoadBalancer) Select(sgroups []*SGroup, flowID int) *SGroup {
+	if len(sgroups) == 0 {
+		return nil
+	}
+	k := flowKey{"10.0.0.1", "10.0.0.2", uint32(flowID), 80, 6}
+	return s.lb.Select(sgroups, k, s.th)
+}
+
+// Runs a scheduling round on simulated worker |w|.
+func (w *Worker) SimScheduleOnce() {
+	w.sgMutex.Lock()
+	defer w.sgMutex.Unlock()
+
+	w.schedPolicy.ScheduleOnce(w)
+}
+
+// Returns the number of migrations done and suppressed on |w|.
+func (w *Worker) MigrationCounts() (int, int) {
+	w.sgMutex.Lock()
+	defer w.sgMutex.Unlock()
+
+	return w.migrations.done, w.migrations.suppressed
+}
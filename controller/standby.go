@@ -0,0 +1,164 @@
+package controller
+
+import (
+	"time"
+
+	glog "github.com/golang/glog"
+)
+
+// This is the place to hide NF cold starts with standby SGroups.
+// On a scale-up miss, a free SGroup still has to start all NF pods
+// of a chain before it serves traffic. A DAG may declare a number of
+// standby SGroups that run its chains, and are registered at
+// CooperativeSched and parked on the idle core, but get no traffic.
+// A scale-up claims a standby SGroup of the chain first, and the
+// controller rebuilds standby SGroups in the background.
+
+// The period (in milliseconds) of rebuilding standby SGroups.
+const kStandbyPeriod = 1000
+
+// Returns the number of standby SGroups declared by |g|.
+func (g *DAG) getStandbyTarget() int {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	return g.standbyTarget
+}
+
+// Sets the number of standby SGroups of |g| to |n|. Extra standby
+// SGroups are kept until they are claimed or |g| is deactivated.
+func (g *DAG) setStandbyTarget(n int) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.standbyTarget = n
+}
+
+// Returns a copy of |g|'s standby SGroups.
+func (g *DAG) getStandbySGroups() []*SGroup {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	standbys := make([]*SGroup, len(g.standbys))
+	copy(standbys, g.standbys)
+	return standbys
+}
+
+// Returns the number of standby SGroups that |g| lacks.
+func (g *DAG) countMissingStandbys() int {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if !g.isActive || len(g.chains) == 0 {
+		return 0
+	}
+	return g.standbyTarget - len(g.standbys)
+}
+
+// Adds a free SGroup |sg| that is going to run |g.chains[chainIdx]|
+// to |g|'s standby SGroups if |g| lacks standby SGroups. Returns
+// true if |sg| is added.
+func (g *DAG) reserveStandby(sg *SGroup, chainIdx int) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if !g.isActive || len(g.standbys) >= g.standbyTarget {
+		return false
+	}
+	g.standbys = append(g.standbys, sg)
+	sg.dag = g
+	sg.chainIdx = chainIdx
+	return true
+}
+
+// Moves a standby SGroup of |g| that runs |g.chains[chainIdx]| to
+// |g|'s active |sgroups|. Prefers ready SGroups to starting ones.
+// Returns nil if |g| has no standby SGroups of the chain, or reaches
+// its max SGroups.
+func (g *DAG) claimStandby(chainIdx int) *SGroup {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if g.maxSGroups > 0 && len(g.sgroups) >= g.maxSGroups {
+		return nil
+	}
+
+	selected := -1
+	for i, sg := range g.standbys {
+		if sg.chainIdx != chainIdx {
+			continue
+		}
+		if sg.IsReady() {
+			selected = i
+			break
+		}
+		if selected == -1 {
+			selected = i
+		}
+	}
+	if selected == -1 {
+		return nil
+	}
+
+	sg := g.standbys[selected]
+	g.standbys = append(g.standbys[:selected], g.standbys[selected+1:]...)
+	g.sgroups = append(g.sgroups, sg)
+	return sg
+}
+
+// Starts standby SGroups of |dag| at free SGroups until |dag| has
+// enough standby SGroups. Standby SGroups spread among all chains of
+// |dag|. Returns the number of standby SGroups being started.
+// Called only by |runStandbys|.
+func (c *FaaSController) replenishStandbys(dag *DAG) int {
+	started := 0
+	for dag.countMissingStandbys() > 0 {
+		sg := c.getFreeSGroup()
+		if sg == nil {
+			glog.V(1).Infof("No free SGroups for standby SGroups of user [%s]", dag.user)
+			break
+		}
+
+		chainIdx := dag.nextChain()
+		if !dag.reserveStandby(sg, chainIdx) {
+			// |dag| has been deactivated, or has got enough
+			// standby SGroups. Returns |sg| to its worker.
+			sg.worker.putFreeSGroup(sg)
+			break
+		}
+
+		glog.Infof("SGroup[%d] on worker[%s] stands by for user [%s]", sg.ID(), sg.worker.name, dag.user)
+		go sg.worker.createSGroup(sg, dag, chainIdx)
+		started += 1
+	}
+	return started
+}
+
+// Wakes up |runStandbys|. Never blocks.
+func (c *FaaSController) notifyStandbys() {
+	select {
+	case c.standbyOp <- FREE_SGROUP:
+	default:
+	}
+}
+
+// Long-running Go-routine function. Rebuilds standby SGroups of all
+// DAGs when it is notified, and every |kStandbyPeriod|.
+func (c *FaaSController) runStandbys() {
+	ticker := time.NewTicker(kStandbyPeriod * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case op := <-c.standbyOp:
+			if op == SHUTDOWN {
+				return
+			}
+		case <-ticker.C:
+		}
+
+		for _, dag := range c.getDAGs() {
+			c.replenishStandbys(dag)
+		}
+	}
+}
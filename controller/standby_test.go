@@ -0,0 +1,54 @@
+package controller
+
+import (
+	"testing"
+)
+
+// Tests of claiming standby SGroups on scale-ups.
+func TestStandbyClaim(t *testing.T) {
+	c, dag := newAdmissionTestController("u")
+	w := newSchedTestWorker(3)
+
+	// |dag| takes at most one standby SGroup.
+	dag.setStandbyTarget(1)
+	starting := newSchedTestSGroup(w, 1, 0, kFaaSInvalidCoreID)
+	starting.state = SGROUP_INSTANTIATING
+	ready := newSchedTestSGroup(w, 2, 0, w.idleCoreID)
+	ready.state = SGROUP_PARKED
+	if !dag.reserveStandby(starting, 0) {
+		t.Fatalf("Failed to reserve a standby SGroup")
+	}
+	if dag.reserveStandby(ready, 0) || dag.countMissingStandbys() != 0 {
+		t.Errorf("Reserved more standby SGroups than the target")
+	}
+	dag.setStandbyTarget(2)
+	dag.reserveStandby(ready, 0)
+
+	// A scale-up claims the ready standby SGroup first, and turns it
+	// active.
+	if _, _, err := c.UpdateFlow("10.1.0.1", "10.0.0.1", 1, 8080, 6); err != nil {
+		t.Fatalf("Failed to assign a flow: %v", err)
+	}
+	if sgroups := dag.getSGroups(); len(sgroups) != 1 || sgroups[0] != ready || !ready.IsActive() {
+		t.Errorf("Expect the ready standby SGroup to serve the flow")
+	}
+	if standbys := dag.getStandbySGroups(); len(standbys) != 1 || standbys[0] != starting {
+		t.Errorf("Expect the starting SGroup to stand by")
+	}
+	if dag.countMissingStandbys() != 1 {
+		t.Errorf("Expect a missing standby SGroup after a claim")
+	}
+
+	// Claims respect the max SGroups of |dag|.
+	dag.setScaling(0, 1)
+	if sg := dag.claimStandby(0); sg != nil {
+		t.Errorf("Claimed SGroup[%d] over the max SGroups", sg.ID())
+	}
+
+	// Deactivated DAGs take no standby SGroups.
+	dag.removeSGroup(starting)
+	dag.setActive(false)
+	if dag.countMissingStandbys() != 0 || dag.reserveStandby(starting, 0) {
+		t.Errorf("Reserved a standby SGroup for an inactive DAG")
+	}
+}
@@ -11,17 +11,28 @@ import (
 
 const (
 	kMeasurementDurationMS = 500
+
+	// The number of SGroup transitions buffered between two
+	// measurements.
+	kMeasureStateEventBufferSize = 1024
 )
 
+// |crossNUMA| is the number of running SGroups on cores of other NUMA
+// nodes than their PCIe VFs.
 type snapshot struct {
-	ts      time.Time
-	coreCnt int64
-	pktRate int64
+	ts        time.Time
+	coreCnt   int64
+	pktRate   int64
+	crossNUMA int64
 }
 
+// |states| receives SGroup transitions, and |transitions| counts
+// transitions into each state in the current log.
 type FaaSLogger struct {
 	ctl           *FaaSController
 	snapshotStore []*snapshot
+	states        chan SGroupStateEvent
+	transitions   map[SGroupState]int
 	// The current log info
 	logOn        bool
 	logIndex     int
@@ -30,6 +41,7 @@ type FaaSLogger struct {
 	testDuration time.Duration
 	avgCoreUsage float64
 	maxCoreUsage int64
+	maxCrossNUMA int64
 	idleCounter  int
 	state        int
 	sgMutex      sync.Mutex
@@ -39,6 +51,8 @@ func NewFaaSLogger(c *FaaSController) *FaaSLogger {
 	return &FaaSLogger{
 		ctl:           c,
 		snapshotStore: make([]*snapshot, 0),
+		states:        make(chan SGroupStateEvent, kMeasureStateEventBufferSize),
+		transitions:   make(map[SGroupState]int),
 		logOn:         false,
 		logIndex:      0,
 		logStartTime:  time.Now(),
@@ -55,8 +69,12 @@ func (l *FaaSLogger) RunFaaSLogger() {
 	l.state = 0
 	l.sgMutex.Unlock()
 
+	unsubscribe := l.ctl.SubscribeSGroupStates(l.states)
+	defer unsubscribe()
+
 	for {
 		s := l.ctl.getSnapshotSummary()
+		l.countTransitions()
 
 		if !l.logOn {
 			if s.coreCnt > 0 || s.pktRate > 0 {
@@ -68,7 +86,9 @@ func (l *FaaSLogger) RunFaaSLogger() {
 				l.snapshotStore = nil
 				l.avgCoreUsage = 0
 				l.maxCoreUsage = 0
+				l.maxCrossNUMA = 0
 				l.idleCounter = 0
+				l.transitions = make(map[SGroupState]int)
 			}
 		}
 
@@ -103,6 +123,18 @@ func (l *FaaSLogger) RunFaaSLogger() {
 	}
 }
 
+// Counts SGroup transitions received since the last call.
+func (l *FaaSLogger) countTransitions() {
+	for {
+		select {
+		case e := <-l.states:
+			l.transitions[e.To] += 1
+		default:
+			return
+		}
+	}
+}
+
 func (l *FaaSLogger) StopFaaSLogger() {
 	l.sgMutex.Lock()
 	l.state = 1
@@ -131,13 +163,19 @@ func (l *FaaSLogger) WriteResultsToFile() error {
 	fmt.Fprintf(f, "Duration = %d millisecond\n", int64(l.testDuration/time.Millisecond))
 	fmt.Fprintf(f, "avg cores = %v\n", l.avgCoreUsage)
 	fmt.Fprintf(f, "max cores = %d\n", l.maxCoreUsage)
+	fmt.Fprintf(f, "max cross-NUMA SGroups = %d\n", l.maxCrossNUMA)
+	fmt.Fprintf(f, "SGroup transitions =")
+	for s := SGROUP_FREE; s <= SGROUP_DESTROYED; s++ {
+		fmt.Fprintf(f, " %s:%d", s, l.transitions[s])
+	}
+	fmt.Fprintf(f, "\n")
 	fmt.Fprintf(f, "-----------------------\n")
 	fmt.Fprintf(f, "------- Timeline ------\n")
 	fmt.Fprintf(f, "-----------------------\n")
 
 	start := l.snapshotStore[0].ts
 	for _, s := range l.snapshotStore {
-		fmt.Fprintf(f, "ts = %d, core = %d, rate: %d\n", int64(s.ts.Sub(start)), s.coreCnt, s.pktRate)
+		fmt.Fprintf(f, "ts = %d, core = %d, rate: %d, cross-NUMA: %d\n", int64(s.ts.Sub(start)), s.coreCnt, s.pktRate, s.crossNUMA)
 	}
 	return nil
 }
@@ -158,6 +196,9 @@ func (l *FaaSLogger) ComputeKeyMetrics() {
 		if curr.coreCnt > l.maxCoreUsage {
 			l.maxCoreUsage = curr.coreCnt
 		}
+		if curr.crossNUMA > l.maxCrossNUMA {
+			l.maxCrossNUMA = curr.crossNUMA
+		}
 		sumCoreTime += int64((curr.ts.Sub(prev.ts))/time.Millisecond) * curr.coreCnt
 		prev = curr
 	}
@@ -169,21 +210,24 @@ func (l *FaaSLogger) ComputeKeyMetrics() {
 func (c *FaaSController) getSnapshotSummary() *snapshot {
 	activeCores := 0
 	pktRate := 0
+	crossNUMA := 0
 	for _, w := range c.workers {
-		c, p := w.getPerWorkerSnapshotSummary()
+		c, p, n := w.getPerWorkerSnapshotSummary()
 		activeCores += c
 		pktRate += p
+		crossNUMA += n
 	}
 
 	return &snapshot{
-		ts:      time.Now(),
-		coreCnt: int64(activeCores),
-		pktRate: int64(pktRate),
+		ts:        time.Now(),
+		coreCnt:   int64(activeCores),
+		pktRate:   int64(pktRate),
+		crossNUMA: int64(crossNUMA),
 	}
 }
 
 // Measurement functions at the Worker.
-func (w *Worker) getPerWorkerSnapshotSummary() (int, int) {
+func (w *Worker) getPerWorkerSnapshotSummary() (int, int, int) {
 	// Stops all updates on Worker |w| temporally.
 	w.sgMutex.Lock()
 	defer w.sgMutex.Unlock()
@@ -197,5 +241,5 @@ func (w *Worker) getPerWorkerSnapshotSummary() (int, int) {
 			currPktRate += sg.GetPktRate()
 		}
 	}
-	return currCores, currPktRate
+	return currCores, currPktRate, w.countCrossNUMASGroups()
 }
@@ -0,0 +1,122 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+
+	utils "github.com/USC-NSL/Low-Latency-FaaS/utils"
+	glog "github.com/golang/glog"
+)
+
+// This is the place to serve background traffic.
+// Background traffic (e.g. the traffic that keeps workers busy in
+// experiments) is pinned to workers by traffic classes in the
+// cluster config. It bypasses DAGs, and is served by the first
+// SGroup of its worker.
+
+// |trafficClass| pins flows matched by |match| to |workers|.
+// A flow is pinned to one of |workers| by the hash of its 5-tuple.
+type trafficClass struct {
+	name    string
+	match   *flowlet
+	workers []*Worker
+}
+
+// Creates a traffic class from its config |spec|.
+func (c *FaaSController) newTrafficClass(spec *utils.TrafficClass) (*trafficClass, error) {
+	srcPorts, err := parsePortRange(spec.SrcPorts)
+	if err != nil {
+		return nil, err
+	}
+	dstPorts, err := parsePortRange(spec.DstPorts)
+	if err != nil {
+		return nil, err
+	}
+	match, err := newFlowlet(spec.SrcIP, spec.DstIP, srcPorts, dstPorts, spec.Proto, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	names := spec.Pool
+	if spec.Worker != "" {
+		names = append([]string{spec.Worker}, names...)
+	}
+	if len(names) == 0 {
+		return nil, errors.New(fmt.Sprintf("traffic class [%s] has no workers", spec.Name))
+	}
+
+	workers := make([]*Worker, 0, len(names))
+	for _, name := range names {
+		w := c.getWorker(name)
+		if w == nil {
+			return nil, errors.New(fmt.Sprintf("traffic class [%s] has an unknown worker %s", spec.Name, name))
+		}
+		workers = append(workers, w)
+	}
+
+	return &trafficClass{
+		name:    spec.Name,
+		match:   match,
+		workers: workers,
+	}, nil
+}
+
+func (tc *trafficClass) String() string {
+	names := make([]string, 0, len(tc.workers))
+	for _, w := range tc.workers {
+		names = append(names, w.name)
+	}
+	return fmt.Sprintf("[%s] %s -> %v", tc.name, tc.match, names)
+}
+
+// Returns the worker that serves flow |k|.
+func (tc *trafficClass) selectWorker(k flowKey) *Worker {
+	if len(tc.workers) == 1 {
+		return tc.workers[0]
+	}
+
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s|%s|%d|%d|%d", k.srcIP, k.dstIP, k.srcPort, k.dstPort, k.proto)
+	return tc.workers[h.Sum32()%uint32(len(tc.workers))]
+}
+
+// Loads background traffic classes from the cluster config |specs|.
+// Invalid classes are skipped.
+func (c *FaaSController) loadTrafficClasses(specs []utils.TrafficClass) {
+	for i := range specs {
+		tc, err := c.newTrafficClass(&specs[i])
+		if err != nil {
+			glog.Errorf("Skip background traffic class. %v", err)
+			continue
+		}
+
+		for _, w := range tc.workers {
+			w.bgTraffic = true
+		}
+		c.trafficClasses = append(c.trafficClasses, tc)
+		glog.Infof("Background traffic class %s", tc)
+	}
+}
+
+// Selects the SGroup that serves flow |k| if |k| is background
+// traffic. Picks the first SGroup of the worker pinned by the first
+// matched traffic class. Returns nil if |k| is not background
+// traffic, or the worker has no SGroups.
+func (c *FaaSController) findBackgroundSGroup(k flowKey) *SGroup {
+	for _, tc := range c.trafficClasses {
+		if !tc.match.Match(k.srcIP, k.dstIP, k.srcPort, k.dstPort, k.proto) {
+			continue
+		}
+
+		w := tc.selectWorker(k)
+		w.sgMutex.Lock()
+		defer w.sgMutex.Unlock()
+
+		if len(w.sgroups) > 0 {
+			return w.sgroups[0]
+		}
+		return nil
+	}
+	return nil
+}
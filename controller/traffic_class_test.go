@@ -0,0 +1,53 @@
+package controller
+
+import (
+	"fmt"
+	"testing"
+
+	utils "github.com/USC-NSL/Low-Latency-FaaS/utils"
+)
+
+// Tests of pinning background traffic to workers by traffic classes.
+func TestTrafficClasses(t *testing.T) {
+	c := &FaaSController{workers: make(map[string]*Worker)}
+	for _, name := range []string{"alpha", "beta", "gamma"} {
+		w := &Worker{name: name}
+		w.sgroups = append(w.sgroups, &SGroup{worker: w})
+		c.workers[name] = w
+	}
+
+	c.loadTrafficClasses([]utils.TrafficClass{
+		{Name: "pinned", DstPorts: "1000", Worker: "alpha"},
+		{Name: "pool", DstIP: "10.0.0.0/24", DstPorts: "1100-1199", Pool: []string{"beta", "gamma"}},
+		{Name: "unknown", DstPorts: "1200", Worker: "node1"},
+	})
+	if len(c.trafficClasses) != 2 {
+		t.Fatalf("Expect 2 traffic classes, got %d", len(c.trafficClasses))
+	}
+	if !c.workers["alpha"].bgTraffic || !c.workers["beta"].bgTraffic {
+		t.Errorf("Failed to mark background workers")
+	}
+
+	if sg := c.findBackgroundSGroup(flowKey{"1.1.1.1", "10.0.0.1", 1, 1000, 6}); sg == nil || sg.worker.name != "alpha" {
+		t.Errorf("Failed to pin a flow to worker alpha")
+	}
+	if sg := c.findBackgroundSGroup(flowKey{"1.1.1.1", "10.0.0.1", 1, 1200, 6}); sg != nil {
+		t.Errorf("A flow is pinned by an invalid traffic class")
+	}
+	if sg := c.findBackgroundSGroup(flowKey{"1.1.1.1", "10.0.1.1", 1, 1100, 6}); sg != nil {
+		t.Errorf("A flow is pinned by a mismatched traffic class")
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		k := flowKey{fmt.Sprintf("1.1.%d.%d", i/256, i%256), "10.0.0.1", uint32(i), 1100, 6}
+		sg := c.findBackgroundSGroup(k)
+		if sg == nil || sg != c.findBackgroundSGroup(k) {
+			t.Fatalf("Failed to pin flow %s to a pool", k)
+		}
+		counts[sg.worker.name] += 1
+	}
+	if counts["beta"] == 0 || counts["gamma"] == 0 || counts["alpha"] != 0 {
+		t.Errorf("Unexpected flow distribution in a pool %v", counts)
+	}
+}
@@ -10,6 +10,7 @@ import (
 
 	grpc "github.com/USC-NSL/Low-Latency-FaaS/grpc"
 	kubectl "github.com/USC-NSL/Low-Latency-FaaS/kubectl"
+	pb "github.com/USC-NSL/Low-Latency-FaaS/proto"
 	utils "github.com/USC-NSL/Low-Latency-FaaS/utils"
 	glog "github.com/golang/glog"
 )
@@ -24,6 +25,9 @@ const (
 
 	// The default per-worker CoopSched gRCP port.
 	schedulerPort = 10515
+
+	// The default gRPC port of the ToR switch controller.
+	torPort = 10516
 )
 
 // The abstraction of a worker node.
@@ -32,41 +36,82 @@ const (
 // |name| is the name of the node in kubernetes.
 // |ip| is the ip address of the worker node.
 // |vSwitchPort| is BESS gRPC port on host (e.g. FlowGen).
-// |cores| maps real core numbers to CPU cores.
+// |cores| maps real core numbers to CPU cores that run NFs.
+// |coopSchedCores| maps cores in |cores| to the cores that
+// CooperativeSched numbers them by (nil: the same numbers).
+// |idleCoreID| is the core in |cores| that holds idle SGroups.
+// |startupCores| are cores that run NF instances while they start up.
+// |cpu| is the CPU of the node, which estimates packet rates and
+// batch counts of |sgroups|.
 // |sgroups| contains all deployed sgroups on the worker.
 // |freeSGroups| are free sGroups not pinned to any core yet (but in memory).
+// |freePool| keeps the number of |freeSGroups| between its watermarks.
 // |instancePortPool| manages ports taken by instances on the node.
 // This is to prevent conflicts on host TCP ports.
 // |pciePool| manages pcie port taken by sGroup on the node.
+// |pcieNUMA| are NUMA nodes of |pcie|.
+// |crossNUMAPlacements| counts SGroups attached to cores of other
+// NUMA nodes than their PCIe VFs.
 // |insStartupPool| is a pool for instances that are on start-up.
-// |op| is a channle to FreeSGroup maintainer(go routine).
+// |bgTraffic| is true if the worker serves background traffic.
+// |poolOp| is a channel to the warm pool manager (go routine).
+// |schedEvents| is a channel of scheduling events posted by SGroups.
 // |wg| is a waiting group for all go routines of this worker.
-// |sgMutex| only protects |sgroups| and |freeSGroups|.
+// |undrained| are draining SGroups that failed to unschedule. They
+// are retried by |retryUndrainedSGroups|.
+// |sgMutex| only protects |sgroups|, |freeSGroups| and |undrained|.
+// |schedPolicy| is the scheduling policy that places |sgroups| on
+// |cores|. It is protected by |sgMutex|.
+// |migrations| governs migrations planned by |schedPolicy|. It is
+// protected by |sgMutex|.
+// |coopSched| (optional) replaces |SchedulerGRPCHandler| to attach and
+// detach SGroups, e.g. in simulation.
+// |onSGroupDestroyed| (optional) is called before a SGroup is reset
+// to a free SGroup, e.g. to remove flows assigned to the SGroup.
+// |onSGroupDraining| (optional) is called when a SGroup starts to
+// drain, e.g. to delete its flows at the ToR switch.
 type Worker struct {
 	grpc.VSwitchGRPCHandler
 	grpc.SchedulerGRPCHandler
-	name             string
-	ip               string
-	pcie             []string
-	switchPort       uint32
-	sched            *Instance
-	cores            map[int]*Core
-	sgroups          SGroupSlice
-	sgroupConns      []int
-	sgroupTarget     int
-	upMutex          sync.Mutex
-	freeSGroups      SGroupSlice
-	instancePortPool *utils.IndexPool
-	pciePool         *utils.IndexPool
-	insStartupPool   *InstancePool
-	bgTraffic        bool
-	op               chan FaaSOP
-	schedOp          chan FaaSOP
-	wg               sync.WaitGroup
-	sgMutex          sync.Mutex
+	name                string
+	ip                  string
+	pcie                []string
+	switchPort          uint32
+	sched               *Instance
+	cores               map[int]*Core
+	coopSchedCores      map[int]int
+	idleCoreID          int
+	startupCores        []int
+	cpu                 cpuSpec
+	sgroups             SGroupSlice
+	sgroupConns         []int
+	sgroupTarget        int
+	upMutex             sync.Mutex
+	freeSGroups         SGroupSlice
+	undrained           []*SGroup
+	freePool            *warmPool
+	instancePortPool    *utils.IndexPool
+	pciePool            *utils.IndexPool
+	pcieNUMA            []int
+	crossNUMAPlacements uint64
+	insStartupPool      *InstancePool
+	bgTraffic           bool
+	poolOp              chan FaaSOP
+	schedOp             chan FaaSOP
+	batchOp             chan FaaSOP
+	schedEvents         chan schedEvent
+	wg                  sync.WaitGroup
+	sgMutex             sync.Mutex
+	schedPolicy         SchedulingPolicy
+	migrations          *migrationGovernor
+	coopSched           coopSchedClient
+	onSGroupDestroyed   func(sg *SGroup)
+	onSGroupDraining    func(sg *SGroup)
 }
 
-func NewWorker(name string, ip string, coreNumOffset int, coreNum int, pcie []string, switchPortNum uint32) *Worker {
+// Creates a worker |name| at |ip|. Its cores are laid out by
+// |coreMap|, which must be well-formed.
+func NewWorker(name string, ip string, coreMap *utils.CoreMap, pcie []string, switchPortNum uint32) *Worker {
 	perWorkerPCIeDevices := make([]string, 0)
 	if len(pcie) > 0 {
 		perWorkerPCIeDevices = pcie
@@ -81,6 +126,9 @@ func NewWorker(name string, ip string, coreNumOffset int, coreNum int, pcie []st
 		pcie:             perWorkerPCIeDevices,
 		switchPort:       uint32(switchPortNum),
 		cores:            make(map[int]*Core),
+		coopSchedCores:   make(map[int]int),
+		idleCoreID:       coreMap.Idle,
+		startupCores:     coreMap.Startup,
 		sgroups:          make([]*SGroup, 0),
 		sgroupConns:      make([]int, 0),
 		sgroupTarget:     int(0),
@@ -89,14 +137,30 @@ func NewWorker(name string, ip string, coreNumOffset int, coreNum int, pcie []st
 		pciePool:         utils.NewIndexPool(0, len(perWorkerPCIeDevices)),
 		insStartupPool:   NewInstancePool(),
 		bgTraffic:        false,
-		op:               make(chan FaaSOP, 64),
+		poolOp:           make(chan FaaSOP, 64),
 		schedOp:          make(chan FaaSOP, 64),
+		batchOp:          make(chan FaaSOP, 64),
+		schedEvents:      make(chan schedEvent, kSchedEventQueueSize),
+		migrations:       newMigrationGovernor(),
 	}
 
-	// coreId is ranged between [coreNumOffset, coreNumOffset + coreNum)
-	for i := 0; i < coreNum; i++ {
-		coreID := i + coreNumOffset
-		w.cores[coreID] = NewCore(coreID)
+	// Uses the default scheduling policy set by the |-sched| flag.
+	if policy, err := newSchedulingPolicy(""); err == nil {
+		w.schedPolicy = policy
+	} else {
+		glog.Errorf("Worker[%s] uses %s. %v", name, kDefaultSchedulingPolicy, err)
+		w.schedPolicy = &noPackingPolicy{}
+	}
+
+	// Uses the watermarks set by the |-freemin| and |-freemax| flags.
+	w.freePool = newWarmPool(kDefaultMinFreeSGroups, kDefaultMaxFreeSGroups, w.createFreeSGroup)
+	if err := w.setWarmPool(defaultMinFreeSGroups, defaultMaxFreeSGroups); err != nil {
+		glog.Errorf("Worker[%s] uses default watermarks of free SGroups. %v", name, err)
+	}
+
+	for _, coreID := range coreMap.NF {
+		w.cores[coreID] = NewCore(coreID, coreMap.NUMANode(coreID))
+		w.coopSchedCores[coreID] = coreMap.CoopSchedCore(coreID)
 	}
 
 	// TODO(Zhuojin): remove VSwitchGRPCHandler.
@@ -111,7 +175,7 @@ func (w *Worker) String() string {
 	w.sgMutex.Lock()
 	defer w.sgMutex.Unlock()
 
-	info := fmt.Sprintf("Worker [%s] at %s \n Core:", w.name, w.ip)
+	info := fmt.Sprintf("Worker [%s] at %s \n CPU: %s\n Scheduling policy: %s (migrations: %s)\n Core (idle: #%d):", w.name, w.ip, w.cpu, w.schedPolicy.Name(), w.migrations, w.idleCoreID)
 
 	coreIDs := []int{}
 	for coreID := range w.cores {
@@ -134,10 +198,41 @@ func (w *Worker) String() string {
 	}
 
 	info += fmt.Sprintf("\n %d remaining free SGroups", len(w.freeSGroups))
+	if p := w.freePool; p != nil {
+		p.mutex.Lock()
+		info += fmt.Sprintf(" (pending: %d, watermarks: [%d, %d], free VFs: %d)", p.pending, p.low, p.high, w.pciePool.Size())
+		p.mutex.Unlock()
+	}
+	info += fmt.Sprintf("\n Cross-NUMA: %d running SGroups, %d placements", w.countCrossNUMASGroups(), w.getCrossNUMAPlacements())
 
 	return info + "\n"
 }
 
+// Sets the scheduling policy of |w| to |policy|. The new policy
+// takes effect in the next scheduling round.
+func (w *Worker) setSchedulingPolicy(policy SchedulingPolicy) {
+	w.sgMutex.Lock()
+	defer w.sgMutex.Unlock()
+
+	w.schedPolicy = policy
+	glog.Infof("Worker[%s] uses scheduling policy %s", w.name, policy.Name())
+}
+
+// Sets the CPU of |w| to |cpu|. It must be called before |w| starts
+// to run SGroups.
+func (w *Worker) setCPU(cpu cpuSpec) {
+	w.cpu = cpu
+}
+
+// Returns the core that starts up NF instances of the SGroup on PCIe
+// device |pcieIdx|. SGroups take startup cores in turn.
+func (w *Worker) getStartupCore(pcieIdx int) int {
+	if len(w.startupCores) == 0 {
+		return w.idleCoreID
+	}
+	return w.startupCores[pcieIdx%len(w.startupCores)]
+}
+
 func (w *Worker) GetPktLoad() int {
 	w.sgMutex.Lock()
 	defer w.sgMutex.Unlock()
@@ -150,13 +245,15 @@ func (w *Worker) GetPktLoad() int {
 }
 
 // Bring up background threads for each worker.
-// (1) FreeSGroupFactory: the background thread for creating new free SGs;
+// (1) WarmPoolLoop: the per-worker thread creates free SGroups;
 // (2) SchedulerLoop: the per-worker thread monitors CPU and traffic loads;
+// (3) BatchLoop: the per-worker thread adjusts batch counts of SGroups;
 func (w *Worker) faasInit() {
 	// Starts a background routine for maintaining |freeSGroups|
-	w.wg.Add(2)
-	go w.RunFreeSGroupFactory(w.op)
+	w.wg.Add(3)
+	go w.WarmPoolLoop()
 	go w.ScheduleLoop()
+	go w.BatchLoop()
 
 	glog.Infof("FaaS Worker[%s] is up.", w.name)
 }
@@ -164,7 +261,7 @@ func (w *Worker) faasInit() {
 // Metron does not run per-worker monitoring functions.
 func (w *Worker) metronInit() {
 	w.wg.Add(1)
-	go w.RunFreeSGroupFactory(w.op)
+	go w.WarmPoolLoop()
 
 	glog.Infof("Metron Worker[%s] is up.", w.name)
 }
@@ -239,11 +336,10 @@ func (w *Worker) destroyInstance(ins *Instance) error {
 	return nil
 }
 
+// Fills the warm pool of |w| up to its high watermark. Afterwards,
+// |WarmPoolLoop| replenishes the pool.
 func (w *Worker) createAllFreeSGroups() {
-	for i := 0; i < 2; i++ {
-		//for i := 0; i < w.pciePool.Size(); i++ {
-		w.op <- FREE_SGROUP
-	}
+	w.replenishFreeSGroups(true)
 }
 
 // Destorys and removes all free SGroups in |w.freeSGroups|. This
@@ -289,31 +385,69 @@ func (w *Worker) getFreeSGroup() *SGroup {
 		sg := w.freeSGroups[n-1]
 		// Removes |sg| from w.freeSGroups.
 		w.freeSGroups = w.freeSGroups[:(n - 1)]
+		w.notifyWarmPool()
 		return sg
 	}
 
 	return nil
 }
 
-// Destorys and removes all SGroups in |w.sgroups|.
+// Returns a free SGroup |sg| that has not run any NFs to
+// |w.freeSGroups|. Unlike |destroySGroup|, |sg| is not reset.
+func (w *Worker) putFreeSGroup(sg *SGroup) {
+	w.sgMutex.Lock()
+	defer w.sgMutex.Unlock()
+
+	w.freeSGroups = append(w.freeSGroups, sg)
+}
+
+// Destorys and removes all SGroups in |w.sgroups| and |w.undrained|.
 func (w *Worker) destroyAllSGroups() {
 	w.sgMutex.Lock()
 	defer w.sgMutex.Unlock()
 
+	// CooperativeSched has been shut down. So, undrained SGroups are
+	// no longer scheduled.
+	w.sgroups = append(w.sgroups, w.undrained...)
+	w.undrained = nil
 	for len(w.sgroups) > 0 {
 		idx := len(w.sgroups)
 		sg := w.sgroups[idx-1]
 		w.sgroups = w.sgroups[:(idx - 1)]
 
-		sg.Reset()
+		if w.onSGroupDestroyed != nil {
+			w.onSGroupDestroyed(sg)
+		}
+		if err := sg.beginDrain(); err != nil {
+			glog.Errorf("%v", err)
+			continue
+		}
+		if err := sg.Reset(); err != nil {
+			glog.Errorf("%v", err)
+			continue
+		}
 		w.freeSGroups = append(w.freeSGroups, sg)
 	}
 }
 
-// Destroys a SGroup |sg|.
-// Note: Unable to destroy a SGroup which is currently attached to a core.
+// Destroys a SGroup |sg|, and returns it to |w.freeSGroups|.
+// Note: Unable to destroy a SGroup which is currently scheduled on a
+// core. A deployed SGroup is released by |releaseSGroup|.
 func (w *Worker) destroySGroup(sg *SGroup) error {
-	sg.Reset()
+	if sg.IsSched() {
+		return fmt.Errorf("SGroup[%d] is still scheduled on core %d of worker[%s]", sg.ID(), sg.GetCoreID(), w.name)
+	}
+
+	// A live |sg| drains before it is reset.
+	if err := sg.beginDrain(); err != nil {
+		return err
+	}
+	if w.onSGroupDestroyed != nil {
+		w.onSGroupDestroyed(sg)
+	}
+	if err := sg.Reset(); err != nil {
+		return err
+	}
 
 	w.sgMutex.Lock()
 	w.freeSGroups = append(w.freeSGroups, sg)
@@ -322,6 +456,55 @@ func (w *Worker) destroySGroup(sg *SGroup) error {
 	return nil
 }
 
+// Releases a deployed SGroup |sg| from its DAG. |sg| is removed from
+// |w.sgroups| so that the scheduler no longer manages it, drained by
+// |drainSGroup|, and then returned to |w.freeSGroups| by
+// |destroySGroup|.
+func (w *Worker) releaseSGroup(sg *SGroup) error {
+	w.sgMutex.Lock()
+	found := false
+	for i, s := range w.sgroups {
+		if s == sg {
+			w.sgroups = append(w.sgroups[:i], w.sgroups[i+1:]...)
+			w.sgroupTarget -= 1
+			found = true
+			break
+		}
+	}
+	w.sgMutex.Unlock()
+
+	if !found {
+		return fmt.Errorf("SGroup[%d] not found by worker[%s]", sg.ID(), w.name)
+	}
+
+	// |sg| no longer takes new flows.
+	if err := sg.beginDrain(); err != nil {
+		glog.Errorf("%v", err)
+	}
+
+	w.upMutex.Lock()
+	for i, groupID := range w.sgroupConns {
+		if groupID == sg.groupID {
+			w.sgroupConns = append(w.sgroupConns[:i], w.sgroupConns[i+1:]...)
+			break
+		}
+	}
+	w.upMutex.Unlock()
+
+	if sg.dag != nil {
+		sg.dag.removeSGroup(sg)
+	}
+
+	if err := w.drainSGroup(sg, time.Duration(drainTimeout)*time.Millisecond); err != nil {
+		// Keeps |sg| (and its NIC queue) until it is unscheduled.
+		w.sgMutex.Lock()
+		w.undrained = append(w.undrained, sg)
+		w.sgMutex.Unlock()
+		return err
+	}
+	return w.destroySGroup(sg)
+}
+
 func (w *Worker) countPendingSGroups() int {
 	w.sgMutex.Lock()
 	defer w.sgMutex.Unlock()
@@ -356,8 +539,41 @@ func (w *Worker) getSGroup(groupID int) *SGroup {
 	return nil
 }
 
+// |coopSchedClient| attaches, detaches and removes SGroups on a worker's
+// CooperativeSched.
+type coopSchedClient interface {
+	AttachChain(tids []int32, core int) (*pb.Error, error)
+	DetachChain(tids []int32, core int) (*pb.Error, error)
+	RemoveChain(tids []int32) (*pb.Error, error)
+}
+
+// Returns the client of |w|'s CooperativeSched.
+func (w *Worker) getCoopSched() coopSchedClient {
+	if w.coopSched != nil {
+		return w.coopSched
+	}
+	return &w.SchedulerGRPCHandler
+}
+
+// Returns the core that |w|'s CooperativeSched numbers core |coreID|
+// by. Note: CooperativeSched does not know the core map of |w|.
+func (w *Worker) coopSchedCore(coreID int) (int, error) {
+	if w.coopSchedCores == nil {
+		return coreID, nil
+	}
+	if schedCoreID, exists := w.coopSchedCores[coreID]; exists {
+		return schedCoreID, nil
+	}
+	return kFaaSInvalidCoreID, errors.New(fmt.Sprintf("Core[%d] is not an NF core", coreID))
+}
+
 // Migrates/Schedules a SGroup with |groupId| to core |coreId|.
 func (w *Worker) attachSGroup(sg *SGroup, coreID int) error {
+	schedCoreID, err := w.coopSchedCore(coreID)
+	if err != nil {
+		return err
+	}
+
 	// Removes |sg| from its previous core.
 	prevCoreID := sg.GetCoreID()
 	if prevCoreID != kFaaSInvalidCoreID {
@@ -369,7 +585,7 @@ func (w *Worker) attachSGroup(sg *SGroup, coreID int) error {
 	}
 
 	// Sends gRPC to inform scheduler.
-	if status, err := w.AttachChain(sg.tids, coreID); err != nil {
+	if status, err := w.getCoopSched().AttachChain(sg.tids, schedCoreID); err != nil {
 		return err
 	} else if status.GetCode() != 0 {
 		return errors.New(fmt.Sprintf("AttachChain gRPC request errmsg: %s", status.GetErrmsg()))
@@ -381,6 +597,7 @@ func (w *Worker) attachSGroup(sg *SGroup, coreID int) error {
 		return errors.New(fmt.Sprintf("Core[%d] not found", coreID))
 	}
 	core.addSGroup(sg)
+	w.recordPlacement(sg, coreID)
 
 	return nil
 }
@@ -389,8 +606,13 @@ func (w *Worker) attachSGroup(sg *SGroup, coreID int) error {
 // The SGroup is still pinned to its original running core, but won't
 // get executed.
 func (w *Worker) detachSGroup(sg *SGroup) error {
+	schedCoreID, err := w.coopSchedCore(sg.GetCoreID())
+	if err != nil {
+		return err
+	}
+
 	// Send gRPC to inform scheduler.
-	if status, err := w.DetachChain(sg.tids, 0); err != nil {
+	if status, err := w.getCoopSched().DetachChain(sg.tids, schedCoreID); err != nil {
 		return err
 	} else if status.GetCode() != 0 {
 		return errors.New(fmt.Sprintf("DetachChain gRPC request errmsg: %s", status.GetErrmsg()))
@@ -406,8 +628,9 @@ func (w *Worker) Close() error {
 
 	if controllerOption == "faas" {
 		// Shutdowns and waits for all background go routines.
-		w.op <- SHUTDOWN
+		w.poolOp <- SHUTDOWN
 		w.schedOp <- SHUTDOWN
+		w.batchOp <- SHUTDOWN
 		w.wg.Wait()
 
 		// Sends a gRPC request to turn CoopSched off.
@@ -426,7 +649,7 @@ func (w *Worker) Close() error {
 		w.destroyAllSGroups()
 		w.destroyAllFreeSGroups()
 	} else if controllerOption == "metron" {
-		w.op <- SHUTDOWN
+		w.poolOp <- SHUTDOWN
 		w.wg.Wait()
 
 		// Cleans up SGroups and free SGroups.
@@ -3,16 +3,17 @@ package controller
 import (
 	"testing"
 	"time"
+
+	utils "github.com/USC-NSL/Low-Latency-FaaS/utils"
 )
 
 // Tests of creating a new worker and initializing all NIC queues.
 func TestWorkerStartFreeSGroups(t *testing.T) {
-	w := NewWorker("ubuntu", "204.57.7.11", 1, 7)
+	w := NewWorker("ubuntu", "204.57.7.11", utils.NewCoreMap(8, 1, 1), nil, 0)
 
 	countSGroups := w.pciePool.Size()
-	for i := 0; i < countSGroups; i++ {
-		w.op <- FREE_SGROUP
-	}
+	w.setWarmPool(countSGroups, countSGroups)
+	w.replenishFreeSGroups(true)
 
 	start := time.Now()
 	for time.Now().Unix()-start.Unix() < 30 && len(w.freeSGroups) != countSGroups {
@@ -33,9 +34,10 @@ func TestWorkerStartFreeSGroups(t *testing.T) {
 
 // Tests of deploying and deleting an NF DAG at a worker.
 func TestStartNFChain(t *testing.T) {
-	w := NewWorker("ubuntu", "204.57.7.11", 1, 7)
+	w := NewWorker("ubuntu", "204.57.7.11", utils.NewCoreMap(8, 1, 1), nil, 0)
 
-	w.op <- FREE_SGROUP
+	w.setWarmPool(1, 1)
+	w.replenishFreeSGroups(true)
 
 	start := time.Now()
 	for time.Now().Unix()-start.Unix() < 20 && len(w.freeSGroups) != 1 {
@@ -48,19 +50,24 @@ func TestStartNFChain(t *testing.T) {
 	}
 
 	dag := newDAG()
-	dag.chains = append([]string{"chacha", "none", "acl"})
+	nf1 := dag.addNF("chacha")
+	nf2 := dag.addNF("none")
+	nf3 := dag.addNF("acl")
+	dag.connectNFs(nf1, nf2, 1)
+	dag.connectNFs(nf2, nf3, 1)
+	dag.Activate()
 
 	// Instantiates a |dag| at the SGroup |sg|.
 	var sg *SGroup = w.freeSGroups[n-1]
 	w.freeSGroups = w.freeSGroups[:(n - 1)]
-	w.createSGroup(sg, dag)
+	w.createSGroup(sg, dag, 0)
 
 	start = time.Now()
 	for time.Now().Unix()-start.Unix() < 10 && len(sg.instances) != 3 {
 		time.Sleep(100 * time.Millisecond)
 	}
 
-	if len(sg.instances) != len(dag.chains) {
+	if len(sg.instances) != len(dag.chains[0].nfs) {
 		t.Errorf("Failed to deploy an NF DAG")
 	}
 
@@ -84,3 +91,40 @@ func TestStartNFChain(t *testing.T) {
 // Tests for Scheduling.
 func TestStartCooperativeSched(t *testing.T) {
 }
+
+// Tests of attaching SGroups on a worker whose NF cores are not
+// contiguous.
+func TestWorkerCoopSchedCores(t *testing.T) {
+	coreMap := &utils.CoreMap{
+		Sched:   []int{0, 8},
+		Idle:    4,
+		Startup: []int{4},
+		NF:      []int{4, 5, 12, 13},
+	}
+	w := NewWorker("node1", "127.0.0.1", coreMap, nil, 0)
+	var log []string
+	w.coopSched = &testCoopSched{log: &log}
+	sg := newSchedTestSGroup(w, 0, 10, kFaaSInvalidCoreID)
+
+	// CooperativeSched numbers core #12 as #3.
+	if err := sg.attachSGroup(12); err != nil {
+		t.Fatalf("Failed to attach SGroup[%d] on core #12. %v", sg.ID(), err)
+	}
+	if err := sg.detachSGroup(); err != nil {
+		t.Fatalf("Failed to detach SGroup[%d]. %v", sg.ID(), err)
+	}
+	if len(log) != 2 || log[0] != "attach 3" || log[1] != "detach 3" {
+		t.Errorf("Expect requests [attach 3 detach 3], got %v", log)
+	}
+	if sg.GetCoreID() != 12 || len(w.cores[12].sGroups) != 1 {
+		t.Errorf("Expect SGroup[%d] on core #12, got core #%d", sg.ID(), sg.GetCoreID())
+	}
+
+	// Core #8 runs CooperativeSched, and never runs SGroups.
+	if err := sg.attachSGroup(8); err == nil {
+		t.Errorf("Attached SGroup[%d] on a scheduler core", sg.ID())
+	}
+	if len(log) != 2 || sg.GetCoreID() != 12 {
+		t.Errorf("Unexpected requests %v after a failed attach", log)
+	}
+}
@@ -2,6 +2,7 @@ package grpc
 
 import (
 	"context"
+	"errors"
 	"net"
 
 	pb "github.com/USC-NSL/Low-Latency-FaaS/proto"
@@ -24,6 +25,15 @@ type Controller interface {
 	InstanceUpdateStats(nodeName string, port int, qlen int, kpps int, cycle int) error
 }
 
+// |FlowRejection| is implemented by errors returned by
+// |Controller.UpdateFlow| when a new flow is rejected on purpose
+// (e.g. by admission control). |RejectReason| is the reason code
+// encoded in |FlowTableEntry.reason|.
+type FlowRejection interface {
+	error
+	RejectReason() uint32
+}
+
 type GRPCServer struct {
 	FaaSController Controller
 }
@@ -52,7 +62,14 @@ func (s *GRPCServer) UpdateFlow(context context.Context, flowInfo *pb.FlowInfo)
 	switchPort, dmac, err := s.FaaSController.UpdateFlow(flowInfo.Ipv4Src, flowInfo.Ipv4Dst,
 		flowInfo.TcpSport, flowInfo.TcpDport, flowInfo.Ipv4Protocol)
 
-	if err != nil {
+	// A rejected flow is not an RPC failure. The switch decides whether
+	// to drop, buffer or retry the flow by |reason|.
+	var rejection FlowRejection
+	if errors.As(err, &rejection) {
+		glog.Infof("Reject flow: %v", err)
+		res := &pb.FlowTableEntry{SwitchPort: 0, Dmac: "none", Reason: rejection.RejectReason(), Errmsg: err.Error()}
+		return res, nil
+	} else if err != nil {
 		glog.Errorf("Failed to serve flow: %v", err)
 		res := &pb.FlowTableEntry{SwitchPort: 0, Dmac: "none"}
 		return res, err
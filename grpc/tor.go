@@ -1,7 +1,38 @@
 package grpc
 
+import (
+	"context"
+	"errors"
+
+	pb "github.com/USC-NSL/Low-Latency-FaaS/proto"
+)
+
 // The handler for sending gRPC requests to a ToR switch.
 // |GRPCClient| is the struct to maintain the gRPC connection.
 type ToRGRPCHandler struct {
 	GRPCClient
 }
+
+// Deletes the entry of the flow (|srcIP|, |dstIP|, |proto|, |srcPort|,
+// |dstPort|) from the switch's FaaSConnTable. The switch asks the
+// controller about the flow again when its next packet arrives.
+func (handler *ToRGRPCHandler) DeleteFlowEntry(srcIP string, dstIP string, proto uint32, srcPort uint32, dstPort uint32) error {
+	if handler.grpcConn == nil {
+		return errors.New("connection does not exist")
+	}
+
+	// Add gRPC context to set timeout for this request
+	ctx, cancel := context.WithTimeout(context.Background(), kGrpcReqTimeout)
+	defer cancel()
+
+	client := pb.NewSwitchControlClient(handler.grpcConn)
+	flow := &pb.FlowInfo{
+		Ipv4Src:      srcIP,
+		Ipv4Dst:      dstIP,
+		Ipv4Protocol: proto,
+		TcpSport:     srcPort,
+		TcpDport:     dstPort,
+	}
+	_, err := client.DeleteFlowEntry(ctx, flow)
+	return err
+}
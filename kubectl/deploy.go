@@ -19,6 +19,9 @@ const kNFImage string = "nf:debug"
 const kCoopSchedImage string = "coopsched:debug"
 const kFaaSControllerPort string = "10515"
 
+// The number of NF cores of a worker if its core map is unknown.
+const kDefaultNFCores int = 15
+
 var kFaaSCluster *utils.Cluster = nil
 var kFaaSControllerIP string = ""
 
@@ -27,9 +30,23 @@ func SetFaaSClusterInfo(cluster *utils.Cluster) {
 	kFaaSControllerIP = cluster.Master.IP
 }
 
+// Returns the core map of worker |nodeName|.
+func getCoreMap(nodeName string) (*utils.CoreMap, error) {
+	if kFaaSCluster == nil {
+		return nil, fmt.Errorf("unknown cluster")
+	}
+	for i := range kFaaSCluster.Workers {
+		if w := &kFaaSCluster.Workers[i]; w.Name == nodeName {
+			return w.GetCoreMap()
+		}
+	}
+	return nil, fmt.Errorf("unknown worker %s", nodeName)
+}
+
 // All kinds of possible NFs.
 var moduleNameMappings = map[string]string{
 	"original": "None",
+	"none":     "None",
 	"fc":       "FlowCounter",
 	"nat":      "NAT",
 	"filter":   "Filter",
@@ -40,6 +57,12 @@ var moduleNameMappings = map[string]string{
 	"bypass":   "Bypass",
 }
 
+// Returns true if NF |nfType| has a module in the NF runtime.
+func IsSupportedNF(nfType string) bool {
+	_, exists := moduleNameMappings[nfType]
+	return exists
+}
+
 // Create an NF instance with type |nfTypes| on node |nodeName|,
 // also assign the port |hostPort| of the host for the instance to receive gRPC requests.
 // In Kubernetes, the instance is run as a deployment with name "nodeName-nfTypes-portId".
@@ -246,14 +269,18 @@ func (k8s *KubeController) makeDPDKDeploymentSpec(nodeName string,
 func (k8s *KubeController) makeSchedDeploymentSpec(nodeName string,
 	hostPort int) (string, unstructured.Unstructured) {
 	deploymentName := fmt.Sprintf("%s-coopsched", nodeName)
-	coreNum := "15"
-	// w.Cores is the total number of available cores in the worker.
-	// Note: One core is required to run gRPC and monitoring threads,
-	// and cannot be used for NF threads.
-	for _, w := range kFaaSCluster.Workers {
-		if w.Name == nodeName {
-			coreNum = fmt.Sprintf("%d", w.Cores-1)
-		}
+
+	// The core map of the worker tells the number of NF cores.
+	// Note: CooperativeSched only takes the number of NF cores, and
+	// lays out its own cores. The controller translates NF cores of the
+	// map to CooperativeSched's cores (see |CoreMap.CoopSchedCore|).
+	// Scheduler cores run gRPC and monitoring threads, and cannot be
+	// used for NF threads.
+	coreNum := kDefaultNFCores
+	if m, err := getCoreMap(nodeName); err != nil {
+		glog.Errorf("CooperativeSched on %s uses the default cores. %v", nodeName, err)
+	} else {
+		coreNum = len(m.NF)
 	}
 
 	deployment := unstructured.Unstructured{
@@ -304,7 +331,7 @@ func (k8s *KubeController) makeSchedDeploymentSpec(nodeName string,
 								},
 								"command": []string{
 									"/app/cooperative_sched",
-									"--cores=" + coreNum,
+									"--cores=" + strconv.Itoa(coreNum),
 									"--cli=0",
 									"--logtostderr=1",
 								},
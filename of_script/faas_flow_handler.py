@@ -534,7 +534,8 @@ class FaaSSwitchController(app_manager.RyuApp):
             response = faas_client.UpdateFlow(flow_info)
 
             if response.dmac == "none":
-                DLOG.info("FaaS Cluster does not have any available cores")
+                # |response.reason| tells why the flow is rejected.
+                DLOG.info("FaaS Controller rejects the flow (reason=%d): %s", response.reason, response.errmsg)
                 return
 
             # OFPActionOutput takes an integer as input.
@@ -552,6 +552,8 @@ class SwitchControlService(switch_rpc.SwitchControlServicer):
             response = faas_client.UpdateFlow(flow_info)
 
             if response.dmac == "none":
+                # |response.reason| tells why the flow is rejected.
+                print('Flow rejected (reason=%d): %s' % (response.reason, response.errmsg))
                 return
 
             binary_dmac = (response.dmac).replace(":", "").decode("hex")
@@ -572,7 +574,7 @@ class SwitchControlService(switch_rpc.SwitchControlServicer):
         return self._stop.is_set()
 
     ## The following functions implement gRPC server function calls.
-    # |request| is an FlowTableEntry.
+    # |request| is a FlowInfo.
     def DeleteFlowEntry(self, request, context):
         table_name = "faas_conn_table"
         entry_key = (request.ipv4_src, request.ipv4_dst, request.ipv4_protocol, request.tcp_sport, request.tcp_dport)
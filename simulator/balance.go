@@ -0,0 +1,89 @@
+package simulator
+
+import (
+	controller "github.com/USC-NSL/Low-Latency-FaaS/controller"
+)
+
+// This is the place to simulate load balancing.
+// With a load balancer, the simulator replays the total traffic of a
+// trace rather than the traffic of each SGroup. The traffic is split
+// into flows of |Config.FlowKpps|. A new flow goes to the SGroup
+// picked by the load-balancing policy with the same thresholds as a
+// DAG, and stays on it until the flow ends. If no SGroup takes the
+// flow, the flow starts the next unused SGroup (a scale-up event),
+// or is rejected if all SGroups are in use. Flows end in the order
+// they start. SGroups start without delays. Like the controller, the
+// policy only sees stats of the last period.
+
+// The default packet rate (in kpps) of a flow.
+const kDefaultFlowKpps = 10
+
+// |flowBalancer| assigns flows to |sgroups|.
+// |flows| are the SGroup indexes of live flows, the oldest first.
+// |nextFlow| is the ID of the last new flow.
+// |used| is the number of SGroups that have taken flows, i.e.
+// |sgroups[:used]|.
+// |rejected| counts new flows that no SGroup takes. The switch asks
+// about a rejected flow again in the next period.
+type flowBalancer struct {
+	lb       *controller.SimLoadBalancer
+	sgroups  []*controller.SGroup
+	flowKpps int
+	flows    []int
+	nextFlow int
+	used     int
+	rejected int
+}
+
+func newFlowBalancer(lb *controller.SimLoadBalancer, sgroups []*controller.SGroup, flowKpps int) *flowBalancer {
+	if flowKpps <= 0 {
+		flowKpps = kDefaultFlowKpps
+	}
+	return &flowBalancer{
+		lb:       lb,
+		sgroups:  sgroups,
+		flowKpps: flowKpps,
+		flows:    make([]int, 0),
+	}
+}
+
+// Splits |kpps| of total traffic into flows, and assigns new flows to
+// SGroups. Returns the offered packet rate (in kpps) of each SGroup.
+func (b *flowBalancer) assign(kpps int) []float64 {
+	want := (kpps + b.flowKpps - 1) / b.flowKpps
+	if want < len(b.flows) {
+		b.flows = b.flows[len(b.flows)-want:]
+	}
+	for n := want - len(b.flows); n > 0; n-- {
+		if idx := b.selectSGroup(); idx >= 0 {
+			b.flows = append(b.flows, idx)
+		} else {
+			b.rejected += 1
+		}
+	}
+
+	offered := make([]float64, len(b.sgroups))
+	for _, idx := range b.flows {
+		offered[idx] += float64(kpps) / float64(want)
+	}
+	return offered
+}
+
+// Returns the index of the SGroup that takes a new flow. Returns -1
+// if the flow is rejected.
+func (b *flowBalancer) selectSGroup() int {
+	b.nextFlow += 1
+	if sg := b.lb.Select(b.sgroups[:b.used], b.nextFlow); sg != nil {
+		for i := 0; i < b.used; i++ {
+			if b.sgroups[i] == sg {
+				return i
+			}
+		}
+	}
+
+	if b.used < len(b.sgroups) {
+		b.used += 1
+		return b.used - 1
+	}
+	return -1
+}
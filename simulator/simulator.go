@@ -0,0 +1,252 @@
+package simulator
+
+import (
+	"fmt"
+	"time"
+
+	controller "github.com/USC-NSL/Low-Latency-FaaS/controller"
+)
+
+// This is the place to simulate a worker.
+// The simulator replays a trace on a simulated worker. In each
+// period, SGroups serve packets on their cores, report their stats
+// to the worker, and the worker runs a scheduling round. The worker
+// runs the same scheduling policies as a real worker, but its
+// CooperativeSched is an in-memory fake, so that policies can be
+// evaluated without BESS, Kubernetes and CooperativeSched.
+//
+// Serving model: an SGroup needs (offered packets + queued packets) /
+// (max packets in a period) of a core. If SGroups on a core need more
+// than the core, they share the core in proportion to their needs.
+// An SGroup that is not running serves no packets. A migrated SGroup
+// serves no packets during the migration.
+//
+// Traffic model: by default, the traffic of each SGroup is replayed
+// as recorded. With a load balancer, the total traffic is assigned
+// to SGroups flow by flow (see balance.go).
+
+// |Config| configures a simulation.
+// |Cores| is the number of cores of the worker (including the idle
+// core).
+// |MigrationLatency| is the time of an attach/detach request to
+// CooperativeSched.
+// |LoadBalancer| (optional) is the load-balancing policy that assigns
+// flows to SGroups with |LBThresholds|.
+// |FlowKpps| is the packet rate of a flow (0: the default rate).
+type Config struct {
+	Cores            int
+	MigrationLatency time.Duration
+	LoadBalancer     string
+	LBThresholds     controller.LBThresholds
+	FlowKpps         int
+}
+
+var DefaultConfig = Config{
+	Cores:            8,
+	MigrationLatency: 2 * time.Millisecond,
+}
+
+// |Report| summarizes a simulation of a scheduling policy.
+// |CoreSeconds| is the time of cores that run SGroups.
+// |Migrations| is the number of SGroups that move between cores.
+// |Suppressed| is the number of migrations suppressed by the worker.
+// |OverloadSeconds| is the time of SGroups that do not get enough
+// CPU cycles for their packets.
+// |QueueingDelayUs| is the average queueing delay of packets.
+// |DroppedPkts| is the number of packets dropped by full NIC queues.
+// |SGroups| is the number of SGroups that get traffic.
+// |RejectedFlows| is the number of new flows that no SGroup takes.
+type Report struct {
+	Policy          string
+	Duration        time.Duration
+	CoreSeconds     float64
+	Migrations      int
+	Suppressed      int
+	OverloadSeconds float64
+	QueueingDelayUs float64
+	DroppedPkts     int64
+	SGroups         int
+	RejectedFlows   int
+}
+
+func (r *Report) String() string {
+	return fmt.Sprintf("%-14s %10.1f %10d %10d %12.1f %12.1f %12d %8d %10d",
+		r.Policy, r.CoreSeconds, r.Migrations, r.Suppressed, r.OverloadSeconds, r.QueueingDelayUs, r.DroppedPkts, r.SGroups, r.RejectedFlows)
+}
+
+// Formats |reports| as a table.
+func FormatReports(reports []*Report) string {
+	info := fmt.Sprintf("%-14s %10s %10s %10s %12s %12s %12s %8s %10s\n",
+		"policy", "core-s", "migrations", "suppressed", "overload-s", "delay-us", "dropped", "sgroups", "rejected")
+	for _, r := range reports {
+		info += r.String() + "\n"
+	}
+	return info
+}
+
+// Replays |trace| on a worker that runs scheduling |policy|.
+func Run(trace *Trace, policy string, cfg Config) (*Report, error) {
+	clock := controller.NewSimClock()
+	w, err := controller.NewSimWorker("sim", cfg.Cores, policy, clock, cfg.MigrationLatency)
+	if err != nil {
+		return nil, err
+	}
+
+	n := trace.SGroups()
+	sgroups := make([]*controller.SGroup, n)
+	for i := range sgroups {
+		sgroups[i] = w.NewSimSGroup(i, trace.NFCount(i))
+	}
+
+	var balancer *flowBalancer
+	if cfg.LoadBalancer != "" {
+		lb, err := controller.NewSimLoadBalancer(cfg.LoadBalancer, cfg.LBThresholds)
+		if err != nil {
+			return nil, err
+		}
+		balancer = newFlowBalancer(lb, sgroups, cfg.FlowKpps)
+	}
+
+	period := trace.Period.Seconds()
+	queues := make([]float64, n)
+	served := make([]float64, n)
+	stalls := make([]float64, n)
+	started := make([]bool, n)
+	report := &Report{
+		Policy:   policy,
+		Duration: time.Duration(trace.Ticks()) * trace.Period,
+	}
+	queuedPktSeconds := 0.0
+	servedPkts := 0.0
+
+	for tick := 0; tick < trace.Ticks(); tick++ {
+		stats := trace.Stats[tick]
+
+		// Packets that arrive in this period. Initial queues are only
+		// replayed with the traffic of each SGroup.
+		offeredKpps := make([]float64, n)
+		initQlens := make([]int, n)
+		if balancer != nil {
+			total := 0
+			for i := range sgroups {
+				total += stats[i][0].Kpps
+			}
+			offeredKpps = balancer.assign(total)
+		} else {
+			for i := range sgroups {
+				offeredKpps[i] = float64(stats[i][0].Kpps)
+				initQlens[i] = stats[i][0].Qlen
+			}
+		}
+
+		offered := make([]float64, n)
+		for i := range sgroups {
+			offered[i] = offeredKpps[i] * 1000 * period
+			if !started[i] && (offered[i] > 0 || initQlens[i] > 0) {
+				started[i] = true
+				queues[i] = float64(initQlens[i])
+				report.SGroups += 1
+			}
+		}
+
+		// Serves packets on cores.
+		cores := make(map[int][]int)
+		for i, sg := range sgroups {
+			served[i] = 0
+			if sg.IsSched() {
+				cores[sg.GetCoreID()] = append(cores[sg.GetCoreID()], i)
+			} else if offered[i]+queues[i] > 0 {
+				report.OverloadSeconds += period
+			}
+		}
+		report.CoreSeconds += float64(len(cores)) * period
+
+		for _, idxs := range cores {
+			capacity := make([]float64, len(idxs))
+			needs := make([]float64, len(idxs))
+			sumNeeds := 0.0
+			for j, i := range idxs {
+				capacity[j] = float64(sgroups[i].GetMaxPktRate()) * 1000 * period * (1 - stalls[i])
+				if capacity[j] > 0 {
+					needs[j] = (offered[i] + queues[i]) / capacity[j]
+				}
+				sumNeeds += needs[j]
+			}
+
+			for j, i := range idxs {
+				share := needs[j]
+				if sumNeeds > 1 {
+					share = needs[j] / sumNeeds
+					if offered[i]+queues[i] > 0 {
+						report.OverloadSeconds += period
+					}
+				}
+				served[i] = share * capacity[j]
+			}
+		}
+
+		// Updates queues, and reports stats to the worker.
+		for i, sg := range sgroups {
+			queues[i] += offered[i] - served[i]
+			if queues[i] < 0 {
+				queues[i] = 0
+			} else if queues[i] > controller.NIC_RX_QUEUE_LENGTH {
+				report.DroppedPkts += int64(queues[i] - controller.NIC_RX_QUEUE_LENGTH)
+				queues[i] = controller.NIC_RX_QUEUE_LENGTH
+			}
+			queuedPktSeconds += queues[i] * period
+			servedPkts += served[i]
+
+			kpps := int(served[i] / period / 1000)
+			for j, s := range stats[i] {
+				qlen := 0
+				if j == 0 {
+					qlen = int(queues[i])
+				}
+				sg.SimUpdateInstance(j, qlen, kpps, s.Cycle)
+			}
+			sg.SimUpdateTrafficInfo()
+		}
+
+		// Runs a scheduling round, and counts migrations between
+		// cores other than the idle core.
+		prevCores := make([]int, n)
+		for i, sg := range sgroups {
+			prevCores[i] = sg.SimRunningCore()
+		}
+		w.SimScheduleOnce()
+		for i, sg := range sgroups {
+			stalls[i] = 0
+			if core := sg.SimRunningCore(); prevCores[i] >= 0 && core >= 0 && core != prevCores[i] {
+				report.Migrations += 1
+				stalls[i] = cfg.MigrationLatency.Seconds() / period
+				if stalls[i] > 1 {
+					stalls[i] = 1
+				}
+			}
+		}
+		clock.Advance(trace.Period)
+	}
+
+	_, report.Suppressed = w.MigrationCounts()
+	if balancer != nil {
+		report.RejectedFlows = balancer.rejected
+	}
+	if servedPkts > 0 {
+		report.QueueingDelayUs = queuedPktSeconds / servedPkts * 1e6
+	}
+	return report, nil
+}
+
+// Replays |trace| with each of |policies|.
+func Compare(trace *Trace, policies []string, cfg Config) ([]*Report, error) {
+	reports := make([]*Report, 0, len(policies))
+	for _, policy := range policies {
+		r, err := Run(trace, policy, cfg)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, r)
+	}
+	return reports, nil
+}
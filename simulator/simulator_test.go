@@ -0,0 +1,128 @@
+package simulator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	controller "github.com/USC-NSL/Low-Latency-FaaS/controller"
+)
+
+// Tests of loading a recorded trace.
+func TestLoadTrace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fileName := filepath.Join(dir, "trace.csv")
+	data := "# tick,sgroup,instance,qlen,kpps,cycle\n0,0,0,10,100,300\n0,0,1,0,100,200\n2,1,0,0,50,400\n"
+	if err := ioutil.WriteFile(fileName, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	trace, err := LoadTrace(fileName, 0)
+	if err != nil {
+		t.Fatalf("Failed to load trace. %v", err)
+	}
+	if trace.Ticks() != 3 || trace.SGroups() != 2 || trace.NFCount(0) != 2 || trace.NFCount(1) != 1 {
+		t.Errorf("Unexpected trace size: ticks=%d, sgroups=%d", trace.Ticks(), trace.SGroups())
+	}
+	if s := trace.Stats[0][0][0]; s.Qlen != 10 || s.Kpps != 100 || s.Cycle != 300 {
+		t.Errorf("Unexpected stats %v", s)
+	}
+	if s := trace.Stats[1][1][0]; s.Kpps != 0 {
+		t.Errorf("Missing stats are not zeros: %v", s)
+	}
+
+	for _, data := range []string{
+		"0,0,0,10,100\n",
+		// SGroup 1 has no samples.
+		"0,0,0,10,100,300\n0,2,0,0,50,400\n",
+	} {
+		if err := ioutil.WriteFile(fileName, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadTrace(fileName, 0); err == nil {
+			t.Errorf("Loaded an invalid trace %q", data)
+		}
+	}
+}
+
+// Tests of comparing scheduling policies on a synthetic trace.
+func TestComparePolicies(t *testing.T) {
+	trace := NewSyntheticTrace(6, 3, 600, 1)
+	reports, err := Compare(trace, controller.SchedulingPolicyNames(), DefaultConfig)
+	if err != nil {
+		t.Fatalf("Failed to run simulations. %v", err)
+	}
+
+	coreSeconds := make(map[string]float64)
+	for _, r := range reports {
+		if r.CoreSeconds <= 0 || r.QueueingDelayUs < 0 || r.OverloadSeconds < 0 {
+			t.Errorf("Unexpected report %s", r)
+		}
+		coreSeconds[r.Policy] = r.CoreSeconds
+	}
+	if coreSeconds["bfd"] >= coreSeconds["no-packing"] {
+		t.Errorf("Packing does not save cores: %v", coreSeconds)
+	}
+	t.Logf("\n%s", FormatReports(reports))
+
+	if _, err := Run(trace, "round-robin", DefaultConfig); err == nil {
+		t.Errorf("Simulated an unknown policy")
+	}
+}
+
+// Tests of simulating load-balancing thresholds.
+func TestSimulateLoadBalancing(t *testing.T) {
+	trace := NewSyntheticTrace(8, 3, 600, 1)
+	cfg := DefaultConfig
+	cfg.LoadBalancer = "high-load-first"
+
+	// Lower thresholds spread flows into more SGroups.
+	reports := make([]*Report, 0)
+	for _, th := range []controller.LBThresholds{{}, {QLoad: 20, PktLoad: 20, MaxPktLoad: 30}} {
+		cfg.LBThresholds = th
+		r, err := Run(trace, "bfd", cfg)
+		if err != nil {
+			t.Fatalf("Failed to run simulations. %v", err)
+		}
+		if r.SGroups == 0 || r.SGroups > trace.SGroups() {
+			t.Errorf("Unexpected report %s", r)
+		}
+		reports = append(reports, r)
+	}
+	if reports[1].SGroups <= reports[0].SGroups {
+		t.Errorf("Lower thresholds do not spread flows: %d vs. %d SGroups", reports[1].SGroups, reports[0].SGroups)
+	}
+	t.Logf("\n%s", FormatReports(reports))
+
+	cfg.LoadBalancer = "round-robin"
+	if _, err := Run(trace, "bfd", cfg); err == nil {
+		t.Errorf("Simulated an unknown load balancer")
+	}
+}
+
+// Benchmarks of scheduling policies on a synthetic trace. Reports the
+// simulated metrics of each policy.
+func BenchmarkSchedulingPolicies(b *testing.B) {
+	trace := NewSyntheticTrace(12, 3, 3000, 1)
+	for _, policy := range controller.SchedulingPolicyNames() {
+		b.Run(policy, func(b *testing.B) {
+			var r *Report
+			for i := 0; i < b.N; i++ {
+				var err error
+				if r, err = Run(trace, policy, DefaultConfig); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(r.CoreSeconds, "core-s")
+			b.ReportMetric(float64(r.Migrations), "migrations")
+			b.ReportMetric(r.OverloadSeconds, "overload-s")
+			b.ReportMetric(r.QueueingDelayUs, "delay-us")
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package simulator
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This is the place to load and generate traces.
+// A trace records per-instance stats of SGroups in each period, i.e.
+// the stats that NF instances report to FaaSController. A recorded
+// trace is a CSV file. Each line is:
+//    tick,sgroup,instance,qlen,kpps,cycle
+// |tick| is the index of the period. |sgroup| and |instance| are
+// indexes of the SGroup and the instance in the SGroup. |kpps| of
+// instance 0 is the offered packet rate of the SGroup. |cycle| is the
+// per-packet cycle cost of the instance. |qlen| of instance 0 in the
+// first period of an SGroup is its initial queue length. Lines that
+// start with '#' are comments. Missing stats are zeros, but each
+// SGroup up to the last one must have samples.
+
+// The default period between two samples of a trace (the period of
+// scheduling rounds).
+const kDefaultTracePeriod = 100 * time.Millisecond
+
+// |InstanceStats| are stats of an instance in a period.
+type InstanceStats struct {
+	Qlen  int
+	Kpps  int
+	Cycle int
+}
+
+// |Trace| is a sequence of per-instance stats.
+// |Period| is the time between two samples.
+// |Stats| are indexed by ticks, SGroups and instances.
+type Trace struct {
+	Period time.Duration
+	Stats  [][][]InstanceStats
+}
+
+// Returns the number of periods in |t|.
+func (t *Trace) Ticks() int {
+	return len(t.Stats)
+}
+
+// Returns the number of SGroups in |t|.
+func (t *Trace) SGroups() int {
+	if len(t.Stats) == 0 {
+		return 0
+	}
+	return len(t.Stats[0])
+}
+
+// Returns the number of instances of SGroup |sg| in |t|.
+func (t *Trace) NFCount(sg int) int {
+	if len(t.Stats) == 0 {
+		return 0
+	}
+	return len(t.Stats[0][sg])
+}
+
+// Creates an empty trace of |ticks| periods, and |nfCounts[i]|
+// instances in SGroup i.
+func newTrace(ticks int, nfCounts []int) *Trace {
+	t := &Trace{
+		Period: kDefaultTracePeriod,
+		Stats:  make([][][]InstanceStats, ticks),
+	}
+	for tick := range t.Stats {
+		t.Stats[tick] = make([][]InstanceStats, len(nfCounts))
+		for sg, nfCount := range nfCounts {
+			t.Stats[tick][sg] = make([]InstanceStats, nfCount)
+		}
+	}
+	return t
+}
+
+// Loads a recorded trace from a CSV file |fileName|. Samples are
+// |period| apart (0: the default period).
+func LoadTrace(fileName string, period time.Duration) (*Trace, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	type sample struct {
+		tick, sg, ins int
+		stats         InstanceStats
+	}
+	samples := make([]sample, 0)
+	ticks := 0
+	nfCounts := make([]int, 0)
+
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum += 1
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, ",")
+		if len(fields) != 6 {
+			return nil, errors.New(fmt.Sprintf("%s:%d: expect 6 fields, got %d", fileName, lineNum, len(fields)))
+		}
+		values := make([]int, len(fields))
+		for i, field := range fields {
+			v, err := strconv.Atoi(strings.TrimSpace(field))
+			if err != nil || v < 0 {
+				return nil, errors.New(fmt.Sprintf("%s:%d: invalid value %s", fileName, lineNum, field))
+			}
+			values[i] = v
+		}
+
+		s := sample{values[0], values[1], values[2], InstanceStats{Qlen: values[3], Kpps: values[4], Cycle: values[5]}}
+		samples = append(samples, s)
+		if s.tick+1 > ticks {
+			ticks = s.tick + 1
+		}
+		for len(nfCounts) <= s.sg {
+			nfCounts = append(nfCounts, 0)
+		}
+		if s.ins+1 > nfCounts[s.sg] {
+			nfCounts[s.sg] = s.ins + 1
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(samples) == 0 {
+		return nil, errors.New(fmt.Sprintf("%s has no samples", fileName))
+	}
+	for sg, nfCount := range nfCounts {
+		if nfCount == 0 {
+			return nil, errors.New(fmt.Sprintf("%s has no samples of SGroup %d", fileName, sg))
+		}
+	}
+
+	t := newTrace(ticks, nfCounts)
+	if period > 0 {
+		t.Period = period
+	}
+	for _, s := range samples {
+		t.Stats[s.tick][s.sg][s.ins] = s.stats
+	}
+	return t, nil
+}
+
+// Generates a synthetic trace of |sgroups| SGroups of |nfCount| NFs in
+// |ticks| periods. Each SGroup has a random base rate that changes
+// like a sine wave with noise, and is idle for a random interval.
+// The same |seed| generates the same trace.
+func NewSyntheticTrace(sgroups int, nfCount int, ticks int, seed int64) *Trace {
+	r := rand.New(rand.NewSource(seed))
+
+	nfCounts := make([]int, sgroups)
+	for i := range nfCounts {
+		nfCounts[i] = nfCount
+	}
+	t := newTrace(ticks, nfCounts)
+
+	for sg := 0; sg < sgroups; sg++ {
+		base := 50 + r.Float64()*400
+		wavePeriod := float64(300 + r.Intn(600))
+		phase := r.Float64() * 2 * math.Pi
+		idleStart := r.Intn(ticks + 1)
+		idleEnd := idleStart + r.Intn(ticks/4+1)
+
+		cycles := make([]int, nfCount)
+		for i := range cycles {
+			cycles[i] = 150 + r.Intn(300)
+		}
+
+		for tick := 0; tick < ticks; tick++ {
+			kpps := 0
+			if tick < idleStart || tick >= idleEnd {
+				wave := 1 + 0.5*math.Sin(2*math.Pi*float64(tick)/wavePeriod+phase)
+				noise := 0.9 + 0.2*r.Float64()
+				kpps = int(base * wave * noise)
+			}
+
+			for i := 0; i < nfCount; i++ {
+				t.Stats[tick][sg][i] = InstanceStats{
+					Kpps:  kpps,
+					Cycle: cycles[i] * (95 + r.Intn(11)) / 100,
+				}
+			}
+		}
+	}
+	return t
+}
@@ -7,19 +7,99 @@ import (
 	"os"
 )
 
+// |BackgroundTraffic| are traffic classes pinned to workers. They
+// bypass DAGs, and are served by the workers' first SGroups.
+// |SchedulingPolicy| is the scheduling policy of all workers (empty:
+// the controller's default policy).
+// |ToR| is the ToR switch. Flows of draining SGroups are deleted at
+// the switch (empty IP: not connected).
 type Cluster struct {
-	Master  ClusterNode   `json:"master"`
-	Ofctl   ClusterNode   `json:"ofctl"`
-	Workers []ClusterNode `json:"workers"`
+	Master            ClusterNode    `json:"master"`
+	Ofctl             ClusterNode    `json:"ofctl"`
+	ToR               ClusterNode    `json:"tor"`
+	Workers           []ClusterNode  `json:"workers"`
+	BackgroundTraffic []TrafficClass `json:"backgroundTraffic"`
+	SchedulingPolicy  string         `json:"schedPolicy"`
 }
 
+// The default number of cores reserved on a worker. Core #0 runs the
+// scheduler's gRPC and monitoring threads.
+const kDefaultReservedCores = 1
+
+// |SchedulingPolicy| overrides the cluster's scheduling policy on
+// this worker.
+// |CPUFreqKHz| is the CPU frequency (in kHz) of this worker (0: the
+// controller's default).
+// |ContextSwitchCycles| is the cost (in CPU cycles) of switching
+// between NF threads on this worker (0: the controller's default).
+// |PCIeNUMA| maps PCIe devices to their NUMA nodes (empty: unknown).
+// |CoreMap| lays out the cores of this worker explicitly. If it is
+// not set, the layout is generated from |Cores|, |ReservedCores| and
+// |IdleCore| (see |GetCoreMap|).
+// |ReservedCores| is the number of cores that never run NFs, i.e.
+// Core #0 ~ #|ReservedCores|-1 (0: 1).
+// |IdleCore| is the core that holds idle SGroups (0: the first core
+// after reserved cores).
 type ClusterNode struct {
-	Name       string   `json:"nodeName"`
-	IP         string   `json:"IP"`
-	Password   string   `json:"password"`
-	PCIe       []string `json:"PCIe"`
-	Cores      int      `json:"CPU"`
-	SwitchPort int      `json:"switchPort"`
+	Name                string         `json:"nodeName"`
+	IP                  string         `json:"IP"`
+	Password            string         `json:"password"`
+	PCIe                []string       `json:"PCIe"`
+	Cores               int            `json:"CPU"`
+	SwitchPort          int            `json:"switchPort"`
+	SchedulingPolicy    string         `json:"schedPolicy"`
+	CPUFreqKHz          int            `json:"cpuFreqKHz"`
+	ContextSwitchCycles int            `json:"contextSwitchCycles"`
+	PCIeNUMA            map[string]int `json:"PCIeNUMA"`
+	CoreMap             *CoreMap       `json:"coreMap"`
+	ReservedCores       int            `json:"reservedCores"`
+	IdleCore            int            `json:"idleCore"`
+	MinFreeSGroups      int            `json:"minFreeSGroups"`
+	MaxFreeSGroups      int            `json:"maxFreeSGroups"`
+}
+
+// Returns the number of cores reserved on |node|.
+func (node *ClusterNode) GetReservedCores() int {
+	if node.ReservedCores <= 0 {
+		return kDefaultReservedCores
+	}
+	return node.ReservedCores
+}
+
+// Returns the core that holds idle SGroups on |node|.
+func (node *ClusterNode) GetIdleCore() int {
+	if node.IdleCore <= 0 {
+		return node.GetReservedCores()
+	}
+	return node.IdleCore
+}
+
+// Returns the core layout of |node|. Returns an error if the layout
+// is not well-formed.
+func (node *ClusterNode) GetCoreMap() (*CoreMap, error) {
+	m := node.CoreMap
+	if m == nil {
+		m = NewCoreMap(node.Cores, node.GetReservedCores(), node.GetIdleCore())
+	}
+	if err := m.Check(node.Cores); err != nil {
+		return nil, fmt.Errorf("worker[%s] has a bad core map: %v", node.Name, err)
+	}
+	return m, nil
+}
+
+// |TrafficClass| pins flows to a |Worker| or a |Pool| of workers.
+// Flows are matched by IPv4 prefixes (e.g. "10.0.0.0/8"), port ranges
+// (e.g. "1000-1099") and the IP protocol. Empty fields match all.
+// A flow of a pool is pinned to one worker of the pool by its hash.
+type TrafficClass struct {
+	Name     string   `json:"name"`
+	SrcIP    string   `json:"srcIP"`
+	DstIP    string   `json:"dstIP"`
+	SrcPorts string   `json:"srcPorts"`
+	DstPorts string   `json:"dstPorts"`
+	Proto    uint32   `json:"proto"`
+	Worker   string   `json:"worker"`
+	Pool     []string `json:"pool"`
 }
 
 func ParseClusterInfo(fileName string) (*Cluster, error) {
@@ -40,10 +120,19 @@ func ParseClusterInfo(fileName string) (*Cluster, error) {
 	fmt.Printf("FaaS NFV cluster:\n")
 	fmt.Printf(" - master node: name=%s, IP=%s\n", cluster.Master.Name, cluster.Master.IP)
 	fmt.Printf(" - ofctl node: name=%s, IP=%s\n", cluster.Ofctl.Name, cluster.Ofctl.IP)
+	if cluster.ToR.IP != "" {
+		fmt.Printf(" - ToR switch: name=%s, IP=%s\n", cluster.ToR.Name, cluster.ToR.IP)
+	}
 	fmt.Printf(" - total %d workers:\n", len(cluster.Workers))
 	for i := 0; i < len(cluster.Workers); i++ {
 		fmt.Printf("   - worker[%d]: name=%s, IP=%s, %d available VFs, switch port=%d\n", i, cluster.Workers[i].Name, cluster.Workers[i].IP, len(cluster.Workers[i].PCIe), cluster.Workers[i].SwitchPort)
+		if m, err := cluster.Workers[i].GetCoreMap(); err == nil {
+			fmt.Printf("     cores: sched=%v, idle=%d, startup=%v, NF=%v, NUMA=%v\n", m.Sched, m.Idle, m.Startup, m.NF, m.NUMA)
+		}
 	}
 
+	for _, class := range cluster.BackgroundTraffic {
+		fmt.Printf(" - background traffic [%s]: dst=%s:%s -> worker=%s, pool=%v\n", class.Name, class.DstIP, class.DstPorts, class.Worker, class.Pool)
+	}
 	return &cluster, nil
 }
@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"fmt"
+)
+
+// The default core that runs NF instances while they start up. A node
+// with fewer cores uses its last core.
+const kDefaultStartupCore = 19
+
+// CooperativeSched only takes the number of NF cores. It runs its own
+// threads on core #0, and numbers NF cores from #1.
+const kCoopSchedFirstNFCore = 1
+
+// |CoreMap| lays out the cores of a worker.
+// |Sched| are cores that run CooperativeSched's gRPC and monitoring
+// threads. NFs never run on them.
+// |Idle| is the NF core that holds idle SGroups.
+// |Startup| are cores that run NF instances while they start up.
+// Instances take these cores in turn. They may be NF cores, but
+// never scheduler cores.
+// |NF| are cores that run SGroups (including |Idle|).
+// |NUMA| annotates NUMA nodes of cores, i.e. |NUMA[i]| are cores on
+// NUMA node i (empty: unknown).
+type CoreMap struct {
+	Sched   []int   `json:"sched"`
+	Idle    int     `json:"idle"`
+	Startup []int   `json:"startup"`
+	NF      []int   `json:"nf"`
+	NUMA    [][]int `json:"numa"`
+}
+
+// Creates the default layout of a worker with |cores| cores. The
+// first |reservedCores| cores run CooperativeSched, and the rest run
+// NFs. |idleCore| holds idle SGroups.
+func NewCoreMap(cores int, reservedCores int, idleCore int) *CoreMap {
+	startupCore := kDefaultStartupCore
+	if startupCore >= cores {
+		startupCore = cores - 1
+	}
+
+	m := &CoreMap{
+		Sched:   make([]int, 0, reservedCores),
+		Idle:    idleCore,
+		Startup: []int{startupCore},
+		NF:      make([]int, 0, cores),
+	}
+	for coreID := 0; coreID < cores; coreID++ {
+		if coreID < reservedCores {
+			m.Sched = append(m.Sched, coreID)
+		} else {
+			m.NF = append(m.NF, coreID)
+		}
+	}
+	return m
+}
+
+// Checks that |m| is well-formed on a node with Core #0 ~
+// #|cores|-1 (|cores| = 0: unknown).
+func (m *CoreMap) Check(cores int) error {
+	if len(m.NF) == 0 {
+		return fmt.Errorf("no NF cores")
+	}
+	if len(m.Startup) == 0 {
+		return fmt.Errorf("no startup cores")
+	}
+	onNode := func(coreID int) bool {
+		return coreID >= 0 && (cores <= 0 || coreID < cores)
+	}
+
+	nf := make(map[int]bool)
+	for _, coreID := range m.NF {
+		if !onNode(coreID) {
+			return fmt.Errorf("NF core %d is not on the node", coreID)
+		} else if nf[coreID] {
+			return fmt.Errorf("duplicate NF core %d", coreID)
+		}
+		nf[coreID] = true
+	}
+	sched := make(map[int]bool)
+	for _, coreID := range m.Sched {
+		if !onNode(coreID) {
+			return fmt.Errorf("scheduler core %d is not on the node", coreID)
+		} else if nf[coreID] {
+			return fmt.Errorf("core %d runs both the scheduler and NFs", coreID)
+		}
+		sched[coreID] = true
+	}
+	if !nf[m.Idle] {
+		return fmt.Errorf("idle core %d is not an NF core", m.Idle)
+	}
+	for _, coreID := range m.Startup {
+		if !onNode(coreID) {
+			return fmt.Errorf("startup core %d is not on the node", coreID)
+		} else if sched[coreID] {
+			return fmt.Errorf("core %d runs both the scheduler and NF startups", coreID)
+		}
+	}
+
+	numa := make(map[int]int)
+	for node, cores := range m.NUMA {
+		for _, coreID := range cores {
+			if prev, exists := numa[coreID]; exists {
+				return fmt.Errorf("core %d is on NUMA nodes %d and %d", coreID, prev, node)
+			}
+			numa[coreID] = node
+		}
+	}
+	return nil
+}
+
+// Returns the NUMA node of core |coreID|. Returns -1 if unknown.
+func (m *CoreMap) NUMANode(coreID int) int {
+	for node, cores := range m.NUMA {
+		for _, c := range cores {
+			if c == coreID {
+				return node
+			}
+		}
+	}
+	return -1
+}
+
+// Returns the core that CooperativeSched numbers NF core |coreID| by,
+// i.e. the i-th core of |NF| is CooperativeSched's core #i+1. Returns
+// -1 if |coreID| is not an NF core.
+func (m *CoreMap) CoopSchedCore(coreID int) int {
+	for i, c := range m.NF {
+		if c == coreID {
+			return kCoopSchedFirstNFCore + i
+		}
+	}
+	return -1
+}
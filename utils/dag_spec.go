@@ -0,0 +1,196 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	yaml "sigs.k8s.io/yaml"
+)
+
+// |DAGSpec| is a declarative specification of a user's NF DAG.
+// |User| is the user's ID.
+// |NFs| are logical NFs. Each NF is referred by its |ID| in |Edges|.
+// |Edges| connect NFs. At a branching NF, traffic is split among
+// downstream NFs by edge weights.
+// |Flowlets| define the traffic processed by this DAG.
+// |Scaling| are hints for scaling this DAG.
+// |LoadBalancer| is the policy that assigns flows to SGroups.
+// |Admission| limits new flows of this DAG.
+// |LatencyTarget| is the target latency (in microseconds) of packets
+// in each SGroup of this DAG (0: no target). SGroups adjust their
+// batch counts to meet the target.
+type DAGSpec struct {
+	User          string           `json:"user"`
+	NFs           []NFSpec         `json:"nfs"`
+	Edges         []EdgeSpec       `json:"edges"`
+	Flowlets      []FlowletSpec    `json:"flowlets"`
+	Scaling       ScalingSpec      `json:"scaling"`
+	LoadBalancer  LoadBalancerSpec `json:"loadBalancer"`
+	Admission     AdmissionSpec    `json:"admission"`
+	LatencyTarget int              `json:"latencyTarget"`
+}
+
+// |NFSpec| describes a logical NF and its per-NF config.
+// |Dummy| NFs run as a Bypass module that burns the profiled
+// cycles of |Type|. |Cycles| overrides the profiled cycle cost.
+type NFSpec struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	Dummy  bool   `json:"dummy"`
+	Cycles int    `json:"cycles"`
+}
+
+// |EdgeSpec| connects NF |From| -> NF |To|. |Weight| defaults to 1.
+type EdgeSpec struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Weight int    `json:"weight"`
+}
+
+// |FlowletSpec| matches flows by their 5-tuple. Empty IPs and zero
+// ports or protocol match all flows. IPs may be CIDR prefixes (e.g.
+// "10.0.0.0/8"). |SrcPorts| and |DstPorts| are inclusive port ranges
+// (e.g. "1000-2000"), and override |SrcPort| and |DstPort|.
+// |Priority| ranks flowlets of overlapping DAGs.
+type FlowletSpec struct {
+	SrcIP    string `json:"srcIP"`
+	DstIP    string `json:"dstIP"`
+	SrcPort  uint32 `json:"srcPort"`
+	DstPort  uint32 `json:"dstPort"`
+	SrcPorts string `json:"srcPorts"`
+	DstPorts string `json:"dstPorts"`
+	Proto    uint32 `json:"proto"`
+	Priority int    `json:"priority"`
+}
+
+// |ScalingSpec| bounds the number of SGroups running a DAG.
+// |InitialSGroups| is the number of SGroups started at activation
+// (0: all free SGroups). |MaxSGroups| caps scale-up (0: no limit).
+// |StandbySGroups| is the number of started SGroups kept without
+// traffic to hide NF cold starts on scale-ups.
+// |MinSGroups| is the number of SGroups kept by scale-in, and
+// |IdleTimeout| is the time (in seconds) that an SGroup stays idle
+// before it is reclaimed (0: default, negative: never).
+type ScalingSpec struct {
+	InitialSGroups int `json:"initialSGroups"`
+	MaxSGroups     int `json:"maxSGroups"`
+	StandbySGroups int `json:"standbySGroups"`
+	MinSGroups     int `json:"minSGroups"`
+	IdleTimeout    int `json:"idleTimeout"`
+}
+
+// |LoadBalancerSpec| selects a load-balancing policy by its name
+// (e.g. "high-load-first", "least-loaded", "p2c", "weighted-random",
+// "consistent-hash"). An empty |Policy| selects the default policy.
+// Thresholds are in percentage values, and zero thresholds are set
+// to their default values.
+type LoadBalancerSpec struct {
+	Policy     string `json:"policy"`
+	QLoad      int    `json:"qload"`
+	PktLoad    int    `json:"pktLoad"`
+	MaxPktLoad int    `json:"maxPktLoad"`
+}
+
+// |AdmissionSpec| configures admission control of new flows.
+// |Tenant| is the tenant that owns the DAG (empty: the user).
+// |FlowRate| is the max rate of new flows per second (0: no limit),
+// and |FlowBurst| is the max burst of new flows.
+// |MaxQLoad| is the max queue load (in percentage values) of an
+// SGroup to take new flows (0: no limit).
+type AdmissionSpec struct {
+	Tenant    string  `json:"tenant"`
+	FlowRate  float64 `json:"flowRate"`
+	FlowBurst int     `json:"flowBurst"`
+	MaxQLoad  int     `json:"maxQLoad"`
+}
+
+// Returns the path of the DAG spec |fileName| in the directory |dir|.
+// An absolute |fileName| is returned as is.
+func DAGSpecPath(dir string, fileName string) string {
+	if filepath.IsAbs(fileName) {
+		return fileName
+	}
+	return filepath.Join(dir, fileName)
+}
+
+// Reads a DAG spec from |fileName|. The file is in YAML if its
+// extension is .yaml or .yml. Otherwise, it is in JSON.
+func ParseDAGSpec(fileName string) (*DAGSpec, error) {
+	specFile, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer specFile.Close()
+
+	byteVal, err := ioutil.ReadAll(specFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var spec DAGSpec
+	ext := filepath.Ext(fileName)
+	if ext == ".yaml" || ext == ".yml" {
+		err = yaml.Unmarshal(byteVal, &spec)
+	} else {
+		err = json.Unmarshal(byteVal, &spec)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse %s. %v", fileName, err)
+	}
+
+	if err := spec.check(); err != nil {
+		return nil, fmt.Errorf("Invalid DAG spec %s. %v", fileName, err)
+	}
+	return &spec, nil
+}
+
+// Checks that |spec| is well-formed. The DAG itself is validated
+// by the controller.
+func (spec *DAGSpec) check() error {
+	if spec.User == "" {
+		return fmt.Errorf("no user")
+	}
+
+	ids := make(map[string]bool)
+	for _, nf := range spec.NFs {
+		if nf.ID == "" || nf.Type == "" {
+			return fmt.Errorf("NF (id=%q, type=%q) needs both id and type", nf.ID, nf.Type)
+		}
+		if ids[nf.ID] {
+			return fmt.Errorf("duplicate NF id %s", nf.ID)
+		}
+		ids[nf.ID] = true
+	}
+
+	for _, e := range spec.Edges {
+		if !ids[e.From] || !ids[e.To] {
+			return fmt.Errorf("edge %s -> %s refers to unknown NFs", e.From, e.To)
+		}
+	}
+
+	scaling := spec.Scaling
+	if scaling.InitialSGroups < 0 || scaling.MaxSGroups < 0 || scaling.StandbySGroups < 0 || scaling.MinSGroups < 0 {
+		return fmt.Errorf("negative scaling hints")
+	}
+	if scaling.MaxSGroups > 0 && scaling.MinSGroups > scaling.MaxSGroups {
+		return fmt.Errorf("min SGroups %d is above max SGroups %d", scaling.MinSGroups, scaling.MaxSGroups)
+	}
+
+	lb := spec.LoadBalancer
+	if lb.QLoad < 0 || lb.PktLoad < 0 || lb.MaxPktLoad < 0 {
+		return fmt.Errorf("negative load-balancing thresholds")
+	}
+
+	admission := spec.Admission
+	if admission.FlowRate < 0 || admission.FlowBurst < 0 || admission.MaxQLoad < 0 {
+		return fmt.Errorf("negative admission-control limits")
+	}
+
+	if spec.LatencyTarget < 0 {
+		return fmt.Errorf("negative latency target")
+	}
+	return nil
+}
@@ -44,6 +44,28 @@ func (p *IndexPool) GetNextAvailable() int {
 	return heap.Pop(p.pool).(int)
 }
 
+// Fetch the smallest number that satisfies |prefer| from the pool.
+// Fetch the smallest number if none satisfies |prefer|.
+func (p *IndexPool) GetNextAvailableIf(prefer func(index int) bool) int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.pool.Len() == 0 {
+		return -1
+	}
+
+	selected := -1
+	for i, index := range p.pool.nums {
+		if prefer(index) && (selected == -1 || index < p.pool.nums[selected]) {
+			selected = i
+		}
+	}
+	if selected == -1 {
+		return heap.Pop(p.pool).(int)
+	}
+	return heap.Remove(p.pool, selected).(int)
+}
+
 // Free a number to the pool.
 func (p *IndexPool) Free(index int) {
 	p.mutex.Lock()
@@ -0,0 +1,108 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// |RotatingFile| is a log file that rotates when it grows over
+// |maxBytes|. The current file is |path|. Rotated files are
+// |path|.1 (the newest) ~ |path|.|backups| (the oldest). Older files
+// are removed. It is safe for concurrent use.
+type RotatingFile struct {
+	path     string
+	maxBytes int64
+	backups  int
+	f        *os.File
+	size     int64
+	mutex    sync.Mutex
+}
+
+// Opens a rotating file at |path|. Appends to |path| if it exists.
+func NewRotatingFile(path string, maxBytes int64, backups int) (*RotatingFile, error) {
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("invalid max size %d bytes", maxBytes)
+	}
+
+	r := &RotatingFile{
+		path:     path,
+		maxBytes: maxBytes,
+		backups:  backups,
+	}
+	if err := r.open(os.O_APPEND); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Opens |r.path| with |flag|. |r.mutex| must be held.
+func (r *RotatingFile) open(flag int) error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|flag, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	r.f = f
+	r.size = info.Size()
+	return nil
+}
+
+// Writes |p| to the current file. Rotates files before the write if
+// the current file would grow over |r.maxBytes|.
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.f == nil {
+		return 0, fmt.Errorf("%s is closed", r.path)
+	}
+	if r.size > 0 && r.size+int64(len(p)) > r.maxBytes {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// Moves |r.path| to |r.path|.1, and shifts older files. |r.mutex|
+// must be held.
+func (r *RotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	r.f = nil
+
+	if r.backups <= 0 {
+		os.Remove(r.path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", r.path, r.backups))
+		for i := r.backups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		if err := os.Rename(r.path, r.path+".1"); err != nil {
+			return err
+		}
+	}
+	return r.open(os.O_TRUNC)
+}
+
+func (r *RotatingFile) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
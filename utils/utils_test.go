@@ -1,7 +1,9 @@
 package utils
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"sort"
 	"sync"
@@ -91,6 +93,24 @@ func TestIndexPoolSingleThread(t *testing.T) {
 	}
 }
 
+func TestIndexPoolPreference(t *testing.T) {
+	pool := NewIndexPool(0, 6)
+	odd := func(index int) bool { return index%2 == 1 }
+	if index := pool.GetNextAvailableIf(odd); index != 1 {
+		t.Errorf("Expect 1, got %d", index)
+	}
+	if index := pool.GetNextAvailableIf(odd); index != 3 {
+		t.Errorf("Expect 3, got %d", index)
+	}
+	if index := pool.GetNextAvailable(); index != 0 {
+		t.Errorf("Expect 0, got %d", index)
+	}
+	none := func(index int) bool { return false }
+	if index := pool.GetNextAvailableIf(none); index != 2 {
+		t.Errorf("Expect 2 without preferred numbers, got %d", index)
+	}
+}
+
 func TestIndexPoolMultiThread(t *testing.T) {
 	base := 100
 	numCount := 10000
@@ -143,3 +163,157 @@ func TestIndexPoolMultiThread(t *testing.T) {
 		}()
 	}
 }
+
+func TestParseDAGSpec(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dagspec")
+	if err != nil {
+		t.Fatalf("Failed to create a temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	jsonSpec := `{"user": "u", "nfs": [{"id": "a", "type": "acl"}, {"id": "b", "type": "nat"}],
+		"edges": [{"from": "a", "to": "b", "weight": 2}], "flowlets": [{"dstPort": 8080}],
+		"scaling": {"maxSGroups": 4}, "loadBalancer": {"policy": "p2c", "qload": 50}, "latencyTarget": 200}`
+	yamlSpec := "user: u\nnfs:\n- id: a\n  type: acl\n- id: b\n  type: nat\n" +
+		"edges:\n- from: a\n  to: b\n  weight: 2\nflowlets:\n- dstPort: 8080\n" +
+		"scaling:\n  maxSGroups: 4\nloadBalancer:\n  policy: p2c\n  qload: 50\nlatencyTarget: 200\n"
+
+	specs := []*DAGSpec{}
+	for name, content := range map[string]string{"spec.json": jsonSpec, "spec.yaml": yamlSpec} {
+		fileName := filepath.Join(dir, name)
+		ioutil.WriteFile(fileName, []byte(content), 0644)
+
+		spec, err := ParseDAGSpec(fileName)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", name, err)
+		}
+		specs = append(specs, spec)
+	}
+
+	if !reflect.DeepEqual(specs[0], specs[1]) {
+		t.Errorf("JSON and YAML specs differ: %+v, %+v", specs[0], specs[1])
+	}
+	if specs[0].Edges[0].Weight != 2 || specs[0].Flowlets[0].DstPort != 8080 || specs[0].Scaling.MaxSGroups != 4 ||
+		specs[0].LoadBalancer.Policy != "p2c" || specs[0].LoadBalancer.QLoad != 50 || specs[0].LatencyTarget != 200 {
+		t.Errorf("Failed to parse the spec: %+v", specs[0])
+	}
+
+	badSpec := filepath.Join(dir, "bad.json")
+	ioutil.WriteFile(badSpec, []byte(`{"user": "u", "nfs": [{"id": "a", "type": "acl"}], "edges": [{"from": "a", "to": "c"}]}`), 0644)
+	if _, err := ParseDAGSpec(badSpec); err == nil {
+		t.Errorf("Failed to reject an edge to an unknown NF")
+	}
+
+	if path := DAGSpecPath("/opt/faas/dags", "exp-a.json"); path != "/opt/faas/dags/exp-a.json" {
+		t.Errorf("Unexpected spec path %s", path)
+	}
+	if path := DAGSpecPath("/opt/faas/dags", badSpec); path != badSpec {
+		t.Errorf("Expect an absolute spec path to be kept, got %s", path)
+	}
+}
+
+func TestClusterNodeCores(t *testing.T) {
+	node := ClusterNode{Name: "node1", Cores: 16}
+	m, err := node.GetCoreMap()
+	if err != nil {
+		t.Fatalf("Failed to get the default core map: %v", err)
+	}
+	if !reflect.DeepEqual(m.Sched, []int{0}) || m.Idle != 1 || len(m.NF) != 15 || m.NF[0] != 1 || m.NUMANode(1) != -1 {
+		t.Errorf("Wrong default core map: %+v", m)
+	}
+	// Startups run on the last core of a node without the default
+	// startup core.
+	if !reflect.DeepEqual(m.Startup, []int{15}) {
+		t.Errorf("Wrong default startup cores: %v", m.Startup)
+	}
+	if m, _ := (&ClusterNode{Name: "node1", Cores: 32}).GetCoreMap(); !reflect.DeepEqual(m.Startup, []int{kDefaultStartupCore}) {
+		t.Errorf("Wrong default startup cores: %v", m.Startup)
+	}
+
+	node = ClusterNode{Name: "node1", Cores: 16, ReservedCores: 2, IdleCore: 15}
+	if m, _ := node.GetCoreMap(); !reflect.DeepEqual(m.Sched, []int{0, 1}) || m.Idle != 15 || len(m.NF) != 14 {
+		t.Errorf("Wrong core map: %+v", m)
+	}
+
+	node.Cores = 32
+	node.CoreMap = &CoreMap{
+		Sched:   []int{0, 16},
+		Idle:    17,
+		Startup: []int{31},
+		NF:      []int{17, 18, 19},
+		NUMA:    [][]int{{0}, {16, 17, 18, 19, 31}},
+	}
+	if m, err := node.GetCoreMap(); err != nil || m.NUMANode(17) != 1 || m.NUMANode(0) != 0 {
+		t.Errorf("Wrong explicit core map: %+v, %v", m, err)
+	}
+
+	// The idle core must run NFs.
+	node.CoreMap.Idle = 16
+	if _, err := node.GetCoreMap(); err == nil {
+		t.Errorf("Failed to reject an idle core on a scheduler core")
+	}
+	node.CoreMap.Idle = 17
+	node.CoreMap.Sched = []int{0, 17}
+	if _, err := node.GetCoreMap(); err == nil {
+		t.Errorf("Failed to reject a core shared by the scheduler and NFs")
+	}
+
+	// Startup cores must be on the node, and must not run the
+	// scheduler.
+	node.CoreMap.Sched = []int{0, 16}
+	node.CoreMap.Startup = []int{32}
+	if _, err := node.GetCoreMap(); err == nil {
+		t.Errorf("Failed to reject a startup core out of the node")
+	}
+	node.CoreMap.Startup = []int{16}
+	if _, err := node.GetCoreMap(); err == nil {
+		t.Errorf("Failed to reject a core shared by the scheduler and NF startups")
+	}
+	node.CoreMap.Startup = []int{18}
+	if _, err := node.GetCoreMap(); err != nil {
+		t.Errorf("Failed to accept a startup core on an NF core. %v", err)
+	}
+
+	// CooperativeSched numbers NF cores from #1 in the order of the
+	// map. The default map keeps the same numbers.
+	m = &CoreMap{Sched: []int{0, 8}, Idle: 4, Startup: []int{4}, NF: []int{4, 5, 12, 13}}
+	if m.CoopSchedCore(4) != 1 || m.CoopSchedCore(12) != 3 || m.CoopSchedCore(8) != -1 {
+		t.Errorf("Wrong CooperativeSched cores of %+v", m)
+	}
+	m = NewCoreMap(16, 1, 1)
+	for _, coreID := range m.NF {
+		if m.CoopSchedCore(coreID) != coreID {
+			t.Errorf("Wrong CooperativeSched core of core #%d: %d", coreID, m.CoopSchedCore(coreID))
+		}
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.jsonl")
+	f, err := NewRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", path, err)
+	}
+	for _, line := range []string{"line-1\n", "line-2\n", "line-3\n", "line-4\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+	}
+	f.Close()
+
+	// The oldest line is removed.
+	for suffix, expected := range map[string]string{"": "line-4\n", ".1": "line-3\n", ".2": "line-2\n"} {
+		if content, _ := ioutil.ReadFile(path + suffix); string(content) != expected {
+			t.Errorf("Expect %q in %s, got %q", expected, path+suffix, content)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expect no %s.3", path)
+	}
+}